@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"distress-management/models"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// WithUser returns a copy of ctx carrying the authenticated user
+func WithUser(ctx context.Context, u *models.User) context.Context {
+	return context.WithValue(ctx, userContextKey, u)
+}
+
+// UserFromContext returns the authenticated user stored on the context, if any
+func UserFromContext(ctx context.Context) (*models.User, bool) {
+	u, ok := ctx.Value(userContextKey).(*models.User)
+	return u, ok && u != nil
+}
+
+// Authenticator validates bearer tokens and loads the current user
+type Authenticator struct {
+	DB     *sql.DB
+	Tokens *TokenManager
+	public map[string]bool
+}
+
+// NewAuthenticator creates an Authenticator. Requests whose path exactly
+// matches one of publicPaths are let through without a token.
+func NewAuthenticator(db *sql.DB, tokens *TokenManager, publicPaths ...string) *Authenticator {
+	public := make(map[string]bool, len(publicPaths))
+	for _, p := range publicPaths {
+		public[p] = true
+	}
+	return &Authenticator{DB: db, Tokens: tokens, public: public}
+}
+
+// Middleware rejects requests without a valid bearer token and puts the
+// authenticated models.User on the request context
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.public[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+		tokenString, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || strings.TrimSpace(tokenString) == "" {
+			writeAuthError(w, http.StatusUnauthorized, "Missing bearer token")
+			return
+		}
+
+		claims, err := a.Tokens.ParseAccessToken(strings.TrimSpace(tokenString))
+		if err != nil {
+			writeAuthError(w, http.StatusUnauthorized, "Invalid or expired token")
+			return
+		}
+
+		user, err := models.GetUser(a.DB, claims.UserID)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Error loading user %d: %v", claims.UserID, err)
+				writeAuthError(w, http.StatusInternalServerError, "Error loading user")
+				return
+			}
+			writeAuthError(w, http.StatusUnauthorized, "User no longer exists")
+			return
+		}
+
+		if !user.Active {
+			writeAuthError(w, http.StatusForbidden, "Account is deactivated")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+func writeAuthError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
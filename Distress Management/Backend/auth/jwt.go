@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"distress-management/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// ErrInvalidToken is returned when an access token fails validation
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Claims are the JWT claims carried by an access token
+type Claims struct {
+	UserID int64  `json:"uid"`
+	Email  string `json:"email"`
+	Role   string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// TokenManager issues and validates access and refresh tokens
+type TokenManager struct {
+	secret     []byte
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// NewTokenManager creates a TokenManager signing with the given secret
+func NewTokenManager(secret string, accessTTL, refreshTTL time.Duration) (*TokenManager, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("JWT secret must be at least 32 characters")
+	}
+	if accessTTL <= 0 {
+		accessTTL = DefaultAccessTokenTTL
+	}
+	if refreshTTL <= 0 {
+		refreshTTL = DefaultRefreshTokenTTL
+	}
+	return &TokenManager{
+		secret:     []byte(secret),
+		AccessTTL:  accessTTL,
+		RefreshTTL: refreshTTL,
+	}, nil
+}
+
+// GenerateAccessToken returns a signed short-lived access token for the user
+func (tm *TokenManager) GenerateAccessToken(u *models.User) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(tm.AccessTTL)
+	claims := Claims{
+		UserID: u.ID,
+		Email:  u.Email,
+		Role:   u.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   fmt.Sprintf("%d", u.ID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString(tm.secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// ParseAccessToken validates a signed access token and returns its claims
+func (tm *TokenManager) ParseAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return tm.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// GenerateRefreshToken returns a random opaque refresh token and the hash
+// that should be persisted in its place
+func GenerateRefreshToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken returns the storage hash of a refresh token
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
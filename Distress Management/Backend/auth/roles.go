@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"distress-management/models"
+)
+
+// Roles map to the people working each stage of the case workflow
+const (
+	RoleAdmin       = "admin"
+	RoleDirector    = "director"
+	RoleFrontOffice = "front_office"
+	RoleOfficer     = "officer"
+	RoleCadet       = "cadet"
+)
+
+// Roles lists every valid role
+var Roles = []string{RoleAdmin, RoleDirector, RoleFrontOffice, RoleOfficer, RoleCadet}
+
+// Permission names an action a role may perform
+type Permission string
+
+const (
+	PermViewCases                  Permission = "view_cases"
+	PermViewAllCases               Permission = "view_all_cases"
+	PermCreateCase                 Permission = "create_case"
+	PermUpdateCase                 Permission = "update_case"
+	PermUpdateCaseStatus           Permission = "update_case_status"
+	PermAssignCase                 Permission = "assign_case"
+	PermUploadDocument             Permission = "upload_document"
+	PermDeleteDocument             Permission = "delete_document"
+	PermAddNote                    Permission = "add_note"
+	PermEditAnyNote                Permission = "edit_any_note"
+	PermViewInternalNotes          Permission = "view_internal_notes"
+	PermIssueInstructions          Permission = "issue_instructions"
+	PermViewDashboard              Permission = "view_dashboard"
+	PermViewUsers                  Permission = "view_users"
+	PermManageUsers                Permission = "manage_users"
+	PermManageDocumentRequirements Permission = "manage_document_requirements"
+)
+
+// rolePermissions is the permission model. Officers and cadets hold
+// view/update permissions but are further limited to the cases assigned to
+// them by CanAccessCase.
+var rolePermissions = map[string][]Permission{
+	RoleAdmin: {
+		PermViewCases, PermViewAllCases, PermCreateCase, PermUpdateCase,
+		PermUpdateCaseStatus, PermAssignCase, PermUploadDocument, PermDeleteDocument,
+		PermAddNote, PermEditAnyNote, PermViewInternalNotes, PermIssueInstructions,
+		PermViewDashboard, PermViewUsers, PermManageUsers, PermManageDocumentRequirements,
+	},
+	RoleDirector: {
+		PermViewCases, PermViewAllCases, PermUpdateCase, PermUpdateCaseStatus,
+		PermAssignCase, PermAddNote, PermEditAnyNote, PermViewInternalNotes,
+		PermIssueInstructions, PermViewDashboard, PermViewUsers, PermManageDocumentRequirements,
+	},
+	RoleFrontOffice: {
+		PermViewCases, PermViewAllCases, PermCreateCase, PermUpdateCase,
+		PermUpdateCaseStatus, PermUploadDocument, PermDeleteDocument, PermAddNote,
+		PermViewDashboard,
+	},
+	RoleOfficer: {
+		PermViewCases, PermUpdateCase, PermUpdateCaseStatus, PermUploadDocument,
+		PermAddNote,
+	},
+	RoleCadet: {
+		PermViewCases, PermUpdateCase, PermUpdateCaseStatus, PermUploadDocument,
+		PermAddNote,
+	},
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// NormalizeRole maps free-text input such as "Front Office" to a role name
+func NormalizeRole(role string) string {
+	role = strings.ToLower(strings.TrimSpace(role))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(role)
+}
+
+// HasPermission reports whether the role grants the permission
+func HasPermission(role string, perm Permission) bool {
+	for _, p := range rolePermissions[NormalizeRole(role)] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOfficerRole reports whether cases can be assigned to users with the role
+func IsOfficerRole(role string) bool {
+	role = NormalizeRole(role)
+	return role == RoleOfficer || role == RoleCadet
+}
+
+// CanAccessCase reports whether the user may see and work on the case.
+// Roles without PermViewAllCases only see cases assigned to them.
+func CanAccessCase(u *models.User, c *models.Case) bool {
+	if HasPermission(u.Role, PermViewAllCases) {
+		return true
+	}
+	return c.AssignedOfficerID != 0 && c.AssignedOfficerID == u.ID
+}
+
+// CanSeeNote reports whether the user may read a progress note with the
+// given visibility, author and author's department on a case they can
+// access. Internal notes are limited to their author and roles with
+// PermViewInternalNotes. Department notes are also seen by users in the
+// author's department; users without a department share it with no one.
+func CanSeeNote(u *models.User, visibility string, authorID int64, authorDepartment string) bool {
+	if visibility == models.VisibilityRequester {
+		return true
+	}
+	if authorID == u.ID || HasPermission(u.Role, PermViewInternalNotes) {
+		return true
+	}
+	return visibility == models.VisibilityDepartment && authorDepartment != "" && authorDepartment == u.Department
+}
+
+// ForbiddenMessage describes a failed permission check
+func ForbiddenMessage(u *models.User, perm Permission) string {
+	return fmt.Sprintf("Forbidden: role %q does not have the %q permission", u.Role, perm)
+}
+
+// Require wraps a handler so it only runs for users holding perm. It must be
+// used behind Authenticator.Middleware.
+func Require(perm Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			writeAuthError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		if !HasPermission(user.Role, perm) {
+			writeAuthError(w, http.StatusForbidden, ForbiddenMessage(user, perm))
+			return
+		}
+		next(w, r)
+	}
+}
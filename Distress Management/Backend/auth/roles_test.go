@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"testing"
+
+	"distress-management/models"
+)
+
+func TestCanSeeNote(t *testing.T) {
+	const authorID = 1
+	author := &models.User{ID: authorID, Role: RoleOfficer, Department: "Consular"}
+	colleague := &models.User{ID: 2, Role: RoleOfficer, Department: "Consular"}
+	frontOffice := &models.User{ID: 3, Role: RoleFrontOffice, Department: "Consular"}
+	outsider := &models.User{ID: 4, Role: RoleFrontOffice, Department: "Protocol"}
+	noDepartment := &models.User{ID: 5, Role: RoleCadet}
+	director := &models.User{ID: 6, Role: RoleDirector, Department: "Protocol"}
+	admin := &models.User{ID: 7, Role: RoleAdmin}
+
+	tests := []struct {
+		name             string
+		user             *models.User
+		authorDepartment string
+		internal         bool
+		department       bool
+	}{
+		{"author", author, "Consular", true, true},
+		{"author without a department", &models.User{ID: authorID, Role: RoleCadet}, "", true, true},
+		{"officer in the department", colleague, "Consular", false, true},
+		{"front office in the department", frontOffice, "Consular", false, true},
+		{"front office in another department", outsider, "Consular", false, false},
+		{"user without a department", noDepartment, "Consular", false, false},
+		{"author without a department and user without one", noDepartment, "", false, false},
+		{"director", director, "Consular", true, true},
+		{"admin", admin, "Consular", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := map[string]bool{
+				models.VisibilityInternal:   tt.internal,
+				models.VisibilityDepartment: tt.department,
+				models.VisibilityRequester:  true,
+			}
+			for visibility, ok := range want {
+				if got := CanSeeNote(tt.user, visibility, authorID, tt.authorDepartment); got != ok {
+					t.Errorf("CanSeeNote(%s, %s) = %v, want %v", tt.user.Role, visibility, got, ok)
+				}
+			}
+		})
+	}
+}
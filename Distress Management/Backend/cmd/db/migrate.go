@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
+
+	"distress-management/auth"
+	"distress-management/models"
 
 	"github.com/joho/godotenv"
 	_ "github.com/go-sql-driver/mysql"
@@ -58,20 +62,54 @@ func main() {
 		log.Fatal("Error executing schema:", err)
 	}
 
-	// Create test cases
-	_, err = db.Exec(`
-		INSERT INTO cases (reference_number, sender_name, receiving_date, subject, country_of_origin, distressed_person_name, nature_of_case, case_details, status, stage)
-		VALUES 
-		('REF001', 'John Doe', NOW(), 'Emergency Medical Assistance', 'Kenya', 'Alice Smith', 'Emergency', 'Need immediate medical assistance', 'Pending', 'Front Office Receipt'),
-		('REF002', 'Jane Smith', NOW(), 'Lost Passport', 'Uganda', 'Bob Johnson', 'Standard', 'Lost passport during travel', 'Under Review', 'Director Review'),
-		('REF003', 'Mike Brown', NOW(), 'Financial Aid', 'Tanzania', 'Carol White', 'Urgent', 'Requires financial assistance', 'In Progress', 'Case Investigation'),
-		('REF004', 'Sarah Wilson', NOW(), 'Legal Support', 'Rwanda', 'David Lee', 'Standard', 'Legal consultation needed', 'Assigned', 'Cadet Assignment'),
-		('REF005', 'Tom Harris', NOW(), 'Medical Emergency', 'Burundi', 'Eve Taylor', 'Emergency', 'Critical medical condition', 'In Progress', 'Case Investigation')
-	`)
+	// Create test cases, numbered the same way the API numbers new cases
+	references, err := models.NewReferenceGenerator(os.Getenv("REFERENCE_PATTERN"),
+		os.Getenv("REFERENCE_RESET") != "never")
 	if err != nil {
-		log.Fatal("Error creating test cases:", err)
+		log.Fatal("Error configuring reference numbers:", err)
+	}
+
+	testCases := [][]string{
+		{"John Doe", "Emergency Medical Assistance", "Kenya", "Alice Smith", "Emergency", "Need immediate medical assistance", "Pending", "Front Office Receipt"},
+		{"Jane Smith", "Lost Passport", "Uganda", "Bob Johnson", "Standard", "Lost passport during travel", "Under Review", "Director Review"},
+		{"Mike Brown", "Financial Aid", "Tanzania", "Carol White", "Urgent", "Requires financial assistance", "In Progress", "Case Investigation"},
+		{"Sarah Wilson", "Legal Support", "Rwanda", "David Lee", "Standard", "Legal consultation needed", "Assigned", "Cadet Assignment"},
+		{"Tom Harris", "Medical Emergency", "Burundi", "Eve Taylor", "Emergency", "Critical medical condition", "In Progress", "Case Investigation"},
+	}
+	for _, tc := range testCases {
+		err := models.WithTx(db, func(tx *sql.Tx) error {
+			ref, err := references.Next(tx, tc[4], time.Now())
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`
+				INSERT INTO cases (reference_number, sender_name, receiving_date, subject, country_of_origin, distressed_person_name, nature_of_case, case_details, status, stage)
+				VALUES (?, ?, NOW(), ?, ?, ?, ?, ?, ?, ?)
+			`, ref, tc[0], tc[1], tc[2], tc[3], tc[4], tc[5], tc[6], tc[7])
+			return err
+		})
+		if err != nil {
+			log.Fatal("Error creating test cases:", err)
+		}
 	}
 	log.Println("Test cases created successfully!")
 
+	// Create the initial administrator so someone can log in
+	if email, password := os.Getenv("ADMIN_EMAIL"), os.Getenv("ADMIN_PASSWORD"); email != "" && password != "" {
+		admin := &models.User{
+			Name:       "Administrator",
+			Email:      email,
+			Password:   password,
+			Role:       auth.RoleAdmin,
+			Department: "Administration",
+		}
+		if err := admin.Create(db); err != nil {
+			log.Fatal("Error creating admin user:", err)
+		}
+		log.Printf("Admin user %s created successfully!", email)
+	} else {
+		log.Println("Warning: ADMIN_EMAIL/ADMIN_PASSWORD not set, no admin user created")
+	}
+
 	log.Println("Database migration completed successfully!")
 }
@@ -6,13 +6,56 @@ USE distress_management;
 SET FOREIGN_KEY_CHECKS = 0;
 
 -- Drop existing tables if they exist
+DROP TABLE IF EXISTS case_assignments;
+DROP TABLE IF EXISTS case_history;
+DROP TABLE IF EXISTS document_link_downloads;
+DROP TABLE IF EXISTS document_links;
+DROP TABLE IF EXISTS upload_sessions;
+DROP TABLE IF EXISTS document_requirements;
 DROP TABLE IF EXISTS documents;
+DROP TABLE IF EXISTS document_categories;
+DROP TABLE IF EXISTS progress_note_revisions;
 DROP TABLE IF EXISTS progress_notes;
 DROP TABLE IF EXISTS cases;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS reference_sequences;
+DROP TABLE IF EXISTS users;
 
 -- Enable foreign key checks
 SET FOREIGN_KEY_CHECKS = 1;
 
+-- Users table
+CREATE TABLE IF NOT EXISTS users (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    password VARCHAR(255) NOT NULL,
+    role VARCHAR(50) NOT NULL,
+    department VARCHAR(100) NOT NULL DEFAULT '',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    last_login TIMESTAMP NULL DEFAULT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+-- Refresh tokens table
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    user_id BIGINT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    family_id CHAR(32) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NULL DEFAULT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Reference number counters, one row per pattern scope (e.g. DM/2026/EMERGENCY/)
+CREATE TABLE IF NOT EXISTS reference_sequences (
+    scope VARCHAR(191) PRIMARY KEY,
+    last_value BIGINT NOT NULL
+);
+
 -- Cases table
 CREATE TABLE IF NOT EXISTS cases (
     id BIGINT PRIMARY KEY AUTO_INCREMENT,
@@ -25,32 +68,221 @@ CREATE TABLE IF NOT EXISTS cases (
     nature_of_case ENUM('Emergency', 'Urgent', 'Standard') NOT NULL,
     case_details TEXT NOT NULL,
     status ENUM('Pending', 'Under Review', 'Assigned', 'In Progress', 'Resolved', 'Closed') NOT NULL DEFAULT 'Pending',
+    assigned_officer_id BIGINT NULL DEFAULT NULL,
     stage ENUM('Front Office Receipt', 'Director Review', 'Cadet Assignment', 'Case Investigation', 'Case Resolution') NOT NULL DEFAULT 'Front Office Receipt',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (assigned_officer_id) REFERENCES users(id) ON DELETE SET NULL
 );
 
+-- Document categories, e.g. passport copy or police abstract
+CREATE TABLE IF NOT EXISTS document_categories (
+    code VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    description VARCHAR(255) NULL
+);
+
+INSERT INTO document_categories (code, name, description) VALUES
+    ('passport_copy', 'Passport copy', 'Copy of the distressed person''s passport or travel document'),
+    ('police_abstract', 'Police abstract', 'Police report or abstract of the incident'),
+    ('medical_report', 'Medical report', 'Medical report or hospital letter'),
+    ('consent_form', 'Consent form', 'Consent of the distressed person or next of kin'),
+    ('death_certificate', 'Death certificate', 'Death certificate or burial permit'),
+    ('correspondence', 'Correspondence', 'Letters and emails from the sender or other agencies'),
+    ('other', 'Other', 'Any other supporting document');
+
 -- Documents table
 CREATE TABLE IF NOT EXISTS documents (
     id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    root_id BIGINT NULL,
+    version INT NOT NULL DEFAULT 1,
+    is_latest BOOLEAN NOT NULL DEFAULT TRUE,
     case_id BIGINT NOT NULL,
     file_name VARCHAR(255) NOT NULL,
-    file_path VARCHAR(255) NOT NULL,
+    category VARCHAR(50) NOT NULL DEFAULT 'other',
+    storage_key VARCHAR(255) NOT NULL,
+    file_type VARCHAR(255) NOT NULL,
+    file_size BIGINT NOT NULL,
+    uploaded_by BIGINT NULL DEFAULT NULL,
     uploaded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (case_id) REFERENCES cases(id) ON DELETE CASCADE
+    scan_status ENUM('pending', 'clean', 'infected', 'failed') NOT NULL DEFAULT 'pending',
+    scan_signature VARCHAR(255) NULL,
+    scanned_at TIMESTAMP NULL,
+    scan_attempts INT NOT NULL DEFAULT 0,
+    scan_error VARCHAR(255) NULL,
+    checksum CHAR(64) NOT NULL DEFAULT '',
+    change_comment TEXT NULL,
+    thumbnail_status ENUM('pending', 'ready', 'none', 'failed') NOT NULL DEFAULT 'none',
+    text_status ENUM('pending', 'extracted', 'failed', 'none') NOT NULL DEFAULT 'none',
+    text_error VARCHAR(255) NULL,
+    extracted_text MEDIUMTEXT NULL,
+    text_extracted_at TIMESTAMP NULL,
+    UNIQUE KEY uq_documents_root_version (root_id, version),
+    FOREIGN KEY (case_id) REFERENCES cases(id) ON DELETE CASCADE,
+    FOREIGN KEY (uploaded_by) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (category) REFERENCES document_categories(code)
+);
+
+-- Categories a case needs documents for before it can be resolved. An empty
+-- subject applies to every case of that nature.
+CREATE TABLE IF NOT EXISTS document_requirements (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    nature_of_case ENUM('Emergency', 'Urgent', 'Standard') NOT NULL,
+    subject VARCHAR(255) NOT NULL DEFAULT '',
+    category_code VARCHAR(50) NOT NULL,
+    UNIQUE KEY uq_document_requirements (nature_of_case, subject, category_code),
+    FOREIGN KEY (category_code) REFERENCES document_categories(code) ON DELETE CASCADE
+);
+
+INSERT INTO document_requirements (nature_of_case, category_code) VALUES
+    ('Emergency', 'passport_copy'),
+    ('Emergency', 'consent_form'),
+    ('Urgent', 'passport_copy'),
+    ('Urgent', 'consent_form'),
+    ('Standard', 'passport_copy');
+
+-- Resumable uploads in progress. The partial content lives on the API host
+-- until the upload completes or the session expires.
+CREATE TABLE IF NOT EXISTS upload_sessions (
+    id CHAR(32) PRIMARY KEY,
+    case_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    category VARCHAR(50) NOT NULL,
+    change_comment TEXT NULL,
+    upload_length BIGINT NOT NULL,
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    status ENUM('active', 'completed', 'failed') NOT NULL DEFAULT 'active',
+    document_id BIGINT NULL,
+    error VARCHAR(255) NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (case_id) REFERENCES cases(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (document_id) REFERENCES documents(id) ON DELETE SET NULL
+);
+
+-- Signed links that let one document be downloaded without an API session.
+-- The link token itself is never stored; it is an HMAC over the link ID,
+-- document ID and expiry. Links and their downloads are an audit trail of
+-- what left the system, so they outlive the document: deleting it only
+-- clears document_id, and the case and file name are copied onto the link.
+CREATE TABLE IF NOT EXISTS document_links (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    document_id BIGINT NULL,
+    case_id BIGINT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    created_by BIGINT NOT NULL,
+    recipient VARCHAR(255) NULL,
+    one_time BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL DEFAULT NULL,
+    revoked_at TIMESTAMP NULL DEFAULT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (document_id) REFERENCES documents(id) ON DELETE SET NULL,
+    FOREIGN KEY (case_id) REFERENCES cases(id) ON DELETE SET NULL,
+    FOREIGN KEY (created_by) REFERENCES users(id)
+);
+
+-- Every download made through a document link
+CREATE TABLE IF NOT EXISTS document_link_downloads (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    link_id BIGINT NOT NULL,
+    ip_address VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(255) NULL,
+    downloaded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (link_id) REFERENCES document_links(id)
 );
 
 -- Progress notes table
 CREATE TABLE IF NOT EXISTS progress_notes (
     id BIGINT PRIMARY KEY AUTO_INCREMENT,
     case_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
     note TEXT NOT NULL,
+    note_type ENUM('call_log', 'field_visit', 'director_instruction', 'internal_comment', 'sender_update') NOT NULL DEFAULT 'internal_comment',
+    visibility ENUM('internal', 'department', 'requester') NOT NULL DEFAULT 'department',
+    revision INT NOT NULL DEFAULT 1,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (case_id) REFERENCES cases(id) ON DELETE CASCADE
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP NULL DEFAULT NULL,
+    deleted_by BIGINT NULL DEFAULT NULL,
+    FOREIGN KEY (case_id) REFERENCES cases(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (deleted_by) REFERENCES users(id)
+);
+
+-- Earlier revisions of progress notes. Each row keeps the text, type and
+-- visibility a note had before it was edited or deleted, and who made that
+-- change.
+CREATE TABLE IF NOT EXISTS progress_note_revisions (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    note_id BIGINT NOT NULL,
+    revision INT NOT NULL,
+    note TEXT NOT NULL,
+    note_type ENUM('call_log', 'field_visit', 'director_instruction', 'internal_comment', 'sender_update') NOT NULL,
+    visibility ENUM('internal', 'department', 'requester') NOT NULL,
+    action ENUM('edit', 'delete') NOT NULL,
+    changed_by BIGINT NOT NULL,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    reason VARCHAR(500) NULL,
+    UNIQUE KEY uq_progress_note_revisions (note_id, revision),
+    FOREIGN KEY (note_id) REFERENCES progress_notes(id) ON DELETE CASCADE,
+    FOREIGN KEY (changed_by) REFERENCES users(id)
+);
+
+-- Case history table: one row per changed field
+CREATE TABLE IF NOT EXISTS case_history (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    case_id BIGINT NOT NULL,
+    user_id BIGINT NULL DEFAULT NULL,
+    field VARCHAR(64) NOT NULL,
+    old_value TEXT NULL,
+    new_value TEXT NULL,
+    reason VARCHAR(500) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (case_id) REFERENCES cases(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Case assignments table: current and past assignees of a case
+CREATE TABLE IF NOT EXISTS case_assignments (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    case_id BIGINT NOT NULL,
+    officer_id BIGINT NOT NULL,
+    assigned_by BIGINT NOT NULL,
+    due_date DATE NULL DEFAULT NULL,
+    instructions TEXT NULL,
+    status ENUM('pending', 'accepted', 'superseded') NOT NULL DEFAULT 'pending',
+    assigned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    accepted_at TIMESTAMP NULL DEFAULT NULL,
+    ended_at TIMESTAMP NULL DEFAULT NULL,
+    FOREIGN KEY (case_id) REFERENCES cases(id) ON DELETE CASCADE,
+    FOREIGN KEY (officer_id) REFERENCES users(id),
+    FOREIGN KEY (assigned_by) REFERENCES users(id)
 );
 
 -- Create indexes
 CREATE INDEX idx_cases_reference_number ON cases(reference_number);
 CREATE INDEX idx_cases_status ON cases(status);
 CREATE INDEX idx_cases_stage ON cases(stage);
+CREATE INDEX idx_cases_assigned_officer_id ON cases(assigned_officer_id);
+CREATE INDEX idx_cases_nature_of_case ON cases(nature_of_case);
+CREATE INDEX idx_cases_country_of_origin ON cases(country_of_origin);
+CREATE INDEX idx_cases_receiving_date ON cases(receiving_date);
+CREATE INDEX idx_cases_created_at ON cases(created_at);
+CREATE INDEX idx_cases_updated_at ON cases(updated_at);
+CREATE INDEX idx_documents_scan_status ON documents(scan_status);
+CREATE INDEX idx_documents_case_latest ON documents(case_id, is_latest);
+CREATE INDEX idx_documents_checksum ON documents(checksum);
+CREATE INDEX idx_documents_storage_key ON documents(storage_key);
+CREATE INDEX idx_documents_thumbnail_status ON documents(scan_status, thumbnail_status);
+CREATE INDEX idx_documents_text_status ON documents(scan_status, text_status);
+CREATE INDEX idx_upload_sessions_expires_at ON upload_sessions(expires_at);
+CREATE INDEX idx_upload_sessions_case_id ON upload_sessions(case_id, status);
+CREATE INDEX idx_document_links_document_id ON document_links(document_id);
+CREATE INDEX idx_document_link_downloads_link_id ON document_link_downloads(link_id);
 CREATE INDEX idx_progress_notes_case_id ON progress_notes(case_id);
+CREATE INDEX idx_case_assignments_case_id ON case_assignments(case_id, status);
+CREATE INDEX idx_case_history_case_id ON case_history(case_id, created_at);
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
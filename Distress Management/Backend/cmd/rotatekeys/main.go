@@ -0,0 +1,180 @@
+// Command rotatekeys re-wraps the data keys of every stored document and
+// thumbnail with the primary master key, so older master keys can be retired.
+// File bodies are not rewritten. With -encrypt-plaintext it also encrypts
+// files stored before encryption was enabled.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"distress-management/models"
+	"distress-management/storage"
+	"distress-management/thumbnail"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	envFile := flag.String("env", "../../.env", "path to the .env file")
+	encryptPlaintext := flag.Bool("encrypt-plaintext", false, "encrypt files stored before encryption was enabled")
+	generateKey := flag.Bool("generate-key", false, "print a new random master key and exit")
+	verbose := flag.Bool("v", false, "also list files that needed no change")
+	flag.Parse()
+
+	if *generateKey {
+		key, err := storage.GenerateMasterKey()
+		if err != nil {
+			log.Fatal("Error generating key:", err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	if err := godotenv.Load(*envFile); err != nil {
+		log.Printf("Warning: .env file not found. Using environment variables.")
+	}
+
+	// Validate required environment variables
+	requiredEnvVars := []string{"DB_HOST", "DB_PORT", "DB_USER", "DB_NAME"}
+	for _, envVar := range requiredEnvVars {
+		if os.Getenv(envVar) == "" {
+			log.Fatalf("Error: %s environment variable is required", envVar)
+		}
+	}
+
+	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_NAME")))
+	if err != nil {
+		log.Fatal("Error connecting to database:", err)
+	}
+	defer db.Close()
+
+	store, err := storage.FromEnv()
+	if err != nil {
+		log.Fatal("Error configuring document storage:", err)
+	}
+	encrypted, ok := store.(*storage.Encrypted)
+	if !ok {
+		log.Fatal("Error: encryption is not configured; set STORAGE_ENCRYPTION_KEY_FILE or STORAGE_ENCRYPTION_KEYS")
+	}
+
+	keys, err := storageKeys(db)
+	if err != nil {
+		log.Fatal("Error loading documents:", err)
+	}
+
+	fmt.Printf("Re-wrapping data keys with master key %q\n\n", encrypted.Keys().Primary())
+
+	var rewrapped, current, plaintext, missing int
+	ctx := context.Background()
+	for _, key := range keys {
+		changed, err := encrypted.Rewrap(ctx, key)
+		switch {
+		case err == nil && changed:
+			rewrapped++
+			fmt.Printf("REWRAPPED    %s\n", key)
+		case err == nil:
+			current++
+			if *verbose {
+				fmt.Printf("CURRENT      %s\n", key)
+			}
+		case errors.Is(err, storage.ErrNotFound):
+			missing++
+			if *verbose {
+				fmt.Printf("MISSING      %s\n", key)
+			}
+		case errors.Is(err, storage.ErrNotEncrypted):
+			plaintext++
+			if !*encryptPlaintext {
+				fmt.Printf("PLAINTEXT    %s\n", key)
+				continue
+			}
+			if err := encrypt(ctx, encrypted, key); err != nil {
+				log.Fatalf("Error encrypting %s: %v", key, err)
+			}
+			fmt.Printf("ENCRYPTED    %s\n", key)
+		default:
+			log.Fatalf("Error re-wrapping %s: %v", key, err)
+		}
+	}
+
+	fmt.Printf("\nChecked %d files: %d re-wrapped, %d already current, %d plaintext, %d missing\n",
+		len(keys), rewrapped, current, plaintext, missing)
+	if plaintext > 0 && !*encryptPlaintext {
+		fmt.Println("Run again with -encrypt-plaintext to encrypt the plaintext files.")
+	}
+}
+
+// storageKeys lists every stored document version and its thumbnails, each
+// once
+func storageKeys(db *sql.DB) ([]string, error) {
+	documents, err := models.GetAllDocumentVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := os.Getenv("THUMBNAIL_SIZES")
+	if spec == "" {
+		spec = thumbnail.DefaultSizes
+	}
+	sizes, err := thumbnail.ParseSizes(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var keys []string
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, doc := range documents {
+		add(doc.StorageKey)
+		if doc.ThumbnailStatus == models.ThumbnailReady {
+			for _, size := range sizes {
+				add(thumbnail.Key(doc.StorageKey, size))
+			}
+		}
+	}
+	return keys, nil
+}
+
+// encrypt rewrites a plaintext file in encrypted form. The content is copied
+// to a temporary file first so it is never read while being replaced.
+func encrypt(ctx context.Context, store *storage.Encrypted, key string) error {
+	f, _, err := store.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmp, err := os.CreateTemp("", "rotatekeys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, f)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return store.Put(ctx, key, tmp, size)
+}
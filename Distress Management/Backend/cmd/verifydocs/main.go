@@ -0,0 +1,103 @@
+// Command verifydocs checks every stored document against the SHA-256
+// checksum recorded in the documents table and reports files that are
+// missing, corrupted or cannot be read, such as encrypted files whose data
+// key is missing or wrapped with a master key no longer in the keyring. It
+// checks every document and exits with status 1 if any problem is found.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"distress-management/models"
+	"distress-management/storage"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	envFile := flag.String("env", "../../.env", "path to the .env file")
+	verbose := flag.Bool("v", false, "also list documents that passed")
+	flag.Parse()
+
+	if err := godotenv.Load(*envFile); err != nil {
+		log.Printf("Warning: .env file not found. Using environment variables.")
+	}
+
+	// Validate required environment variables
+	requiredEnvVars := []string{"DB_HOST", "DB_PORT", "DB_USER", "DB_NAME"}
+	for _, envVar := range requiredEnvVars {
+		if os.Getenv(envVar) == "" {
+			log.Fatalf("Error: %s environment variable is required", envVar)
+		}
+	}
+
+	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_NAME")))
+	if err != nil {
+		log.Fatal("Error connecting to database:", err)
+	}
+	defer db.Close()
+
+	store, err := storage.FromEnv()
+	if err != nil {
+		log.Fatal("Error configuring document storage:", err)
+	}
+
+	documents, err := models.GetAllDocumentVersions(db)
+	if err != nil {
+		log.Fatal("Error loading documents:", err)
+	}
+
+	// Identical uploads share one object, so each key is read only once
+	results := map[string]error{}
+	var missing, corrupted, unreadable, unchecked int
+	ctx := context.Background()
+
+	for _, doc := range documents {
+		if doc.Checksum == "" {
+			unchecked++
+			fmt.Printf("NO CHECKSUM  document %d (case %d, %s)\n", doc.ID, doc.CaseID, doc.FileName)
+			continue
+		}
+
+		err, seen := results[doc.StorageKey]
+		if !seen {
+			err = storage.Verify(ctx, store, doc.StorageKey, doc.Checksum)
+			results[doc.StorageKey] = err
+		}
+
+		switch {
+		case err == nil:
+			if *verbose {
+				fmt.Printf("OK           document %d (case %d, %s)\n", doc.ID, doc.CaseID, doc.FileName)
+			}
+		case errors.Is(err, storage.ErrNotFound):
+			missing++
+			fmt.Printf("MISSING      document %d (case %d, %s): %s\n", doc.ID, doc.CaseID, doc.FileName, doc.StorageKey)
+		case errors.Is(err, storage.ErrChecksumMismatch):
+			corrupted++
+			fmt.Printf("CORRUPTED    document %d (case %d, %s): %s\n", doc.ID, doc.CaseID, doc.FileName, doc.StorageKey)
+		default:
+			unreadable++
+			fmt.Printf("UNREADABLE   document %d (case %d, %s): %s: %v\n", doc.ID, doc.CaseID, doc.FileName, doc.StorageKey, err)
+		}
+	}
+
+	fmt.Printf("\nChecked %d documents in %d stored files: %d missing, %d corrupted, %d unreadable, %d without checksum\n",
+		len(documents), len(results), missing, corrupted, unreadable, unchecked)
+
+	if missing > 0 || corrupted > 0 || unreadable > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,145 @@
+// Package extract pulls plain text out of uploaded documents so their content
+// can be searched. PDF, DOCX and XLSX are supported, using only the standard
+// library.
+package extract
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+// MaxTextSize caps the text kept for one document; the rest is dropped
+const MaxTextSize = 1 << 20
+
+// maxSourceSize bounds the files read into memory for parsing, and the
+// decompressed size of any one part of a file
+const maxSourceSize = 64 << 20
+
+var (
+	// ErrUnsupported is returned for types text cannot be extracted from
+	ErrUnsupported = errors.New("text extraction is not supported for this file type")
+	// ErrEncrypted is returned for password-protected documents
+	ErrEncrypted = errors.New("document is encrypted")
+	// ErrTooLarge is returned for documents too large to parse
+	ErrTooLarge = errors.New("document is too large to extract text from")
+	// ErrTooComplex is returned for documents that take too much work to
+	// extract text from, such as PDFs whose forms draw each other many
+	// times over
+	ErrTooComplex = errors.New("document is too complex to extract text from")
+	// ErrNoText is returned when a document has no text layer, such as a
+	// PDF of scanned pages
+	ErrNoText = errors.New("document contains no text; it may be a scanned image")
+)
+
+// MIME types of the supported formats
+const (
+	mimePDF  = "application/pdf"
+	mimeDOCX = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	mimeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+// Supported reports whether text can be extracted from the MIME type
+func Supported(mimeType string) bool {
+	switch mimeType {
+	case mimePDF, mimeDOCX, mimeXLSX:
+		return true
+	}
+	return false
+}
+
+// Text extracts the plain text of a document of the given MIME type. Text
+// beyond MaxTextSize is dropped. Extraction stops with ctx's error once ctx
+// is done.
+func Text(ctx context.Context, r io.ReaderAt, size int64, mimeType string) (string, error) {
+	out := &textBuilder{limit: MaxTextSize}
+
+	var err error
+	switch mimeType {
+	case mimePDF:
+		err = extractPDF(ctx, r, size, out)
+	case mimeDOCX:
+		err = extractDOCX(ctx, r, size, out)
+	case mimeXLSX:
+		err = extractXLSX(ctx, r, size, out)
+	default:
+		return "", ErrUnsupported
+	}
+	if err != nil && err != errTextFull {
+		return "", err
+	}
+
+	text := normalize(out.String())
+	if text == "" {
+		return "", ErrNoText
+	}
+	return text, nil
+}
+
+// errTextFull stops extraction once MaxTextSize is reached
+var errTextFull = errors.New("text limit reached")
+
+// ctxCheckInterval is how many tokens or objects are read between checks of
+// the context
+const ctxCheckInterval = 1024
+
+// textBuilder collects extracted text up to a limit
+type textBuilder struct {
+	strings.Builder
+	limit int
+}
+
+// write appends s, returning errTextFull once the limit is reached
+func (b *textBuilder) write(s string) error {
+	if b.Len()+len(s) > b.limit {
+		// Drop any rune cut in half by the limit
+		b.WriteString(strings.ToValidUTF8(s[:b.limit-b.Len()], ""))
+		return errTextFull
+	}
+	b.WriteString(s)
+	return nil
+}
+
+// newline starts a new line unless the text already ends with one
+func (b *textBuilder) newline() error {
+	if b.Len() == 0 || strings.HasSuffix(b.String(), "\n") {
+		return nil
+	}
+	return b.write("\n")
+}
+
+// space separates words unless the text already ends with whitespace
+func (b *textBuilder) space() error {
+	s := b.String()
+	if len(s) == 0 || strings.HasSuffix(s, " ") || strings.HasSuffix(s, "\n") || strings.HasSuffix(s, "\t") {
+		return nil
+	}
+	return b.write(" ")
+}
+
+// normalize makes extracted text valid UTF-8, collapses runs of spaces and
+// trims blank lines
+func normalize(text string) string {
+	text = strings.ToValidUTF8(text, "")
+	text = strings.ReplaceAll(text, "\x00", "")
+
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\r' || r == '\f' || r == '\v' || r == '\u00a0'
+		}), " ")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,92 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTextBuilderLimit(t *testing.T) {
+	tests := []struct {
+		writes  []string
+		want    string
+		wantErr error
+	}{
+		{[]string{"abc", "def"}, "abcdef", nil},
+		{[]string{"abcde", "€"}, "abcde€", nil},
+		{[]string{"abcdef", "ghi"}, "abcdefgh", errTextFull},
+		{[]string{"abcdef", "é€"}, "abcdefé", errTextFull},
+		// Runes cut in half by the limit are dropped
+		{[]string{"abcdefg", "é"}, "abcdefg", errTextFull},
+		{[]string{"abcdef", "x€"}, "abcdefx", errTextFull},
+	}
+
+	for _, tt := range tests {
+		b := &textBuilder{limit: 8}
+		var err error
+		for _, s := range tt.writes {
+			if err = b.write(s); err != nil {
+				break
+			}
+		}
+		if err != tt.wantErr || b.String() != tt.want {
+			t.Errorf("writing %q = %q, %v; want %q, %v", tt.writes, b.String(), err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// TestTextMaxSize checks that a document with more text than MaxTextSize is
+// cut at the limit, on a rune boundary
+func TestTextMaxSize(t *testing.T) {
+	// Three-byte runes, so the limit falls inside one
+	paragraph := `<w:p><w:r><w:t>` + strings.Repeat("€", 1000) + `</w:t></w:r></w:p>`
+	data := buildZip(t, zipPart{"word/document.xml",
+		wordPart("document", `<w:body>`+strings.Repeat(paragraph, MaxTextSize/3000+10)+`</w:body>`)})
+
+	text, err := Text(context.Background(), bytes.NewReader(data), int64(len(data)), mimeDOCX)
+	if err != nil {
+		t.Fatalf("Text(): %v", err)
+	}
+	if len(text) > MaxTextSize || len(text) < MaxTextSize-utf8.UTFMax {
+		t.Errorf("Text() returned %d bytes, want just under %d", len(text), MaxTextSize)
+	}
+	if !utf8.ValidString(text) || !strings.HasSuffix(text, "€") {
+		t.Errorf("Text() was not cut on a rune boundary: ends with %q", text[len(text)-4:])
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"  Hello   world  ", "Hello world"},
+		{"a  b\r\nc", "a b\nc"},
+		{"\n\n\nfirst\n\n\n\nsecond\n\n", "first\n\nsecond"},
+		{"tab\tkept", "tab\tkept"},
+		{"bad \xff utf-8 and \x00 nul", "bad utf-8 and nul"},
+		{" \n \n ", ""},
+	}
+	for _, tt := range tests {
+		if got := normalize(tt.in); got != tt.want {
+			t.Errorf("normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTextUnsupported(t *testing.T) {
+	for _, mimeType := range []string{"image/png", "text/plain", ""} {
+		if Supported(mimeType) {
+			t.Errorf("Supported(%q) = true", mimeType)
+		}
+		if _, err := Text(context.Background(), strings.NewReader("data"), 4, mimeType); err != ErrUnsupported {
+			t.Errorf("Text(%q) error = %v, want ErrUnsupported", mimeType, err)
+		}
+	}
+	for _, mimeType := range []string{mimePDF, mimeDOCX, mimeXLSX} {
+		if !Supported(mimeType) {
+			t.Errorf("Supported(%q) = false", mimeType)
+		}
+	}
+}
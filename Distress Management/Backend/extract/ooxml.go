@@ -0,0 +1,237 @@
+package extract
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// docxParts are the parts of a Word document holding text, in reading order
+var docxParts = regexp.MustCompile(`^word/(document|header\d*|footer\d*|footnotes|endnotes)\.xml$`)
+
+// worksheetPart matches the worksheets of a workbook
+var worksheetPart = regexp.MustCompile(`^xl/worksheets/sheet(\d+)\.xml$`)
+
+// extractDOCX writes the paragraphs of a Word document, one per line
+func extractDOCX(ctx context.Context, r io.ReaderAt, size int64, out *textBuilder) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("reading DOCX: %w", err)
+	}
+
+	var parts []*zip.File
+	for _, f := range zr.File {
+		if docxParts.MatchString(f.Name) {
+			parts = append(parts, f)
+		}
+	}
+	// The body first, then headers, footers and notes
+	sort.SliceStable(parts, func(i, j int) bool {
+		return parts[i].Name == "word/document.xml" && parts[j].Name != "word/document.xml"
+	})
+
+	for _, part := range parts {
+		err := readXMLPart(ctx, part, func(d *xml.Decoder, t xml.Token) error {
+			switch t := t.(type) {
+			case xml.StartElement:
+				switch t.Name.Local {
+				case "t":
+					return writeElementText(d, t, out)
+				case "tab":
+					return out.write("\t")
+				case "br", "cr":
+					return out.newline()
+				}
+			case xml.EndElement:
+				if t.Name.Local == "p" {
+					return out.newline()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := out.newline(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractXLSX writes every worksheet's cell values, one row per line with
+// tabs between cells
+func extractXLSX(ctx context.Context, r io.ReaderAt, size int64, out *textBuilder) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("reading XLSX: %w", err)
+	}
+
+	var sharedStrings []string
+	type sheet struct {
+		number int
+		file   *zip.File
+	}
+	var sheets []sheet
+	for _, f := range zr.File {
+		if f.Name == "xl/sharedStrings.xml" {
+			if sharedStrings, err = readSharedStrings(ctx, f); err != nil {
+				return err
+			}
+		}
+		if m := worksheetPart.FindStringSubmatch(f.Name); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			sheets = append(sheets, sheet{n, f})
+		}
+	}
+	sort.Slice(sheets, func(i, j int) bool { return sheets[i].number < sheets[j].number })
+
+	for _, s := range sheets {
+		var cellType string
+		inValue := false
+		cells := 0
+		err := readXMLPart(ctx, s.file, func(d *xml.Decoder, t xml.Token) error {
+			switch t := t.(type) {
+			case xml.StartElement:
+				switch t.Name.Local {
+				case "row":
+					cells = 0
+				case "c":
+					cellType = attr(t, "t")
+					if cells > 0 {
+						if err := out.write("\t"); err != nil {
+							return err
+						}
+					}
+					cells++
+				case "v":
+					inValue = true
+				case "t":
+					// Inline string
+					return writeElementText(d, t, out)
+				}
+			case xml.EndElement:
+				switch t.Name.Local {
+				case "v":
+					inValue = false
+				case "row":
+					return out.newline()
+				}
+			case xml.CharData:
+				if !inValue {
+					return nil
+				}
+				value := strings.TrimSpace(string(t))
+				if cellType == "s" {
+					i, err := strconv.Atoi(value)
+					if err != nil || i < 0 || i >= len(sharedStrings) {
+						return nil
+					}
+					value = sharedStrings[i]
+				}
+				return out.write(value)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := out.newline(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSharedStrings loads a workbook's shared string table
+func readSharedStrings(ctx context.Context, f *zip.File) ([]string, error) {
+	var table []string
+	var current strings.Builder
+	inText := false
+	total := 0
+	err := readXMLPart(ctx, f, func(d *xml.Decoder, t xml.Token) error {
+		switch t := t.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "si":
+				current.Reset()
+			case "t":
+				inText = true
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "si":
+				table = append(table, current.String())
+			case "t":
+				inText = false
+			}
+		case xml.CharData:
+			if inText {
+				total += len(t)
+				if total > maxSourceSize {
+					return ErrTooLarge
+				}
+				current.Write(t)
+			}
+		}
+		return nil
+	})
+	return table, err
+}
+
+// readXMLPart streams the tokens of an XML part to fn. The decompressed size
+// is limited so an archive bomb cannot run for long, and it stops once ctx
+// is done.
+func readXMLPart(ctx context.Context, f *zip.File, fn func(*xml.Decoder, xml.Token) error) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", f.Name, err)
+	}
+	defer rc.Close()
+
+	d := xml.NewDecoder(io.LimitReader(rc, maxSourceSize))
+	d.Strict = false
+	for n := 1; ; n++ {
+		if n%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		t, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("parsing %s: %w", f.Name, err)
+		}
+		if err := fn(d, t); err != nil {
+			return err
+		}
+	}
+}
+
+// writeElementText writes the character data of the element just started
+func writeElementText(d *xml.Decoder, start xml.StartElement, out *textBuilder) error {
+	var text struct {
+		Value string `xml:",chardata"`
+	}
+	if err := d.DecodeElement(&text, &start); err != nil {
+		return err
+	}
+	return out.write(text.Value)
+}
+
+func attr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"testing"
+)
+
+// zipPart is one file of an OOXML package
+type zipPart struct {
+	name, content string
+}
+
+// buildZip writes the parts to a ZIP archive in the order given
+func buildZip(t *testing.T, parts ...zipPart) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, p := range parts {
+		w, err := zw.Create(p.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(p.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+const wordNamespace = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"`
+
+// wordPart wraps body XML in a Word document part
+func wordPart(root, body string) string {
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<w:` + root + ` ` + wordNamespace + `>` + body + `</w:` + root + `>`
+}
+
+func docxSample(t *testing.T) []byte {
+	return buildZip(t,
+		zipPart{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"/>`},
+		// Headers come after the body, whatever their place in the archive
+		zipPart{"word/header1.xml", wordPart("hdr", `<w:p><w:r><w:t>Ministry of Foreign Affairs</w:t></w:r></w:p>`)},
+		zipPart{"word/document.xml", wordPart("document", `<w:body>`+
+			`<w:p><w:r><w:t xml:space="preserve">Passport lost in </w:t></w:r><w:r><w:rPr><w:b/></w:rPr><w:t>Nairobi</w:t></w:r></w:p>`+
+			`<w:p><w:r><w:t>Name:</w:t><w:tab/><w:t>Jane</w:t><w:br/><w:t>Second line</w:t></w:r></w:p>`+
+			`<w:tbl><w:tr><w:tc><w:p><w:r><w:t>In a table</w:t></w:r></w:p></w:tc></w:tr></w:tbl>`+
+			`<w:p><w:r><w:t xml:space="preserve">  Caf&#233; &amp; Co  </w:t></w:r></w:p>`+
+			`</w:body>`)},
+		zipPart{"word/footnotes.xml", wordPart("footnotes", `<w:footnote><w:p><w:r><w:t>See the police abstract</w:t></w:r></w:p></w:footnote>`)},
+		// Comments are not part of the document's text
+		zipPart{"word/comments.xml", wordPart("comments", `<w:comment><w:p><w:r><w:t>Reviewer remark</w:t></w:r></w:p></w:comment>`)},
+	)
+}
+
+const sheetNamespace = `xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"`
+
+func sheetPart(rows string) string {
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?><worksheet ` + sheetNamespace + `><sheetData>` + rows + `</sheetData></worksheet>`
+}
+
+func xlsxSample(t *testing.T) []byte {
+	return buildZip(t,
+		zipPart{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"/>`},
+		zipPart{"xl/workbook.xml", `<workbook ` + sheetNamespace + `/>`},
+		// Sheets are read in number order, not archive order
+		zipPart{"xl/worksheets/sheet10.xml", sheetPart(`<row r="1"><c r="A1" t="inlineStr"><is><t>Tenth sheet</t></is></c></row>`)},
+		zipPart{"xl/worksheets/sheet2.xml", sheetPart(`<row r="1"><c r="A1" t="s"><v>3</v></c></row>`)},
+		zipPart{"xl/worksheets/sheet1.xml", sheetPart(
+			`<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c></row>` +
+				`<row r="2"><c r="A2" t="inlineStr"><is><t>Jane Doe</t></is></c><c r="B2" t="s"><v>2</v></c><c r="C2"><v>42.5</v></c></row>` +
+				// A shared string index out of range is skipped
+				`<row r="3"><c r="A3" t="s"><v>99</v></c></row>`)},
+		zipPart{"xl/sharedStrings.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?><sst ` + sheetNamespace + ` count="4" uniqueCount="4">` +
+			`<si><t>Name</t></si>` +
+			`<si><t>Country</t></si>` +
+			`<si><r><t xml:space="preserve">Rich </t></r><r><rPr><b/></rPr><t>text</t></r></si>` +
+			`<si><t>Second sheet</t></si>` +
+			`</sst>`},
+	)
+}
+
+func TestOOXMLText(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		data     []byte
+		want     string
+		wantErr  error
+	}{
+		{"docx", mimeDOCX, docxSample(t),
+			"Passport lost in Nairobi\nName:\tJane\nSecond line\nIn a table\nCafé & Co\nMinistry of Foreign Affairs\nSee the police abstract", nil},
+		{"xlsx", mimeXLSX, xlsxSample(t),
+			"Name\tCountry\nJane Doe\tRich text\t42.5\nSecond sheet\nTenth sheet", nil},
+		{"docx without text", mimeDOCX, buildZip(t, zipPart{"word/document.xml", wordPart("document", `<w:body><w:p/></w:body>`)}), "", ErrNoText},
+		{"xlsx without sheets", mimeXLSX, buildZip(t, zipPart{"xl/workbook.xml", `<workbook/>`}), "", ErrNoText},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Text(context.Background(), bytes.NewReader(tt.data), int64(len(tt.data)), tt.mimeType)
+			if err != tt.wantErr {
+				t.Fatalf("Text() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Text() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOOXMLMalformed checks that truncated and damaged archives are handled
+// without panicking
+func TestOOXMLMalformed(t *testing.T) {
+	samples := map[string][]byte{
+		mimeDOCX: docxSample(t),
+		mimeXLSX: xlsxSample(t),
+	}
+	broken := []zipPart{
+		{"word/document.xml", `<w:document><w:body><w:p><w:t>unclosed`},
+		{"xl/sharedStrings.xml", `<sst><si><t>one</t><si><t>`},
+		{"xl/worksheets/sheet1.xml", `<worksheet><sheetData><row><c t="s"><v>-1</v></c><c t="s"><v>x</v></c>`},
+	}
+
+	for mimeType, sample := range samples {
+		for n := 0; n < len(sample); n += 11 {
+			Text(context.Background(), bytes.NewReader(sample[:n]), int64(n), mimeType)
+		}
+		for _, part := range broken {
+			data := buildZip(t, part)
+			Text(context.Background(), bytes.NewReader(data), int64(len(data)), mimeType)
+		}
+	}
+}
+
+func TestOOXMLCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var rows bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		rows.WriteString(`<row><c t="inlineStr"><is><t>cell</t></is></c></row>`)
+	}
+	data := buildZip(t, zipPart{"xl/worksheets/sheet1.xml", sheetPart(rows.String())})
+
+	if _, err := Text(ctx, bytes.NewReader(data), int64(len(data)), mimeXLSX); err != context.Canceled {
+		t.Fatalf("Text() error = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,668 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/ascii85"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// maxFormDepth bounds form XObjects drawn inside each other
+const maxFormDepth = 8
+
+// Limits on the work done for one PDF, so a crafted file cannot keep the
+// extractor busy. maxPDFDecodedSize bounds the stream data decoded, counting
+// each stream once as decoded streams are cached. maxPDFOperations bounds
+// the content stream objects interpreted, counting a form again each time it
+// is drawn.
+const (
+	maxPDFDecodedSize = 256 << 20
+	maxPDFOperations  = 10000000
+)
+
+// objectHeader finds the start of an indirect object, "12 0 obj"
+var objectHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+var errUnsupportedFilter = errors.New("unsupported PDF stream filter")
+
+// pdfDocument holds every object of a PDF, found by scanning the file
+// rather than trusting its cross-reference table, which is often damaged in
+// scanned or generated files
+type pdfDocument struct {
+	objects  map[int]interface{}
+	trailers []pdfDict
+	fonts    map[int]*pdfFont
+
+	ctx context.Context
+	// decoded and cmaps cache decoded streams and parsed ToUnicode CMaps,
+	// which pages, forms and fonts share
+	decoded map[*pdfStream]decodedStream
+	cmaps   map[*pdfStream]*toUnicode
+	// drawing holds the forms being drawn, to skip forms that draw themselves
+	drawing map[*pdfStream]bool
+	// decodedSize and operations count work against the limits above
+	decodedSize int
+	operations  int
+	// err is set once extraction must stop, because a limit was reached or
+	// ctx is done
+	err error
+}
+
+// decodedStream is the cached result of decoding a stream
+type decodedStream struct {
+	data []byte
+	err  error
+}
+
+// pdfPage is a page and the resources it inherits
+type pdfPage struct {
+	dict      pdfDict
+	resources pdfDict
+}
+
+// extractPDF writes the text shown on each page of a PDF
+func extractPDF(ctx context.Context, r io.ReaderAt, size int64, out *textBuilder) error {
+	if size > maxSourceSize {
+		return ErrTooLarge
+	}
+	data := make([]byte, size)
+	if n, err := r.ReadAt(data, 0); int64(n) != size {
+		return fmt.Errorf("reading PDF: %w", err)
+	}
+
+	doc, err := parsePDF(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	for _, page := range doc.pages() {
+		content, err := doc.contents(page.dict["Contents"])
+		if err != nil {
+			return err
+		}
+		if err := doc.writeContent(content, page.resources, out, 0); err != nil {
+			return err
+		}
+		if err := out.newline(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePDF loads the objects of a PDF, including those packed in object
+// streams
+func parsePDF(ctx context.Context, data []byte) (*pdfDocument, error) {
+	header := data
+	if len(header) > 1024 {
+		header = header[:1024]
+	}
+	if !bytes.Contains(header, []byte("%PDF-")) {
+		return nil, errors.New("not a PDF file")
+	}
+
+	doc := &pdfDocument{
+		objects: map[int]interface{}{},
+		fonts:   map[int]*pdfFont{},
+		ctx:     ctx,
+		decoded: map[*pdfStream]decodedStream{},
+		cmaps:   map[*pdfStream]*toUnicode{},
+		drawing: map[*pdfStream]bool{},
+	}
+	skipUntil := 0
+	for i, m := range objectHeader.FindAllSubmatchIndex(data, -1) {
+		if i%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		// Ignore matches inside stream data
+		if m[0] < skipUntil {
+			continue
+		}
+		num, err := strconv.Atoi(string(data[m[2]:m[3]]))
+		if err != nil {
+			continue
+		}
+
+		l := &pdfLexer{data: data, pos: m[1]}
+		obj, ok, err := l.object()
+		if err != nil || !ok {
+			continue
+		}
+		if dict, isDict := obj.(pdfDict); isDict {
+			l.skipSpace()
+			if bytes.HasPrefix(data[l.pos:], []byte("stream")) {
+				stream, end := doc.streamData(data, l.pos+len("stream"), dict)
+				obj = stream
+				skipUntil = end
+			}
+		}
+		doc.objects[num] = obj
+
+		if stream, isStream := obj.(*pdfStream); isStream {
+			switch stream.dict["Type"] {
+			case pdfName("ObjStm"):
+				doc.loadObjectStream(stream)
+			case pdfName("XRef"):
+				doc.trailers = append(doc.trailers, stream.dict)
+			}
+		}
+		if doc.err != nil {
+			return nil, doc.err
+		}
+	}
+
+	for i := 0; ; {
+		idx := bytes.Index(data[i:], []byte("trailer"))
+		if idx < 0 {
+			break
+		}
+		i += idx + len("trailer")
+		l := &pdfLexer{data: data, pos: i}
+		if obj, ok, err := l.object(); err == nil && ok {
+			if dict, isDict := obj.(pdfDict); isDict {
+				doc.trailers = append(doc.trailers, dict)
+			}
+		}
+	}
+
+	for _, trailer := range doc.trailers {
+		if _, encrypted := trailer["Encrypt"]; encrypted {
+			return nil, ErrEncrypted
+		}
+	}
+	return doc, nil
+}
+
+// streamData returns the raw data of a stream whose keyword ends at pos, and
+// where the stream ends in the file
+func (doc *pdfDocument) streamData(data []byte, pos int, dict pdfDict) (*pdfStream, int) {
+	if bytes.HasPrefix(data[pos:], []byte("\r\n")) {
+		pos += 2
+	} else if pos < len(data) && (data[pos] == '\n' || data[pos] == '\r') {
+		pos++
+	}
+
+	// Trust /Length when it points at the endstream keyword
+	if length, ok := doc.resolve(dict["Length"]).(float64); ok && length >= 0 {
+		end := pos + int(length)
+		if end <= len(data) {
+			rest := bytes.TrimLeft(data[end:], "\r\n \t")
+			if bytes.HasPrefix(rest, []byte("endstream")) {
+				return &pdfStream{dict: dict, data: data[pos:end]}, end
+			}
+		}
+	}
+
+	end := bytes.Index(data[pos:], []byte("endstream"))
+	if end < 0 {
+		return &pdfStream{dict: dict, data: data[pos:]}, len(data)
+	}
+	raw := bytes.TrimRight(data[pos:pos+end], "\r\n")
+	return &pdfStream{dict: dict, data: raw}, pos + end
+}
+
+// loadObjectStream adds the objects packed in an object stream
+func (doc *pdfDocument) loadObjectStream(s *pdfStream) {
+	data, err := doc.decodeStream(s)
+	if err != nil {
+		return
+	}
+	n, _ := doc.resolve(s.dict["N"]).(float64)
+	first, _ := doc.resolve(s.dict["First"]).(float64)
+	if first <= 0 || int(first) > len(data) {
+		return
+	}
+
+	header := &pdfLexer{data: data[:int(first)]}
+	for i := 0; i < int(n); i++ {
+		num, ok1, _ := header.object()
+		offset, ok2, _ := header.object()
+		objNum, isNum := num.(float64)
+		objOffset, isOffset := offset.(float64)
+		if !ok1 || !ok2 || !isNum || !isOffset {
+			return
+		}
+		pos := int(first) + int(objOffset)
+		if pos < 0 || pos >= len(data) {
+			continue
+		}
+		l := &pdfLexer{data: data, pos: pos}
+		if obj, ok, err := l.object(); err == nil && ok {
+			doc.objects[int(objNum)] = obj
+		}
+	}
+}
+
+// resolve follows indirect references
+func (doc *pdfDocument) resolve(obj interface{}) interface{} {
+	for i := 0; i < 32; i++ {
+		ref, ok := obj.(pdfRef)
+		if !ok {
+			return obj
+		}
+		obj = doc.objects[ref.num]
+	}
+	return nil
+}
+
+// dict resolves obj to a dictionary, taking a stream's dictionary
+func (doc *pdfDocument) dict(obj interface{}) pdfDict {
+	switch v := doc.resolve(obj).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.dict
+	}
+	return nil
+}
+
+// decodeStream applies a stream's filters. The result is cached, and once
+// maxPDFDecodedSize has been decoded every call fails with ErrTooComplex.
+func (doc *pdfDocument) decodeStream(s *pdfStream) ([]byte, error) {
+	if d, ok := doc.decoded[s]; ok {
+		return d.data, d.err
+	}
+	if doc.decodedSize > maxPDFDecodedSize {
+		return nil, doc.stop(ErrTooComplex)
+	}
+
+	data, err := doc.applyFilters(s)
+	doc.decodedSize += len(data)
+	doc.decoded[s] = decodedStream{data, err}
+	return data, err
+}
+
+// applyFilters decodes a stream's data
+func (doc *pdfDocument) applyFilters(s *pdfStream) ([]byte, error) {
+	data := s.data
+	for _, name := range doc.filters(s) {
+		var err error
+		switch name {
+		case "FlateDecode", "Fl":
+			data, err = inflate(data)
+		case "ASCIIHexDecode", "AHx":
+			l := &pdfLexer{data: data}
+			data = l.hexString()
+		case "ASCII85Decode", "A85":
+			data, err = decodeASCII85(data)
+		default:
+			err = errUnsupportedFilter
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// inflate decompresses zlib data, keeping whatever could be read from a
+// truncated or corrupt stream
+func inflate(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(zr, maxSourceSize+1))
+	if len(out) > maxSourceSize {
+		return nil, ErrTooLarge
+	}
+	if err != nil && len(out) == 0 {
+		return nil, err
+	}
+	return out, nil
+}
+
+func decodeASCII85(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	data = bytes.TrimPrefix(data, []byte("<~"))
+	if end := bytes.Index(data, []byte("~>")); end >= 0 {
+		data = data[:end]
+	}
+	// "z" expands to four zero bytes
+	out := make([]byte, 4*len(data)+4)
+	n, _, err := ascii85.Decode(out, data, true)
+	return out[:n], err
+}
+
+// pages returns the pages in order by walking the page tree from the
+// document catalog. Files whose catalog cannot be found fall back to every
+// page object in object number order.
+func (doc *pdfDocument) pages() []pdfPage {
+	var pages []pdfPage
+	visited := map[int]bool{}
+
+	var walk func(node interface{}, resources pdfDict, depth int)
+	walk = func(node interface{}, resources pdfDict, depth int) {
+		if ref, ok := node.(pdfRef); ok {
+			if visited[ref.num] {
+				return
+			}
+			visited[ref.num] = true
+		}
+		dict := doc.dict(node)
+		if dict == nil || depth > maxNesting {
+			return
+		}
+		if r := doc.dict(dict["Resources"]); r != nil {
+			resources = r
+		}
+
+		if kids, ok := doc.resolve(dict["Kids"]).(pdfArray); ok {
+			for _, kid := range kids {
+				walk(kid, resources, depth+1)
+			}
+			return
+		}
+		pages = append(pages, pdfPage{dict: dict, resources: resources})
+	}
+
+	for i := len(doc.trailers) - 1; i >= 0 && len(pages) == 0; i-- {
+		if catalog := doc.dict(doc.trailers[i]["Root"]); catalog != nil {
+			walk(catalog["Pages"], nil, 0)
+		}
+	}
+	if len(pages) > 0 {
+		return pages
+	}
+
+	var nums []int
+	for num, obj := range doc.objects {
+		if d, ok := obj.(pdfDict); ok && d["Type"] == pdfName("Page") {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		page := doc.objects[num].(pdfDict)
+		resources := doc.dict(page["Resources"])
+		for parent, depth := page["Parent"], 0; resources == nil && parent != nil && depth < maxNesting; depth++ {
+			p := doc.dict(parent)
+			if p == nil {
+				break
+			}
+			resources = doc.dict(p["Resources"])
+			parent = p["Parent"]
+		}
+		pages = append(pages, pdfPage{dict: page, resources: resources})
+	}
+	return pages
+}
+
+// stop records why extraction must end and returns it. The first reason
+// given is kept.
+func (doc *pdfDocument) stop(err error) error {
+	if doc.err == nil {
+		doc.err = err
+	}
+	return doc.err
+}
+
+// step counts an interpreted object against maxPDFOperations, checking ctx
+// now and then
+func (doc *pdfDocument) step() error {
+	if doc.err != nil {
+		return doc.err
+	}
+	doc.operations++
+	if doc.operations > maxPDFOperations {
+		return doc.stop(ErrTooComplex)
+	}
+	if doc.operations%ctxCheckInterval == 0 {
+		if err := doc.ctx.Err(); err != nil {
+			return doc.stop(err)
+		}
+	}
+	return nil
+}
+
+// contents decodes and joins a page's content streams. Pages whose content
+// adds up to more than maxSourceSize, for example by listing one large
+// stream many times, fail with ErrTooComplex.
+func (doc *pdfDocument) contents(obj interface{}) ([]byte, error) {
+	var streams []interface{}
+	switch v := doc.resolve(obj).(type) {
+	case *pdfStream:
+		streams = []interface{}{v}
+	case pdfArray:
+		streams = v
+	}
+
+	var buf bytes.Buffer
+	for _, s := range streams {
+		stream, ok := doc.resolve(s).(*pdfStream)
+		if !ok {
+			continue
+		}
+		data, err := doc.decodeStream(stream)
+		if doc.err != nil {
+			return nil, doc.err
+		}
+		if err != nil {
+			continue
+		}
+		if buf.Len()+len(data) > maxSourceSize {
+			return nil, doc.stop(ErrTooComplex)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// writeContent interprets the text operators of a content stream
+func (doc *pdfDocument) writeContent(content []byte, resources pdfDict, out *textBuilder, depth int) error {
+	l := &pdfLexer{data: content}
+	var operands []interface{}
+	var font *pdfFont
+	lastY, haveY := 0.0, false
+
+	for {
+		if err := doc.step(); err != nil {
+			return err
+		}
+		start := l.pos
+		obj, ok, err := l.object()
+		if err != nil {
+			// Skip the damaged object, making sure to move forward
+			if l.pos == start {
+				l.pos++
+			}
+			operands = operands[:0]
+			continue
+		}
+		if !ok {
+			return nil
+		}
+
+		op, isOperator := obj.(pdfKeyword)
+		if !isOperator {
+			if len(operands) < 16 {
+				operands = append(operands, obj)
+			}
+			continue
+		}
+
+		var werr error
+		switch op {
+		case "Tf":
+			if len(operands) >= 1 {
+				if name, ok := operands[0].(pdfName); ok {
+					font = doc.font(resources, name)
+				}
+			}
+		case "Tj":
+			if len(operands) >= 1 {
+				werr = doc.writeString(operands[len(operands)-1], font, out)
+			}
+		case "'":
+			if werr = out.newline(); werr == nil && len(operands) >= 1 {
+				werr = doc.writeString(operands[len(operands)-1], font, out)
+			}
+		case "\"":
+			if werr = out.newline(); werr == nil && len(operands) >= 3 {
+				werr = doc.writeString(operands[2], font, out)
+			}
+		case "TJ":
+			if len(operands) >= 1 {
+				arr, _ := operands[len(operands)-1].(pdfArray)
+				for _, item := range arr {
+					if n, ok := item.(float64); ok {
+						// A large negative adjustment is a word gap
+						if n < -200 {
+							werr = out.space()
+						}
+					} else {
+						werr = doc.writeString(item, font, out)
+					}
+					if werr != nil {
+						break
+					}
+				}
+			}
+		case "Td", "TD":
+			if len(operands) == 2 {
+				if ty, _ := operands[1].(float64); ty != 0 {
+					werr = out.newline()
+				} else {
+					werr = out.space()
+				}
+			}
+		case "T*":
+			werr = out.newline()
+		case "Tm":
+			if len(operands) == 6 {
+				y, _ := operands[5].(float64)
+				if haveY && y != lastY {
+					werr = out.newline()
+				} else {
+					werr = out.space()
+				}
+				lastY, haveY = y, true
+			}
+		case "ET":
+			werr = out.space()
+		case "BI":
+			l.skipInlineImage()
+		case "Do":
+			if len(operands) >= 1 && depth < maxFormDepth {
+				if name, ok := operands[0].(pdfName); ok {
+					werr = doc.writeForm(resources, name, out, depth)
+				}
+			}
+		}
+		if werr != nil {
+			return werr
+		}
+		operands = operands[:0]
+	}
+}
+
+// writeForm draws the text of a form XObject. A form that draws itself,
+// directly or through other forms, is drawn once.
+func (doc *pdfDocument) writeForm(resources pdfDict, name pdfName, out *textBuilder, depth int) error {
+	xobjects := doc.dict(resources["XObject"])
+	if xobjects == nil {
+		return nil
+	}
+	form, ok := doc.resolve(xobjects[name]).(*pdfStream)
+	if !ok || form.dict["Subtype"] != pdfName("Form") || doc.drawing[form] {
+		return nil
+	}
+	data, err := doc.decodeStream(form)
+	if err != nil {
+		return doc.err
+	}
+	if r := doc.dict(form.dict["Resources"]); r != nil {
+		resources = r
+	}
+
+	doc.drawing[form] = true
+	defer delete(doc.drawing, form)
+	return doc.writeContent(data, resources, out, depth+1)
+}
+
+// skipInlineImage moves past the data of an inline image, which follows the
+// ID operator and ends with EI
+func (l *pdfLexer) skipInlineImage() {
+	id := bytes.Index(l.data[l.pos:], []byte("ID"))
+	if id < 0 {
+		l.pos = len(l.data)
+		return
+	}
+	l.pos += id + 3
+	for l.pos < len(l.data) {
+		ei := bytes.Index(l.data[l.pos:], []byte("EI"))
+		if ei < 0 {
+			l.pos = len(l.data)
+			return
+		}
+		end := l.pos + ei
+		l.pos = end + 2
+		if end > 0 && isPDFSpace(l.data[end-1]) && (l.pos == len(l.data) || isPDFSpace(l.data[l.pos])) {
+			return
+		}
+	}
+}
+
+// writeString decodes a shown string with the current font
+func (doc *pdfDocument) writeString(obj interface{}, font *pdfFont, out *textBuilder) error {
+	s, ok := obj.(pdfString)
+	if !ok {
+		return nil
+	}
+	if font == nil {
+		font = &pdfFont{}
+	}
+	return out.write(font.decode(s))
+}
+
+// font loads a font from the resources, caching fonts shared by pages
+func (doc *pdfDocument) font(resources pdfDict, name pdfName) *pdfFont {
+	fonts := doc.dict(resources["Font"])
+	if fonts == nil {
+		return nil
+	}
+	ref, isRef := fonts[name].(pdfRef)
+	if isRef {
+		if f, cached := doc.fonts[ref.num]; cached {
+			return f
+		}
+	}
+
+	f := &pdfFont{}
+	if dict := doc.dict(fonts[name]); dict != nil {
+		f.composite = dict["Subtype"] == pdfName("Type0")
+		if stream, ok := doc.resolve(dict["ToUnicode"]).(*pdfStream); ok {
+			f.cmap = doc.cmap(stream)
+		}
+	}
+
+	if isRef {
+		doc.fonts[ref.num] = f
+	}
+	return f
+}
+
+// cmap parses a ToUnicode CMap, caching it for fonts that are not shared by
+// reference
+func (doc *pdfDocument) cmap(s *pdfStream) *toUnicode {
+	if m, cached := doc.cmaps[s]; cached {
+		return m
+	}
+	var m *toUnicode
+	if data, err := doc.decodeStream(s); err == nil {
+		m = parseCMap(data)
+	}
+	doc.cmaps[s] = m
+	return m
+}
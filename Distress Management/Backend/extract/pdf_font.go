@@ -0,0 +1,234 @@
+package extract
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxCMapEntries bounds the codes a ToUnicode CMap may map
+const maxCMapEntries = 1 << 17
+
+// pdfFont decodes the strings shown with a font
+type pdfFont struct {
+	// composite fonts (Type0) use multi-byte codes
+	composite bool
+	cmap      *toUnicode
+}
+
+// toUnicode is a parsed ToUnicode CMap
+type toUnicode struct {
+	// lengths are the byte lengths of codes, shortest first
+	lengths []int
+	chars   map[string]string
+}
+
+// decode converts the codes of a shown string to text. Fonts without a
+// ToUnicode map are assumed to use WinAnsiEncoding; composite fonts without
+// one cannot be decoded.
+func (f *pdfFont) decode(s []byte) string {
+	if f.cmap != nil {
+		return f.cmap.decode(s, f.composite)
+	}
+	if f.composite {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case c >= 0x80 && c < 0xa0:
+			if r := winAnsi[c-0x80]; r != 0 {
+				b.WriteRune(r)
+			}
+		case c >= 0x20 || c == '\t' || c == '\n':
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+func (m *toUnicode) decode(s []byte, composite bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		matched := false
+		for _, n := range m.lengths {
+			if i+n > len(s) {
+				break
+			}
+			if text, ok := m.chars[string(s[i:i+n])]; ok {
+				b.WriteString(text)
+				i += n
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+
+		// Unmapped code: skip one code of the usual width
+		switch {
+		case len(m.lengths) > 0:
+			i += m.lengths[0]
+		case composite:
+			i += 2
+		default:
+			i++
+		}
+	}
+	return b.String()
+}
+
+// parseCMap reads the codespace ranges and bfchar/bfrange mappings of a
+// ToUnicode CMap. It returns nil if the CMap maps nothing.
+func parseCMap(data []byte) *toUnicode {
+	m := &toUnicode{chars: map[string]string{}}
+	lengths := map[int]bool{}
+	l := &pdfLexer{data: data}
+
+	// next reads the next object, stopping at the given end keyword
+	next := func(end string) (interface{}, bool) {
+		obj, ok, err := l.object()
+		if err != nil || !ok || obj == pdfKeyword(end) {
+			return nil, false
+		}
+		return obj, true
+	}
+
+	for {
+		obj, ok, err := l.object()
+		if err != nil || !ok {
+			break
+		}
+		switch obj {
+		case pdfKeyword("begincodespacerange"):
+			for {
+				lo, ok1 := next("endcodespacerange")
+				_, ok2 := next("endcodespacerange")
+				if !ok1 || !ok2 {
+					break
+				}
+				if code, ok := lo.(pdfString); ok && len(code) > 0 && len(code) <= 4 {
+					lengths[len(code)] = true
+				}
+			}
+		case pdfKeyword("beginbfchar"):
+			for len(m.chars) < maxCMapEntries {
+				src, ok1 := next("endbfchar")
+				dst, ok2 := next("endbfchar")
+				if !ok1 || !ok2 {
+					break
+				}
+				code, isCode := src.(pdfString)
+				if !isCode || len(code) == 0 {
+					continue
+				}
+				if text, ok := dst.(pdfString); ok {
+					m.chars[string(code)] = decodeUTF16(text)
+				}
+			}
+		case pdfKeyword("beginbfrange"):
+			for len(m.chars) < maxCMapEntries {
+				lo, ok1 := next("endbfrange")
+				hi, ok2 := next("endbfrange")
+				dst, ok3 := next("endbfrange")
+				if !ok1 || !ok2 || !ok3 {
+					break
+				}
+				m.addRange(lo, hi, dst)
+			}
+		}
+	}
+
+	if len(m.chars) == 0 {
+		return nil
+	}
+	if len(lengths) == 0 {
+		for code := range m.chars {
+			lengths[len(code)] = true
+		}
+	}
+	for n := range lengths {
+		m.lengths = append(m.lengths, n)
+	}
+	sort.Ints(m.lengths)
+	return m
+}
+
+// addRange maps the codes lo to hi. dst is either the text of lo, with the
+// last character incremented for each following code, or an array with the
+// text of every code.
+func (m *toUnicode) addRange(lo, hi, dst interface{}) {
+	loCode, ok1 := lo.(pdfString)
+	hiCode, ok2 := hi.(pdfString)
+	if !ok1 || !ok2 || len(loCode) == 0 || len(loCode) != len(hiCode) || len(loCode) > 4 {
+		return
+	}
+	first, last := codeValue(loCode), codeValue(hiCode)
+	if last < first || last-first >= maxCMapEntries {
+		return
+	}
+
+	for c := first; c <= last && len(m.chars) < maxCMapEntries; c++ {
+		code := codeBytes(c, len(loCode))
+		switch d := dst.(type) {
+		case pdfString:
+			units := utf16Units(d)
+			if len(units) == 0 {
+				return
+			}
+			units[len(units)-1] += uint16(c - first)
+			m.chars[code] = string(utf16.Decode(units))
+		case pdfArray:
+			i := int(c - first)
+			if i >= len(d) {
+				return
+			}
+			if text, ok := d[i].(pdfString); ok {
+				m.chars[code] = decodeUTF16(text)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func codeValue(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+func codeBytes(v uint32, n int) string {
+	b := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	return string(b)
+}
+
+func utf16Units(b []byte) []uint16 {
+	if len(b) == 1 {
+		return []uint16{uint16(b[0])}
+	}
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return units
+}
+
+func decodeUTF16(b []byte) string {
+	return string(utf16.Decode(utf16Units(b)))
+}
+
+// winAnsi maps the bytes 0x80-0x9F of WinAnsiEncoding, which differ from
+// Latin-1
+var winAnsi = [32]rune{
+	'€', 0, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0, 'Ž', 0,
+	0, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0, 'ž', 'Ÿ',
+}
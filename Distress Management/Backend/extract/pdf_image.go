@@ -0,0 +1,307 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+)
+
+// ErrNoImage is returned by PageImage when the first page of a PDF has no
+// image it can decode
+var ErrNoImage = errors.New("first page has no image that can be decoded")
+
+// PageImage returns the largest image on the first page of a PDF, such as the
+// scan of a scanned page, for previews. Images with more than maxPixels
+// pixels are skipped. JPEG (DCTDecode) images are supported, as are 8-bit
+// gray, RGB and CMYK and 1-bit gray images stored with the filters text
+// extraction understands, with or without PNG predictors. Pages drawing
+// other kinds of images, or none, return ErrNoImage.
+func PageImage(ctx context.Context, r io.ReaderAt, size int64, maxPixels int) (image.Image, error) {
+	if size > maxSourceSize {
+		return nil, ErrTooLarge
+	}
+	data := make([]byte, size)
+	if n, err := r.ReadAt(data, 0); int64(n) != size {
+		return nil, fmt.Errorf("reading PDF: %w", err)
+	}
+
+	doc, err := parsePDF(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	pages := doc.pages()
+	if len(pages) == 0 {
+		return nil, ErrNoImage
+	}
+
+	// Largest first, falling back to smaller images that can be decoded
+	candidates := doc.pageImages(pages[0].resources, map[*pdfStream]bool{}, 0)
+	for len(candidates) > 0 {
+		best := 0
+		for i, s := range candidates {
+			if doc.imageArea(s) > doc.imageArea(candidates[best]) {
+				best = i
+			}
+		}
+		s := candidates[best]
+		candidates = append(candidates[:best], candidates[best+1:]...)
+
+		if doc.imageArea(s) > maxPixels {
+			continue
+		}
+		if img, err := doc.decodeImage(s); err == nil {
+			return img, nil
+		}
+		if doc.err != nil {
+			return nil, doc.err
+		}
+	}
+	return nil, ErrNoImage
+}
+
+// pageImages lists the image XObjects in resources and in the forms they
+// hold
+func (doc *pdfDocument) pageImages(resources pdfDict, visited map[*pdfStream]bool, depth int) []*pdfStream {
+	xobjects := doc.dict(resources["XObject"])
+	if xobjects == nil || depth > maxFormDepth {
+		return nil
+	}
+
+	var images []*pdfStream
+	for _, obj := range xobjects {
+		s, ok := doc.resolve(obj).(*pdfStream)
+		if !ok || visited[s] {
+			continue
+		}
+		visited[s] = true
+		switch s.dict["Subtype"] {
+		case pdfName("Image"):
+			images = append(images, s)
+		case pdfName("Form"):
+			images = append(images, doc.pageImages(doc.dict(s.dict["Resources"]), visited, depth+1)...)
+		}
+	}
+	return images
+}
+
+// imageArea returns the number of pixels of an image XObject
+func (doc *pdfDocument) imageArea(s *pdfStream) int {
+	w, h := doc.number(s.dict["Width"]), doc.number(s.dict["Height"])
+	if w < 1 || h < 1 || w > 1<<16 || h > 1<<16 {
+		return 0
+	}
+	return int(w) * int(h)
+}
+
+// decodeImage decodes an image XObject
+func (doc *pdfDocument) decodeImage(s *pdfStream) (image.Image, error) {
+	filters := doc.filters(s)
+	if len(filters) > 0 && (filters[len(filters)-1] == "DCTDecode" || filters[len(filters)-1] == "DCT") {
+		// Undo any filters applied on top of the JPEG data
+		inner := &pdfStream{dict: pdfDict{}, data: s.data}
+		for k, v := range s.dict {
+			inner.dict[k] = v
+		}
+		inner.dict["Filter"] = filtersArray(filters[:len(filters)-1])
+		data, err := doc.decodeStream(inner)
+		if err != nil {
+			return nil, err
+		}
+		// The JPEG may not be the size the dictionary claims
+		config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if config.Width*config.Height > doc.imageArea(s) {
+			return nil, errUnsupportedImage
+		}
+		return jpeg.Decode(bytes.NewReader(data))
+	}
+
+	if mask, _ := doc.resolve(s.dict["ImageMask"]).(bool); mask {
+		return nil, errUnsupportedImage
+	}
+	data, err := doc.decodeStream(s)
+	if err != nil {
+		return nil, err
+	}
+
+	w, h := int(doc.number(s.dict["Width"])), int(doc.number(s.dict["Height"]))
+	bits := int(doc.number(s.dict["BitsPerComponent"]))
+	components := doc.colorComponents(s.dict["ColorSpace"])
+	if doc.imageArea(s) == 0 || components == 0 || (bits != 8 && !(bits == 1 && components == 1)) {
+		return nil, errUnsupportedImage
+	}
+	stride := (w*components*bits + 7) / 8
+
+	if params := doc.dict(s.dict["DecodeParms"]); params != nil {
+		if predictor := doc.number(params["Predictor"]); predictor >= 10 {
+			if data, err = unpredictPNG(data, stride, (components*bits+7)/8, h); err != nil {
+				return nil, err
+			}
+		} else if predictor > 1 {
+			return nil, errUnsupportedImage
+		}
+	}
+	if len(data) < stride*h {
+		return nil, errUnsupportedImage
+	}
+
+	rect := image.Rect(0, 0, w, h)
+	switch {
+	case bits == 1:
+		img := image.NewGray(rect)
+		for y := 0; y < h; y++ {
+			row := data[y*stride:]
+			for x := 0; x < w; x++ {
+				if row[x/8]&(0x80>>(x%8)) != 0 {
+					img.Pix[y*img.Stride+x] = 0xff
+				}
+			}
+		}
+		return img, nil
+	case components == 1:
+		img := image.NewGray(rect)
+		for y := 0; y < h; y++ {
+			copy(img.Pix[y*img.Stride:], data[y*stride:y*stride+w])
+		}
+		return img, nil
+	case components == 3:
+		img := image.NewRGBA(rect)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				p := data[y*stride+x*3:]
+				img.SetRGBA(x, y, color.RGBA{p[0], p[1], p[2], 0xff})
+			}
+		}
+		return img, nil
+	default:
+		img := image.NewCMYK(rect)
+		for y := 0; y < h; y++ {
+			copy(img.Pix[y*img.Stride:], data[y*stride:y*stride+w*4])
+		}
+		return img, nil
+	}
+}
+
+var errUnsupportedImage = errors.New("unsupported PDF image")
+
+// filters returns the names of a stream's filters, in the order they are
+// undone
+func (doc *pdfDocument) filters(s *pdfStream) []pdfName {
+	var names []pdfName
+	switch f := doc.resolve(s.dict["Filter"]).(type) {
+	case pdfName:
+		names = append(names, f)
+	case pdfArray:
+		for _, item := range f {
+			name, _ := doc.resolve(item).(pdfName)
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func filtersArray(names []pdfName) pdfArray {
+	a := make(pdfArray, len(names))
+	for i, name := range names {
+		a[i] = name
+	}
+	return a
+}
+
+// number resolves obj to a number, or 0
+func (doc *pdfDocument) number(obj interface{}) float64 {
+	n, _ := doc.resolve(obj).(float64)
+	return n
+}
+
+// colorComponents returns the number of components of a device or ICC-based
+// color space, or 0 for others
+func (doc *pdfDocument) colorComponents(obj interface{}) int {
+	switch cs := doc.resolve(obj).(type) {
+	case pdfName:
+		switch cs {
+		case "DeviceGray", "G", "CalGray":
+			return 1
+		case "DeviceRGB", "RGB", "CalRGB":
+			return 3
+		case "DeviceCMYK", "CMYK":
+			return 4
+		}
+	case pdfArray:
+		if len(cs) == 2 && doc.resolve(cs[0]) == pdfName("ICCBased") {
+			if n := int(doc.number(doc.dict(cs[1])["N"])); n == 1 || n == 3 || n == 4 {
+				return n
+			}
+		}
+		if len(cs) > 0 {
+			if name, ok := doc.resolve(cs[0]).(pdfName); ok {
+				return doc.colorComponents(name)
+			}
+		}
+	}
+	return 0
+}
+
+// unpredictPNG undoes the PNG predictors applied row by row to image data,
+// where each row starts with the number of its predictor
+func unpredictPNG(data []byte, stride, bpp, rows int) ([]byte, error) {
+	if len(data) < (stride+1)*rows {
+		return nil, errUnsupportedImage
+	}
+	out := make([]byte, stride*rows)
+	prev := make([]byte, stride)
+	for y := 0; y < rows; y++ {
+		predictor := data[y*(stride+1)]
+		src := data[y*(stride+1)+1 : (y+1)*(stride+1)]
+		row := out[y*stride : (y+1)*stride]
+		for x := range row {
+			var left, upLeft byte
+			if x >= bpp {
+				left, upLeft = row[x-bpp], prev[x-bpp]
+			}
+			up := prev[x]
+			switch predictor {
+			case 0:
+				row[x] = src[x]
+			case 1:
+				row[x] = src[x] + left
+			case 2:
+				row[x] = src[x] + up
+			case 3:
+				row[x] = src[x] + byte((int(left)+int(up))/2)
+			case 4:
+				row[x] = src[x] + paeth(left, up, upLeft)
+			default:
+				return nil, errUnsupportedImage
+			}
+		}
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
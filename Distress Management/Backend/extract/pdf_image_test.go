@@ -0,0 +1,165 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func pdfPageImage(data []byte, maxPixels int) (image.Image, error) {
+	return PageImage(context.Background(), bytes.NewReader(data), int64(len(data)), maxPixels)
+}
+
+// imageXObject is an image XObject of w x h pixels with the given dictionary
+// entries and data
+func imageXObject(w, h int, dict string, data []byte) string {
+	return pdfStreamObject(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d %s", w, h, dict), data)
+}
+
+func testJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// grayRows returns the gray levels of img, row by row
+func grayRows(img image.Image) [][]uint8 {
+	b := img.Bounds()
+	rows := make([][]uint8, b.Dy())
+	for y := range rows {
+		for x := 0; x < b.Dx(); x++ {
+			rows[y] = append(rows[y], color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y)
+		}
+	}
+	return rows
+}
+
+func TestPageImage(t *testing.T) {
+	// Two rows of 4 gray pixels, the first stored with the Sub predictor and
+	// the second with the Up predictor
+	predicted := []byte{1, 10, 10, 10, 10, 2, 5, 5, 5, 5}
+	jpegData := testJPEG(t, 8, 4)
+
+	tests := []struct {
+		name string
+		pdf  []byte
+		// want is the gray levels of the image, or nil to check only its size
+		want          [][]uint8
+		width, height int
+	}{
+		{"8-bit gray",
+			onePagePDF(nil, "/Im1 6 0 R", imageXObject(3, 2, "/ColorSpace /DeviceGray /BitsPerComponent 8", []byte{0, 128, 255, 1, 2, 3})),
+			[][]uint8{{0, 128, 255}, {1, 2, 3}}, 3, 2},
+		{"flate RGB",
+			onePagePDF(nil, "/Im1 6 0 R", imageXObject(2, 1, "/ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode",
+				deflate([]byte{255, 255, 255, 0, 0, 0}))),
+			[][]uint8{{255, 0}}, 2, 1},
+		{"PNG predictors",
+			onePagePDF(nil, "/Im1 6 0 R", imageXObject(4, 2, "/ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /FlateDecode "+
+				"/DecodeParms << /Predictor 15 /Colors 1 /Columns 4 >>", deflate(predicted))),
+			[][]uint8{{10, 20, 30, 40}, {15, 25, 35, 45}}, 4, 2},
+		{"1-bit gray",
+			onePagePDF(nil, "/Im1 6 0 R", imageXObject(10, 1, "/ColorSpace /DeviceGray /BitsPerComponent 1", []byte{0xa0, 0x40})),
+			[][]uint8{{255, 0, 255, 0, 0, 0, 0, 0, 0, 255}}, 10, 1},
+		{"ICC-based CMYK",
+			onePagePDF(nil, "/Im1 6 0 R",
+				imageXObject(1, 1, "/ColorSpace [/ICCBased 7 0 R] /BitsPerComponent 8", []byte{0, 0, 0, 0}),
+				pdfStreamObject("/N 4", []byte("icc"))),
+			[][]uint8{{255}}, 1, 1},
+		{"JPEG",
+			onePagePDF(nil, "/Im1 6 0 R", imageXObject(8, 4, "/ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /DCTDecode", jpegData)),
+			nil, 8, 4},
+		{"hex-encoded JPEG",
+			onePagePDF(nil, "/Im1 6 0 R", imageXObject(8, 4, "/ColorSpace /DeviceGray /BitsPerComponent 8 /Filter [/ASCIIHexDecode /DCTDecode]",
+				encodeASCIIHex(jpegData))),
+			nil, 8, 4},
+		{"largest image",
+			onePagePDF(nil, "/Small 6 0 R /Large 7 0 R",
+				imageXObject(2, 2, "/ColorSpace /DeviceGray /BitsPerComponent 8", make([]byte, 4)),
+				imageXObject(8, 4, "/ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /DCTDecode", jpegData)),
+			nil, 8, 4},
+		{"image in a form",
+			onePagePDF(nil, "/Fm1 6 0 R",
+				pdfStreamObject("/Type /XObject /Subtype /Form /BBox [0 0 10 10] /Resources << /XObject << /Im1 7 0 R >> >>", []byte("/Im1 Do")),
+				imageXObject(1, 1, "/ColorSpace /DeviceGray /BitsPerComponent 8", []byte{42})),
+			[][]uint8{{42}}, 1, 1},
+		{"largest image unsupported",
+			onePagePDF(nil, "/Small 6 0 R /Large 7 0 R",
+				imageXObject(1, 1, "/ColorSpace /DeviceGray /BitsPerComponent 8", []byte{42}),
+				imageXObject(100, 100, "/ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /JPXDecode", []byte("jpx"))),
+			[][]uint8{{42}}, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := pdfPageImage(tt.pdf, 1000)
+			if err != nil {
+				t.Fatalf("PageImage(): %v", err)
+			}
+			if b := img.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Fatalf("PageImage() is %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+			if tt.want != nil {
+				if got := grayRows(img); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+					t.Errorf("PageImage() pixels = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPageImageNone(t *testing.T) {
+	gray := "/ColorSpace /DeviceGray /BitsPerComponent 8"
+	tests := []struct {
+		name string
+		pdf  []byte
+	}{
+		{"text only", onePagePDF([]byte("BT /F1 12 Tf (Hello, world) Tj ET"), "")},
+		{"no pages", buildPDF("", "<< /Type /Catalog /Pages 2 0 R >>", "<< /Type /Pages /Kids [] /Count 0 >>")},
+		{"JPEG 2000", onePagePDF(nil, "/Im1 6 0 R", imageXObject(2, 2, gray+" /Filter /JPXDecode", []byte("jpx")))},
+		{"image mask", onePagePDF(nil, "/Im1 6 0 R", imageXObject(8, 1, "/ImageMask true /BitsPerComponent 1", []byte{0xff}))},
+		{"indexed colors", onePagePDF(nil, "/Im1 6 0 R", imageXObject(1, 1, "/ColorSpace [/Indexed /DeviceRGB 0 <000000>] /BitsPerComponent 8", []byte{0}))},
+		{"short data", onePagePDF(nil, "/Im1 6 0 R", imageXObject(4, 4, gray, []byte{1, 2, 3}))},
+		// A JPEG larger than its dictionary claims is not decoded
+		{"JPEG larger than declared", onePagePDF(nil, "/Im1 6 0 R", imageXObject(1, 1, gray+" /Filter /DCTDecode", testJPEG(t, 8, 4)))},
+		{"too large", onePagePDF(nil, "/Im1 6 0 R", imageXObject(100, 100, gray, make([]byte, 10000)))},
+	}
+	for _, tt := range tests {
+		if img, err := pdfPageImage(tt.pdf, 1000); err != ErrNoImage {
+			t.Errorf("%s: PageImage() = %v, %v; want ErrNoImage", tt.name, img, err)
+		}
+	}
+
+	if _, err := pdfPageImage([]byte("Hello, world"), 1000); err == nil || err == ErrNoImage {
+		t.Errorf("PageImage() of a file that is not a PDF: error = %v", err)
+	}
+}
+
+func TestPageImageMalformed(t *testing.T) {
+	inputs := [][]byte{
+		// A color space that refers to itself
+		onePagePDF(nil, "/Im1 6 0 R", imageXObject(1, 1, "/ColorSpace 7 0 R /BitsPerComponent 8", []byte{0}), "[7 0 R]"),
+		// A form holding itself
+		onePagePDF(nil, "/Fm1 6 0 R", pdfStreamObject("/Type /XObject /Subtype /Form /Resources << /XObject << /Fm1 6 0 R >> >>", nil)),
+		// An unknown predictor
+		onePagePDF(nil, "/Im1 6 0 R", imageXObject(1, 1, "/ColorSpace /DeviceGray /BitsPerComponent 8 /DecodeParms << /Predictor 15 >>", []byte{9, 0})),
+		// Negative and huge dimensions
+		onePagePDF(nil, "/Im1 6 0 R", imageXObject(-1, 4, "/ColorSpace /DeviceGray /BitsPerComponent 8", []byte{0})),
+		onePagePDF(nil, "/Im1 6 0 R", imageXObject(1<<20, 1<<20, "/ColorSpace /DeviceGray /BitsPerComponent 8", []byte{0})),
+	}
+	for i, data := range inputs {
+		if img, err := pdfPageImage(data, 1000); err != ErrNoImage {
+			t.Errorf("input %d: PageImage() = %v, %v; want ErrNoImage", i, img, err)
+		}
+	}
+}
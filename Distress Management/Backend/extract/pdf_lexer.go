@@ -0,0 +1,302 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strconv"
+)
+
+// PDF object types produced by pdfLexer. Numbers are float64, booleans are
+// bool and null is nil.
+type (
+	pdfName    string
+	pdfKeyword string
+	pdfString  []byte
+	pdfArray   []interface{}
+	pdfDict    map[pdfName]interface{}
+	pdfRef     struct{ num, gen int }
+	pdfStream  struct {
+		dict pdfDict
+		data []byte
+	}
+)
+
+// maxNesting bounds nested arrays and dictionaries
+const maxNesting = 64
+
+var errSyntax = errors.New("PDF syntax error")
+
+// pdfLexer reads PDF objects from a byte slice. It is used for the file
+// itself, object streams, content streams and CMaps.
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isPDFDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+// skipSpace skips whitespace and comments
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+// regular reads a run of regular characters
+func (l *pdfLexer) regular() []byte {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	return l.data[start:l.pos]
+}
+
+// object reads the next object. At the end of the data it returns nil with
+// ok false.
+func (l *pdfLexer) object() (obj interface{}, ok bool, err error) {
+	return l.nested(0)
+}
+
+func (l *pdfLexer) nested(depth int) (interface{}, bool, error) {
+	if depth > maxNesting {
+		return nil, false, errSyntax
+	}
+
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, false, nil
+	}
+
+	switch c := l.data[l.pos]; c {
+	case '/':
+		l.pos++
+		return pdfName(decodeName(l.regular())), true, nil
+	case '(':
+		l.pos++
+		return l.literalString(), true, nil
+	case '<':
+		if l.pos+1 < len(l.data) && l.data[l.pos+1] == '<' {
+			l.pos += 2
+			return l.dict(depth)
+		}
+		l.pos++
+		return l.hexString(), true, nil
+	case '[':
+		l.pos++
+		var arr pdfArray
+		for {
+			l.skipSpace()
+			if l.pos >= len(l.data) {
+				return nil, false, errSyntax
+			}
+			if l.data[l.pos] == ']' {
+				l.pos++
+				return arr, true, nil
+			}
+			v, ok, err := l.nested(depth + 1)
+			if err != nil || !ok {
+				return nil, false, errSyntax
+			}
+			arr = append(arr, v)
+		}
+	case ']', '>', ')', '{', '}':
+		// Stray delimiter; skip it so callers always make progress
+		l.pos++
+		return pdfKeyword(string(c)), true, nil
+	}
+
+	token := l.regular()
+	if len(token) == 0 {
+		l.pos++
+		return nil, true, nil
+	}
+	if n, err := strconv.ParseFloat(string(token), 64); err == nil {
+		// "num gen R" is an indirect reference
+		if isInteger(token) {
+			save := l.pos
+			l.skipSpace()
+			gen := l.regular()
+			l.skipSpace()
+			if isInteger(gen) && l.pos < len(l.data) && l.data[l.pos] == 'R' &&
+				(l.pos+1 == len(l.data) || isPDFSpace(l.data[l.pos+1]) || isPDFDelimiter(l.data[l.pos+1])) {
+				l.pos++
+				g, _ := strconv.Atoi(string(gen))
+				return pdfRef{int(n), g}, true, nil
+			}
+			l.pos = save
+		}
+		return n, true, nil
+	}
+
+	switch string(token) {
+	case "true":
+		return true, true, nil
+	case "false":
+		return false, true, nil
+	case "null":
+		return nil, true, nil
+	}
+	return pdfKeyword(token), true, nil
+}
+
+func (l *pdfLexer) dict(depth int) (interface{}, bool, error) {
+	d := pdfDict{}
+	for {
+		l.skipSpace()
+		if l.pos >= len(l.data) {
+			return nil, false, errSyntax
+		}
+		if l.data[l.pos] == '>' {
+			if l.pos+1 < len(l.data) && l.data[l.pos+1] == '>' {
+				l.pos += 2
+				return d, true, nil
+			}
+			return nil, false, errSyntax
+		}
+
+		key, ok, err := l.nested(depth + 1)
+		if err != nil || !ok {
+			return nil, false, errSyntax
+		}
+		name, isName := key.(pdfName)
+		if !isName {
+			return nil, false, errSyntax
+		}
+		value, ok, err := l.nested(depth + 1)
+		if err != nil || !ok {
+			return nil, false, errSyntax
+		}
+		d[name] = value
+	}
+}
+
+func (l *pdfLexer) literalString() pdfString {
+	var out []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return out
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return out
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// Line continuation
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						v = v*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func (l *pdfLexer) hexString() pdfString {
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		if c := l.data[l.pos]; !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	l.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	n, _ := hex.Decode(out, digits)
+	return out[:n]
+}
+
+// decodeName resolves #xx escapes in a name
+func decodeName(b []byte) string {
+	if bytes.IndexByte(b, '#') < 0 {
+		return string(b)
+	}
+	var out []byte
+	for i := 0; i < len(b); i++ {
+		if b[i] == '#' && i+2 < len(b) {
+			var v [1]byte
+			if _, err := hex.Decode(v[:], b[i+1:i+3]); err == nil {
+				out = append(out, v[0])
+				i += 2
+				continue
+			}
+		}
+		out = append(out, b[i])
+	}
+	return string(out)
+}
+
+func isInteger(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,359 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/ascii85"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// buildPDF assembles a PDF whose objects are numbered from 1 in the order
+// given, with a cross-reference table and a trailer pointing at object 1 as
+// the catalog. An empty object is left out, as a free entry. trailerExtra is
+// added to the trailer dictionary.
+func buildPDF(trailerExtra string, objects ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		if obj == "" {
+			continue
+		}
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		if off == 0 {
+			b.WriteString("0000000000 65535 f \n")
+		} else {
+			fmt.Fprintf(&b, "%010d 00000 n \n", off)
+		}
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R %s>>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, trailerExtra, xref)
+	return b.Bytes()
+}
+
+// pdfStreamObject returns a stream object with the dictionary entries and data
+func pdfStreamObject(dict string, data []byte) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+}
+
+func deflate(data []byte) []byte {
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	zw.Write(data)
+	zw.Close()
+	return b.Bytes()
+}
+
+func encodeASCII85(data []byte) []byte {
+	out := make([]byte, ascii85.MaxEncodedLen(len(data)))
+	return append(out[:ascii85.Encode(out, data)], "~>"...)
+}
+
+func encodeASCIIHex(data []byte) []byte {
+	return []byte(hex.EncodeToString(data) + ">")
+}
+
+// Fonts for pagePDF
+const (
+	helvetica = "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>"
+	// identityFont is a composite font mapped to text by the CMap in object 6
+	identityFont = "<< /Type /Font /Subtype /Type0 /BaseFont /NotoSans /Encoding /Identity-H /ToUnicode 6 0 R >>"
+)
+
+// toUnicodeCMap maps the two-byte codes 1 to 6 to "H", "i", "j", "é", an
+// emoji and "!"
+const toUnicodeCMap = `/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def
+/CMapName /Adobe-Identity-UCS def
+/CMapType 2 def
+1 begincodespacerange
+<0000> <FFFF>
+endcodespacerange
+2 beginbfchar
+<0001> <0048>
+<0004> <00E9>
+endbfchar
+2 beginbfrange
+<0002> <0003> <0069>
+<0005> <0006> [<D83DDE00> <0021>]
+endbfrange
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end`
+
+// pagePDF is a document with one page drawing a content stream with the
+// given dictionary entries, using font as /F1. Further objects are numbered
+// from 6.
+func pagePDF(contentDict string, content []byte, font string, xobjects string, extra ...string) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R " +
+			"/Resources << /Font << /F1 5 0 R >> /XObject << " + xobjects + " >> >> >>",
+		pdfStreamObject(contentDict, content),
+		font,
+	}
+	return buildPDF("", append(objects, extra...)...)
+}
+
+// onePagePDF is a document with one page drawing content with Helvetica as
+// /F1 and the given XObjects
+func onePagePDF(content []byte, xobjects string, extra ...string) []byte {
+	return pagePDF("", content, helvetica, xobjects, extra...)
+}
+
+// objectStreamPDF is a document whose catalog, page tree and page are packed
+// in a compressed object stream
+func objectStreamPDF() []byte {
+	bodies := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+	}
+	var header, body strings.Builder
+	for i, b := range bodies {
+		fmt.Fprintf(&header, "%d %d ", i+1, body.Len())
+		body.WriteString(b + "\n")
+	}
+	packed := header.String() + body.String()
+
+	return buildPDF("", "", "", "",
+		pdfStreamObject("/Filter /FlateDecode", deflate([]byte("BT /F1 12 Tf (Packed objects) Tj ET"))),
+		helvetica,
+		pdfStreamObject(fmt.Sprintf("/Type /ObjStm /N 3 /First %d /Filter /FlateDecode", header.Len()), deflate([]byte(packed))),
+	)
+}
+
+// twoPagePDF has two pages that inherit their font from the page tree,
+// listed in the opposite order to their object numbers
+func twoPagePDF() []byte {
+	return buildPDF("",
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [5 0 R 3 0 R] /Count 2 /Resources << /Font << /F1 7 0 R >> >> >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+		pdfStreamObject("", []byte("BT /F1 12 Tf (Second page) Tj ET")),
+		"<< /Type /Page /Parent 2 0 R /Contents 6 0 R >>",
+		pdfStreamObject("", []byte("BT /F1 12 Tf (First page) Tj ET")),
+		helvetica,
+	)
+}
+
+func extractPDFText(ctx context.Context, data []byte) (string, error) {
+	return Text(ctx, bytes.NewReader(data), int64(len(data)), mimePDF)
+}
+
+// TestPDFFormsDrawnManyTimes checks that forms drawing each other over and
+// over stop at the operation limit instead of running for hours
+func TestPDFFormsDrawnManyTimes(t *testing.T) {
+	// Forms 6 to 14 each draw the next one ten times: 10^8 draws in all
+	var forms []string
+	for i := 0; i < 9; i++ {
+		next := 6 + i + 1
+		content := "BT /F1 12 Tf (deep) Tj ET"
+		resources := ""
+		if i < 8 {
+			content = strings.Repeat(fmt.Sprintf("/Fm%d Do\n", next), 10)
+			resources = fmt.Sprintf("/Resources << /XObject << /Fm%d %d 0 R >> >>", next, next)
+		}
+		forms = append(forms, pdfStreamObject("/Type /XObject /Subtype /Form /BBox [0 0 10 10] "+resources, []byte(content)))
+	}
+	data := onePagePDF([]byte("/Fm6 Do"), "/Fm6 6 0 R", forms...)
+
+	if _, err := extractPDFText(context.Background(), data); !errors.Is(err, ErrTooComplex) {
+		t.Fatalf("Text() error = %v, want ErrTooComplex", err)
+	}
+}
+
+// TestPDFFormDrawingItself checks that a form that draws itself is drawn once
+func TestPDFFormDrawingItself(t *testing.T) {
+	form := pdfStreamObject("/Type /XObject /Subtype /Form /BBox [0 0 10 10] /Resources << /Font << /F1 5 0 R >> /XObject << /X 6 0 R /Y 7 0 R >> >>",
+		[]byte("BT /F1 12 Tf (Looping) Tj ET\n/X Do /Y Do /X Do"))
+	sibling := pdfStreamObject("/Type /XObject /Subtype /Form /BBox [0 0 10 10] /Resources << /XObject << /X 6 0 R >> >>",
+		[]byte("/X Do /X Do"))
+	data := onePagePDF([]byte("/X Do"), "/X 6 0 R", form, sibling)
+
+	text, err := extractPDFText(context.Background(), data)
+	if err != nil {
+		t.Fatalf("Text(): %v", err)
+	}
+	if text != "Looping" {
+		t.Errorf("Text() = %q, want %q", text, "Looping")
+	}
+}
+
+// TestPDFRepeatedContentStream checks that a page listing one large stream
+// many times is refused rather than joined into gigabytes of content
+func TestPDFRepeatedContentStream(t *testing.T) {
+	large := deflate(bytes.Repeat([]byte("0 0 m\n"), 2<<20))
+	refs := strings.Repeat("4 0 R ", 100)
+	data := buildPDF("",
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Contents ["+refs+"] >>",
+		pdfStreamObject("/Filter /FlateDecode", large),
+	)
+
+	if _, err := extractPDFText(context.Background(), data); !errors.Is(err, ErrTooComplex) {
+		t.Fatalf("Text() error = %v, want ErrTooComplex", err)
+	}
+}
+
+func TestPDFCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	data := onePagePDF([]byte("BT /F1 12 Tf (Hello) Tj ET"), "")
+	if _, err := extractPDFText(ctx, data); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Text() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestPDFText(t *testing.T) {
+	hello := []byte("BT /F1 12 Tf 72 720 Td (Hello, world) Tj ET")
+	encrypt := "<< /Filter /Standard /V 2 /R 3 /Length 128 /P -4 /O <00> /U <00> >>"
+
+	// A cross-reference table pointing nowhere is ignored
+	brokenXref := onePagePDF(hello, "")
+	xref := bytes.Index(brokenXref, []byte("xref\n"))
+	copy(brokenXref[xref:], bytes.ReplaceAll(brokenXref[xref:], []byte(" 00000 n"), []byte(" 00007 n")))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr error
+	}{
+		{"plain", onePagePDF(hello, ""), "Hello, world", nil},
+		{"flate", pagePDF("/Filter /FlateDecode", deflate(hello), helvetica, ""), "Hello, world", nil},
+		{"abbreviated flate", pagePDF("/Filter /Fl", deflate(hello), helvetica, ""), "Hello, world", nil},
+		{"ascii85", pagePDF("/Filter /ASCII85Decode", encodeASCII85(hello), helvetica, ""), "Hello, world", nil},
+		{"ascii hex", pagePDF("/Filter /ASCIIHexDecode", encodeASCIIHex(hello), helvetica, ""), "Hello, world", nil},
+		{"filter chain", pagePDF("/Filter [/ASCII85Decode /FlateDecode]", encodeASCII85(deflate(hello)), helvetica, ""), "Hello, world", nil},
+		{"unsupported filter", pagePDF("/Filter /DCTDecode", hello, helvetica, ""), "", ErrNoText},
+		{"object stream", objectStreamPDF(), "Packed objects", nil},
+		{"broken cross-reference table", brokenXref, "Hello, world", nil},
+		{"no catalog", buildPDF("", "", "",
+			"<< /Type /Page /Contents 4 0 R >>", pdfStreamObject("", []byte("BT (Orphan page) Tj ET"))), "Orphan page", nil},
+		{"page order", twoPagePDF(), "First page\nSecond page", nil},
+		{"to unicode cmap", pagePDF("", []byte("BT /F1 12 Tf <0001000200030004> Tj <00050006> Tj ET"), identityFont, "",
+			pdfStreamObject("", []byte(toUnicodeCMap))), "Hij\u00e9\U0001F600!", nil},
+		{"compressed cmap", pagePDF("", []byte("BT /F1 12 Tf [<0001> 50 <0002>] TJ ET"), identityFont, "",
+			pdfStreamObject("/Filter /FlateDecode", deflate([]byte(toUnicodeCMap)))), "Hi", nil},
+		{"composite font without cmap", pagePDF("", []byte("BT /F1 12 Tf <00010002> Tj ET"),
+			"<< /Type /Font /Subtype /Type0 /Encoding /Identity-H >>", ""), "", ErrNoText},
+		{"win ansi", onePagePDF([]byte(`BT /F1 12 Tf (\223quoted\224 \200100) Tj ET`), ""), "\u201cquoted\u201d \u20ac100", nil},
+		{"escapes", onePagePDF([]byte(`BT /F1 12 Tf (a \(nested\) \
+string) Tj ET`), ""), "a (nested) string", nil},
+		{"word gaps", onePagePDF([]byte("BT /F1 12 Tf [(Hel) -20 (lo) -300 (world)] TJ ET"), ""), "Hello world", nil},
+		{"lines", onePagePDF([]byte("BT /F1 12 Tf 72 720 Td (Line one) Tj 0 -14 Td (Line two) Tj T* (Line three) Tj (Line four) ' ET"), ""),
+			"Line one\nLine two\nLine three\nLine four", nil},
+		{"text matrix", onePagePDF([]byte("BT /F1 12 Tf 1 0 0 1 72 720 Tm (Left) Tj 1 0 0 1 300 720 Tm (right) Tj 1 0 0 1 72 700 Tm (Below) Tj ET"), ""),
+			"Left right\nBelow", nil},
+		{"inline image", onePagePDF([]byte("BI /W 2 /H 1 /BPC 8 /CS /G ID \xffEI EI BT /F1 12 Tf (After image) Tj ET"), ""), "After image", nil},
+		{"form xobject", onePagePDF([]byte("q /Fm1 Do Q"), "/Fm1 6 0 R",
+			pdfStreamObject("/Type /XObject /Subtype /Form /BBox [0 0 100 100] /Resources << /Font << /F1 5 0 R >> >>",
+				[]byte("BT /F1 12 Tf (In a form) Tj ET"))), "In a form", nil},
+		{"scanned page", onePagePDF([]byte("q 612 0 0 792 0 0 cm /Im1 Do Q"), "/Im1 6 0 R",
+			pdfStreamObject("/Type /XObject /Subtype /Image /Width 1 /Height 1 /ColorSpace /DeviceGray /BitsPerComponent 8", []byte{0})), "", ErrNoText},
+		{"encrypted", buildPDF("/Encrypt 6 0 R /ID [<01> <01>] ",
+			"<< /Type /Catalog /Pages 2 0 R >>", "<< /Type /Pages /Kids [] /Count 0 >>", "", "", "", encrypt), "", ErrEncrypted},
+		{"encrypted with xref stream", onePagePDF(hello, "", encrypt,
+			pdfStreamObject("/Type /XRef /Size 8 /Root 1 0 R /Encrypt 6 0 R /W [1 2 1]", nil)), "", ErrEncrypted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractPDFText(context.Background(), tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("Text() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Text() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// pdfSamples are well-formed PDFs used as the starting point for the
+// malformed input tests and the fuzz target
+func pdfSamples() [][]byte {
+	return [][]byte{
+		onePagePDF([]byte("BT /F1 12 Tf 72 720 Td (Hello, world) Tj ET"), ""),
+		pagePDF("/Filter [/ASCII85Decode /FlateDecode]", encodeASCII85(deflate([]byte("BT /F1 12 Tf [(A) -300 (B)] TJ ET"))), helvetica, ""),
+		pagePDF("", []byte("BT /F1 12 Tf <0001000200030004> Tj ET"), identityFont, "", pdfStreamObject("", []byte(toUnicodeCMap))),
+		objectStreamPDF(),
+		twoPagePDF(),
+	}
+}
+
+// TestPDFMalformed checks that truncated and damaged files are handled
+// without panicking
+func TestPDFMalformed(t *testing.T) {
+	inputs := [][]byte{
+		nil,
+		[]byte("Hello, world"),
+		[]byte("%PDF-"),
+		[]byte("%PDF-1.4\n1 0 obj << /Length 99 >> stream\nBT (x) Tj"),
+		[]byte("%PDF-1.4\n1 0 obj " + strings.Repeat("[", 10000)),
+		[]byte("%PDF-1.4\n1 0 obj " + strings.Repeat("<<", 10000)),
+		[]byte("%PDF-1.4\n1 0 obj << /Type /ObjStm /N 1000000 /First 1 /Length 3 >> stream\n1 0\nendstream"),
+		[]byte("%PDF-1.4\n1 0 obj << /Length -5 >> stream\nendstream trailer << /Root 1 0 R >>"),
+		[]byte("%PDF-1.4\n1 0 obj 1 0 R endobj 2 0 obj 2 0 R endobj trailer << /Root 1 0 R /Size 2 0 R >>"),
+		[]byte("%PDF-1.4\n1 0 obj << /Type /Pages /Kids [1 0 R 1 0 R] >> endobj trailer << /Root << /Pages 1 0 R >> >>"),
+		onePagePDF([]byte("BT /F1 12 Tf (unterminated"), ""),
+		onePagePDF([]byte("BT /F1 Tf Tj TJ ' \" Td Tm Do BI ID"), ""),
+		pagePDF("/Filter /FlateDecode", []byte("not zlib data"), helvetica, ""),
+		pagePDF("/Filter /FlateDecode", deflate(bytes.Repeat([]byte("x"), 100000))[:50], helvetica, ""),
+		pagePDF("", []byte("BT /F1 12 Tf <0001> Tj ET"), identityFont, "",
+			pdfStreamObject("", []byte("begincodespacerange <> <FFFFFFFFFF> endcodespacerange beginbfrange <0000> <FFFF> <D800> endbfrange"))),
+	}
+	for _, sample := range pdfSamples() {
+		for n := 0; n < len(sample); n += 7 {
+			inputs = append(inputs, sample[:n])
+		}
+	}
+
+	for _, data := range inputs {
+		// Errors are expected; only panics and hangs fail the test
+		extractPDFText(context.Background(), data)
+	}
+}
+
+// FuzzParsePDF checks that no input makes the PDF parser or content
+// interpreter panic
+func FuzzParsePDF(f *testing.F) {
+	for _, sample := range pdfSamples() {
+		f.Add(sample)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		doc, err := parsePDF(context.Background(), data)
+		if err != nil {
+			return
+		}
+		out := &textBuilder{limit: MaxTextSize}
+		for _, page := range doc.pages() {
+			content, err := doc.contents(page.dict["Contents"])
+			if err != nil {
+				return
+			}
+			if err := doc.writeContent(content, page.resources, out, 0); err != nil {
+				return
+			}
+		}
+	})
+}
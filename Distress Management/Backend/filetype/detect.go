@@ -0,0 +1,206 @@
+package filetype
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrUnrecognized means the content does not match any known type
+	ErrUnrecognized = errors.New("unrecognized file type")
+	// ErrExecutable means the content is a program or script
+	ErrExecutable = errors.New("executable files are not allowed")
+	// ErrMacroEnabled means an Office file carries VBA macros
+	ErrMacroEnabled = errors.New("macro-enabled Office files are not allowed")
+	// ErrPolyglot means the content is valid as more than one format, a
+	// common trick for smuggling a payload past type checks
+	ErrPolyglot = errors.New("file is valid as more than one format")
+	// ErrMalformed means the content starts like a known type but is damaged
+	ErrMalformed = errors.New("file is damaged or incomplete")
+)
+
+const headSize = 4096
+
+var executableMagic = [][]byte{
+	[]byte("MZ"),               // Windows PE
+	[]byte("\x7fELF"),          // ELF
+	[]byte("\xca\xfe\xba\xbe"), // Mach-O universal, Java class
+	[]byte("\xfe\xed\xfa\xce"), // Mach-O
+	[]byte("\xfe\xed\xfa\xcf"),
+	[]byte("\xce\xfa\xed\xfe"),
+	[]byte("\xcf\xfa\xed\xfe"),
+	[]byte("#!"), // shell script
+}
+
+// Markup that browsers or interpreters will act on if they are tricked into
+// treating a binary file as text
+var activeMarkup = [][]byte{
+	[]byte("<script"),
+	[]byte("<html"),
+	[]byte("<!doctype html"),
+	[]byte("<svg"),
+	[]byte("<?php"),
+}
+
+// Detect identifies the content of r, which is size bytes long. The
+// signature must be at the very start of the file, and files that also
+// parse as a second format are rejected.
+func Detect(r io.ReaderAt, size int64) (Type, error) {
+	head := make([]byte, headSize)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return Type{}, err
+	}
+	head = head[:n]
+
+	for _, magic := range executableMagic {
+		if bytes.HasPrefix(head, magic) {
+			return Type{}, ErrExecutable
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		if hasActiveMarkup(head) {
+			return Type{}, ErrPolyglot
+		}
+		return checkTrailer(r, size, PDF)
+	case bytes.HasPrefix(head, []byte("\xff\xd8\xff")):
+		return checkImage(r, size, head, JPEG)
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return checkImage(r, size, head, PNG)
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return checkImage(r, size, head, GIF)
+	case len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")):
+		t, err := detectISOMedia(head[8:12])
+		if err != nil {
+			return Type{}, err
+		}
+		return checkTrailer(r, size, t)
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return detectOOXML(r, size)
+	case bytes.HasPrefix(head, oleMagic):
+		t, err := detectOLE(r, size)
+		if err != nil {
+			return Type{}, err
+		}
+		return checkTrailer(r, size, t)
+	}
+
+	return Type{}, ErrUnrecognized
+}
+
+func hasActiveMarkup(head []byte) bool {
+	lower := bytes.ToLower(head)
+	for _, markup := range activeMarkup {
+		if bytes.Contains(lower, markup) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkImage(r io.ReaderAt, size int64, head []byte, t Type) (Type, error) {
+	if hasActiveMarkup(head) {
+		return Type{}, ErrPolyglot
+	}
+	if _, _, err := image.DecodeConfig(io.NewSectionReader(r, 0, size)); err != nil {
+		return Type{}, ErrMalformed
+	}
+	return checkTrailer(r, size, t)
+}
+
+// detectISOMedia classifies an ISO base media file (MP4, QuickTime) by the
+// major brand of its leading ftyp box
+func detectISOMedia(brand []byte) (Type, error) {
+	switch string(brand) {
+	case "qt  ":
+		return MOV, nil
+	case "isom", "iso2", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "M4V ", "dash", "mmp4", "MSNV":
+		return MP4, nil
+	}
+	return Type{}, ErrUnrecognized
+}
+
+// checkTrailer rejects non-ZIP files that end with a ZIP central directory.
+// ZIP readers look for it at the end of the file, so such a file opens as an
+// archive (or a JAR) as well as the type it claims to be.
+func checkTrailer(r io.ReaderAt, size int64, t Type) (Type, error) {
+	const maxTrailer = 22 + 65535 // end of central directory plus maximum comment
+
+	n := int64(maxTrailer)
+	if size < n {
+		n = size
+	}
+	tail := make([]byte, n)
+	if _, err := r.ReadAt(tail, size-n); err != nil && err != io.EOF {
+		return Type{}, err
+	}
+	if bytes.Contains(tail, []byte("PK\x05\x06")) {
+		return Type{}, ErrPolyglot
+	}
+	return t, nil
+}
+
+// detectOOXML tells Word and Excel documents apart by their main part and
+// rejects any package that carries a VBA project
+func detectOOXML(r io.ReaderAt, size int64) (Type, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return Type{}, ErrMalformed
+	}
+
+	var contentTypes, word, excel bool
+	for _, f := range zr.File {
+		name := strings.ToLower(f.Name)
+		switch {
+		case name == "[content_types].xml":
+			contentTypes = true
+			if macro, err := declaresMacros(f); err != nil {
+				return Type{}, ErrMalformed
+			} else if macro {
+				return Type{}, ErrMacroEnabled
+			}
+		case strings.HasSuffix(name, "vbaproject.bin"), strings.HasSuffix(name, "vbadata.xml"):
+			return Type{}, ErrMacroEnabled
+		case name == "word/document.xml":
+			word = true
+		case name == "xl/workbook.xml":
+			excel = true
+		}
+	}
+
+	switch {
+	case !contentTypes:
+		// A plain ZIP archive
+		return Type{}, ErrUnrecognized
+	case word && excel:
+		return Type{}, ErrPolyglot
+	case word:
+		return DOCX, nil
+	case excel:
+		return XLSX, nil
+	}
+	return Type{}, ErrUnrecognized
+}
+
+func declaresMacros(f *zip.File) (bool, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, 1<<20))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Contains(bytes.ToLower(data), []byte("macroenabled")), nil
+}
@@ -0,0 +1,263 @@
+package filetype
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func testImage() image.Image {
+	img := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.White, color.Black})
+	img.SetColorIndex(1, 1, 1)
+	return img
+}
+
+func pngSample(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func jpegSample(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gifSample(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const pdfSample = "%PDF-1.4\n1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n" +
+	"2 0 obj << /Type /Pages /Kids [] /Count 0 >> endobj\n" +
+	"trailer << /Root 1 0 R >>\n%%EOF\n"
+
+// isoMediaSample is an ftyp box with the given major brand followed by an
+// empty mdat box
+func isoMediaSample(brand string) []byte {
+	b := []byte("\x00\x00\x00\x14ftyp" + brand + "\x00\x00\x02\x00" + brand)
+	return append(b, "\x00\x00\x00\x08mdat"...)
+}
+
+// zipSample builds a ZIP archive with the named files
+func zipSample(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const ooxmlContentTypes = `<?xml version="1.0" encoding="UTF-8"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>
+</Types>`
+
+// oleSample builds a minimal OLE2 compound file with 512-byte sectors: the
+// header, one FAT sector and one directory sector holding the root entry and
+// the named streams
+func oleSample(names ...string) []byte {
+	const sector = 512
+	file := make([]byte, 3*sector)
+
+	header := file[:sector]
+	copy(header, oleMagic)
+	binary.LittleEndian.PutUint16(header[0x1A:], 3)      // major version
+	binary.LittleEndian.PutUint16(header[0x1C:], 0xFFFE) // byte order
+	binary.LittleEndian.PutUint16(header[0x1E:], 9)      // sector shift
+	binary.LittleEndian.PutUint16(header[0x20:], 6)      // mini sector shift
+	binary.LittleEndian.PutUint32(header[0x2C:], 1)      // FAT sectors
+	binary.LittleEndian.PutUint32(header[0x30:], 1)      // first directory sector
+	binary.LittleEndian.PutUint32(header[0x3C:], oleEndOfChain)
+	binary.LittleEndian.PutUint32(header[0x44:], oleEndOfChain) // no DIFAT
+	for i := 0; i < 109; i++ {
+		binary.LittleEndian.PutUint32(header[0x4C+4*i:], 0xFFFFFFFF)
+	}
+	binary.LittleEndian.PutUint32(header[0x4C:], 0) // FAT in sector 0
+
+	fat := file[sector : 2*sector]
+	for i := 0; i < sector/4; i++ {
+		binary.LittleEndian.PutUint32(fat[4*i:], 0xFFFFFFFF)
+	}
+	binary.LittleEndian.PutUint32(fat[0:], 0xFFFFFFFD) // sector 0 is the FAT
+	binary.LittleEndian.PutUint32(fat[4:], oleEndOfChain)
+
+	dir := file[2*sector:]
+	for i, name := range append([]string{"Root Entry"}, names...) {
+		entry := dir[i*128 : (i+1)*128]
+		units := utf16.Encode([]rune(name))
+		for j, u := range units {
+			binary.LittleEndian.PutUint16(entry[2*j:], u)
+		}
+		binary.LittleEndian.PutUint16(entry[0x40:], uint16(2*len(units)+2))
+		if i == 0 {
+			entry[0x42] = 5 // root storage
+		} else {
+			entry[0x42] = 2 // stream
+		}
+	}
+	return file
+}
+
+func TestDetect(t *testing.T) {
+	pngData := pngSample(t)
+	jpegData := jpegSample(t)
+	gifData := gifSample(t)
+	jar := zipSample(t, map[string]string{"META-INF/MANIFEST.MF": "Manifest-Version: 1.0\n"})
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    Type
+		wantErr error
+	}{
+		{"pdf", []byte(pdfSample), PDF, nil},
+		{"png", pngData, PNG, nil},
+		{"jpeg", jpegData, JPEG, nil},
+		{"gif", gifData, GIF, nil},
+		{"mp4", isoMediaSample("isom"), MP4, nil},
+		{"mov", isoMediaSample("qt  "), MOV, nil},
+		{"docx", zipSample(t, map[string]string{"[Content_Types].xml": ooxmlContentTypes, "word/document.xml": "<w:document/>"}), DOCX, nil},
+		{"xlsx", zipSample(t, map[string]string{"[Content_Types].xml": "<Types/>", "xl/workbook.xml": "<workbook/>"}), XLSX, nil},
+		{"doc", oleSample("WordDocument", "\x05SummaryInformation"), DOC, nil},
+		{"xls", oleSample("Workbook"), XLS, nil},
+
+		{"windows executable", append([]byte("MZ\x90\x00"), make([]byte, 60)...), Type{}, ErrExecutable},
+		{"elf", []byte("\x7fELF\x02\x01\x01"), Type{}, ErrExecutable},
+		{"shell script", []byte("#!/bin/sh\nrm -rf /\n"), Type{}, ErrExecutable},
+
+		{"docm content type", zipSample(t, map[string]string{
+			"[Content_Types].xml": `<Types><Override ContentType="application/vnd.ms-word.document.macroEnabled.main+xml"/></Types>`,
+			"word/document.xml":   "<w:document/>",
+		}), Type{}, ErrMacroEnabled},
+		{"xlsm vba project", zipSample(t, map[string]string{
+			"[Content_Types].xml": "<Types/>",
+			"xl/workbook.xml":     "<workbook/>",
+			"xl/vbaProject.bin":   "\xd0\xcf\x11\xe0",
+		}), Type{}, ErrMacroEnabled},
+		{"doc with macros", oleSample("WordDocument", "Macros"), Type{}, ErrMacroEnabled},
+
+		// Polyglots: valid as the claimed type and as something else
+		{"png with appended jar", append(append([]byte{}, pngData...), jar...), Type{}, ErrPolyglot},
+		{"jpeg with appended zip", append(append([]byte{}, jpegData...), jar...), Type{}, ErrPolyglot},
+		{"pdf with appended zip", append([]byte(pdfSample), jar...), Type{}, ErrPolyglot},
+		{"pdf with html", []byte("%PDF-1.4\n<html><script>alert(1)</script></html>\n%%EOF"), Type{}, ErrPolyglot},
+		{"gif with script", append(append([]byte{}, gifData[:13]...), "<script>alert(1)</script>"...), Type{}, ErrPolyglot},
+		{"docx and xlsx", zipSample(t, map[string]string{
+			"[Content_Types].xml": "<Types/>",
+			"word/document.xml":   "<w:document/>",
+			"xl/workbook.xml":     "<workbook/>",
+		}), Type{}, ErrPolyglot},
+		{"doc and xls", oleSample("WordDocument", "Workbook"), Type{}, ErrPolyglot},
+
+		{"truncated png", pngData[:20], Type{}, ErrMalformed},
+		{"truncated zip", []byte("PK\x03\x04\x14\x00\x00\x00"), Type{}, ErrMalformed},
+		{"plain zip", jar, Type{}, ErrUnrecognized},
+		{"unknown ftyp brand", isoMediaSample("heic"), Type{}, ErrUnrecognized},
+		{"other compound file", oleSample("Contents"), Type{}, ErrUnrecognized},
+		{"text", []byte("just some notes"), Type{}, ErrUnrecognized},
+		{"empty", nil, Type{}, ErrUnrecognized},
+		// A signature that is not at the start does not count
+		{"pdf signature later in file", append([]byte("junk"), pdfSample...), Type{}, ErrUnrecognized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Detect(bytes.NewReader(tt.content), int64(len(tt.content)))
+			if err != tt.wantErr {
+				t.Fatalf("Detect() error = %v, want %v", err, tt.wantErr)
+			}
+			if got.Name != tt.want.Name {
+				t.Errorf("Detect() = %q, want %q", got.Name, tt.want.Name)
+			}
+		})
+	}
+}
+
+func TestMatchesExtension(t *testing.T) {
+	tests := []struct {
+		t        Type
+		filename string
+		want     bool
+	}{
+		{PDF, "report.pdf", true},
+		{PDF, "REPORT.PDF", true},
+		{PDF, "report.pdf.exe", false},
+		{PDF, "report.docx", false},
+		{PDF, "report", false},
+		{JPEG, "photo.jpg", true},
+		{JPEG, "photo.jpeg", true},
+		{JPEG, "photo.png", false},
+		{MP4, "clip.m4v", true},
+		{DOCX, "letter.doc", false},
+	}
+	for _, tt := range tests {
+		if got := tt.t.MatchesExtension(tt.filename); got != tt.want {
+			t.Errorf("%s.MatchesExtension(%q) = %v, want %v", tt.t.Name, tt.filename, got, tt.want)
+		}
+	}
+}
+
+// TestDetectIgnoresName checks that content decides the type: a PNG named
+// .pdf is detected as a PNG, and then fails the extension check
+func TestDetectIgnoresName(t *testing.T) {
+	data := pngSample(t)
+	got, err := Detect(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Detect(): %v", err)
+	}
+	if got.Name != PNG.Name {
+		t.Fatalf("Detect() = %q, want png", got.Name)
+	}
+	if got.MatchesExtension("scan.pdf") {
+		t.Error("a PNG matched the extension .pdf")
+	}
+}
+
+func TestParseAllowlist(t *testing.T) {
+	a, err := ParseAllowlist("pdf, image/png ,.docx,,JPG")
+	if err != nil {
+		t.Fatalf("ParseAllowlist: %v", err)
+	}
+	for _, allowed := range []Type{PDF, PNG, DOCX, JPEG} {
+		if !a.Allows(allowed) {
+			t.Errorf("allow-list does not allow %s", allowed.Name)
+		}
+	}
+	if a.Allows(MP4) {
+		t.Error("allow-list allows mp4")
+	}
+	if got, want := strings.Join(a.Names(), ","), "docx,jpeg,pdf,png"; got != want {
+		t.Errorf("Names() = %s, want %s", got, want)
+	}
+
+	for _, bad := range []string{"", " , ", "exe", "pdf,text/html"} {
+		if _, err := ParseAllowlist(bad); err == nil {
+			t.Errorf("ParseAllowlist(%q) succeeded, want error", bad)
+		}
+	}
+}
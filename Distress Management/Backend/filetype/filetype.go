@@ -0,0 +1,113 @@
+// Package filetype identifies uploaded documents from their content rather
+// than the name or Content-Type the client sends.
+package filetype
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Type is a document format the server can recognize
+type Type struct {
+	// Name is the short name used in configuration, e.g. "pdf"
+	Name string
+	MIME string
+	// Kind groups types for display: pdf, document, spreadsheet, image or video
+	Kind string
+	// Extensions lists the accepted file extensions; the first is used when
+	// storing the file
+	Extensions []string
+}
+
+var (
+	PDF  = Type{Name: "pdf", MIME: "application/pdf", Kind: "pdf", Extensions: []string{".pdf"}}
+	DOC  = Type{Name: "doc", MIME: "application/msword", Kind: "document", Extensions: []string{".doc"}}
+	XLS  = Type{Name: "xls", MIME: "application/vnd.ms-excel", Kind: "spreadsheet", Extensions: []string{".xls"}}
+	DOCX = Type{Name: "docx", MIME: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Kind: "document", Extensions: []string{".docx"}}
+	XLSX = Type{Name: "xlsx", MIME: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Kind: "spreadsheet", Extensions: []string{".xlsx"}}
+	JPEG = Type{Name: "jpeg", MIME: "image/jpeg", Kind: "image", Extensions: []string{".jpg", ".jpeg"}}
+	PNG  = Type{Name: "png", MIME: "image/png", Kind: "image", Extensions: []string{".png"}}
+	GIF  = Type{Name: "gif", MIME: "image/gif", Kind: "image", Extensions: []string{".gif"}}
+	MP4  = Type{Name: "mp4", MIME: "video/mp4", Kind: "video", Extensions: []string{".mp4", ".m4v"}}
+	MOV  = Type{Name: "mov", MIME: "video/quicktime", Kind: "video", Extensions: []string{".mov"}}
+)
+
+// Known lists every type Detect can return
+var Known = []Type{PDF, DOC, XLS, DOCX, XLSX, JPEG, PNG, GIF, MP4, MOV}
+
+// DefaultAllowed is the allow-list used when none is configured
+const DefaultAllowed = "pdf,doc,xls,docx,xlsx,jpeg,png,gif,mp4,mov"
+
+// Lookup finds a known type by short name, MIME type or extension
+func Lookup(s string) (Type, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, t := range Known {
+		if s == t.Name || s == t.MIME {
+			return t, true
+		}
+		for _, ext := range t.Extensions {
+			if s == ext || "."+s == ext {
+				return t, true
+			}
+		}
+	}
+	return Type{}, false
+}
+
+// Extension returns the extension to store a file of this type under
+func (t Type) Extension() string {
+	return t.Extensions[0]
+}
+
+// MatchesExtension reports whether filename's extension is one of the
+// type's extensions
+func (t Type) MatchesExtension(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, e := range t.Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowlist is the set of types accepted for upload, keyed by MIME type
+type Allowlist map[string]Type
+
+// ParseAllowlist builds an allow-list from a comma-separated list of type
+// names, MIME types or extensions, such as "pdf,docx,image/png"
+func ParseAllowlist(list string) (Allowlist, error) {
+	a := Allowlist{}
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		t, ok := Lookup(item)
+		if !ok {
+			return nil, fmt.Errorf("filetype: unknown file type %q", strings.TrimSpace(item))
+		}
+		a[t.MIME] = t
+	}
+	if len(a) == 0 {
+		return nil, fmt.Errorf("filetype: allow-list is empty")
+	}
+	return a, nil
+}
+
+// Allows reports whether t may be uploaded
+func (a Allowlist) Allows(t Type) bool {
+	_, ok := a[t.MIME]
+	return ok
+}
+
+// Names returns the short names of the allowed types, sorted
+func (a Allowlist) Names() []string {
+	names := make([]string, 0, len(a))
+	for _, t := range a {
+		names = append(names, t.Name)
+	}
+	sort.Strings(names)
+	return names
+}
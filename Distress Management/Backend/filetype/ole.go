@@ -0,0 +1,148 @@
+package filetype
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// oleMagic starts every OLE2 compound file (legacy .doc and .xls)
+var oleMagic = []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")
+
+const (
+	oleEndOfChain  = 0xFFFFFFFE
+	oleMaxSectors  = 1 << 20
+	oleMaxDirChain = 1 << 12
+)
+
+// detectOLE reads the directory of an OLE2 compound file and classifies it
+// by the streams it contains. Word keeps macros in a "Macros" storage and
+// Excel in "_VBA_PROJECT_CUR".
+func detectOLE(r io.ReaderAt, size int64) (Type, error) {
+	names, err := oleEntryNames(r, size)
+	if err != nil {
+		return Type{}, ErrMalformed
+	}
+
+	var word, excel bool
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "macros", "_vba_project_cur", "vba", "_vba_project":
+			return Type{}, ErrMacroEnabled
+		case "worddocument":
+			word = true
+		case "workbook", "book":
+			excel = true
+		}
+	}
+
+	switch {
+	case word && excel:
+		return Type{}, ErrPolyglot
+	case word:
+		return DOC, nil
+	case excel:
+		return XLS, nil
+	}
+	// Other compound files, including password-protected OOXML, cannot be
+	// inspected
+	return Type{}, ErrUnrecognized
+}
+
+type oleFile struct {
+	r          io.ReaderAt
+	size       int64
+	sectorSize int64
+}
+
+func (f *oleFile) sector(id uint32) ([]byte, error) {
+	off := (int64(id) + 1) * f.sectorSize
+	if off+f.sectorSize > f.size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, f.sectorSize)
+	if _, err := f.r.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func oleEntryNames(r io.ReaderAt, size int64) ([]string, error) {
+	header := make([]byte, 512)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+
+	shift := binary.LittleEndian.Uint16(header[0x1E:])
+	if shift != 9 && shift != 12 {
+		return nil, ErrMalformed
+	}
+	f := &oleFile{r: r, size: size, sectorSize: 1 << shift}
+
+	numFAT := binary.LittleEndian.Uint32(header[0x2C:])
+	firstDir := binary.LittleEndian.Uint32(header[0x30:])
+	firstDIFAT := binary.LittleEndian.Uint32(header[0x44:])
+	if numFAT > oleMaxSectors/uint32(f.sectorSize/4) {
+		return nil, ErrMalformed
+	}
+
+	// The first 109 FAT sector locations are in the header, the rest in a
+	// chain of DIFAT sectors
+	var fatSectors []uint32
+	for i := 0; i < 109 && uint32(len(fatSectors)) < numFAT; i++ {
+		fatSectors = append(fatSectors, binary.LittleEndian.Uint32(header[0x4C+4*i:]))
+	}
+	perDIFAT := int(f.sectorSize/4) - 1
+	for next, hops := firstDIFAT, 0; uint32(len(fatSectors)) < numFAT && next < oleEndOfChain; hops++ {
+		if hops > oleMaxDirChain {
+			return nil, ErrMalformed
+		}
+		buf, err := f.sector(next)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < perDIFAT && uint32(len(fatSectors)) < numFAT; i++ {
+			fatSectors = append(fatSectors, binary.LittleEndian.Uint32(buf[4*i:]))
+		}
+		next = binary.LittleEndian.Uint32(buf[4*perDIFAT:])
+	}
+
+	var fat []uint32
+	for _, id := range fatSectors {
+		buf, err := f.sector(id)
+		if err != nil {
+			return nil, err
+		}
+		for i := int64(0); i < f.sectorSize; i += 4 {
+			fat = append(fat, binary.LittleEndian.Uint32(buf[i:]))
+		}
+	}
+
+	// Walk the directory chain; each sector holds 128-byte entries
+	var names []string
+	for id, hops := firstDir, 0; id < oleEndOfChain; hops++ {
+		if hops > oleMaxDirChain || int(id) >= len(fat) {
+			return nil, ErrMalformed
+		}
+		buf, err := f.sector(id)
+		if err != nil {
+			return nil, err
+		}
+		for off := int64(0); off+128 <= f.sectorSize; off += 128 {
+			entry := buf[off : off+128]
+			nameLen := int(binary.LittleEndian.Uint16(entry[0x40:]))
+			if entry[0x42] == 0 || nameLen < 2 || nameLen > 64 {
+				continue
+			}
+			units := make([]uint16, nameLen/2-1)
+			for i := range units {
+				units[i] = binary.LittleEndian.Uint16(entry[2*i:])
+			}
+			names = append(names, string(utf16.Decode(units)))
+		}
+		id = fat[id]
+	}
+
+	return names, nil
+}
@@ -2,9 +2,39 @@ package handlers
 
 import (
 	"database/sql"
+	"time"
+
+	"distress-management/auth"
+	"distress-management/filetype"
+	"distress-management/models"
+	"distress-management/scanner"
+	"distress-management/search"
+	"distress-management/storage"
+	"distress-management/thumbnail"
 )
 
 // App struct holds application dependencies
 type App struct {
-	DB *sql.DB
+	DB          *sql.DB
+	Tokens      *auth.TokenManager
+	SearchIndex *search.Index
+	References  *models.ReferenceGenerator
+	Storage     storage.Storage
+	FileTypes   filetype.Allowlist
+	Scanner     scanner.Scanner // nil when none is configured; uploads then stay pending
+	Uploads     UploadSettings
+	// ScanMaxAttempts is how many scanner errors a document may get before
+	// it is marked failed; 0 means DefaultScanMaxAttempts
+	ScanMaxAttempts int
+	// ThumbnailSizes are the thumbnail sizes generated for image documents;
+	// the first is served by default
+	ThumbnailSizes []thumbnail.Size
+	// NoteEditWindow is how long after writing a note it may be edited or
+	// deleted; 0 means no limit
+	NoteEditWindow time.Duration
+	// Links signs the tokens of public document links
+	Links *auth.LinkSigner
+	// PublicURL is the scheme and host the API is reached at, used to build
+	// absolute document links; links are relative if it is empty
+	PublicURL string
 }
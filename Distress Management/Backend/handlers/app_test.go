@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"distress-management/auth"
+	"distress-management/models"
+	"distress-management/search"
+	"distress-management/storage"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+)
+
+// newTestApp returns an App on the MySQL database named by TEST_DATABASE_DSN
+// and local storage in a temporary directory. The test is skipped if the
+// variable is not set. Every table is dropped and created again from the
+// schema, so the DSN must name a scratch database, e.g.
+// TEST_DATABASE_DSN="root:@tcp(localhost:3306)/distress_test?parseTime=true"
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	loadTestSchema(t, db)
+
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, err := auth.NewLinkSigner(strings.Repeat("test-link-secret-", 2), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &App{
+		DB:          db,
+		SearchIndex: search.NewIndex(),
+		Storage:     store,
+		Links:       links,
+	}
+}
+
+// loadTestSchema runs cmd/db/schema_temp.sql statement by statement, leaving
+// out the statements that create and select the production database. It
+// uses one connection, as the schema turns foreign key checks off and on for
+// the session.
+func loadTestSchema(t *testing.T, db *sql.DB) {
+	t.Helper()
+
+	schema, err := os.ReadFile("../cmd/db/schema_temp.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, stmt := range strings.Split(string(schema), ";\n") {
+		var lines []string
+		for _, line := range strings.Split(stmt, "\n") {
+			if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+				lines = append(lines, line)
+			}
+		}
+		stmt = strings.TrimSpace(strings.Join(lines, "\n"))
+		if stmt == "" || strings.HasPrefix(stmt, "CREATE DATABASE") || strings.HasPrefix(stmt, "USE ") {
+			continue
+		}
+		if _, err := conn.ExecContext(context.Background(), stmt); err != nil {
+			t.Fatalf("loading schema: %v\n%s", err, stmt)
+		}
+	}
+}
+
+var testSeq atomic.Int64
+
+// testUser creates an active user with the role and department
+func testUser(t *testing.T, app *App, role, department string) *models.User {
+	t.Helper()
+
+	n := testSeq.Add(1)
+	u := &models.User{
+		Name:       fmt.Sprintf("%s %d", role, n),
+		Email:      fmt.Sprintf("%s%d@example.org", role, n),
+		Password:   "correct horse battery staple",
+		Role:       role,
+		Department: department,
+	}
+	if err := u.Create(app.DB); err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	return u
+}
+
+// testCase creates a case, assigned to officer unless it is nil
+func testCase(t *testing.T, app *App, officer *models.User) *models.Case {
+	t.Helper()
+
+	now := time.Now().Truncate(time.Second)
+	c := &models.Case{
+		ReferenceNumber:      fmt.Sprintf("TEST/%d", testSeq.Add(1)),
+		SenderName:           "Embassy",
+		ReceivingDate:        now,
+		Subject:              "Lost passport",
+		CountryOfOrigin:      "Kenya",
+		DistressedPersonName: "Jane Doe",
+		NatureOfCase:         "Standard",
+		CaseDetails:          "Passport lost during travel",
+		Status:               "Pending",
+		Stage:                "Front Office Receipt",
+		CreatedAt:            now,
+		UpdatedAt:            now,
+	}
+	if err := c.Create(app.DB); err != nil {
+		t.Fatalf("creating case: %v", err)
+	}
+	if officer != nil {
+		if err := c.SetAssignedOfficer(app.DB, officer.ID); err != nil {
+			t.Fatalf("assigning case: %v", err)
+		}
+	}
+	return c
+}
+
+// testDocument stores content as a clean, scanned document of the case
+func testDocument(t *testing.T, app *App, c *models.Case, uploader *models.User, name string, content []byte) *models.Document {
+	t.Helper()
+
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	key := storage.ContentKeyFor(app.Storage, checksum)
+	if err := app.Storage.Put(context.Background(), key, bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("storing document: %v", err)
+	}
+
+	doc := &models.Document{
+		CaseID:     c.ID,
+		FileName:   name,
+		StorageKey: key,
+		FileType:   "application/pdf",
+		FileSize:   int64(len(content)),
+		UploadedBy: uploader.ID,
+		ScanStatus: models.ScanClean,
+		Checksum:   checksum,
+	}
+	if err := doc.Create(app.DB); err != nil {
+		t.Fatalf("creating document: %v", err)
+	}
+	return doc
+}
+
+// serve routes r to h registered under pattern, as the user if one is given
+func serve(h http.HandlerFunc, pattern string, r *http.Request, user *models.User) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc(pattern, h)
+	if user != nil {
+		r = r.WithContext(auth.WithUser(r.Context(), user))
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, r)
+	return rec
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"distress-management/auth"
+	"distress-management/models"
+	"distress-management/workflow"
+)
+
+// AssignCase puts an officer in charge of a case and moves it into Cadet
+// Assignment. Assigning a case that already has an officer reassigns it; the
+// previous assignment is kept as superseded.
+func (app *App) AssignCase(w http.ResponseWriter, r *http.Request) {
+	existing, user, ok := app.authorizeCase(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		OfficerID    int64  `json:"officerId"`
+		DueDate      string `json:"dueDate"`
+		Instructions string `json:"instructions"`
+		Reason       string `json:"reason"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	var dueDate models.NullTime
+	if input.DueDate != "" {
+		d, err := time.Parse("2006-01-02", input.DueDate)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "dueDate must be formatted as YYYY-MM-DD")
+			return
+		}
+		dueDate = models.NullTime{NullTime: sql.NullTime{Time: d, Valid: true}}
+	}
+
+	officer, err := models.GetUser(app.DB, input.OfficerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusBadRequest, "Officer not found")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Error retrieving officer")
+		}
+		return
+	}
+	if !officer.Active {
+		respondWithError(w, http.StatusBadRequest, "Cannot assign a case to an inactive user")
+		return
+	}
+	if !auth.IsOfficerRole(officer.Role) {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf(
+			"Cannot assign a case to a user with role %q; the user must be an officer or cadet", officer.Role))
+		return
+	}
+
+	from := workflow.State{Stage: existing.Stage, Status: existing.Status}
+	transition, err := workflow.Resolve(from, user.Role, workflow.ActionAssign, workflow.State{})
+	switch err {
+	case nil:
+	case workflow.ErrRoleNotAllowed:
+		respondWithError(w, http.StatusForbidden, fmt.Sprintf("Forbidden: role %q may not assign cases", user.Role))
+		return
+	default:
+		respondWithTransitionConflict(w, err.Error(), existing, user)
+		return
+	}
+
+	previousOfficerID := existing.AssignedOfficerID
+	assignment := &models.CaseAssignment{
+		CaseID:       existing.ID,
+		OfficerID:    officer.ID,
+		OfficerName:  officer.Name,
+		AssignedBy:   user.ID,
+		DueDate:      dueDate,
+		Instructions: strings.TrimSpace(input.Instructions),
+	}
+
+	err = models.WithTx(app.DB, func(tx *sql.Tx) error {
+		if err := existing.MoveTo(tx, transition.To.Stage, transition.To.Status); err != nil {
+			return err
+		}
+		if err := models.SupersedeAssignments(tx, existing.ID); err != nil {
+			return err
+		}
+		if err := assignment.Create(tx); err != nil {
+			return err
+		}
+		if err := existing.SetAssignedOfficer(tx, officer.ID); err != nil {
+			return err
+		}
+		return models.RecordCaseChanges(tx, existing.ID, user.ID, input.Reason, []models.FieldChange{
+			{Field: models.HistoryFieldStage, OldValue: from.Stage, NewValue: transition.To.Stage},
+			{Field: models.HistoryFieldStatus, OldValue: from.Status, NewValue: transition.To.Status},
+			{Field: models.HistoryFieldAssignedOfficer, OldValue: formatID(previousOfficerID), NewValue: formatID(officer.ID)},
+		})
+	})
+	if err != nil {
+		if err == models.ErrCaseStateChanged {
+			respondWithTransitionConflict(w, err.Error(), existing, user)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error assigning case")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, assignment)
+}
+
+// AcceptAssignment lets the assigned officer accept the case, which starts
+// the investigation
+func (app *App) AcceptAssignment(w http.ResponseWriter, r *http.Request) {
+	existing, user, ok := app.authorizeCase(w, r)
+	if !ok {
+		return
+	}
+
+	assignment, err := models.GetCurrentAssignment(app.DB, existing.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusConflict, "Case has no open assignment")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Error retrieving assignment")
+		}
+		return
+	}
+
+	if assignment.OfficerID != user.ID {
+		respondWithError(w, http.StatusForbidden, "Forbidden: only the assigned officer can accept this assignment")
+		return
+	}
+	if assignment.Status == models.AssignmentAccepted {
+		respondWithError(w, http.StatusConflict, "Assignment has already been accepted")
+		return
+	}
+
+	from := workflow.State{Stage: existing.Stage, Status: existing.Status}
+	transition, err := workflow.Resolve(from, user.Role, workflow.ActionStartInvestigation, workflow.State{})
+	switch err {
+	case nil:
+	case workflow.ErrRoleNotAllowed:
+		respondWithError(w, http.StatusForbidden, fmt.Sprintf("Forbidden: role %q may not accept assignments", user.Role))
+		return
+	default:
+		respondWithTransitionConflict(w, err.Error(), existing, user)
+		return
+	}
+
+	err = models.WithTx(app.DB, func(tx *sql.Tx) error {
+		if err := existing.MoveTo(tx, transition.To.Stage, transition.To.Status); err != nil {
+			return err
+		}
+		if err := assignment.Accept(tx); err != nil {
+			return err
+		}
+		return models.RecordCaseChanges(tx, existing.ID, user.ID, "Assignment accepted", []models.FieldChange{
+			{Field: models.HistoryFieldStage, OldValue: from.Stage, NewValue: transition.To.Stage},
+			{Field: models.HistoryFieldStatus, OldValue: from.Status, NewValue: transition.To.Status},
+		})
+	})
+	if err != nil {
+		if err == models.ErrCaseStateChanged {
+			respondWithTransitionConflict(w, err.Error(), existing, user)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error accepting assignment")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, assignment)
+}
+
+// GetCaseAssignments lists the current and past assignees of a case
+func (app *App) GetCaseAssignments(w http.ResponseWriter, r *http.Request) {
+	existing, _, ok := app.authorizeCase(w, r)
+	if !ok {
+		return
+	}
+
+	assignments, err := models.GetCaseAssignments(app.DB, existing.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving assignments")
+		return
+	}
+
+	if assignments == nil {
+		assignments = []models.CaseAssignment{}
+	}
+
+	respondWithJSON(w, http.StatusOK, assignments)
+}
+
+// formatID renders an optional ID for case history, leaving unset IDs empty
+func formatID(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
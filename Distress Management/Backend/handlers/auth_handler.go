@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"distress-management/auth"
+	"distress-management/models"
+)
+
+type tokenResponse struct {
+	Token            string       `json:"token"`
+	TokenType        string       `json:"tokenType"`
+	ExpiresAt        time.Time    `json:"expiresAt"`
+	RefreshToken     string       `json:"refreshToken"`
+	RefreshExpiresAt time.Time    `json:"refreshExpiresAt"`
+	User             *models.User `json:"user"`
+}
+
+// Login authenticates a user by email and password and issues a token pair
+func (app *App) Login(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	input.Email = strings.TrimSpace(input.Email)
+	if input.Email == "" || input.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Email and password are required")
+		return
+	}
+
+	user, err := models.GetUserByEmail(app.DB, input.Email)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error looking up user %s: %v", input.Email, err)
+			respondWithError(w, http.StatusInternalServerError, "Error during login")
+			return
+		}
+		respondWithError(w, http.StatusUnauthorized, "Invalid email or password")
+		return
+	}
+
+	if err := user.ComparePassword(input.Password); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid email or password")
+		return
+	}
+
+	if !user.Active {
+		respondWithError(w, http.StatusForbidden, "Account is deactivated")
+		return
+	}
+
+	if err := user.UpdateLastLogin(app.DB); err != nil {
+		log.Printf("Error updating last login for user %d: %v", user.ID, err)
+	}
+
+	familyID, err := newTokenFamily()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error issuing tokens")
+		return
+	}
+
+	app.issueTokens(w, user, familyID)
+}
+
+// RefreshToken exchanges a refresh token for a new token pair. Every refresh
+// token can be used exactly once; presenting a rotated token again revokes the
+// whole login session.
+func (app *App) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.RefreshToken == "" {
+		respondWithError(w, http.StatusBadRequest, "Refresh token is required")
+		return
+	}
+
+	stored, err := models.GetRefreshTokenByHash(app.DB, auth.HashRefreshToken(input.RefreshToken))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			respondWithError(w, http.StatusInternalServerError, "Error refreshing token")
+			return
+		}
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+
+	if stored.RevokedAt.Valid {
+		log.Printf("Refresh token reuse detected for user %d, revoking session", stored.UserID)
+		models.RevokeRefreshTokenFamily(app.DB, stored.FamilyID)
+		respondWithError(w, http.StatusUnauthorized, "Refresh token has already been used")
+		return
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token has expired")
+		return
+	}
+
+	user, err := models.GetUser(app.DB, stored.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+
+	if !user.Active {
+		models.RevokeRefreshTokenFamily(app.DB, stored.FamilyID)
+		respondWithError(w, http.StatusForbidden, "Account is deactivated")
+		return
+	}
+
+	if err := stored.Revoke(app.DB); err != nil {
+		if err == models.ErrRefreshTokenUsed {
+			models.RevokeRefreshTokenFamily(app.DB, stored.FamilyID)
+			respondWithError(w, http.StatusUnauthorized, "Refresh token has already been used")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error refreshing token")
+		return
+	}
+
+	app.issueTokens(w, user, stored.FamilyID)
+}
+
+// Logout revokes the login session the given refresh token belongs to
+func (app *App) Logout(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.RefreshToken == "" {
+		respondWithError(w, http.StatusBadRequest, "Refresh token is required")
+		return
+	}
+
+	user, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	stored, err := models.GetRefreshTokenByHash(app.DB, auth.HashRefreshToken(input.RefreshToken))
+	if err == nil {
+		if stored.UserID != user.ID {
+			respondWithError(w, http.StatusForbidden, "Refresh token belongs to another user")
+			return
+		}
+		if err := models.RevokeRefreshTokenFamily(app.DB, stored.FamilyID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error logging out")
+			return
+		}
+	} else if err != sql.ErrNoRows {
+		respondWithError(w, http.StatusInternalServerError, "Error logging out")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Logged out successfully"})
+}
+
+// issueTokens creates a new access token and refresh token in the given
+// session family and writes them to the response
+func (app *App) issueTokens(w http.ResponseWriter, user *models.User, familyID string) {
+	accessToken, expiresAt, err := app.Tokens.GenerateAccessToken(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error issuing tokens")
+		return
+	}
+
+	refreshToken, refreshHash, err := auth.GenerateRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error issuing tokens")
+		return
+	}
+
+	stored := &models.RefreshToken{
+		UserID:    user.ID,
+		TokenHash: refreshHash,
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(app.Tokens.RefreshTTL),
+	}
+	if err := stored.Create(app.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error issuing tokens")
+		return
+	}
+
+	user.Password = ""
+	respondWithJSON(w, http.StatusOK, tokenResponse{
+		Token:            accessToken,
+		TokenType:        "Bearer",
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: stored.ExpiresAt,
+		User:             user,
+	})
+}
+
+func newTokenFamily() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
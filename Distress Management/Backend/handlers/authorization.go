@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"distress-management/auth"
+	"distress-management/models"
+
+	"github.com/gorilla/mux"
+)
+
+// currentUser returns the authenticated user, writing a 401 if there is none
+func currentUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	user, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return nil, false
+	}
+	return user, true
+}
+
+// authorizeCase loads the case named by the {id} route variable and checks
+// that the current user may work on it. On failure it writes the error
+// response and returns false.
+func (app *App) authorizeCase(w http.ResponseWriter, r *http.Request) (*models.Case, *models.User, bool) {
+	user, ok := currentUser(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	caseID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid case ID")
+		return nil, nil, false
+	}
+
+	c, err := models.GetCase(app.DB, caseID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Case not found")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Error retrieving case")
+		}
+		return nil, nil, false
+	}
+
+	if !auth.CanAccessCase(user, c) {
+		respondWithError(w, http.StatusForbidden, "Forbidden: this case is not assigned to you")
+		return nil, nil, false
+	}
+
+	return c, user, true
+}
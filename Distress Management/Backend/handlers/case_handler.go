@@ -4,99 +4,147 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/gorilla/mux"
+	"distress-management/auth"
+	"distress-management/models"
+	"distress-management/workflow"
 )
 
-// GetCases returns a list of all cases
+const maxCasesPageSize = 100
+
+// caseListItem is the shape of a case in the GET /api/cases response
+type caseListItem struct {
+	ID                   int64     `json:"id"`
+	ReferenceNumber      string    `json:"referenceNumber"`
+	SenderName           string    `json:"senderName"`
+	ReceivingDate        time.Time `json:"receivingDate"`
+	Subject              string    `json:"subject"`
+	CountryOfOrigin      string    `json:"countryOfOrigin"`
+	DistressedPersonName string    `json:"distressedPersonName"`
+	NatureOfCase         string    `json:"natureOfCase"`
+	CaseDetails          string    `json:"caseDetails"`
+	Status               string    `json:"status"`
+	Stage                string    `json:"stage"`
+	AssignedOfficerID    int64     `json:"assignedOfficerId,omitempty"`
+	CreatedAt            time.Time `json:"createdAt"`
+	UpdatedAt            time.Time `json:"updatedAt"`
+}
+
+// GetCases returns a page of cases. It supports filtering on status, stage,
+// nature_of_case, country_of_origin, assigned_officer_id and a
+// received_from/received_to date range, free-text search with q, and sorting
+// with sort=<column> (prefix with - for descending). Paging metadata is
+// returned in the X-Total-Count, X-Page, X-Per-Page, X-Total-Pages and Link
+// headers.
 func (app *App) GetCases(w http.ResponseWriter, r *http.Request) {
-	page := 1
-	limit := 10
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	q := models.CaseQuery{
+		Statuses:  queryList(params, "status"),
+		Stages:    queryList(params, "stage"),
+		Natures:   queryList(params, "nature_of_case"),
+		Countries: queryList(params, "country_of_origin"),
+		Search:    params.Get("q"),
+		Sort:      "created_at",
+		Desc:      true,
+		Page:      1,
+		Limit:     10,
+	}
 
 	// Parse page and limit from query parameters
-	if pageStr := r.URL.Query().Get("page"); pageStr != "" {
+	if pageStr := params.Get("page"); pageStr != "" {
 		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
+			q.Page = p
 		}
 	}
-	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+	if limitStr := params.Get("limit"); limitStr != "" {
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
+			q.Limit = min(l, maxCasesPageSize)
 		}
 	}
 
-	fmt.Printf("Fetching cases with page: %d, limit: %d\n", page, limit)
-	rows, err := app.DB.Query(`
-		SELECT id, reference_number, sender_name, receiving_date, subject, 
-		country_of_origin, distressed_person_name, nature_of_case, case_details, 
-		status, stage, created_at, updated_at
-		FROM cases
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`, limit, (page-1)*limit)
-	if err != nil {
-		fmt.Printf("Error fetching cases: %v\n", err)
-		http.Error(w, "Error retrieving cases: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var cases []map[string]interface{}
-	for rows.Next() {
-		var c struct {
-			ID                   int64   `json:"id"`
-			ReferenceNumber     string  `json:"referenceNumber"`
-			SenderName          string  `json:"senderName"`
-			ReceivingDate       string  `json:"receivingDate"`
-			Subject             string  `json:"subject"`
-			CountryOfOrigin     string  `json:"countryOfOrigin"`
-			DistressedPersonName string `json:"distressedPersonName"`
-			NatureOfCase        string  `json:"natureOfCase"`
-			CaseDetails         string  `json:"caseDetails"`
-			Status              string  `json:"status"`
-			Stage               string  `json:"stage"`
-			CreatedAt           string  `json:"createdAt"`
-			UpdatedAt           string  `json:"updatedAt"`
+	if sort := params.Get("sort"); sort != "" {
+		column := strings.TrimPrefix(sort, "-")
+		if _, ok := models.CaseSortColumns[column]; !ok {
+			respondWithError(w, http.StatusBadRequest, "Cannot sort by "+column)
+			return
 		}
+		q.Sort = column
+		q.Desc = strings.HasPrefix(sort, "-") || strings.EqualFold(params.Get("order"), "desc")
+	}
 
-		err := rows.Scan(
-			&c.ID, &c.ReferenceNumber, &c.SenderName, &c.ReceivingDate,
-			&c.Subject, &c.CountryOfOrigin, &c.DistressedPersonName,
-			&c.NatureOfCase, &c.CaseDetails, &c.Status, &c.Stage,
-			&c.CreatedAt, &c.UpdatedAt,
-		)
+	if officer := params.Get("assigned_officer_id"); officer != "" {
+		id, err := strconv.ParseInt(officer, 10, 64)
 		if err != nil {
-			http.Error(w, "Error scanning case: "+err.Error(), http.StatusInternalServerError)
+			respondWithError(w, http.StatusBadRequest, "Invalid assigned_officer_id")
 			return
 		}
+		q.AssignedOfficerID = id
+	}
 
-		// Convert struct to map
-		b, _ := json.Marshal(c)
-		var m map[string]interface{}
-		json.Unmarshal(b, &m)
-		cases = append(cases, m)
+	var err error
+	if q.ReceivedFrom, err = parseDateParam(params.Get("received_from"), false); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid received_from: "+err.Error())
+		return
+	}
+	if q.ReceivedTo, err = parseDateParam(params.Get("received_to"), true); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid received_to: "+err.Error())
+		return
 	}
 
-	if cases == nil {
-		cases = []map[string]interface{}{} // Return empty array instead of null
+	// Officers and cadets only see the cases assigned to them
+	if !auth.HasPermission(user.Role, auth.PermViewAllCases) {
+		q.AssignedOfficerID = user.ID
 	}
 
-	fmt.Printf("Successfully fetched %d cases\n", len(cases))
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(cases)
+	found, total, err := models.SearchCases(app.DB, q)
+	if err != nil {
+		log.Printf("Error fetching cases: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving cases")
+		return
+	}
+
+	cases := make([]caseListItem, 0, len(found))
+	for _, c := range found {
+		cases = append(cases, caseListItem{
+			ID:                   c.ID,
+			ReferenceNumber:      c.ReferenceNumber,
+			SenderName:           c.SenderName,
+			ReceivingDate:        c.ReceivingDate,
+			Subject:              c.Subject,
+			CountryOfOrigin:      c.CountryOfOrigin,
+			DistressedPersonName: c.DistressedPersonName,
+			NatureOfCase:         c.NatureOfCase,
+			CaseDetails:          c.CaseDetails,
+			Status:               c.Status,
+			Stage:                c.Stage,
+			AssignedOfficerID:    c.AssignedOfficerID,
+			CreatedAt:            c.CreatedAt,
+			UpdatedAt:            c.UpdatedAt,
+		})
+	}
+
+	setPaginationHeaders(w, r, q.Page, q.Limit, total)
+
+	respondWithJSON(w, http.StatusOK, cases)
 }
 
 // GetCase returns a single case by ID
 func (app *App) GetCase(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid case ID", http.StatusBadRequest)
+	existing, _, ok := app.authorizeCase(w, r)
+	if !ok {
 		return
 	}
+	id := existing.ID
 
 	var c struct {
 		ID                   int64   `json:"id"`
@@ -112,9 +160,10 @@ func (app *App) GetCase(w http.ResponseWriter, r *http.Request) {
 		Stage               string  `json:"stage"`
 		CreatedAt           string  `json:"createdAt"`
 		UpdatedAt           string  `json:"updatedAt"`
+		MissingDocuments    []models.DocumentCategory `json:"missingDocuments"`
 	}
 
-	err = app.DB.QueryRow(`
+	err := app.DB.QueryRow(`
 		SELECT id, reference_number, sender_name, receiving_date, subject,
 		country_of_origin, distressed_person_name, nature_of_case, case_details,
 		status, stage, created_at, updated_at
@@ -135,6 +184,13 @@ func (app *App) GetCase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	checklist, err := models.GetDocumentChecklist(app.DB, existing)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.MissingDocuments = models.MissingDocuments(checklist)
+
 	// Convert struct to map
 	b, _ := json.Marshal(c)
 	var m map[string]interface{}
@@ -147,6 +203,11 @@ func (app *App) GetCase(w http.ResponseWriter, r *http.Request) {
 
 // CreateCase creates a new case
 func (app *App) CreateCase(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
 	var input struct {
 		SenderName           string `json:"senderName"`
 		Subject             string `json:"subject"`
@@ -161,33 +222,48 @@ func (app *App) CreateCase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate reference number (you might want to make this more sophisticated)
-	var lastID int
-	err := app.DB.QueryRow("SELECT COALESCE(MAX(id), 0) FROM cases").Scan(&lastID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	referenceNumber := fmt.Sprintf("REF%05d", lastID+1)
-
-	result, err := app.DB.Exec(`
-		INSERT INTO cases (
-			reference_number, sender_name, receiving_date, subject,
-			country_of_origin, distressed_person_name, nature_of_case,
-			case_details, status, stage
-		) VALUES (?, ?, NOW(), ?, ?, ?, ?, ?, 'Pending', 'Front Office Receipt')
-	`,
-		referenceNumber, input.SenderName, input.Subject,
-		input.CountryOfOrigin, input.DistressedPersonName,
-		input.NatureOfCase, input.CaseDetails,
-	)
+	var id int64
+	var referenceNumber string
+	err := models.WithTx(app.DB, func(tx *sql.Tx) error {
+		// Allocate the reference number in the same transaction as the insert
+		// so a failed insert hands the number back
+		var err error
+		referenceNumber, err = app.References.Next(tx, input.NatureOfCase, time.Now())
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(`
+			INSERT INTO cases (
+				reference_number, sender_name, receiving_date, subject,
+				country_of_origin, distressed_person_name, nature_of_case,
+				case_details, status, stage
+			) VALUES (?, ?, NOW(), ?, ?, ?, ?, ?, 'Pending', 'Front Office Receipt')
+		`,
+			referenceNumber, input.SenderName, input.Subject,
+			input.CountryOfOrigin, input.DistressedPersonName,
+			input.NatureOfCase, input.CaseDetails,
+		)
+		if err != nil {
+			return err
+		}
+
+		id, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		return models.RecordCaseChanges(tx, id, user.ID, "", []models.FieldChange{
+			{Field: models.HistoryFieldCreated, NewValue: referenceNumber},
+		})
+	})
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	app.indexCase(id)
 
-	id, _ := result.LastInsertId()
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -199,12 +275,11 @@ func (app *App) CreateCase(w http.ResponseWriter, r *http.Request) {
 
 // UpdateCase updates an existing case
 func (app *App) UpdateCase(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid case ID", http.StatusBadRequest)
+	existing, user, ok := app.authorizeCase(w, r)
+	if !ok {
 		return
 	}
+	id := existing.ID
 
 	var input struct {
 		SenderName           string `json:"senderName"`
@@ -213,6 +288,7 @@ func (app *App) UpdateCase(w http.ResponseWriter, r *http.Request) {
 		DistressedPersonName string `json:"distressedPersonName"`
 		NatureOfCase        string `json:"natureOfCase"`
 		CaseDetails         string `json:"caseDetails"`
+		Reason              string `json:"reason"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
@@ -220,22 +296,37 @@ func (app *App) UpdateCase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = app.DB.Exec(`
-		UPDATE cases
-		SET sender_name = ?, subject = ?, country_of_origin = ?,
-			distressed_person_name = ?, nature_of_case = ?, case_details = ?,
-			updated_at = NOW()
-		WHERE id = ?
-	`,
-		input.SenderName, input.Subject, input.CountryOfOrigin,
-		input.DistressedPersonName, input.NatureOfCase, input.CaseDetails,
-		id,
-	)
+	err := models.WithTx(app.DB, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE cases
+			SET sender_name = ?, subject = ?, country_of_origin = ?,
+				distressed_person_name = ?, nature_of_case = ?, case_details = ?,
+				updated_at = NOW()
+			WHERE id = ?
+		`,
+			input.SenderName, input.Subject, input.CountryOfOrigin,
+			input.DistressedPersonName, input.NatureOfCase, input.CaseDetails,
+			id,
+		)
+		if err != nil {
+			return err
+		}
+
+		return models.RecordCaseChanges(tx, id, user.ID, input.Reason, []models.FieldChange{
+			{Field: "sender_name", OldValue: existing.SenderName, NewValue: input.SenderName},
+			{Field: "subject", OldValue: existing.Subject, NewValue: input.Subject},
+			{Field: "country_of_origin", OldValue: existing.CountryOfOrigin, NewValue: input.CountryOfOrigin},
+			{Field: "distressed_person_name", OldValue: existing.DistressedPersonName, NewValue: input.DistressedPersonName},
+			{Field: "nature_of_case", OldValue: existing.NatureOfCase, NewValue: input.NatureOfCase},
+			{Field: "case_details", OldValue: existing.CaseDetails, NewValue: input.CaseDetails},
+		})
+	})
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	app.indexCase(id)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -244,39 +335,158 @@ func (app *App) UpdateCase(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// UpdateCaseStatus updates the status and stage of a case
+// UpdateCaseStatus moves a case along the workflow. The request names either
+// an action or the target stage and/or status; illegal moves are rejected with
+// 409 and the list of allowed next steps.
 func (app *App) UpdateCaseStatus(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid case ID", http.StatusBadRequest)
+	existing, user, ok := app.authorizeCase(w, r)
+	if !ok {
 		return
 	}
 
 	var input struct {
+		Action string `json:"action"`
 		Status string `json:"status"`
 		Stage  string `json:"stage"`
+		Reason string `json:"reason"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	from := workflow.State{Stage: existing.Stage, Status: existing.Status}
+	transition, err := workflow.Resolve(from, user.Role, input.Action,
+		workflow.State{Stage: input.Stage, Status: input.Status})
+	switch err {
+	case nil:
+	case workflow.ErrRoleNotAllowed:
+		respondWithError(w, http.StatusForbidden, fmt.Sprintf(
+			"Forbidden: role %q may not %s", user.Role, strings.ToLower(transition.Name)))
+		return
+	default:
+		respondWithTransitionConflict(w, err.Error(), existing, user)
+		return
+	}
+
+	if transition.Endpoint != "" {
+		respondWithTransitionConflict(w, fmt.Sprintf("Use POST /api/cases/%d%s to %s",
+			existing.ID, transition.Endpoint, strings.ToLower(transition.Name)), existing, user)
 		return
 	}
 
-	_, err = app.DB.Exec(`
-		UPDATE cases
-		SET status = ?, stage = ?, updated_at = NOW()
-		WHERE id = ?
-	`, input.Status, input.Stage, id)
+	if transition.RequiresDocuments {
+		checklist, err := models.GetDocumentChecklist(app.DB, existing)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error checking required documents")
+			return
+		}
+		if missing := models.MissingDocuments(checklist); len(missing) > 0 {
+			respondWithMissingDocuments(w, existing, user, missing)
+			return
+		}
+	}
 
+	err = models.WithTx(app.DB, func(tx *sql.Tx) error {
+		if err := existing.MoveTo(tx, transition.To.Stage, transition.To.Status); err != nil {
+			return err
+		}
+		return models.RecordCaseChanges(tx, existing.ID, user.ID, input.Reason, []models.FieldChange{
+			{Field: models.HistoryFieldStage, OldValue: from.Stage, NewValue: transition.To.Stage},
+			{Field: models.HistoryFieldStatus, OldValue: from.Status, NewValue: transition.To.Status},
+		})
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err == models.ErrCaseStateChanged {
+			respondWithTransitionConflict(w, err.Error(), existing, user)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error updating case status")
 		return
 	}
+	existing.Stage, existing.Status = transition.To.Stage, transition.To.Status
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
 		"message": "Case status updated successfully",
+		"action":  transition.Action,
+		"stage":   existing.Stage,
+		"status":  existing.Status,
+	})
+}
+
+// GetCaseTimeline returns the status changes, field edits, progress notes and
+// document uploads of a case in chronological order. Notes the caller may
+// not see are left out.
+func (app *App) GetCaseTimeline(w http.ResponseWriter, r *http.Request) {
+	existing, user, ok := app.authorizeCase(w, r)
+	if !ok {
+		return
+	}
+
+	events, err := models.GetCaseTimeline(app.DB, existing.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving case timeline")
+		return
+	}
+
+	visible := events[:0]
+	for _, e := range events {
+		if e.Type != models.TimelineNote || auth.CanSeeNote(user, e.Visibility, e.ActorID, e.ActorDepartment) {
+			visible = append(visible, e)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, visible)
+}
+
+// GetCaseTransitions lists the workflow actions the caller may take on a case
+func (app *App) GetCaseTransitions(w http.ResponseWriter, r *http.Request) {
+	existing, user, ok := app.authorizeCase(w, r)
+	if !ok {
+		return
+	}
+
+	checklist, err := models.GetDocumentChecklist(app.DB, existing)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error checking required documents")
+		return
+	}
+
+	from := workflow.State{Stage: existing.Stage, Status: existing.Status}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"stage":            existing.Stage,
+		"status":           existing.Status,
+		"transitions":      workflow.AllowedFor(from, user.Role),
+		"missingDocuments": models.MissingDocuments(checklist),
+	})
+}
+
+// respondWithMissingDocuments writes a 409 for a transition that is blocked
+// until the listed document categories are uploaded
+func respondWithMissingDocuments(w http.ResponseWriter, c *models.Case, user *models.User, missing []models.DocumentCategory) {
+	names := make([]string, len(missing))
+	for i, m := range missing {
+		names[i] = m.Name
+	}
+
+	from := workflow.State{Stage: c.Stage, Status: c.Status}
+	respondWithJSON(w, http.StatusConflict, map[string]interface{}{
+		"error":              "Required documents are missing: " + strings.Join(names, ", "),
+		"stage":              c.Stage,
+		"status":             c.Status,
+		"missingDocuments":   missing,
+		"allowedTransitions": workflow.AllowedFor(from, user.Role),
+	})
+}
+
+// respondWithTransitionConflict writes a 409 listing the moves still available
+func respondWithTransitionConflict(w http.ResponseWriter, message string, c *models.Case, user *models.User) {
+	from := workflow.State{Stage: c.Stage, Status: c.Status}
+	respondWithJSON(w, http.StatusConflict, map[string]interface{}{
+		"error":              message,
+		"stage":              c.Stage,
+		"status":             c.Status,
+		"allowedTransitions": workflow.AllowedFor(from, user.Role),
 	})
 }
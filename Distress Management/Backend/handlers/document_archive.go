@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"distress-management/auth"
+	"distress-management/models"
+	"distress-management/storage"
+)
+
+// archiveManifest describes the contents of a case document archive
+type archiveManifest struct {
+	Case struct {
+		ID                   int64  `json:"id"`
+		ReferenceNumber      string `json:"referenceNumber"`
+		Subject              string `json:"subject"`
+		DistressedPersonName string `json:"distressedPersonName"`
+		NatureOfCase         string `json:"natureOfCase"`
+		Status               string `json:"status"`
+		Stage                string `json:"stage"`
+	} `json:"case"`
+	GeneratedAt time.Time         `json:"generatedAt"`
+	GeneratedBy string            `json:"generatedBy"`
+	Audience    string            `json:"audience"`
+	Documents   []archiveDocument `json:"documents"`
+	Notes       []archiveNote     `json:"notes"`
+}
+
+// archiveNote is the manifest entry for a progress note. Deleted notes are
+// left out.
+type archiveNote struct {
+	ID         int64     `json:"id"`
+	NoteType   string    `json:"noteType"`
+	Visibility string    `json:"visibility"`
+	Pinned     bool      `json:"pinned"`
+	Note       string    `json:"note"`
+	AuthorID   int64     `json:"authorId"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// archiveDocument is the manifest entry for one document version. Documents
+// that are not clean, or whose content cannot be read, are listed but not
+// included.
+type archiveDocument struct {
+	ID               int64     `json:"id"`
+	RootID           int64     `json:"rootId"`
+	Version          int       `json:"version"`
+	IsLatest         bool      `json:"isLatest"`
+	FileName         string    `json:"fileName"`
+	Category         string    `json:"category"`
+	FileType         string    `json:"fileType"`
+	FileSize         int64     `json:"fileSize"`
+	Checksum         string    `json:"checksum"`
+	ChangeComment    string    `json:"changeComment,omitempty"`
+	UploadedBy       int64     `json:"uploadedBy"`
+	UploadedAt       time.Time `json:"uploadedAt"`
+	ScanStatus       string    `json:"scanStatus"`
+	Included         bool      `json:"included"`
+	ArchivePath      string    `json:"archivePath,omitempty"`
+	ChecksumVerified bool      `json:"checksumVerified"`
+	Reason           string    `json:"reason,omitempty"`
+}
+
+// GetDocumentArchive streams a ZIP of a case's documents with a manifest.json
+// describing each one and listing the progress notes the caller may see.
+// Only the latest versions are included unless ?versions=all is given.
+// ?audience=requester limits the notes to those shareable with the requester,
+// for exports that leave the department.
+func (app *App) GetDocumentArchive(w http.ResponseWriter, r *http.Request) {
+	c, user, ok := app.authorizeCase(w, r)
+	if !ok {
+		return
+	}
+
+	audience := r.URL.Query().Get("audience")
+	switch audience {
+	case "":
+		audience = models.VisibilityDepartment
+	case models.VisibilityDepartment, models.VisibilityRequester:
+	default:
+		respondWithError(w, http.StatusBadRequest, "audience must be department or requester")
+		return
+	}
+
+	allVersions := r.URL.Query().Get("versions") == "all"
+	documents, err := models.GetDocumentsByCase(app.DB, c.ID, allVersions)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving documents")
+		return
+	}
+
+	notes, err := models.GetProgressNotes(app.DB, c.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving progress notes")
+		return
+	}
+
+	manifest := archiveManifest{
+		GeneratedAt: time.Now().UTC(),
+		GeneratedBy: user.Email,
+		Audience:    audience,
+		Documents:   []archiveDocument{},
+		Notes:       []archiveNote{},
+	}
+	manifest.Case.ID = c.ID
+	manifest.Case.ReferenceNumber = c.ReferenceNumber
+	manifest.Case.Subject = c.Subject
+	manifest.Case.DistressedPersonName = c.DistressedPersonName
+	manifest.Case.NatureOfCase = c.NatureOfCase
+	manifest.Case.Status = c.Status
+	manifest.Case.Stage = c.Stage
+	for _, n := range notes {
+		if n.IsDeleted() || !auth.CanSeeNote(user, n.Visibility, n.UserID, n.AuthorDepartment) {
+			continue
+		}
+		if audience == models.VisibilityRequester && n.Visibility != models.VisibilityRequester {
+			continue
+		}
+		manifest.Notes = append(manifest.Notes, archiveNote{
+			ID:         n.ID,
+			NoteType:   n.NoteType,
+			Visibility: n.Visibility,
+			Pinned:     n.Pinned,
+			Note:       n.Note,
+			AuthorID:   n.UserID,
+			CreatedAt:  n.CreatedAt,
+			UpdatedAt:  n.UpdatedAt,
+		})
+	}
+
+	archiveName := archiveFileName(c.ReferenceNumber) + "-documents.zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	log.Printf("User %d exported the documents of case %d", user.ID, c.ID)
+
+	zw := zip.NewWriter(w)
+	for _, doc := range documents {
+		entry := archiveDocument{
+			ID:            doc.ID,
+			RootID:        doc.RootID,
+			Version:       doc.Version,
+			IsLatest:      doc.IsLatest,
+			FileName:      doc.FileName,
+			Category:      doc.Category,
+			FileType:      doc.FileType,
+			FileSize:      doc.FileSize,
+			Checksum:      doc.Checksum,
+			ChangeComment: doc.ChangeComment,
+			UploadedBy:    doc.UploadedBy,
+			UploadedAt:    doc.UploadedAt,
+			ScanStatus:    doc.ScanStatus,
+		}
+
+		if doc.ScanStatus != models.ScanClean {
+			entry.Reason = "scan status is " + doc.ScanStatus
+			manifest.Documents = append(manifest.Documents, entry)
+			continue
+		}
+
+		entry.ArchivePath = archiveDocumentPath(&doc, allVersions)
+		verified, err := app.writeArchiveDocument(r, zw, &doc, entry.ArchivePath)
+		var contentErr *archiveContentError
+		if errors.As(err, &contentErr) {
+			// One unreadable document should not cost the whole export
+			log.Printf("Error reading document %d for archive of case %d: %v", doc.ID, c.ID, err)
+			switch {
+			case contentErr.Partial:
+				entry.Reason = "content could not be read; the archived file is incomplete"
+			case errors.Is(err, storage.ErrNotFound):
+				entry.ArchivePath = ""
+				entry.Reason = "content is missing from storage"
+			default:
+				entry.ArchivePath = ""
+				entry.Reason = "content could not be read"
+			}
+			manifest.Documents = append(manifest.Documents, entry)
+			continue
+		}
+		if err != nil {
+			// The response is already partly written, so the only way to
+			// signal failure is to abort the connection
+			log.Printf("Error adding document %d to archive of case %d: %v", doc.ID, c.ID, err)
+			panic(http.ErrAbortHandler)
+		}
+		entry.Included = true
+		entry.ChecksumVerified = verified
+		if !verified {
+			log.Printf("Document %d in archive of case %d does not match its checksum", doc.ID, c.ID)
+			entry.Reason = "content does not match the recorded checksum"
+		}
+		manifest.Documents = append(manifest.Documents, entry)
+	}
+
+	mw, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: manifest.GeneratedAt})
+	if err == nil {
+		enc := json.NewEncoder(mw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(manifest)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("Error finishing archive of case %d: %v", c.ID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// archiveContentError is a failure to read a document's stored content, as
+// opposed to a failure to write the archive. Partial is set when some of the
+// content was already written to the archive.
+type archiveContentError struct {
+	Err     error
+	Partial bool
+}
+
+func (e *archiveContentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *archiveContentError) Unwrap() error {
+	return e.Err
+}
+
+// writeArchiveDocument copies a document into the archive and reports whether
+// its content matched the recorded checksum. Errors reading the content are
+// returned as an *archiveContentError.
+func (app *App) writeArchiveDocument(r *http.Request, zw *zip.Writer, doc *models.Document, name string) (bool, error) {
+	f, _, err := app.Storage.Open(r.Context(), doc.StorageKey)
+	if err != nil {
+		return false, &archiveContentError{Err: err}
+	}
+	defer f.Close()
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: doc.UploadedAt})
+	if err != nil {
+		return false, err
+	}
+
+	hash := sha256.New()
+	src := &readErrorRecorder{r: f}
+	if _, err := io.Copy(io.MultiWriter(fw, hash), src); err != nil {
+		if src.err != nil {
+			return false, &archiveContentError{Err: src.err, Partial: true}
+		}
+		return false, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == doc.Checksum, nil
+}
+
+// readErrorRecorder remembers the error its reader failed with, so a copy can
+// tell read errors from write errors
+type readErrorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (rr *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if err != nil && err != io.EOF {
+		rr.err = err
+	}
+	return n, err
+}
+
+// archiveDocumentPath names a document inside the archive. The ID prefix keeps
+// names unique when several documents share a file name.
+func archiveDocumentPath(doc *models.Document, allVersions bool) string {
+	name := archiveFileName(path.Base(strings.ReplaceAll(doc.FileName, "\\", "/")))
+	if allVersions {
+		return fmt.Sprintf("documents/%d-v%d-%s", doc.RootID, doc.Version, name)
+	}
+	return fmt.Sprintf("documents/%d-%s", doc.RootID, name)
+}
+
+// archiveFileName makes s safe to use as a file name on common systems
+func archiveFileName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, strings.ContainsRune(`/\:*?"<>|`, r):
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(s))
+	if s == "" || s == "." || s == ".." {
+		return "file"
+	}
+	return s
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"distress-management/models"
+)
+
+var naturesOfCase = []string{"Emergency", "Urgent", "Standard"}
+
+var errUnknownCategory = errors.New("unknown document category")
+
+// GetDocumentCategories lists the categories documents can be filed under
+func (app *App) GetDocumentCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := models.GetDocumentCategories(app.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving document categories")
+		return
+	}
+	if categories == nil {
+		categories = []models.DocumentCategory{}
+	}
+
+	respondWithJSON(w, http.StatusOK, categories)
+}
+
+// GetDocumentRequirements lists the required categories per nature of case
+// and subject
+func (app *App) GetDocumentRequirements(w http.ResponseWriter, r *http.Request) {
+	requirements, err := models.GetDocumentRequirements(app.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving document requirements")
+		return
+	}
+	if requirements == nil {
+		requirements = []models.DocumentRequirement{}
+	}
+
+	respondWithJSON(w, http.StatusOK, requirements)
+}
+
+// SetDocumentRequirements replaces the required categories for one nature of
+// case, optionally narrowed to a subject
+func (app *App) SetDocumentRequirements(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		NatureOfCase string   `json:"natureOfCase"`
+		Subject      string   `json:"subject"`
+		Categories   []string `json:"categories"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	valid := false
+	for _, n := range naturesOfCase {
+		if input.NatureOfCase == n {
+			valid = true
+		}
+	}
+	if !valid {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("natureOfCase must be one of %s", strings.Join(naturesOfCase, ", ")))
+		return
+	}
+
+	err := models.WithTx(app.DB, func(tx *sql.Tx) error {
+		for _, code := range input.Categories {
+			exists, err := models.DocumentCategoryExists(tx, code)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("%w: %q", errUnknownCategory, code)
+			}
+		}
+		return models.SetDocumentRequirements(tx, input.NatureOfCase, strings.TrimSpace(input.Subject), input.Categories)
+	})
+	if err != nil {
+		if errors.Is(err, errUnknownCategory) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error saving document requirements")
+		return
+	}
+
+	app.GetDocumentRequirements(w, r)
+}
+
+// GetDocumentChecklist reports which required documents a case has and which
+// are still missing
+func (app *App) GetDocumentChecklist(w http.ResponseWriter, r *http.Request) {
+	c, _, ok := app.authorizeCase(w, r)
+	if !ok {
+		return
+	}
+
+	checklist, err := models.GetDocumentChecklist(app.DB, c)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving document checklist")
+		return
+	}
+	missing := models.MissingDocuments(checklist)
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"complete": len(missing) == 0,
+		"required": checklist,
+		"missing":  missing,
+	})
+}
+
+// documentCategory reads the "category" field of an upload, falling back to
+// fallback when it is empty. It writes a 400 for unknown categories.
+func (app *App) documentCategory(w http.ResponseWriter, r *http.Request, fallback string) (string, bool) {
+	code := strings.TrimSpace(r.FormValue("category"))
+	if code == "" {
+		return fallback, true
+	}
+
+	exists, err := models.DocumentCategoryExists(app.DB, code)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error checking document category")
+		return "", false
+	}
+	if !exists {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s: %q", errUnknownCategory, code))
+		return "", false
+	}
+	return code, true
+}
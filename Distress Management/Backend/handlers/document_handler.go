@@ -1,115 +1,284 @@
 package handlers
 
 import (
+	"context"
+	"database/sql"
+	"distress-management/auth"
 	"distress-management/models"
+	"distress-management/search"
+	"distress-management/storage"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
 const (
-	uploadDir = "./uploads"
-	maxFileSize = 10 << 20 // 10 MB
+	maxFileSize   = 10 << 20  // 10 MB per file
+	maxUploadSize = 100 << 20 // 100 MB per request
 )
 
-func init() {
-	// Create uploads directory if it doesn't exist
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		panic(err)
+// UploadDocument accepts one or more files in the "document" (or
+// "documents") fields of a multipart form. The optional "category" and
+// "comment" fields apply to every file. A single file is answered with the
+// document; several files with a result per file, so one rejected file does
+// not fail the rest.
+func (app *App) UploadDocument(w http.ResponseWriter, r *http.Request) {
+	// Verify case exists and the caller may work on it
+	c, user, ok := app.authorizeCase(w, r)
+	if !ok {
+		return
 	}
-}
 
-func (app *App) UploadDocument(w http.ResponseWriter, r *http.Request) {
-	// Parse case ID from URL
-	vars := mux.Vars(r)
-	caseID, err := strconv.ParseInt(vars["id"], 10, 64)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid case ID")
+	files, ok := parseUploadForm(w, r)
+	if !ok {
 		return
 	}
 
-	// Verify case exists
-	_, err = models.GetCase(app.DB, caseID)
-	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Case not found")
+	category, ok := app.documentCategory(w, r, models.DefaultDocumentCategory)
+	if !ok {
 		return
 	}
+	comment := strings.TrimSpace(r.FormValue("comment"))
 
-	// Limit file size
-	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize)
-	if err := r.ParseMultipartForm(maxFileSize); err != nil {
-		respondWithError(w, http.StatusBadRequest, "File too large (max 10MB)")
+	if len(files) == 1 {
+		doc, err := app.addDocument(r.Context(), c, user, files[0], category, comment)
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusCreated, app.uploadResult(doc, user))
 		return
 	}
 
-	// Get file from form
-	file, header, err := r.FormFile("document")
+	results := make([]fileUploadResult, len(files))
+	failed := 0
+	for i, fh := range files {
+		results[i].FileName = fh.Filename
+
+		doc, err := app.addDocument(r.Context(), c, user, fh, category, comment)
+		if err != nil {
+			failed++
+			results[i].Status = "rejected"
+			results[i].Error = uploadErrorMessage(err)
+			continue
+		}
+
+		result := app.uploadResult(doc, user)
+		results[i].Status = "created"
+		results[i].Document = &result
+	}
+
+	status := http.StatusCreated
+	if failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	respondWithJSON(w, status, map[string]interface{}{
+		"uploaded": len(files) - failed,
+		"failed":   failed,
+		"results":  results,
+	})
+}
+
+// fileUploadResult is the outcome for one file of a multi-file upload
+type fileUploadResult struct {
+	FileName string                `json:"fileName"`
+	Status   string                `json:"status"`
+	Error    string                `json:"error,omitempty"`
+	Document *documentUploadResult `json:"document,omitempty"`
+}
+
+// addDocument validates, stores and saves one uploaded file as a new document
+func (app *App) addDocument(ctx context.Context, c *models.Case, user *models.User, fh *multipart.FileHeader, category, comment string) (*models.Document, error) {
+	if err := app.checkCaseQuota(c.ID, fh.Size); err != nil {
+		return nil, err
+	}
+
+	doc, err := app.receiveFile(ctx, c, fh, func(doc *models.Document) error {
+		doc.UploadedBy = user.ID
+		doc.Category = category
+		doc.ChangeComment = comment
+
+		// Create also sets the new document's root_id, which must not be
+		// left unset if that second statement fails
+		err := models.WithTx(app.DB, func(tx *sql.Tx) error {
+			return doc.Create(tx)
+		})
+		if err != nil {
+			log.Printf("Error saving document record for case %d: %v", c.ID, err)
+			return &uploadError{http.StatusInternalServerError, "Error saving document record"}
+		}
+		return nil
+	})
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Error retrieving file")
+		return nil, err
+	}
+
+	app.documentAdded(doc, c)
+	return doc, nil
+}
+
+// AddDocumentVersion uploads a replacement for a document. Earlier versions
+// are kept and can still be listed and downloaded.
+func (app *App) AddDocumentVersion(w http.ResponseWriter, r *http.Request) {
+	c, current, ok := app.authorizeDocument(w, r)
+	if !ok {
+		return
+	}
+	user, ok := currentUser(w, r)
+	if !ok {
 		return
 	}
-	defer file.Close()
 
-	// Validate file type
-	fileType := header.Header.Get("Content-Type")
-	if !isAllowedFileType(fileType) {
-		respondWithError(w, http.StatusBadRequest, "File type not allowed")
+	files, ok := parseUploadForm(w, r)
+	if !ok {
+		return
+	}
+	if len(files) != 1 {
+		respondWithError(w, http.StatusBadRequest, "Upload exactly one file as a new version")
 		return
 	}
 
-	// Create unique filename
-	ext := filepath.Ext(header.Filename)
-	filename := fmt.Sprintf("case_%d_%d%s", caseID, time.Now().Unix(), ext)
-	filePath := filepath.Join(uploadDir, filename)
+	// A new version stays in the same category unless told otherwise
+	category, ok := app.documentCategory(w, r, current.Category)
+	if !ok {
+		return
+	}
 
-	// Create file on disk
-	dst, err := os.Create(filePath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving file")
+	if err := app.checkCaseQuota(c.ID, files[0].Size); err != nil {
+		respondWithUploadError(w, err)
 		return
 	}
-	defer dst.Close()
 
-	// Copy file contents
-	if _, err := io.Copy(dst, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving file")
+	var supersededID int64
+	next, err := app.receiveFile(r.Context(), c, files[0], func(next *models.Document) error {
+		next.UploadedBy = user.ID
+		next.Category = category
+		next.ChangeComment = strings.TrimSpace(r.FormValue("comment"))
+
+		err := models.WithTx(app.DB, func(tx *sql.Tx) error {
+			var err error
+			supersededID, err = current.AddVersion(tx, next)
+			return err
+		})
+		if errors.Is(err, models.ErrDocumentVersionConflict) {
+			return &uploadError{http.StatusConflict, "Document was changed by someone else, please retry"}
+		}
+		if err != nil {
+			return &uploadError{http.StatusInternalServerError, "Error saving document version"}
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithUploadError(w, err)
 		return
 	}
 
-	// Create document record
-	doc := &models.Document{
-		CaseID:   caseID,
-		FileName: header.Filename,
-		FilePath: filePath,
-		FileType: fileType,
-		FileSize: header.Size,
+	// Only the latest version is searchable
+	app.SearchIndex.Remove(search.TypeDocument, supersededID)
+	app.documentAdded(next, c)
+
+	respondWithJSON(w, http.StatusCreated, app.uploadResult(next, user))
+}
+
+// parseUploadForm parses a multipart upload and returns its files. Parts
+// beyond what fits in memory are spooled to disk by the multipart reader.
+func parseUploadForm(w http.ResponseWriter, r *http.Request) ([]*multipart.FileHeader, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(maxFileSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Upload too large (max 100MB per request)")
+		} else {
+			respondWithError(w, http.StatusBadRequest, "Invalid multipart upload")
+		}
+		return nil, false
 	}
 
-	if err := doc.Create(app.DB); err != nil {
-		// Clean up file if database insert fails
-		os.Remove(filePath)
-		respondWithError(w, http.StatusInternalServerError, "Error saving document record")
-		return
+	files := append(r.MultipartForm.File["document"], r.MultipartForm.File["documents"]...)
+	if len(files) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Error retrieving file")
+		return nil, false
 	}
+	return files, true
+}
 
-	respondWithJSON(w, http.StatusCreated, doc)
+// documentUploadResult is a saved document plus any other documents that
+// already have identical content
+type documentUploadResult struct {
+	*models.Document
+	Duplicates []duplicateDocument `json:"duplicates"`
 }
 
-func (app *App) GetDocuments(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	caseID, err := strconv.ParseInt(vars["id"], 10, 64)
+// duplicateDocument points the uploader at an existing copy of a file. Copies
+// on cases the uploader cannot see are reported without details.
+type duplicateDocument struct {
+	SameCase      bool   `json:"sameCase"`
+	DocumentID    int64  `json:"documentId,omitempty"`
+	CaseID        int64  `json:"caseId,omitempty"`
+	CaseReference string `json:"caseReference,omitempty"`
+	FileName      string `json:"fileName,omitempty"`
+	Version       int    `json:"version,omitempty"`
+}
+
+func (app *App) uploadResult(doc *models.Document, user *models.User) documentUploadResult {
+	result := documentUploadResult{Document: doc, Duplicates: []duplicateDocument{}}
+
+	matches, err := models.GetDocumentsByChecksum(app.DB, doc.Checksum)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid case ID")
+		log.Printf("Error looking up duplicates of document %d: %v", doc.ID, err)
+		return result
+	}
+
+	cases := map[int64]*models.Case{}
+	for _, m := range matches {
+		if m.ID == doc.ID {
+			continue
+		}
+		dup := duplicateDocument{SameCase: m.CaseID == doc.CaseID}
+
+		c, seen := cases[m.CaseID]
+		if !seen {
+			c, _ = models.GetCase(app.DB, m.CaseID)
+			cases[m.CaseID] = c
+		}
+		if c != nil && auth.CanAccessCase(user, c) {
+			dup.DocumentID = m.ID
+			dup.CaseID = m.CaseID
+			dup.CaseReference = c.ReferenceNumber
+			dup.FileName = m.FileName
+			dup.Version = m.Version
+		}
+		result.Duplicates = append(result.Duplicates, dup)
+	}
+
+	return result
+}
+
+// documentAdded indexes and scans a newly saved document. Its text is
+// indexed once it has been extracted.
+func (app *App) documentAdded(doc *models.Document, c *models.Case) {
+	app.SearchIndex.Put(documentSearchEntry(doc, c.ReferenceNumber, ""))
+	app.scanDocumentAsync(*doc)
+}
+
+// GetDocuments lists the latest version of each of a case's documents, or
+// every version with ?versions=all
+func (app *App) GetDocuments(w http.ResponseWriter, r *http.Request) {
+	c, _, ok := app.authorizeCase(w, r)
+	if !ok {
 		return
 	}
 
-	documents, err := models.GetDocumentsByCase(app.DB, caseID)
+	allVersions := r.URL.Query().Get("versions") == "all"
+	documents, err := models.GetDocumentsByCase(app.DB, c.ID, allVersions)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error retrieving documents")
 		return
@@ -118,40 +287,178 @@ func (app *App) GetDocuments(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, documents)
 }
 
+// GetDocumentVersions lists every version of a document, oldest first
+func (app *App) GetDocumentVersions(w http.ResponseWriter, r *http.Request) {
+	_, doc, ok := app.authorizeDocument(w, r)
+	if !ok {
+		return
+	}
+
+	versions, err := models.GetDocumentVersions(app.DB, doc.RootID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving document versions")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, versions)
+}
+
+// DeleteDocument deletes a document with all of its versions
 func (app *App) DeleteDocument(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	docID, err := strconv.ParseInt(vars["docId"], 10, 64)
+	_, doc, ok := app.authorizeDocument(w, r)
+	if !ok {
+		return
+	}
+
+	versions, err := models.GetDocumentVersions(app.DB, doc.RootID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid document ID")
+		respondWithError(w, http.StatusInternalServerError, "Error deleting document")
 		return
 	}
 
-	// Get document to get file path
-	doc := &models.Document{ID: docID}
 	if err := doc.Delete(app.DB); err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error deleting document")
 		return
 	}
 
-	// Delete file from disk
-	if err := os.Remove(doc.FilePath); err != nil {
-		// Log error but don't fail the request
-		fmt.Printf("Error deleting file %s: %v\n", doc.FilePath, err)
+	for _, v := range versions {
+		// Delete file from storage unless another document has the same content
+		if err := app.releaseContent(r.Context(), v.StorageKey); err != nil {
+			// Log error but don't fail the request
+			log.Printf("Error deleting file %s: %v", v.StorageKey, err)
+		}
+
+		app.SearchIndex.Remove(search.TypeDocument, v.ID)
 	}
 
 	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Document deleted"})
 }
 
-func isAllowedFileType(fileType string) bool {
-	allowedTypes := map[string]bool{
-		"application/pdf":                true,
-		"application/msword":            true,
-		"application/vnd.ms-excel":      true,
-		"application/vnd.openxmlformats-officedocument.wordprocessingml.document": true,
-		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":       true,
-		"image/jpeg": true,
-		"image/png":  true,
-		"image/gif":  true,
+// DownloadDocument streams a document's content. It supports Range requests
+// and ETag/Last-Modified revalidation. Documents are sent as attachments
+// unless ?disposition=inline is given for a type browsers can preview.
+func (app *App) DownloadDocument(w http.ResponseWriter, r *http.Request) {
+	_, doc, ok := app.authorizeDocument(w, r)
+	if !ok {
+		return
+	}
+
+	app.serveDocument(w, r, doc)
+}
+
+// authorizeDocument loads the document named by the {docId} route variable and
+// checks that it belongs to the case in the URL and that the caller may see
+// that case
+func (app *App) authorizeDocument(w http.ResponseWriter, r *http.Request) (*models.Case, *models.Document, bool) {
+	c, _, ok := app.authorizeCase(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	docID, err := strconv.ParseInt(mux.Vars(r)["docId"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid document ID")
+		return nil, nil, false
+	}
+
+	doc, err := models.GetDocument(app.DB, docID)
+	if err != nil || doc.CaseID != c.ID {
+		respondWithError(w, http.StatusNotFound, "Document not found")
+		return nil, nil, false
+	}
+
+	return c, doc, true
+}
+
+// serveDocument writes the content of doc with caching and Range support.
+// Documents that have not passed the virus scan are refused.
+func (app *App) serveDocument(w http.ResponseWriter, r *http.Request, doc *models.Document) {
+	f, ok := app.openDocument(w, r, doc)
+	if !ok {
+		return
+	}
+	defer f.Close()
+
+	writeDocument(w, r, doc, f)
+}
+
+// openDocument opens the content of a document that has passed the virus
+// scan. Full downloads are checked against the recorded checksum. On failure
+// it writes the error response and returns false.
+func (app *App) openDocument(w http.ResponseWriter, r *http.Request, doc *models.Document) (io.ReadSeekCloser, bool) {
+	switch doc.ScanStatus {
+	case models.ScanClean:
+	case models.ScanInfected:
+		respondWithError(w, http.StatusForbidden, "Document failed the virus scan and is quarantined")
+		return nil, false
+	case models.ScanFailed:
+		respondWithError(w, http.StatusForbidden, "Document could not be scanned for viruses")
+		return nil, false
+	default:
+		w.Header().Set("Retry-After", "10")
+		respondWithError(w, http.StatusConflict, "Document is still being scanned for viruses")
+		return nil, false
+	}
+
+	f, _, err := app.Storage.Open(r.Context(), doc.StorageKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, "Document content is missing")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Error reading document")
+		}
+		return nil, false
+	}
+
+	// Check full downloads against the recorded checksum before sending
+	// anything. Range requests, used to resume large downloads, skip this so
+	// each chunk does not re-read the whole file.
+	if r.Method == http.MethodGet && r.Header.Get("Range") == "" && doc.Checksum != "" {
+		sum, _, err := storage.Checksum(f)
+		if err == nil && sum != doc.Checksum {
+			err = storage.ErrChecksumMismatch
+		}
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			log.Printf("Integrity check failed for document %d (%s): %v", doc.ID, doc.StorageKey, err)
+			respondWithError(w, http.StatusInternalServerError, "Document content failed its integrity check")
+			return nil, false
+		}
+	}
+
+	return f, true
+}
+
+// writeDocument sends opened document content with its headers
+func writeDocument(w http.ResponseWriter, r *http.Request, doc *models.Document, f io.ReadSeeker) {
+	disposition := "attachment"
+	if r.URL.Query().Get("disposition") == "inline" && isInlineFileType(doc.FileType) {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", doc.FileType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": doc.FileName}))
+	w.Header().Set("ETag", documentETag(doc))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// ServeContent handles Range, If-Range, If-None-Match and If-Modified-Since
+	http.ServeContent(w, r, doc.FileName, doc.UploadedAt, f)
+}
+
+// documentETag identifies a version of a document's content
+func documentETag(doc *models.Document) string {
+	return fmt.Sprintf(`"doc-%d-%d-%d"`, doc.ID, doc.FileSize, doc.UploadedAt.Unix())
+}
+
+// isInlineFileType reports whether browsers can safely preview the type
+func isInlineFileType(fileType string) bool {
+	switch fileType {
+	case "application/pdf", "image/jpeg", "image/png", "image/gif", "video/mp4":
+		return true
 	}
-	return allowedTypes[fileType]
+	return false
 }
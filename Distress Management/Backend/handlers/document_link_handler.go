@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"distress-management/auth"
+	"distress-management/models"
+
+	"github.com/gorilla/mux"
+)
+
+// documentLinkPath is the public path signed links point to. It must be
+// allow-listed in the authenticator.
+const documentLinkPath = "/api/links/download"
+
+// createdDocumentLink is the response to minting a link. The token is only
+// ever shown here.
+type createdDocumentLink struct {
+	Link  *models.DocumentLink `json:"link"`
+	Token string               `json:"token"`
+	URL   string               `json:"url"`
+}
+
+// CreateDocumentLink mints a signed URL that downloads one document version
+// without an API session. The body may set "expiresIn" (a duration such as
+// "24h", at most the configured maximum), "oneTime" and a free-text
+// "recipient".
+func (app *App) CreateDocumentLink(w http.ResponseWriter, r *http.Request) {
+	_, doc, ok := app.authorizeDocument(w, r)
+	if !ok {
+		return
+	}
+	user, _ := currentUser(w, r)
+
+	var input struct {
+		ExpiresIn string `json:"expiresIn"`
+		OneTime   bool   `json:"oneTime"`
+		Recipient string `json:"recipient"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	ttl := app.Links.DefaultTTL
+	if input.ExpiresIn != "" {
+		d, err := time.ParseDuration(input.ExpiresIn)
+		if err != nil || d <= 0 {
+			respondWithError(w, http.StatusBadRequest, "expiresIn must be a duration such as 30m or 24h")
+			return
+		}
+		ttl = d
+	}
+	if ttl > app.Links.MaxTTL {
+		respondWithError(w, http.StatusBadRequest, "expiresIn may be at most "+app.Links.MaxTTL.String())
+		return
+	}
+
+	recipient := strings.TrimSpace(input.Recipient)
+	if len(recipient) > 255 {
+		respondWithError(w, http.StatusBadRequest, "Recipient must be at most 255 characters")
+		return
+	}
+
+	if doc.ScanStatus == models.ScanInfected {
+		respondWithError(w, http.StatusForbidden, "Document failed the virus scan and is quarantined")
+		return
+	}
+
+	link := &models.DocumentLink{
+		DocumentID: doc.ID,
+		CaseID:     doc.CaseID,
+		FileName:   doc.FileName,
+		CreatedBy:  user.ID,
+		Recipient:  recipient,
+		OneTime:    input.OneTime,
+		// The token only carries whole seconds
+		ExpiresAt: time.Now().Add(ttl).Truncate(time.Second),
+	}
+	if err := link.Create(app.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error creating link")
+		return
+	}
+
+	token := app.Links.Sign(auth.LinkClaims{LinkID: link.ID, DocumentID: doc.ID, ExpiresAt: link.ExpiresAt})
+	respondWithJSON(w, http.StatusCreated, createdDocumentLink{
+		Link:  link,
+		Token: token,
+		URL:   app.PublicURL + documentLinkPath + "?token=" + url.QueryEscape(token),
+	})
+}
+
+// GetDocumentLinks lists the links minted for a document version with their
+// download counts
+func (app *App) GetDocumentLinks(w http.ResponseWriter, r *http.Request) {
+	_, doc, ok := app.authorizeDocument(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := models.GetDocumentLinks(app.DB, doc.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving links")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, links)
+}
+
+// GetDocumentLink returns a link with the log of downloads made through it
+func (app *App) GetDocumentLink(w http.ResponseWriter, r *http.Request) {
+	link, ok := app.authorizeDocumentLink(w, r)
+	if !ok {
+		return
+	}
+
+	downloads, err := models.GetDocumentLinkDownloads(app.DB, link.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving link downloads")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"link":      link,
+		"downloads": downloads,
+	})
+}
+
+// RevokeDocumentLink disables a link before it expires. Anyone who can see
+// the case may revoke its links, so a link sent to the wrong address can be
+// shut off quickly.
+func (app *App) RevokeDocumentLink(w http.ResponseWriter, r *http.Request) {
+	link, ok := app.authorizeDocumentLink(w, r)
+	if !ok {
+		return
+	}
+
+	if err := link.Revoke(app.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error revoking link")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, link)
+}
+
+// authorizeDocumentLink loads the link named by the {linkId} route variable
+// and checks that it belongs to the document in the URL
+func (app *App) authorizeDocumentLink(w http.ResponseWriter, r *http.Request) (*models.DocumentLink, bool) {
+	_, doc, ok := app.authorizeDocument(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	linkID, err := strconv.ParseInt(mux.Vars(r)["linkId"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid link ID")
+		return nil, false
+	}
+
+	link, err := models.GetDocumentLink(app.DB, linkID)
+	if err != nil || link.DocumentID != doc.ID {
+		respondWithError(w, http.StatusNotFound, "Link not found")
+		return nil, false
+	}
+
+	return link, true
+}
+
+// DownloadLinkedDocument serves the document of a signed link. It is public:
+// the token in the query string is the only credential. Links stop working
+// once they expire or are revoked, after the first download if they are
+// one-time, and when their creator is deactivated or loses access to the
+// case. Every GET is logged against the link and uses up a one-time link,
+// whether or not it asks for a Range.
+func (app *App) DownloadLinkedDocument(w http.ResponseWriter, r *http.Request) {
+	claims, err := app.Links.Parse(r.URL.Query().Get("token"), time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Invalid or expired link")
+		return
+	}
+
+	link, err := models.GetDocumentLink(app.DB, claims.LinkID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusGone, "Link is no longer valid")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Error loading link")
+		}
+		return
+	}
+	if link.DocumentID != claims.DocumentID || !link.Usable(time.Now()) {
+		respondWithError(w, http.StatusGone, "Link is no longer valid")
+		return
+	}
+
+	doc, err := models.GetDocument(app.DB, link.DocumentID)
+	if err != nil {
+		respondWithError(w, http.StatusGone, "Link is no longer valid")
+		return
+	}
+	if !app.linkCreatorHasAccess(link, doc) {
+		respondWithError(w, http.StatusGone, "Link is no longer valid")
+		return
+	}
+
+	// Keep the token out of the Referer of anything the document links to
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	// Documents that cannot be served are refused here, before the link is
+	// used up
+	f, ok := app.openDocument(w, r, doc)
+	if !ok {
+		return
+	}
+	defer f.Close()
+
+	if r.Method == http.MethodHead {
+		writeDocument(w, r, doc, f)
+		return
+	}
+
+	// Any GET uses the link, ranged or not. Exempting ranges would let a
+	// one-time link be read again and again with Range: bytes=0-.
+	if err := link.Use(app.DB); err != nil {
+		if errors.Is(err, models.ErrDocumentLinkUsed) {
+			respondWithError(w, http.StatusGone, "Link is no longer valid")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Error loading link")
+		}
+		return
+	}
+
+	ip := clientIP(r)
+	if err := link.LogDownload(app.DB, ip, r.UserAgent()); err != nil {
+		log.Printf("Error logging download of document %d through link %d: %v", doc.ID, link.ID, err)
+	}
+	log.Printf("Document %d downloaded through link %d from %s", doc.ID, link.ID, ip)
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	writeDocument(rec, r, doc, f)
+
+	// Give a one-time link back if the request was refused before any of
+	// the document was sent, such as a Range that cannot be satisfied. A
+	// transfer cut off part way stays spent, or the link could be read in
+	// pieces by aborting each download before its end.
+	if link.OneTime && rec.status >= http.StatusBadRequest {
+		log.Printf("Download of document %d through link %d was refused with status %d; link is usable again",
+			doc.ID, link.ID, rec.status)
+		if err := link.ReleaseUse(app.DB); err != nil {
+			log.Printf("Error releasing link %d: %v", link.ID, err)
+		}
+	}
+}
+
+// statusRecorder records the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// linkCreatorHasAccess reports whether the user who minted a link is still
+// active and may still see the document's case
+func (app *App) linkCreatorHasAccess(link *models.DocumentLink, doc *models.Document) bool {
+	creator, err := models.GetUser(app.DB, link.CreatedBy)
+	if err != nil || !creator.Active {
+		return false
+	}
+	c, err := models.GetCase(app.DB, doc.CaseID)
+	if err != nil {
+		return false
+	}
+	return auth.CanAccessCase(creator, c)
+}
+
+// clientIP returns the address the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
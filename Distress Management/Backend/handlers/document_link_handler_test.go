@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"distress-management/auth"
+)
+
+// TestDownloadLinkedDocumentOneTime checks that a one-time link serves its
+// document once, whether that first GET asks for a Range or not
+func TestDownloadLinkedDocumentOneTime(t *testing.T) {
+	app := newTestApp(t)
+	user := testUser(t, app, auth.RoleFrontOffice, "")
+	c := testCase(t, app, nil)
+	content := bytes.Repeat([]byte("%PDF-1.4 linked document\n"), 100)
+	doc := testDocument(t, app, c, user, "report.pdf", content)
+
+	createLink := func(t *testing.T, oneTime bool) string {
+		t.Helper()
+		body := fmt.Sprintf(`{"oneTime": %t}`, oneTime)
+		r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/cases/%d/documents/%d/links", c.ID, doc.ID), strings.NewReader(body))
+		rec := serve(app.CreateDocumentLink, "/api/cases/{id}/documents/{docId}/links", r, user)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("creating link: status %d: %s", rec.Code, rec.Body)
+		}
+		var created createdDocumentLink
+		if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+			t.Fatal(err)
+		}
+		return created.Token
+	}
+
+	type request struct {
+		method     string
+		rangeValue string
+		wantStatus int
+	}
+	full := request{http.MethodGet, "", http.StatusOK}
+	ranged := request{http.MethodGet, "bytes=0-", http.StatusPartialContent}
+	gone := func(req request) request {
+		req.wantStatus = http.StatusGone
+		return req
+	}
+
+	tests := []struct {
+		name     string
+		oneTime  bool
+		requests []request
+	}{
+		{"full download first", true, []request{full, gone(full), gone(ranged)}},
+		{"ranged download first", true, []request{ranged, gone(ranged), gone(full)}},
+		{"partial range first", true, []request{{http.MethodGet, "bytes=0-99", http.StatusPartialContent}, gone(ranged)}},
+		{"unsatisfiable range gives the link back", true, []request{
+			{http.MethodGet, "bytes=100000-", http.StatusRequestedRangeNotSatisfiable}, full, gone(full)}},
+		{"head does not use the link", true, []request{{http.MethodHead, "", http.StatusOK}, ranged, gone(ranged)}},
+		{"reusable link", false, []request{ranged, full, ranged}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := createLink(t, tt.oneTime)
+
+			for i, req := range tt.requests {
+				r := httptest.NewRequest(req.method, documentLinkPath+"?token="+url.QueryEscape(token), nil)
+				if req.rangeValue != "" {
+					r.Header.Set("Range", req.rangeValue)
+				}
+				rec := serve(app.DownloadLinkedDocument, documentLinkPath, r, nil)
+
+				if rec.Code != req.wantStatus {
+					t.Fatalf("request %d (%s, Range %q): status %d, want %d: %s",
+						i+1, req.method, req.rangeValue, rec.Code, req.wantStatus, rec.Body)
+				}
+				if req.method == http.MethodGet && req.wantStatus == http.StatusOK && !bytes.Equal(rec.Body.Bytes(), content) {
+					t.Errorf("request %d: got %d bytes that do not match the document", i+1, rec.Body.Len())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"distress-management/models"
+	"distress-management/scanner"
+)
+
+// scanTimeout bounds a single virus scan, including reading from storage
+const scanTimeout = 5 * time.Minute
+
+// DefaultScanMaxAttempts is how many times the scanner may reject a document
+// with an error before it is marked failed
+const DefaultScanMaxAttempts = 5
+
+// scanDocumentAsync scans a new upload in the background. The document stays
+// pending, and cannot be downloaded, until the scan finishes. Without a
+// scanner it stays pending.
+func (app *App) scanDocumentAsync(doc models.Document) {
+	if app.Scanner == nil {
+		return
+	}
+	go func() {
+		if err := app.scanDocument(context.Background(), &doc); err != nil {
+			log.Printf("Error scanning document %d: %v (will retry)", doc.ID, err)
+		}
+	}()
+}
+
+// scanDocument streams a stored document through the scanner and records the
+// verdict. Infected documents are quarantined by their scan status.
+func (app *App) scanDocument(ctx context.Context, doc *models.Document) error {
+	ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+	defer cancel()
+
+	f, _, err := app.Storage.Open(ctx, doc.StorageKey)
+	if err != nil {
+		return fmt.Errorf("opening content: %w", err)
+	}
+	defer f.Close()
+
+	result, err := app.Scanner.Scan(ctx, f)
+	if err != nil {
+		// Errors reported by the scanner itself, such as a file over its
+		// size limit, will not go away by retrying forever; connection
+		// errors are retried without counting
+		if errors.Is(err, scanner.ErrClamd) {
+			if err := doc.RecordScanError(app.DB, err.Error(), app.scanMaxAttempts()); err != nil {
+				return err
+			}
+			if doc.ScanStatus == models.ScanFailed {
+				log.Printf("Document %d on case %d could not be scanned after %d attempts and is blocked: %v",
+					doc.ID, doc.CaseID, doc.ScanAttempts, err)
+				return nil
+			}
+		}
+		return err
+	}
+
+	status := models.ScanClean
+	if result.Infected {
+		status = models.ScanInfected
+		log.Printf("Document %d on case %d is infected (%s) and has been quarantined",
+			doc.ID, doc.CaseID, result.Signature)
+	}
+
+	if err := doc.SetScanResult(app.DB, status, result.Signature); err != nil {
+		return err
+	}
+
+	// Thumbnails and text are only extracted once a document is known to be
+	// clean
+	if doc.ThumbnailStatus == models.ThumbnailPending {
+		if status == models.ScanInfected {
+			if err := doc.SetThumbnailStatus(app.DB, models.ThumbnailNone); err != nil {
+				return err
+			}
+		} else if err := app.generateThumbnails(ctx, doc); err != nil {
+			log.Printf("Error generating thumbnails for document %d: %v (will retry)", doc.ID, err)
+		}
+	}
+	if doc.TextStatus == models.TextPending {
+		if status == models.ScanInfected {
+			return doc.SkipTextExtraction(app.DB)
+		}
+		if err := app.extractDocumentText(ctx, doc); err != nil {
+			log.Printf("Error extracting text from document %d: %v (will retry)", doc.ID, err)
+		}
+	}
+	return nil
+}
+
+func (app *App) scanMaxAttempts() int {
+	if app.ScanMaxAttempts > 0 {
+		return app.ScanMaxAttempts
+	}
+	return DefaultScanMaxAttempts
+}
+
+// RescanPendingDocuments scans every document still pending, such as uploads
+// made while the scanner was unreachable or the server restarted mid-scan. It
+// runs once immediately and then every interval until ctx is cancelled.
+func (app *App) RescanPendingDocuments(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		documents, err := models.GetPendingScanDocuments(app.DB)
+		if err != nil {
+			log.Printf("Error loading documents pending a virus scan: %v", err)
+		}
+		for i := range documents {
+			if err := app.scanDocument(ctx, &documents[i]); err != nil {
+				log.Printf("Error scanning document %d: %v (will retry)", documents[i].ID, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"distress-management/extract"
+	"distress-management/models"
+)
+
+// extractTimeout bounds copying a document out of storage for extraction,
+// and extractTextTimeout bounds extracting its text once copied. Documents
+// whose text takes longer are marked failed.
+const (
+	extractTimeout     = 5 * time.Minute
+	extractTextTimeout = 2 * time.Minute
+)
+
+// errExtractTimeout is recorded for documents whose text took longer than
+// extractTextTimeout to extract
+var errExtractTimeout = errors.New("text extraction timed out")
+
+// extractDocumentText extracts the text of a PDF, DOCX or XLSX document,
+// stores it with the document and adds it to the search index. Documents
+// whose content cannot be parsed are marked failed with the reason; storage
+// and database errors are returned so extraction is retried.
+func (app *App) extractDocumentText(ctx context.Context, doc *models.Document) error {
+	if !extract.Supported(doc.FileType) {
+		return nil
+	}
+
+	text, err := app.reuseExtractedText(doc)
+	if err != nil {
+		return err
+	}
+	if text == "" {
+		text, err = app.readDocumentText(ctx, doc)
+		if err != nil {
+			var failure *extractionFailure
+			if !errors.As(err, &failure) {
+				return err
+			}
+			log.Printf("Cannot extract text from document %d: %v", doc.ID, failure.err)
+			return doc.SetTextError(app.DB, failure.err.Error())
+		}
+	}
+
+	if err := doc.SetExtractedText(app.DB, text); err != nil {
+		return err
+	}
+	app.indexDocumentText(doc.ID, text)
+	return nil
+}
+
+// extractionFailure wraps an error in the document itself, as opposed to one
+// reading it
+type extractionFailure struct {
+	err error
+}
+
+func (e *extractionFailure) Error() string {
+	return e.err.Error()
+}
+
+// readDocumentText copies a document out of storage and extracts its text
+func (app *App) readDocumentText(ctx context.Context, doc *models.Document) (string, error) {
+	copyCtx, cancel := context.WithTimeout(ctx, extractTimeout)
+	defer cancel()
+
+	f, _, err := app.Storage.Open(copyCtx, doc.StorageKey)
+	if err != nil {
+		return "", fmt.Errorf("opening content: %w", err)
+	}
+	defer f.Close()
+
+	// The parsers need random access, which remote storage cannot offer
+	// cheaply, so work on a local copy
+	staged, err := stageFile(f)
+	if err != nil {
+		return "", fmt.Errorf("copying content: %w", err)
+	}
+	defer staged.Remove()
+
+	extractCtx, cancelExtract := context.WithTimeout(ctx, extractTextTimeout)
+	defer cancelExtract()
+
+	text, err := extract.Text(extractCtx, staged, staged.Size, doc.FileType)
+	if err != nil {
+		// Extraction cut short by shutting down is tried again later
+		if ctx.Err() != nil {
+			return "", err
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = errExtractTimeout
+		}
+		return "", &extractionFailure{err}
+	}
+	return text, nil
+}
+
+// reuseExtractedText returns the text already extracted from another
+// document with identical content, if any
+func (app *App) reuseExtractedText(doc *models.Document) (string, error) {
+	if doc.Checksum == "" {
+		return "", nil
+	}
+	matches, err := models.GetDocumentsByChecksum(app.DB, doc.Checksum)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range matches {
+		if m.ID != doc.ID && m.TextStatus == models.TextExtracted {
+			return models.GetDocumentText(app.DB, m.ID)
+		}
+	}
+	return "", nil
+}
+
+// indexDocumentText re-indexes a document with its extracted text, unless a
+// newer version replaced it in the meantime
+func (app *App) indexDocumentText(docID int64, text string) {
+	doc, err := models.GetDocument(app.DB, docID)
+	if err != nil || !doc.IsLatest {
+		return
+	}
+	c, err := models.GetCase(app.DB, doc.CaseID)
+	if err != nil {
+		log.Printf("Error indexing document %d: %v", docID, err)
+		return
+	}
+	app.SearchIndex.Put(documentSearchEntry(doc, c.ReferenceNumber, text))
+}
+
+// ExtractPendingDocumentTexts extracts the text of clean documents still
+// waiting for it, such as ones whose extraction hit a storage error or was
+// interrupted by a restart. It runs once immediately and then every interval
+// until ctx is cancelled.
+func (app *App) ExtractPendingDocumentTexts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		documents, err := models.GetPendingTextDocuments(app.DB)
+		if err != nil {
+			log.Printf("Error loading documents pending text extraction: %v", err)
+		}
+		for i := range documents {
+			if err := app.extractDocumentText(ctx, &documents[i]); err != nil {
+				log.Printf("Error extracting text from document %d: %v (will retry)", documents[i].ID, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
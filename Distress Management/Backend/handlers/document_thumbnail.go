@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"distress-management/models"
+	"distress-management/storage"
+	"distress-management/thumbnail"
+)
+
+// thumbnailTimeout bounds generating every thumbnail of one document
+const thumbnailTimeout = 2 * time.Minute
+
+// thumbnailUnavailable is the response for a document without a thumbnail
+type thumbnailUnavailable struct {
+	Error           string                      `json:"error"`
+	ThumbnailStatus string                      `json:"thumbnailStatus"`
+	Placeholder     *models.DocumentPlaceholder `json:"placeholder"`
+}
+
+// GetDocumentThumbnail serves a JPEG thumbnail of an image or PDF document.
+// ?size= picks one of the configured sizes; the first is the default.
+// Documents without a thumbnail get their placeholder metadata instead.
+func (app *App) GetDocumentThumbnail(w http.ResponseWriter, r *http.Request) {
+	_, doc, ok := app.authorizeDocument(w, r)
+	if !ok {
+		return
+	}
+
+	size, ok := app.thumbnailSize(r.URL.Query().Get("size"))
+	if !ok {
+		names := make([]string, len(app.ThumbnailSizes))
+		for i, s := range app.ThumbnailSizes {
+			names[i] = s.Name
+		}
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("Unknown thumbnail size (available: %s)", strings.Join(names, ", ")))
+		return
+	}
+
+	switch doc.ThumbnailStatus {
+	case models.ThumbnailReady:
+	case models.ThumbnailPending:
+		w.Header().Set("Retry-After", "10")
+		respondWithJSON(w, http.StatusConflict, thumbnailUnavailable{
+			Error:           "Thumbnail is still being generated",
+			ThumbnailStatus: doc.ThumbnailStatus,
+			Placeholder:     doc.Placeholder,
+		})
+		return
+	default:
+		respondWithJSON(w, http.StatusNotFound, thumbnailUnavailable{
+			Error:           "Document has no thumbnail",
+			ThumbnailStatus: doc.ThumbnailStatus,
+			Placeholder:     doc.Placeholder,
+		})
+		return
+	}
+
+	key := thumbnail.Key(doc.StorageKey, size)
+	f, info, err := app.Storage.Open(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Sizes added to the configuration after the document was
+		// thumbnailed are generated on first use
+		if err = app.generateThumbnails(r.Context(), doc); err == nil {
+			f, info, err = app.Storage.Open(r.Context(), key)
+		}
+	}
+	if err != nil {
+		log.Printf("Error reading thumbnail %s of document %d: %v", key, doc.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Error reading thumbnail")
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("ETag", fmt.Sprintf(`"thumb-%d-%d"`, doc.ID, size.Pixels))
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", info.ModTime, f)
+}
+
+// thumbnailSize finds a configured size by name, or the default size
+func (app *App) thumbnailSize(name string) (thumbnail.Size, bool) {
+	if len(app.ThumbnailSizes) == 0 {
+		return thumbnail.Size{}, false
+	}
+	if name == "" {
+		return app.ThumbnailSizes[0], true
+	}
+	for _, s := range app.ThumbnailSizes {
+		if strings.EqualFold(s.Name, name) {
+			return s, true
+		}
+	}
+	return thumbnail.Size{}, false
+}
+
+// generateThumbnails stores every configured thumbnail size of an image or
+// PDF document next to its content and marks the thumbnails ready. Thumbnails
+// are keyed by content, so identical uploads share them and existing ones are
+// kept. Images that cannot be decoded are marked failed, and PDFs without a
+// page image none; storage errors are returned so generation is retried.
+func (app *App) generateThumbnails(ctx context.Context, doc *models.Document) error {
+	if !thumbnail.Supported(doc.FileType) {
+		return doc.SetThumbnailStatus(app.DB, models.ThumbnailNone)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, thumbnailTimeout)
+	defer cancel()
+
+	var missing []thumbnail.Size
+	for _, size := range app.ThumbnailSizes {
+		_, err := app.Storage.Stat(ctx, thumbnail.Key(doc.StorageKey, size))
+		if errors.Is(err, storage.ErrNotFound) {
+			missing = append(missing, size)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if len(missing) > 0 {
+		img, err := app.decodeThumbnailSource(ctx, doc)
+		if errors.Is(err, thumbnail.ErrNoPreview) {
+			return doc.SetThumbnailStatus(app.DB, models.ThumbnailNone)
+		}
+		var failure *thumbnailFailure
+		if errors.As(err, &failure) {
+			log.Printf("Cannot thumbnail document %d: %v", doc.ID, failure.err)
+			return doc.SetThumbnailStatus(app.DB, models.ThumbnailFailed)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, size := range missing {
+			data, err := thumbnail.Render(img, size)
+			if err != nil {
+				return err
+			}
+			if err := app.Storage.Put(ctx, thumbnail.Key(doc.StorageKey, size), bytes.NewReader(data), int64(len(data))); err != nil {
+				return err
+			}
+		}
+	}
+
+	if doc.ThumbnailStatus == models.ThumbnailReady {
+		return nil
+	}
+	return doc.SetThumbnailStatus(app.DB, models.ThumbnailReady)
+}
+
+// thumbnailFailure wraps an error decoding a document, as opposed to one
+// reading it
+type thumbnailFailure struct {
+	err error
+}
+
+func (e *thumbnailFailure) Error() string {
+	return e.err.Error()
+}
+
+// decodeThumbnailSource decodes the image a document's thumbnails are made
+// from: the document itself, or the image on the first page of a PDF. PDFs
+// are copied to a temporary file first, as the parser needs random access.
+func (app *App) decodeThumbnailSource(ctx context.Context, doc *models.Document) (image.Image, error) {
+	f, _, err := app.Storage.Open(ctx, doc.StorageKey)
+	if err != nil {
+		return nil, fmt.Errorf("opening content: %w", err)
+	}
+	defer f.Close()
+
+	var img image.Image
+	if doc.FileType == "application/pdf" {
+		staged, err := stageFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("copying content: %w", err)
+		}
+		defer staged.Remove()
+		img, err = thumbnail.DecodePDF(ctx, staged, staged.Size)
+	} else {
+		img, err = thumbnail.Decode(f)
+	}
+	if err != nil && err != thumbnail.ErrNoPreview {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &thumbnailFailure{err}
+	}
+	return img, err
+}
+
+// GeneratePendingThumbnails generates thumbnails for clean documents that do
+// not have them yet, such as ones whose generation failed on a storage error
+// or was interrupted by a restart. It runs once immediately and then every
+// interval until ctx is cancelled.
+func (app *App) GeneratePendingThumbnails(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		documents, err := models.GetPendingThumbnailDocuments(app.DB)
+		if err != nil {
+			log.Printf("Error loading documents pending thumbnails: %v", err)
+		}
+		for i := range documents {
+			if err := app.generateThumbnails(ctx, &documents[i]); err != nil {
+				log.Printf("Error generating thumbnails for document %d: %v (will retry)", documents[i].ID, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
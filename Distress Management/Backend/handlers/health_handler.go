@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// Health reports whether the API and its database are reachable
+func (app *App) Health(w http.ResponseWriter, r *http.Request) {
+	if err := app.DB.PingContext(r.Context()); err != nil {
+		respondWithJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"status":   "unavailable",
+			"database": err.Error(),
+		})
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
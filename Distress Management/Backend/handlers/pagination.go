@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setPaginationHeaders writes X-Total-Count, X-Page, X-Per-Page, X-Total-Pages
+// and an RFC 8288 Link header with first/prev/next/last relations
+func setPaginationHeaders(w http.ResponseWriter, r *http.Request, page, limit, total int) {
+	totalPages := (total + limit - 1) / limit
+	if totalPages == 0 {
+		totalPages = 1
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Header().Set("X-Page", strconv.Itoa(page))
+	w.Header().Set("X-Per-Page", strconv.Itoa(limit))
+	w.Header().Set("X-Total-Pages", strconv.Itoa(totalPages))
+
+	pageURL := func(p int) string {
+		u := *r.URL
+		q := u.Query()
+		q.Set("page", strconv.Itoa(p))
+		q.Set("limit", strconv.Itoa(limit))
+		u.RawQuery = q.Encode()
+		return u.RequestURI()
+	}
+
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(1))}
+	if page > 1 {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(min(page-1, totalPages))))
+	}
+	if page < totalPages {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(page+1)))
+	}
+	links = append(links, fmt.Sprintf(`<%s>; rel="last"`, pageURL(totalPages)))
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// queryList returns the values of a query parameter that may be repeated
+// (?status=a&status=b) or comma separated (?status=a,b)
+func queryList(params url.Values, key string) []string {
+	var values []string
+	for _, raw := range params[key] {
+		for _, v := range strings.Split(raw, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// parseDateParam parses a YYYY-MM-DD or RFC 3339 query parameter. With
+// endOfDay set, a bare date is moved to the start of the following day so it
+// can be used as an exclusive upper bound that includes the whole day.
+func parseDateParam(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.New("expected YYYY-MM-DD or an RFC 3339 timestamp")
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -1,50 +1,296 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"distress-management/auth"
 	"distress-management/models"
+	"distress-management/search"
+
 	"github.com/gorilla/mux"
 )
 
+// AddProgressNote adds a note to a case. The optional "noteType" defaults to
+// internal_comment and "visibility" to the type's default (see
+// models.DefaultNoteVisibility). Only supervisors may write director
+// instructions.
 func (app *App) AddProgressNote(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	caseID, err := strconv.ParseInt(vars["id"], 10, 64)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid case ID")
+	c, user, ok := app.authorizeCase(w, r)
+	if !ok {
 		return
 	}
+	caseID := c.ID
 
-	var note models.ProgressNote
-	if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
+	var input struct {
+		Note       string `json:"note"`
+		NoteType   string `json:"noteType"`
+		Visibility string `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	note.CaseID = caseID
+	if strings.TrimSpace(input.Note) == "" {
+		respondWithError(w, http.StatusBadRequest, "Note is required")
+		return
+	}
+
+	noteType, visibility, ok := classifyNote(w, user, input.NoteType, input.Visibility, nil)
+	if !ok {
+		return
+	}
+
+	// The author is always the authenticated user, never the request body
+	note := models.ProgressNote{
+		CaseID:     caseID,
+		UserID:     user.ID,
+		Note:       input.Note,
+		NoteType:   noteType,
+		Visibility: visibility,
+	}
 	if err := note.Create(app.DB); err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	app.SearchIndex.Put(noteSearchEntry(&note, c.ReferenceNumber))
+
 	respondWithJSON(w, http.StatusCreated, note)
 }
 
+// GetProgressNotes lists the notes of a case the caller may see, pinned
+// director instructions first
 func (app *App) GetProgressNotes(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	caseID, err := strconv.ParseInt(vars["id"], 10, 64)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid case ID")
+	c, user, ok := app.authorizeCase(w, r)
+	if !ok {
 		return
 	}
 
-	notes, err := models.GetProgressNotes(app.DB, caseID)
+	notes, err := models.GetProgressNotes(app.DB, c.ID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, notes)
+	visible := []models.ProgressNote{}
+	for _, n := range notes {
+		if auth.CanSeeNote(user, n.Visibility, n.UserID, n.AuthorDepartment) {
+			visible = append(visible, n)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, visible)
+}
+
+// classifyNote validates a note's type and visibility. Empty values keep
+// those of current, or take the defaults for a new note. On failure it
+// writes the error response and returns false.
+func classifyNote(w http.ResponseWriter, user *models.User, noteType, visibility string, current *models.ProgressNote) (string, string, bool) {
+	noteType = strings.TrimSpace(noteType)
+	visibility = strings.TrimSpace(visibility)
+
+	if noteType == "" {
+		noteType = models.NoteInternalComment
+		if current != nil {
+			noteType = current.NoteType
+		}
+	}
+	if !models.ValidNoteType(noteType) {
+		respondWithError(w, http.StatusBadRequest, "noteType must be one of "+strings.Join(models.NoteTypes, ", "))
+		return "", "", false
+	}
+	if noteType == models.NoteDirectorInstruction && (current == nil || current.NoteType != noteType) &&
+		!auth.HasPermission(user.Role, auth.PermIssueInstructions) {
+		respondWithError(w, http.StatusForbidden, auth.ForbiddenMessage(user, auth.PermIssueInstructions))
+		return "", "", false
+	}
+
+	if visibility == "" {
+		visibility = models.DefaultNoteVisibility(noteType)
+		if current != nil {
+			visibility = current.Visibility
+		}
+	}
+	if !models.ValidNoteVisibility(visibility) {
+		respondWithError(w, http.StatusBadRequest, "visibility must be one of "+strings.Join(models.NoteVisibilities, ", "))
+		return "", "", false
+	}
+
+	return noteType, visibility, true
+}
+
+// UpdateProgressNote replaces the text of a note, and its type or visibility
+// if "noteType" or "visibility" are given. Only the author or a supervisor
+// may edit it, and only within NoteEditWindow of it being written. The
+// previous version is kept as a revision; an optional "reason" is recorded
+// with it.
+func (app *App) UpdateProgressNote(w http.ResponseWriter, r *http.Request) {
+	c, note, user, ok := app.authorizeNoteChange(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Note       string `json:"note"`
+		NoteType   string `json:"noteType"`
+		Visibility string `json:"visibility"`
+		Reason     string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if strings.TrimSpace(input.Note) == "" {
+		respondWithError(w, http.StatusBadRequest, "Note is required")
+		return
+	}
+	if len(input.Reason) > 500 {
+		respondWithError(w, http.StatusBadRequest, "Reason must be at most 500 characters")
+		return
+	}
+	noteType, visibility, ok := classifyNote(w, user, input.NoteType, input.Visibility, note)
+	if !ok {
+		return
+	}
+
+	err := models.WithTx(app.DB, func(tx *sql.Tx) error {
+		return note.Edit(tx, input.Note, noteType, visibility, user.ID, strings.TrimSpace(input.Reason))
+	})
+	if err != nil {
+		respondWithNoteChangeError(w, err)
+		return
+	}
+
+	app.SearchIndex.Put(noteSearchEntry(note, c.ReferenceNumber))
+
+	respondWithJSON(w, http.StatusOK, note)
+}
+
+// DeleteProgressNote tombstones a note under the same rules as
+// UpdateProgressNote. The note stays in the list with its text removed; the
+// text is kept as a revision.
+func (app *App) DeleteProgressNote(w http.ResponseWriter, r *http.Request) {
+	_, note, user, ok := app.authorizeNoteChange(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if len(input.Reason) > 500 {
+		respondWithError(w, http.StatusBadRequest, "Reason must be at most 500 characters")
+		return
+	}
+
+	err := models.WithTx(app.DB, func(tx *sql.Tx) error {
+		return note.Delete(tx, user.ID, strings.TrimSpace(input.Reason))
+	})
+	if err != nil {
+		respondWithNoteChangeError(w, err)
+		return
+	}
+
+	app.SearchIndex.Remove(search.TypeNote, note.ID)
+
+	respondWithJSON(w, http.StatusOK, note)
+}
+
+// GetProgressNoteRevisions returns a note with its earlier revisions, oldest
+// first, including the text of deleted notes. Revisions whose visibility the
+// caller may not see are left out.
+func (app *App) GetProgressNoteRevisions(w http.ResponseWriter, r *http.Request) {
+	_, note, user, ok := app.authorizeNote(w, r)
+	if !ok {
+		return
+	}
+
+	revisions, err := models.GetNoteRevisions(app.DB, note.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving note revisions")
+		return
+	}
+
+	visible := []models.NoteRevision{}
+	for _, rev := range revisions {
+		if auth.CanSeeNote(user, rev.Visibility, note.UserID, note.AuthorDepartment) {
+			visible = append(visible, rev)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"note":      note,
+		"revisions": visible,
+	})
+}
+
+// authorizeNote loads the note named by the {noteId} route variable and
+// checks that it belongs to the case in the URL and that the caller may see
+// both the case and the note
+func (app *App) authorizeNote(w http.ResponseWriter, r *http.Request) (*models.Case, *models.ProgressNote, *models.User, bool) {
+	c, user, ok := app.authorizeCase(w, r)
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	noteID, err := strconv.ParseInt(mux.Vars(r)["noteId"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid note ID")
+		return nil, nil, nil, false
+	}
+
+	note, err := models.GetProgressNote(app.DB, noteID)
+	if err != nil || note.CaseID != c.ID || !auth.CanSeeNote(user, note.Visibility, note.UserID, note.AuthorDepartment) {
+		respondWithError(w, http.StatusNotFound, "Note not found")
+		return nil, nil, nil, false
+	}
+
+	return c, note, user, true
+}
+
+// authorizeNoteChange is authorizeNote for edits and deletes: the caller must
+// be the author or a supervisor, and the note must be live and inside the
+// edit window
+func (app *App) authorizeNoteChange(w http.ResponseWriter, r *http.Request) (*models.Case, *models.ProgressNote, *models.User, bool) {
+	c, note, user, ok := app.authorizeNote(w, r)
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	if note.UserID != user.ID && !auth.HasPermission(user.Role, auth.PermEditAnyNote) {
+		respondWithError(w, http.StatusForbidden, "Only the author or a supervisor can change this note")
+		return nil, nil, nil, false
+	}
+	if note.IsDeleted() {
+		respondWithError(w, http.StatusConflict, "Note has been deleted")
+		return nil, nil, nil, false
+	}
+	if app.NoteEditWindow > 0 && time.Since(note.CreatedAt) > app.NoteEditWindow {
+		respondWithError(w, http.StatusForbidden,
+			fmt.Sprintf("Notes can only be changed within %s of being written", app.NoteEditWindow))
+		return nil, nil, nil, false
+	}
+
+	return c, note, user, true
+}
+
+func respondWithNoteChangeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, models.ErrNoteDeleted) {
+		respondWithError(w, http.StatusConflict, "Note has been deleted")
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Error saving note")
 }
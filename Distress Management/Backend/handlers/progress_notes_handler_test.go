@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"distress-management/auth"
+	"distress-management/models"
+	"distress-management/search"
+)
+
+// getJSON serves a GET of path through h and decodes the response into v
+func getJSON(t *testing.T, h http.HandlerFunc, pattern, path string, user *models.User, v interface{}) int {
+	t.Helper()
+
+	rec := serve(h, pattern, httptest.NewRequest(http.MethodGet, path, nil), user)
+	if rec.Code == http.StatusOK && v != nil {
+		if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+	return rec.Code
+}
+
+func sortedIDs(ids []int64) []int64 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// TestNoteVisibility checks, for each role, which notes show up in the note
+// list, revisions, timeline, archive manifest and search results
+func TestNoteVisibility(t *testing.T) {
+	app := newTestApp(t)
+
+	author := testUser(t, app, auth.RoleOfficer, "Consular")
+	colleague := testUser(t, app, auth.RoleFrontOffice, "Consular")
+	outsider := testUser(t, app, auth.RoleFrontOffice, "Protocol")
+	loner := testUser(t, app, auth.RoleFrontOffice, "")
+	director := testUser(t, app, auth.RoleDirector, "")
+	c := testCase(t, app, author)
+
+	addNote := func(by *models.User, visibility string) *models.ProgressNote {
+		t.Helper()
+		n := &models.ProgressNote{CaseID: c.ID, UserID: by.ID, Note: "evacuation " + visibility,
+			NoteType: models.NoteCallLog, Visibility: visibility}
+		if err := n.Create(app.DB); err != nil {
+			t.Fatalf("creating note: %v", err)
+		}
+		return n
+	}
+	editNote := func(n *models.ProgressNote, visibility string) {
+		t.Helper()
+		err := models.WithTx(app.DB, func(tx *sql.Tx) error {
+			return n.Edit(tx, n.Note+" (edited)", n.NoteType, visibility, n.UserID, "")
+		})
+		if err != nil {
+			t.Fatalf("editing note: %v", err)
+		}
+	}
+
+	internal := addNote(author, models.VisibilityInternal)
+	department := addNote(author, models.VisibilityDepartment)
+	editNote(department, models.VisibilityDepartment)
+	// Written as internal, then shared with the requester: the internal
+	// revision stays hidden
+	requester := addNote(author, models.VisibilityInternal)
+	editNote(requester, models.VisibilityRequester)
+	// A department note by a user with no department
+	lonerNote := addNote(loner, models.VisibilityDepartment)
+
+	for _, n := range []*models.ProgressNote{internal, department, requester, lonerNote} {
+		app.SearchIndex.Put(noteSearchEntry(n, c.ReferenceNumber))
+	}
+
+	tests := []struct {
+		name string
+		user *models.User
+		// want lists the notes the user may see, and revisions how many
+		// earlier revisions of each they may see where there are any
+		want      []*models.ProgressNote
+		revisions map[*models.ProgressNote]int
+	}{
+		{"author", author, []*models.ProgressNote{internal, department, requester},
+			map[*models.ProgressNote]int{department: 1, requester: 1}},
+		{"same department", colleague, []*models.ProgressNote{department, requester},
+			map[*models.ProgressNote]int{department: 1, requester: 0}},
+		{"other department", outsider, []*models.ProgressNote{requester},
+			map[*models.ProgressNote]int{requester: 0}},
+		{"no department", loner, []*models.ProgressNote{requester, lonerNote},
+			map[*models.ProgressNote]int{requester: 0}},
+		{"director", director, []*models.ProgressNote{internal, department, requester, lonerNote},
+			map[*models.ProgressNote]int{department: 1, requester: 1}},
+	}
+
+	casePath := fmt.Sprintf("/api/cases/%d", c.ID)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []int64
+			for _, n := range tt.want {
+				want = append(want, n.ID)
+			}
+			want = sortedIDs(want)
+			check := func(what string, got []int64) {
+				t.Helper()
+				if fmt.Sprint(sortedIDs(got)) != fmt.Sprint(want) {
+					t.Errorf("%s: got notes %v, want %v", what, got, want)
+				}
+			}
+
+			var notes []models.ProgressNote
+			if code := getJSON(t, app.GetProgressNotes, "/api/cases/{id}/notes", casePath+"/notes", tt.user, &notes); code != http.StatusOK {
+				t.Fatalf("listing notes: status %d", code)
+			}
+			var ids []int64
+			for _, n := range notes {
+				ids = append(ids, n.ID)
+			}
+			check("note list", ids)
+
+			var timeline []models.TimelineEvent
+			if code := getJSON(t, app.GetCaseTimeline, "/api/cases/{id}/timeline", casePath+"/timeline", tt.user, &timeline); code != http.StatusOK {
+				t.Fatalf("timeline: status %d", code)
+			}
+			ids = nil
+			for _, e := range timeline {
+				if e.Type == models.TimelineNote {
+					ids = append(ids, e.NoteID)
+				}
+			}
+			check("timeline", ids)
+
+			check("archive manifest", archiveNoteIDs(t, app, casePath+"/documents/archive", tt.user))
+
+			var results struct {
+				Results map[string][]search.Hit `json:"results"`
+			}
+			if code := getJSON(t, app.Search, "/api/search", "/api/search?q=evacuation", tt.user, &results); code != http.StatusOK {
+				t.Fatalf("search: status %d", code)
+			}
+			ids = nil
+			for _, hit := range results.Results["notes"] {
+				ids = append(ids, hit.ID)
+			}
+			check("search", ids)
+
+			for _, n := range []*models.ProgressNote{internal, department, requester, lonerNote} {
+				var body struct {
+					Revisions []models.NoteRevision `json:"revisions"`
+				}
+				path := fmt.Sprintf("%s/notes/%d/revisions", casePath, n.ID)
+				code := getJSON(t, app.GetProgressNoteRevisions, "/api/cases/{id}/notes/{noteId}/revisions", path, tt.user, &body)
+				switch {
+				case !contains(tt.want, n):
+					if code != http.StatusNotFound {
+						t.Errorf("revisions of note %d: status %d, want 404", n.ID, code)
+					}
+				case code != http.StatusOK:
+					t.Errorf("revisions of note %d: status %d, want 200", n.ID, code)
+				case len(body.Revisions) != tt.revisions[n]:
+					t.Errorf("revisions of note %d: got %d, want %d", n.ID, len(body.Revisions), tt.revisions[n])
+				}
+			}
+		})
+	}
+
+	// An archive for the requester holds only requester notes, whoever asks
+	got := archiveNoteIDs(t, app, casePath+"/documents/archive?audience=requester", director)
+	if fmt.Sprint(got) != fmt.Sprint([]int64{requester.ID}) {
+		t.Errorf("requester archive: got notes %v, want [%d]", got, requester.ID)
+	}
+}
+
+func contains(notes []*models.ProgressNote, n *models.ProgressNote) bool {
+	for _, m := range notes {
+		if m == n {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveNoteIDs downloads a case archive and returns the IDs of the notes in
+// its manifest
+func archiveNoteIDs(t *testing.T, app *App, path string, user *models.User) []int64 {
+	t.Helper()
+
+	rec := serve(app.GetDocumentArchive, "/api/cases/{id}/documents/archive", httptest.NewRequest(http.MethodGet, path, nil), user)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("archive: status %d: %s", rec.Code, rec.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zr.Open("manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var manifest archiveManifest
+	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, n := range manifest.Notes {
+		ids = append(ids, n.ID)
+	}
+	return sortedIDs(ids)
+}
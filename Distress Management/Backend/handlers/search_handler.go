@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"distress-management/auth"
+	"distress-management/models"
+	"distress-management/search"
+)
+
+// Search runs a full-text query over cases, progress notes and documents.
+// Hits are ranked, grouped by entity type and limited to the cases the
+// caller may see.
+func (app *App) Search(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		respondWithError(w, http.StatusBadRequest, "Query parameter q is required")
+		return
+	}
+
+	opts := search.Options{Types: queryList(r.URL.Query(), "types")}
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			opts.Limit = min(l, 100)
+		}
+	}
+
+	// Officers and cadets only get hits from the cases assigned to them
+	if !auth.HasPermission(user.Role, auth.PermViewAllCases) {
+		ids, err := models.GetAssignedCaseIDs(app.DB, user.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error running search")
+			return
+		}
+		allowed := make(map[int64]bool, len(ids))
+		for _, id := range ids {
+			allowed[id] = true
+		}
+		opts.Allow = func(caseID int64) bool { return allowed[caseID] }
+	}
+
+	// Internal notes are only found by their author and supervisors, and
+	// department notes also by the author's current colleagues
+	colleagues := map[int64]bool{}
+	if user.Department != "" && !auth.HasPermission(user.Role, auth.PermViewInternalNotes) {
+		users, err := models.GetUsers(app.DB, models.UserFilter{Department: user.Department})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error running search")
+			return
+		}
+		for _, u := range users {
+			colleagues[u.ID] = true
+		}
+	}
+	opts.AllowEntry = func(e search.Entry) bool {
+		if e.Type != search.TypeNote {
+			return true
+		}
+		authorDepartment := ""
+		if colleagues[e.AuthorID] {
+			authorDepartment = user.Department
+		}
+		return auth.CanSeeNote(user, e.Visibility, e.AuthorID, authorDepartment)
+	}
+
+	grouped := app.SearchIndex.Search(query, opts)
+	results := map[string][]search.Hit{
+		"cases":     nonNilHits(grouped[search.TypeCase]),
+		"notes":     nonNilHits(grouped[search.TypeNote]),
+		"documents": nonNilHits(grouped[search.TypeDocument]),
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"query":   query,
+		"total":   len(results["cases"]) + len(results["notes"]) + len(results["documents"]),
+		"results": results,
+	})
+}
+
+func nonNilHits(hits []search.Hit) []search.Hit {
+	if hits == nil {
+		return []search.Hit{}
+	}
+	return hits
+}
+
+// RebuildSearchIndex loads every case, progress note and document into the
+// search index
+func (app *App) RebuildSearchIndex() error {
+	cases, err := models.GetAllCases(app.DB)
+	if err != nil {
+		return fmt.Errorf("loading cases: %w", err)
+	}
+	references := make(map[int64]string, len(cases))
+	for i := range cases {
+		references[cases[i].ID] = cases[i].ReferenceNumber
+		app.SearchIndex.Put(caseSearchEntry(&cases[i]))
+	}
+
+	notes, err := models.GetAllProgressNotes(app.DB)
+	if err != nil {
+		return fmt.Errorf("loading progress notes: %w", err)
+	}
+	for i := range notes {
+		app.SearchIndex.Put(noteSearchEntry(&notes[i], references[notes[i].CaseID]))
+	}
+
+	documents, err := models.GetAllDocuments(app.DB)
+	if err != nil {
+		return fmt.Errorf("loading documents: %w", err)
+	}
+	texts, err := models.GetExtractedTexts(app.DB)
+	if err != nil {
+		return fmt.Errorf("loading document text: %w", err)
+	}
+	for i := range documents {
+		app.SearchIndex.Put(documentSearchEntry(&documents[i], references[documents[i].CaseID], texts[documents[i].ID]))
+	}
+
+	return nil
+}
+
+// indexCase reloads a case into the search index after it changed
+func (app *App) indexCase(caseID int64) {
+	c, err := models.GetCase(app.DB, caseID)
+	if err != nil {
+		log.Printf("Error indexing case %d: %v", caseID, err)
+		return
+	}
+	app.SearchIndex.Put(caseSearchEntry(c))
+}
+
+func caseSearchEntry(c *models.Case) search.Entry {
+	return search.Entry{
+		Type:          search.TypeCase,
+		ID:            c.ID,
+		CaseID:        c.ID,
+		CaseReference: c.ReferenceNumber,
+		Title:         c.ReferenceNumber + " " + c.Subject,
+		Text: strings.Join([]string{
+			c.SenderName, c.DistressedPersonName, c.CountryOfOrigin, c.CaseDetails,
+		}, "\n"),
+	}
+}
+
+func noteSearchEntry(n *models.ProgressNote, caseReference string) search.Entry {
+	return search.Entry{
+		Type:          search.TypeNote,
+		ID:            n.ID,
+		CaseID:        n.CaseID,
+		CaseReference: caseReference,
+		Title:         fmt.Sprintf("Progress note %d", n.ID),
+		Text:          n.Note,
+		Visibility:    n.Visibility,
+		AuthorID:      n.UserID,
+	}
+}
+
+// documentSearchEntry indexes a document by its file name and any text
+// extracted from it
+func documentSearchEntry(d *models.Document, caseReference, text string) search.Entry {
+	return search.Entry{
+		Type:          search.TypeDocument,
+		ID:            d.ID,
+		CaseID:        d.CaseID,
+		CaseReference: caseReference,
+		Title:         d.FileName,
+		Text:          strings.TrimSpace(d.FileName + "\n" + text),
+	}
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"distress-management/extract"
+	"distress-management/filetype"
+	"distress-management/models"
+	"distress-management/storage"
+	"distress-management/thumbnail"
+)
+
+// stagedFile is an upload spooled to a temporary file and hashed on the way,
+// so it can be inspected before anything reaches document storage. Staged
+// files are plaintext even when storage is encrypted.
+type stagedFile struct {
+	*os.File
+	Size     int64
+	Checksum string
+}
+
+// stageFile copies r to a temporary file, computing its size and SHA-256
+func stageFile(r io.Reader) (*stagedFile, error) {
+	f, err := os.CreateTemp(os.Getenv("UPLOAD_TMP_DIR"), "upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), r)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return &stagedFile{File: f, Size: size, Checksum: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// Remove closes and deletes the temporary file
+func (f *stagedFile) Remove() {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// contentLocks serializes work on the same content-addressed object, so an
+// object cannot be deleted as unused between a new upload finding it already
+// stored and the upload's document being saved
+var contentLocks keyLocks
+
+// keyLocks is a set of mutexes by key. A key's entry only exists while it is
+// held or waited for.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks key and returns the function that unlocks it
+func (l *keyLocks) lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*keyLock{}
+	}
+	kl := l.locks[key]
+	if kl == nil {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+		l.mu.Lock()
+		kl.refs--
+		if kl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// contentKey returns the key content with checksum is stored under. Content
+// another document already has keeps its key: encrypted storage names
+// content with a key derived from the primary master key, so after a
+// rotation it would name identical content differently.
+func (app *App) contentKey(checksum string) (string, error) {
+	key, err := models.GetStorageKeyByChecksum(app.DB, checksum)
+	if err == sql.ErrNoRows {
+		return storage.ContentKeyFor(app.Storage, checksum), nil
+	}
+	return key, err
+}
+
+// storeContent writes a staged file to storage under key, its
+// content-addressed key. Identical content is stored once, so if the key
+// already exists the upload is not repeated. The caller must hold the key's
+// content lock.
+func (app *App) storeContent(ctx context.Context, key string, f *stagedFile) error {
+	_, err := app.Storage.Stat(ctx, key)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return app.Storage.Put(ctx, key, f, f.Size)
+}
+
+// releaseContent deletes a stored object, and any thumbnails of it, once no
+// document refers to it
+func (app *App) releaseContent(ctx context.Context, key string) error {
+	unlock := contentLocks.lock(key)
+	defer unlock()
+	return app.deleteUnusedContent(ctx, key)
+}
+
+// deleteUnusedContent is releaseContent for a caller that already holds the
+// key's content lock
+func (app *App) deleteUnusedContent(ctx context.Context, key string) error {
+	n, err := models.CountDocumentsByStorageKey(app.DB, key)
+	if err != nil || n > 0 {
+		return err
+	}
+	for _, size := range app.ThumbnailSizes {
+		if err := app.Storage.Delete(ctx, thumbnail.Key(key, size)); err != nil {
+			return err
+		}
+	}
+	return app.Storage.Delete(ctx, key)
+}
+
+// uploadError is a rejected upload and the status to report it with
+type uploadError struct {
+	Status  int
+	Message string
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+// respondWithUploadError writes the response for an error from receiveFile
+// or addDocument
+func respondWithUploadError(w http.ResponseWriter, err error) {
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		respondWithError(w, ue.Status, ue.Message)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Error saving file")
+}
+
+// uploadErrorMessage returns the client-facing message for an upload error
+func uploadErrorMessage(err error) string {
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		return ue.Message
+	}
+	return "Error saving file"
+}
+
+// receiveFile validates one uploaded file, writes it to storage and saves its
+// document with save; see storeStagedFile
+func (app *App) receiveFile(ctx context.Context, c *models.Case, fh *multipart.FileHeader, save func(*models.Document) error) (*models.Document, error) {
+	if fh.Size > maxFileSize {
+		return nil, &uploadError{http.StatusRequestEntityTooLarge, "File too large (max 10MB)"}
+	}
+
+	file, err := fh.Open()
+	if err != nil {
+		return nil, &uploadError{http.StatusBadRequest, "Error retrieving file"}
+	}
+	defer file.Close()
+
+	// Stage the upload in a temporary file, hashing it on the way
+	staged, err := stageFile(file)
+	if err != nil {
+		log.Printf("Error staging upload for case %d: %v", c.ID, err)
+		return nil, &uploadError{http.StatusInternalServerError, "Error reading file"}
+	}
+	defer staged.Remove()
+
+	return app.storeStagedFile(ctx, c, staged, fh.Filename, save)
+}
+
+// storeStagedFile identifies a staged file, writes it to storage under its
+// checksum and calls save to record the document. The content is locked
+// until save returns, and released again if save fails; save's error is
+// returned as is.
+func (app *App) storeStagedFile(ctx context.Context, c *models.Case, staged *stagedFile, filename string, save func(*models.Document) error) (*models.Document, error) {
+	// Identify the file from its content; the client's Content-Type and
+	// file name are not trusted
+	fileType, err := app.detectFileType(staged, staged.Size, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := app.contentKey(staged.Checksum)
+	if err != nil {
+		log.Printf("Error looking up document %s: %v", staged.Checksum, err)
+		return nil, &uploadError{http.StatusInternalServerError, "Error saving file"}
+	}
+	unlock := contentLocks.lock(key)
+	defer unlock()
+
+	if err := app.storeContent(ctx, key, staged); err != nil {
+		log.Printf("Error storing document %s: %v", staged.Checksum, err)
+		return nil, &uploadError{http.StatusInternalServerError, "Error saving file"}
+	}
+
+	doc := &models.Document{
+		CaseID:     c.ID,
+		FileName:   filename,
+		StorageKey: key,
+		FileType:   fileType.MIME,
+		FileSize:   staged.Size,
+		Checksum:   staged.Checksum,
+	}
+	if thumbnail.Supported(doc.FileType) {
+		doc.ThumbnailStatus = models.ThumbnailPending
+	}
+	if extract.Supported(doc.FileType) {
+		doc.TextStatus = models.TextPending
+	}
+
+	if err := save(doc); err != nil {
+		// Clean up the file unless other documents share it
+		if err := app.deleteUnusedContent(ctx, key); err != nil {
+			log.Printf("Error deleting file %s: %v", key, err)
+		}
+		return nil, err
+	}
+	return doc, nil
+}
+
+// detectFileType sniffs an upload and checks it against the allow-list and
+// the extension of the client's file name
+func (app *App) detectFileType(r io.ReaderAt, size int64, filename string) (filetype.Type, error) {
+	fileType, err := filetype.Detect(r, size)
+	if err != nil {
+		switch err {
+		case filetype.ErrUnrecognized, filetype.ErrExecutable, filetype.ErrMacroEnabled,
+			filetype.ErrPolyglot, filetype.ErrMalformed:
+			return filetype.Type{}, &uploadError{http.StatusUnsupportedMediaType, "File rejected: " + err.Error()}
+		}
+		return filetype.Type{}, &uploadError{http.StatusInternalServerError, "Error reading file"}
+	}
+
+	if !app.FileTypes.Allows(fileType) {
+		return filetype.Type{}, &uploadError{http.StatusUnsupportedMediaType,
+			fmt.Sprintf("File type %s not allowed (allowed: %s)", fileType.Name, strings.Join(app.FileTypes.Names(), ", "))}
+	}
+
+	if !fileType.MatchesExtension(filename) {
+		return filetype.Type{}, &uploadError{http.StatusBadRequest,
+			fmt.Sprintf("File extension %q does not match its content (%s)", filepath.Ext(filename), fileType.Name)}
+	}
+
+	return fileType, nil
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"distress-management/auth"
+	"distress-management/filetype"
+	"distress-management/models"
+	"distress-management/storage"
+)
+
+// TestStoreStagedFileAcrossKeyRotation checks that identical uploads share
+// one stored object after the primary master key is rotated
+func TestStoreStagedFileAcrossKeyRotation(t *testing.T) {
+	app := newTestApp(t)
+	user := testUser(t, app, auth.RoleFrontOffice, "")
+	c := testCase(t, app, nil)
+	ctx := context.Background()
+
+	fileTypes, err := filetype.ParseAllowlist("pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.FileTypes = fileTypes
+
+	inner, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	key2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	useKeys := func(spec string) {
+		keys, err := storage.ParseKeyring(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.Storage = storage.NewEncrypted(inner, keys)
+	}
+
+	content := []byte("%PDF-1.4\n1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n" +
+		"2 0 obj << /Type /Pages /Kids [] /Count 0 >> endobj\n" +
+		"trailer << /Root 1 0 R >>\n%%EOF\n")
+	upload := func() *models.Document {
+		t.Helper()
+		staged, err := stageFile(bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer staged.Remove()
+
+		doc, err := app.storeStagedFile(ctx, c, staged, "report.pdf", func(d *models.Document) error {
+			d.UploadedBy = user.ID
+			return d.Create(app.DB)
+		})
+		if err != nil {
+			t.Fatalf("storing upload: %v", err)
+		}
+		return doc
+	}
+
+	useKeys("k1:" + key1)
+	first := upload()
+
+	useKeys("k2:" + key2 + ",k1:" + key1)
+	if fresh := storage.ContentKeyFor(app.Storage, first.Checksum); fresh == first.StorageKey {
+		t.Fatal("content is named the same under the new primary key; the test does not rotate")
+	}
+	second := upload()
+
+	if second.StorageKey != first.StorageKey {
+		t.Errorf("upload after rotation stored under %s, want the existing %s", second.StorageKey, first.StorageKey)
+	}
+	if _, err := inner.Stat(ctx, storage.ContentKeyFor(app.Storage, first.Checksum)); err == nil {
+		t.Error("content was stored again under the new primary key's name")
+	}
+}
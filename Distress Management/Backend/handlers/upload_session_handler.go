@@ -0,0 +1,454 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"distress-management/models"
+	"distress-management/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// tusVersion is the version of the tus resumable upload protocol implemented
+// by the upload session endpoints
+const tusVersion = "1.0.0"
+
+// UploadSettings configures resumable uploads and per-case storage quotas
+type UploadSettings struct {
+	// SessionDir holds the partial content of resumable uploads
+	SessionDir string
+	// MaxSize is the largest file accepted through a resumable upload
+	MaxSize int64
+	// SessionTTL is how long a session may sit idle before it expires
+	SessionTTL time.Duration
+	// CaseQuota caps the total size of a case's documents; 0 means no limit
+	CaseQuota int64
+}
+
+// sessionLocks serializes chunks written to the same session, and the sweep
+// of expired sessions with them
+var sessionLocks keyLocks
+
+func lockSession(id string) func() {
+	return sessionLocks.lock(id)
+}
+
+// CreateUpload starts a resumable upload (tus "creation"). The total size is
+// given in Upload-Length and the file name, category and comment in
+// Upload-Metadata as base64-encoded "filename", "category" and "comment".
+func (app *App) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	c, user, ok := app.authorizeCase(w, r)
+	if !ok {
+		return
+	}
+	setTusHeaders(w)
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Length must be a positive number of bytes")
+		return
+	}
+	if length > app.Uploads.MaxSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("File too large (max %d bytes)", app.Uploads.MaxSize))
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata")
+		return
+	}
+	fileName := strings.TrimSpace(metadata["filename"])
+	if fileName == "" {
+		fileName = strings.TrimSpace(metadata["name"])
+	}
+	if fileName == "" {
+		respondWithError(w, http.StatusBadRequest, "Upload-Metadata must include a filename")
+		return
+	}
+
+	category := strings.TrimSpace(metadata["category"])
+	if category == "" {
+		category = models.DefaultDocumentCategory
+	}
+	exists, err := models.DocumentCategoryExists(app.DB, category)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error checking document category")
+		return
+	}
+	if !exists {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s: %q", errUnknownCategory, category))
+		return
+	}
+
+	if err := app.checkCaseQuota(c.ID, length); err != nil {
+		respondWithUploadError(w, err)
+		return
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error creating upload")
+		return
+	}
+
+	session := &models.UploadSession{
+		ID:            id,
+		CaseID:        c.ID,
+		UserID:        user.ID,
+		FileName:      fileName,
+		Category:      category,
+		ChangeComment: strings.TrimSpace(metadata["comment"]),
+		Length:        length,
+		ExpiresAt:     time.Now().Add(app.Uploads.SessionTTL),
+	}
+
+	// Create the empty content file before the record so a session never
+	// exists without one
+	f, err := os.OpenFile(app.sessionPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Error creating upload session file: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Error creating upload")
+		return
+	}
+	f.Close()
+
+	if err := session.Create(app.DB); err != nil {
+		os.Remove(app.sessionPath(id))
+		respondWithError(w, http.StatusInternalServerError, "Error creating upload")
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/cases/%d/uploads/%s", c.ID, id))
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	respondWithJSON(w, http.StatusCreated, session)
+}
+
+// GetUpload reports a session's progress. HEAD returns it in tus headers;
+// GET also returns the session as JSON, including the created document once
+// the upload has completed.
+func (app *App) GetUpload(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := app.authorizeUploadSession(w, r)
+	if !ok {
+		return
+	}
+	setTusHeaders(w)
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method == http.MethodHead {
+		if session.Status == models.UploadFailed {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, session)
+}
+
+// PatchUpload appends a chunk to a session. The chunk must start at the
+// session's current offset (Upload-Offset). When the last byte arrives the
+// file goes through the same validation, scanning and storage as
+// UploadDocument and the session records the new document.
+func (app *App) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	c, session, ok := app.authorizeUploadSession(w, r)
+	if !ok {
+		return
+	}
+	setTusHeaders(w)
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Offset must be a non-negative number")
+		return
+	}
+
+	unlock := lockSession(session.ID)
+	defer unlock()
+
+	// Reload under the lock; another chunk may have just been written
+	session, err = models.GetUploadSession(app.DB, session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+	if session.Status != models.UploadActive {
+		respondWithError(w, http.StatusGone, "Upload is no longer active")
+		return
+	}
+	if offset != session.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Upload-Offset is %d, expected %d", offset, session.Offset))
+		return
+	}
+
+	f, err := os.OpenFile(app.sessionPath(session.ID), os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Error opening upload session %s: %v", session.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Error writing upload")
+		return
+	}
+	// Drop bytes from an earlier chunk that were written but never recorded
+	if err := f.Truncate(offset); err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		respondWithError(w, http.StatusInternalServerError, "Error writing upload")
+		return
+	}
+
+	// Keep whatever arrives even if the connection drops, so the client can
+	// resume from there
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, session.Length-offset))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	if n > 0 {
+		if err := session.Advance(app.DB, offset, offset+n, time.Now().Add(app.Uploads.SessionTTL)); err != nil {
+			respondWithError(w, http.StatusConflict, "Upload was modified concurrently")
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	if copyErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Upload interrupted; resume from Upload-Offset")
+		return
+	}
+
+	if session.Offset == session.Length {
+		doc, err := app.finishUpload(r.Context(), c, session)
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		w.Header().Set("Upload-Document-Id", strconv.FormatInt(doc.ID, 10))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteUpload abandons a session (tus "termination")
+func (app *App) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := app.authorizeUploadSession(w, r)
+	if !ok {
+		return
+	}
+	setTusHeaders(w)
+
+	unlock := lockSession(session.ID)
+	defer unlock()
+
+	if err := app.removeUploadSession(session); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error deleting upload")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload validates a completed session's file and saves it as a
+// document. A rejected file fails the session; the partial file is only
+// removed once the session has failed or completed.
+func (app *App) finishUpload(ctx context.Context, c *models.Case, session *models.UploadSession) (*models.Document, error) {
+	f, err := os.Open(app.sessionPath(session.ID))
+	if err != nil {
+		return nil, err
+	}
+	checksum, size, err := storage.Checksum(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	staged := &stagedFile{File: f, Size: size, Checksum: checksum}
+
+	doc, err := app.storeStagedFile(ctx, c, staged, session.FileName, func(doc *models.Document) error {
+		doc.UploadedBy = session.UserID
+		doc.Category = session.Category
+		doc.ChangeComment = session.ChangeComment
+
+		return models.WithTx(app.DB, func(tx *sql.Tx) error {
+			if err := doc.Create(tx); err != nil {
+				return err
+			}
+			return session.Complete(tx, doc.ID)
+		})
+	})
+	if err != nil {
+		// Only a rejected file fails the session. After a storage or database
+		// error the session and its content are kept, so the upload can be
+		// finished by an empty PATCH at the final offset.
+		var ue *uploadError
+		if errors.As(err, &ue) && ue.Status < http.StatusInternalServerError {
+			session.Fail(app.DB, ue.Message)
+			staged.Remove()
+		} else {
+			log.Printf("Error finishing upload session %s: %v", session.ID, err)
+			staged.Close()
+		}
+		return nil, err
+	}
+	staged.Remove()
+
+	app.documentAdded(doc, c)
+	return doc, nil
+}
+
+// authorizeUploadSession loads the session named by {uploadId}, checking that
+// it belongs to the case in the URL and was started by the caller
+func (app *App) authorizeUploadSession(w http.ResponseWriter, r *http.Request) (*models.Case, *models.UploadSession, bool) {
+	c, user, ok := app.authorizeCase(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	session, err := models.GetUploadSession(app.DB, mux.Vars(r)["uploadId"])
+	if err != nil || session.CaseID != c.ID || session.UserID != user.ID {
+		respondWithError(w, http.StatusNotFound, "Upload not found")
+		return nil, nil, false
+	}
+	if session.Status == models.UploadActive && time.Now().After(session.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Upload has expired")
+		return nil, nil, false
+	}
+
+	return c, session, true
+}
+
+// SweepUploadSessions deletes expired sessions and their partial files every
+// interval until ctx is cancelled
+func (app *App) SweepUploadSessions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sessions, err := models.GetExpiredUploadSessions(app.DB, time.Now())
+		if err != nil {
+			log.Printf("Error loading expired upload sessions: %v", err)
+		}
+		removed := 0
+		for _, expired := range sessions {
+			if app.removeExpiredUploadSession(expired) {
+				removed++
+			}
+		}
+		if removed > 0 {
+			log.Printf("Removed %d expired upload sessions", removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeExpiredUploadSession removes a session listed as expired, unless a
+// chunk extended, completed or failed it in the meantime
+func (app *App) removeExpiredUploadSession(expired models.UploadSession) bool {
+	unlock := lockSession(expired.ID)
+	defer unlock()
+
+	session, err := models.GetUploadSession(app.DB, expired.ID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading expired upload session %s: %v", expired.ID, err)
+		}
+		return false
+	}
+	if session.Status != expired.Status || !time.Now().After(session.ExpiresAt) {
+		return false
+	}
+
+	if err := app.removeUploadSession(session); err != nil {
+		log.Printf("Error removing expired upload session %s: %v", session.ID, err)
+		return false
+	}
+	return true
+}
+
+func (app *App) removeUploadSession(session *models.UploadSession) error {
+	if err := os.Remove(app.sessionPath(session.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return session.Delete(app.DB)
+}
+
+// checkCaseQuota rejects an upload of size bytes that would take the case
+// over its storage quota
+func (app *App) checkCaseQuota(caseID, size int64) error {
+	if app.Uploads.CaseQuota <= 0 {
+		return nil
+	}
+
+	used, err := models.CaseStorageUsage(app.DB, caseID)
+	if err != nil {
+		return err
+	}
+	if used+size > app.Uploads.CaseQuota {
+		return &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf(
+			"Case storage quota exceeded (%d of %d bytes used)", used, app.Uploads.CaseQuota)}
+	}
+	return nil
+}
+
+func (app *App) sessionPath(id string) string {
+	return filepath.Join(app.Uploads.SessionDir, id+".part")
+}
+
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma-separated
+// "key base64value" pairs
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, errors.New("invalid base64 value for " + key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
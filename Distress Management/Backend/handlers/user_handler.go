@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"distress-management/auth"
+	"distress-management/models"
+
+	"github.com/gorilla/mux"
+)
+
+const minPasswordLength = 8
+
+// ListUsers returns users, optionally filtered by role, department and active flag
+func (app *App) ListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.UserFilter{
+		Role:       auth.NormalizeRole(query.Get("role")),
+		Department: strings.TrimSpace(query.Get("department")),
+	}
+
+	if activeStr := query.Get("active"); activeStr != "" {
+		active, err := strconv.ParseBool(activeStr)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "active must be true or false")
+			return
+		}
+		filter.Active = &active
+	}
+
+	users, err := models.GetUsers(app.DB, filter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error retrieving users")
+		return
+	}
+
+	if users == nil {
+		users = []models.User{}
+	}
+
+	respondWithJSON(w, http.StatusOK, users)
+}
+
+// GetUser returns a single user by ID
+func (app *App) GetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// GetCurrentUser returns the authenticated user
+func (app *App) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// CreateUser creates a new user account
+func (app *App) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name       string `json:"name"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		Role       string `json:"role"`
+		Department string `json:"department"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	user := &models.User{
+		Name:       strings.TrimSpace(input.Name),
+		Email:      strings.TrimSpace(input.Email),
+		Password:   input.Password,
+		Role:       auth.NormalizeRole(input.Role),
+		Department: strings.TrimSpace(input.Department),
+	}
+
+	if user.Name == "" || user.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "Name and email are required")
+		return
+	}
+	if !auth.ValidRole(user.Role) {
+		respondWithError(w, http.StatusBadRequest, "Role must be one of: "+strings.Join(auth.Roles, ", "))
+		return
+	}
+	if len(input.Password) < minPasswordLength {
+		respondWithError(w, http.StatusBadRequest, "Password must be at least 8 characters")
+		return
+	}
+
+	if err := user.Create(app.DB); err != nil {
+		if err == models.ErrEmailExists {
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error creating user")
+		return
+	}
+
+	user.Password = ""
+	respondWithJSON(w, http.StatusCreated, user)
+}
+
+// UpdateUser updates a user's profile, role or active flag. Omitted fields are left unchanged.
+func (app *App) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name       *string `json:"name"`
+		Email      *string `json:"email"`
+		Role       *string `json:"role"`
+		Department *string `json:"department"`
+		Active     *bool   `json:"active"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if input.Name != nil {
+		user.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.Email != nil {
+		user.Email = strings.TrimSpace(*input.Email)
+	}
+	if input.Role != nil {
+		user.Role = auth.NormalizeRole(*input.Role)
+		if !auth.ValidRole(user.Role) {
+			respondWithError(w, http.StatusBadRequest, "Role must be one of: "+strings.Join(auth.Roles, ", "))
+			return
+		}
+	}
+	if input.Department != nil {
+		user.Department = strings.TrimSpace(*input.Department)
+	}
+	if input.Active != nil {
+		if !*input.Active && app.isCurrentUser(r, user) {
+			respondWithError(w, http.StatusBadRequest, "You cannot deactivate your own account")
+			return
+		}
+		user.Active = *input.Active
+	}
+
+	if user.Name == "" || user.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "Name and email are required")
+		return
+	}
+
+	if err := user.Update(app.DB); err != nil {
+		if err == models.ErrEmailExists {
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error updating user")
+		return
+	}
+
+	if !user.Active {
+		app.revokeSessions(user)
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// DeactivateUser disables a user account and ends its sessions. Users are
+// never hard-deleted because cases and notes reference them.
+func (app *App) DeactivateUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	if app.isCurrentUser(r, user) {
+		respondWithError(w, http.StatusBadRequest, "You cannot deactivate your own account")
+		return
+	}
+
+	user.Active = false
+	if err := user.Update(app.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error deactivating user")
+		return
+	}
+	app.revokeSessions(user)
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "User deactivated"})
+}
+
+// ChangePassword lets the current user change their own password
+func (app *App) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if len(input.NewPassword) < minPasswordLength {
+		respondWithError(w, http.StatusBadRequest, "New password must be at least 8 characters")
+		return
+	}
+
+	// GetUser never loads the hash, so look it up by email
+	withHash, err := models.GetUserByEmail(app.DB, user.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error changing password")
+		return
+	}
+
+	if err := withHash.ComparePassword(input.CurrentPassword); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Current password is incorrect")
+		return
+	}
+
+	if err := user.UpdatePassword(app.DB, input.NewPassword); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error changing password")
+		return
+	}
+
+	// Sign out every other session; the caller keeps its access token until it expires
+	app.revokeSessions(user)
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Password changed successfully"})
+}
+
+// loadUser loads the user named by the {id} route variable
+func (app *App) loadUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return nil, false
+	}
+
+	user, err := models.GetUser(app.DB, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "User not found")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Error retrieving user")
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (app *App) isCurrentUser(r *http.Request, u *models.User) bool {
+	current, ok := auth.UserFromContext(r.Context())
+	return ok && current.ID == u.ID
+}
+
+func (app *App) revokeSessions(u *models.User) {
+	if err := models.RevokeUserRefreshTokens(app.DB, u.ID); err != nil {
+		log.Printf("Error revoking sessions for user %d: %v", u.ID, err)
+	}
+}
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"distress-management/auth"
+	"distress-management/filetype"
 	"distress-management/handlers"
+	"distress-management/models"
+	"distress-management/scanner"
+	"distress-management/search"
+	"distress-management/storage"
+	"distress-management/thumbnail"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
@@ -23,18 +35,13 @@ func main() {
 	}
 
 	// Validate required environment variables
-	requiredEnvVars := []string{"DB_HOST", "DB_PORT", "DB_USER", "DB_NAME"}
+	requiredEnvVars := []string{"DB_HOST", "DB_PORT", "DB_USER", "DB_NAME", "JWT_SECRET"}
 	for _, envVar := range requiredEnvVars {
 		if os.Getenv(envVar) == "" {
 			log.Fatalf("Error: %s environment variable is required", envVar)
 		}
 	}
 
-	// Create uploads directory if it doesn't exist
-	if err := os.MkdirAll("./uploads", 0755); err != nil {
-		log.Fatal("Error creating uploads directory:", err)
-	}
-
 	// Initialize database with retry mechanism
 	var db *sql.DB
 	var err error
@@ -62,39 +69,228 @@ func main() {
 		log.Fatal("Error pinging database:", err)
 	}
 
+	// Initialize token manager
+	tokens, err := auth.NewTokenManager(os.Getenv("JWT_SECRET"),
+		durationFromEnv("ACCESS_TOKEN_TTL", auth.DefaultAccessTokenTTL),
+		durationFromEnv("REFRESH_TOKEN_TTL", auth.DefaultRefreshTokenTTL))
+	if err != nil {
+		log.Fatal("Error configuring authentication:", err)
+	}
+
+	// Initialize signed document links. They use their own secret if one is
+	// set, so it can be rotated to revoke every outstanding link at once.
+	linkSecret := os.Getenv("DOCUMENT_LINK_SECRET")
+	if linkSecret == "" {
+		linkSecret = os.Getenv("JWT_SECRET")
+	}
+	links, err := auth.NewLinkSigner(linkSecret,
+		durationFromEnv("DOCUMENT_LINK_TTL", auth.DefaultLinkTTL),
+		durationFromEnv("DOCUMENT_LINK_MAX_TTL", auth.DefaultMaxLinkTTL))
+	if err != nil {
+		log.Fatal("Error configuring document links:", err)
+	}
+
+	// Initialize case reference number generator
+	references, err := models.NewReferenceGenerator(os.Getenv("REFERENCE_PATTERN"),
+		os.Getenv("REFERENCE_RESET") != "never")
+	if err != nil {
+		log.Fatal("Error configuring reference numbers:", err)
+	}
+
+	// Initialize document storage
+	store, err := storage.FromEnv()
+	if err != nil {
+		log.Fatal("Error configuring document storage:", err)
+	}
+	if encrypted, ok := store.(*storage.Encrypted); ok {
+		log.Printf("Encrypting stored documents with master key %q", encrypted.Keys().Primary())
+		log.Printf("Note: uploads are staged unencrypted in UPLOAD_TMP_DIR and UPLOAD_SESSION_DIR; keep those on an encrypted or private disk")
+	} else {
+		log.Printf("Warning: no storage encryption keys are set. Documents are stored unencrypted.")
+	}
+
+	// Initialize the list of document types accepted for upload
+	allowedTypes := os.Getenv("ALLOWED_FILE_TYPES")
+	if allowedTypes == "" {
+		allowedTypes = filetype.DefaultAllowed
+	}
+	fileTypes, err := filetype.ParseAllowlist(allowedTypes)
+	if err != nil {
+		log.Fatal("Error configuring allowed file types:", err)
+	}
+
+	// Initialize the virus scanner. Without one, uploads stay pending and
+	// cannot be downloaded unless scanning is explicitly turned off.
+	var virusScanner scanner.Scanner
+	if addr := os.Getenv("CLAMD_ADDRESS"); addr != "" {
+		clamd, err := scanner.NewClamd(addr, durationFromEnv("CLAMD_TIMEOUT", 2*time.Minute))
+		if err != nil {
+			log.Fatal("Error configuring virus scanner:", err)
+		}
+		if err := clamd.Ping(context.Background()); err != nil {
+			log.Printf("Warning: clamd at %s is not responding (%v); uploads stay pending until it is", addr, err)
+		}
+		virusScanner = clamd
+	} else if os.Getenv("VIRUS_SCANNING") == "disabled" {
+		log.Printf("Warning: VIRUS_SCANNING is disabled. Uploaded documents will NOT be scanned for viruses.")
+		virusScanner = scanner.Noop{}
+	} else {
+		log.Printf("Warning: CLAMD_ADDRESS is not set. Uploaded documents stay pending and cannot be downloaded " +
+			"until a scanner is configured; set VIRUS_SCANNING=disabled to skip scanning.")
+	}
+
+	// Initialize resumable uploads. Larger files cannot be scanned unless
+	// clamd's StreamMaxLength is raised along with the limit.
+	uploads := handlers.UploadSettings{
+		SessionDir: os.Getenv("UPLOAD_SESSION_DIR"),
+		MaxSize:    sizeFromEnv("RESUMABLE_UPLOAD_MAX_SIZE", scanner.ClamdStreamMaxLength),
+		SessionTTL: durationFromEnv("UPLOAD_SESSION_TTL", 24*time.Hour),
+		CaseQuota:  sizeFromEnv("CASE_STORAGE_QUOTA", 0),
+	}
+	if uploads.SessionDir == "" {
+		uploads.SessionDir = filepath.Join(os.TempDir(), "distress-uploads")
+	}
+	if err := os.MkdirAll(uploads.SessionDir, 0700); err != nil {
+		log.Fatal("Error creating upload session directory:", err)
+	}
+
+	// Initialize thumbnail sizes
+	thumbnailSpec := os.Getenv("THUMBNAIL_SIZES")
+	if thumbnailSpec == "" {
+		thumbnailSpec = thumbnail.DefaultSizes
+	}
+	thumbnailSizes, err := thumbnail.ParseSizes(thumbnailSpec)
+	if err != nil {
+		log.Fatal("Error parsing THUMBNAIL_SIZES:", err)
+	}
+
 	// Initialize router and handlers
 	router := mux.NewRouter()
 	app := &handlers.App{
-		DB: db,
+		DB:          db,
+		Tokens:      tokens,
+		SearchIndex: search.NewIndex(),
+		References:  references,
+		Storage:     store,
+		FileTypes:   fileTypes,
+		Scanner:     virusScanner,
+		Uploads:     uploads,
+
+		ScanMaxAttempts: intFromEnv("SCAN_MAX_ATTEMPTS", handlers.DefaultScanMaxAttempts),
+
+		ThumbnailSizes: thumbnailSizes,
+		NoteEditWindow: durationFromEnv("NOTE_EDIT_WINDOW", 24*time.Hour),
+		Links:          links,
+		PublicURL:      strings.TrimRight(os.Getenv("PUBLIC_URL"), "/"),
+	}
+
+	// Load cases, notes and documents into the search index
+	if err := app.RebuildSearchIndex(); err != nil {
+		log.Fatal("Error building search index:", err)
 	}
+	log.Printf("Search index built with %d entries", app.SearchIndex.Len())
 
-	// API routes
+	// Retry virus scans that did not complete
+	if virusScanner != nil {
+		go app.RescanPendingDocuments(context.Background(), durationFromEnv("SCAN_RETRY_INTERVAL", 5*time.Minute))
+	}
+
+	// Generate thumbnails that did not complete
+	go app.GeneratePendingThumbnails(context.Background(), durationFromEnv("THUMBNAIL_RETRY_INTERVAL", 5*time.Minute))
+
+	// Extract document text that was not extracted yet
+	go app.ExtractPendingDocumentTexts(context.Background(), durationFromEnv("TEXT_RETRY_INTERVAL", 5*time.Minute))
+
+	// Remove abandoned resumable uploads
+	go app.SweepUploadSessions(context.Background(), durationFromEnv("UPLOAD_SWEEP_INTERVAL", 15*time.Minute))
+
+	// API routes. Everything under /api requires a bearer token except the
+	// explicitly allow-listed paths below.
 	apiRouter := router.PathPrefix("/api").Subrouter()
+	authenticator := auth.NewAuthenticator(db, tokens,
+		"/api/health",
+		"/api/auth/login",
+		"/api/auth/refresh",   // the access token has usually expired by the time this is called
+		"/api/links/download", // signed document links carry their own token
+	)
+	apiRouter.Use(authenticator.Middleware)
+
+	apiRouter.HandleFunc("/health", app.Health).Methods("GET")
+
+	// Auth routes
+	apiRouter.HandleFunc("/auth/login", app.Login).Methods("POST")
+	apiRouter.HandleFunc("/auth/refresh", app.RefreshToken).Methods("POST")
+	apiRouter.HandleFunc("/auth/logout", app.Logout).Methods("POST")
 
 	// Cases routes
-	apiRouter.HandleFunc("/cases", app.GetCases).Methods("GET")
-	apiRouter.HandleFunc("/cases", app.CreateCase).Methods("POST")
-	apiRouter.HandleFunc("/cases/{id}", app.GetCase).Methods("GET")
-	apiRouter.HandleFunc("/cases/{id}", app.UpdateCase).Methods("PUT")
-	apiRouter.HandleFunc("/cases/{id}/status", app.UpdateCaseStatus).Methods("PATCH")
+	apiRouter.HandleFunc("/cases", auth.Require(auth.PermViewCases, app.GetCases)).Methods("GET")
+	apiRouter.HandleFunc("/cases", auth.Require(auth.PermCreateCase, app.CreateCase)).Methods("POST")
+	apiRouter.HandleFunc("/cases/{id}", auth.Require(auth.PermViewCases, app.GetCase)).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}", auth.Require(auth.PermUpdateCase, app.UpdateCase)).Methods("PUT")
+	apiRouter.HandleFunc("/cases/{id}/status", auth.Require(auth.PermUpdateCaseStatus, app.UpdateCaseStatus)).Methods("PATCH")
+	apiRouter.HandleFunc("/cases/{id}/assign", auth.Require(auth.PermAssignCase, app.AssignCase)).Methods("POST")
+	apiRouter.HandleFunc("/cases/{id}/assignment/accept", auth.Require(auth.PermUpdateCaseStatus, app.AcceptAssignment)).Methods("POST")
+	apiRouter.HandleFunc("/cases/{id}/assignments", auth.Require(auth.PermViewCases, app.GetCaseAssignments)).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}/timeline", auth.Require(auth.PermViewCases, app.GetCaseTimeline)).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}/transitions", auth.Require(auth.PermViewCases, app.GetCaseTransitions)).Methods("GET")
 
 	// Documents routes
-	apiRouter.HandleFunc("/cases/{id}/documents", app.UploadDocument).Methods("POST")
-	apiRouter.HandleFunc("/cases/{id}/documents", app.GetDocuments).Methods("GET")
-	apiRouter.HandleFunc("/cases/{id}/documents/{docId}", app.DeleteDocument).Methods("DELETE")
+	apiRouter.HandleFunc("/cases/{id}/documents/checklist", auth.Require(auth.PermViewCases, app.GetDocumentChecklist)).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}/documents/archive", auth.Require(auth.PermViewCases, app.GetDocumentArchive)).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}/documents", auth.Require(auth.PermUploadDocument, app.UploadDocument)).Methods("POST")
+	apiRouter.HandleFunc("/cases/{id}/documents", auth.Require(auth.PermViewCases, app.GetDocuments)).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}/documents/{docId}", auth.Require(auth.PermDeleteDocument, app.DeleteDocument)).Methods("DELETE")
+	apiRouter.HandleFunc("/cases/{id}/documents/{docId}/content", auth.Require(auth.PermViewCases, app.DownloadDocument)).Methods("GET", "HEAD")
+	apiRouter.HandleFunc("/cases/{id}/documents/{docId}/thumbnail", auth.Require(auth.PermViewCases, app.GetDocumentThumbnail)).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}/documents/{docId}/versions", auth.Require(auth.PermUploadDocument, app.AddDocumentVersion)).Methods("POST")
+	apiRouter.HandleFunc("/cases/{id}/documents/{docId}/versions", auth.Require(auth.PermViewCases, app.GetDocumentVersions)).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}/documents/{docId}/links", auth.Require(auth.PermViewCases, app.CreateDocumentLink)).Methods("POST")
+	apiRouter.HandleFunc("/cases/{id}/documents/{docId}/links", auth.Require(auth.PermViewCases, app.GetDocumentLinks)).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}/documents/{docId}/links/{linkId}", auth.Require(auth.PermViewCases, app.GetDocumentLink)).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}/documents/{docId}/links/{linkId}", auth.Require(auth.PermViewCases, app.RevokeDocumentLink)).Methods("DELETE")
+
+	// Signed document links (public, see the authenticator allow-list)
+	apiRouter.HandleFunc("/links/download", app.DownloadLinkedDocument).Methods("GET", "HEAD")
+
+	// Resumable upload routes (tus protocol)
+	apiRouter.HandleFunc("/cases/{id}/uploads", auth.Require(auth.PermUploadDocument, app.CreateUpload)).Methods("POST")
+	apiRouter.HandleFunc("/cases/{id}/uploads/{uploadId}", auth.Require(auth.PermUploadDocument, app.GetUpload)).Methods("GET", "HEAD")
+	apiRouter.HandleFunc("/cases/{id}/uploads/{uploadId}", auth.Require(auth.PermUploadDocument, app.PatchUpload)).Methods("PATCH")
+	apiRouter.HandleFunc("/cases/{id}/uploads/{uploadId}", auth.Require(auth.PermUploadDocument, app.DeleteUpload)).Methods("DELETE")
 
 	// Progress notes routes
-	apiRouter.HandleFunc("/cases/{id}/notes", app.AddProgressNote).Methods("POST")
-	apiRouter.HandleFunc("/cases/{id}/notes", app.GetProgressNotes).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}/notes", auth.Require(auth.PermAddNote, app.AddProgressNote)).Methods("POST")
+	apiRouter.HandleFunc("/cases/{id}/notes", auth.Require(auth.PermViewCases, app.GetProgressNotes)).Methods("GET")
+	apiRouter.HandleFunc("/cases/{id}/notes/{noteId}", auth.Require(auth.PermAddNote, app.UpdateProgressNote)).Methods("PUT")
+	apiRouter.HandleFunc("/cases/{id}/notes/{noteId}", auth.Require(auth.PermAddNote, app.DeleteProgressNote)).Methods("DELETE")
+	apiRouter.HandleFunc("/cases/{id}/notes/{noteId}/revisions", auth.Require(auth.PermViewCases, app.GetProgressNoteRevisions)).Methods("GET")
+
+	// Search routes
+	apiRouter.HandleFunc("/search", auth.Require(auth.PermViewCases, app.Search)).Methods("GET")
+
+	// Document category routes
+	apiRouter.HandleFunc("/document-categories", auth.Require(auth.PermViewCases, app.GetDocumentCategories)).Methods("GET")
+	apiRouter.HandleFunc("/document-requirements", auth.Require(auth.PermViewCases, app.GetDocumentRequirements)).Methods("GET")
+	apiRouter.HandleFunc("/document-requirements", auth.Require(auth.PermManageDocumentRequirements, app.SetDocumentRequirements)).Methods("PUT")
+
+	// Users routes. /users/me must be registered before /users/{id}.
+	apiRouter.HandleFunc("/users/me", app.GetCurrentUser).Methods("GET")
+	apiRouter.HandleFunc("/users/me/password", app.ChangePassword).Methods("PUT")
+	apiRouter.HandleFunc("/users", auth.Require(auth.PermViewUsers, app.ListUsers)).Methods("GET")
+	apiRouter.HandleFunc("/users", auth.Require(auth.PermManageUsers, app.CreateUser)).Methods("POST")
+	apiRouter.HandleFunc("/users/{id:[0-9]+}", auth.Require(auth.PermViewUsers, app.GetUser)).Methods("GET")
+	apiRouter.HandleFunc("/users/{id:[0-9]+}", auth.Require(auth.PermManageUsers, app.UpdateUser)).Methods("PUT")
+	apiRouter.HandleFunc("/users/{id:[0-9]+}", auth.Require(auth.PermManageUsers, app.DeactivateUser)).Methods("DELETE")
 
 	// Dashboard routes
-	apiRouter.HandleFunc("/dashboard/stats", app.GetDashboardStats).Methods("GET")
+	apiRouter.HandleFunc("/dashboard/stats", auth.Require(auth.PermViewDashboard, app.GetDashboardStats)).Methods("GET")
 
 	// CORS configuration
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3000"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowedHeaders:   []string{"Content-Type"},
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"},
+		ExposedHeaders:   []string{"X-Total-Count", "X-Page", "X-Per-Page", "X-Total-Pages", "Link", "Location", "Tus-Resumable", "Upload-Offset", "Upload-Length", "Upload-Expires", "Upload-Document-Id"},
 		AllowCredentials: true,
 		Debug:           true,
 	})
@@ -115,10 +311,74 @@ func main() {
 	}
 }
 
-// Middleware to log requests
+// Middleware to log requests. Signed document link tokens are credentials,
+// so they are redacted from the logged URL.
 func logRequestFunc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s", r.Method, r.RequestURI)
+		log.Printf("%s %s", r.Method, redactedURI(r.URL))
 		next.ServeHTTP(w, r)
 	})
 }
+
+// redactedURI returns the path and query of u with any token parameter
+// replaced
+func redactedURI(u *url.URL) string {
+	query := u.Query()
+	if query.Has("token") {
+		query.Set("token", "REDACTED")
+		return u.EscapedPath() + "?" + query.Encode()
+	}
+	return u.RequestURI()
+}
+
+// durationFromEnv parses a duration such as "15m" from the environment
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Error: %s must be a duration such as 15m or 24h: %v", name, err)
+	}
+	return d
+}
+
+// intFromEnv parses a positive whole number from the environment
+func intFromEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Fatalf("Error: %s must be a positive whole number", name)
+	}
+	return n
+}
+
+// sizeFromEnv parses a byte size such as "500MB" or "2GB" from the environment
+func sizeFromEnv(name string, fallback int64) int64 {
+	value := strings.ToUpper(strings.TrimSpace(os.Getenv(name)))
+	if value == "" {
+		return fallback
+	}
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		log.Fatalf("Error: %s must be a size such as 500MB or 2GB", name)
+	}
+	return n * multiplier
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Assignment statuses
+const (
+	AssignmentPending    = "pending"
+	AssignmentAccepted   = "accepted"
+	AssignmentSuperseded = "superseded"
+)
+
+// CaseAssignment records an officer being put in charge of a case. Earlier
+// assignments are kept as superseded so the case keeps a history of assignees.
+type CaseAssignment struct {
+	ID           int64     `json:"id"`
+	CaseID       int64     `json:"case_id"`
+	OfficerID    int64     `json:"officer_id"`
+	OfficerName  string    `json:"officer_name"`
+	AssignedBy   int64     `json:"assigned_by"`
+	DueDate      NullTime  `json:"due_date"`
+	Instructions string    `json:"instructions"`
+	Status       string    `json:"status"`
+	AssignedAt   time.Time `json:"assigned_at"`
+	AcceptedAt   NullTime  `json:"accepted_at"`
+	EndedAt      NullTime  `json:"ended_at"`
+}
+
+// Create stores a new pending assignment
+func (a *CaseAssignment) Create(db DBTX) error {
+	a.Status = AssignmentPending
+	a.AssignedAt = time.Now()
+
+	query := `INSERT INTO case_assignments
+		(case_id, officer_id, assigned_by, due_date, instructions, status, assigned_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := db.Exec(query, a.CaseID, a.OfficerID, a.AssignedBy, a.DueDate,
+		a.Instructions, a.Status, a.AssignedAt)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	a.ID = id
+	return nil
+}
+
+// Accept marks the assignment as accepted by the officer
+func (a *CaseAssignment) Accept(db DBTX) error {
+	now := time.Now()
+	_, err := db.Exec(`UPDATE case_assignments SET status = ?, accepted_at = ? WHERE id = ?`,
+		AssignmentAccepted, now, a.ID)
+	if err != nil {
+		return err
+	}
+
+	a.Status = AssignmentAccepted
+	a.AcceptedAt = NullTime{sql.NullTime{Time: now, Valid: true}}
+	return nil
+}
+
+// SupersedeAssignments ends every open assignment of a case
+func SupersedeAssignments(db DBTX, caseID int64) error {
+	_, err := db.Exec(`UPDATE case_assignments SET status = ?, ended_at = NOW()
+		WHERE case_id = ? AND status <> ?`,
+		AssignmentSuperseded, caseID, AssignmentSuperseded)
+	return err
+}
+
+// GetCurrentAssignment returns the open assignment of a case
+func GetCurrentAssignment(db *sql.DB, caseID int64) (*CaseAssignment, error) {
+	assignments, err := queryAssignments(db, `WHERE a.case_id = ? AND a.status <> ?
+		ORDER BY a.assigned_at DESC, a.id DESC LIMIT 1`, caseID, AssignmentSuperseded)
+	if err != nil {
+		return nil, err
+	}
+	if len(assignments) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &assignments[0], nil
+}
+
+// GetCaseAssignments returns every assignment of a case, newest first
+func GetCaseAssignments(db *sql.DB, caseID int64) ([]CaseAssignment, error) {
+	return queryAssignments(db, `WHERE a.case_id = ? ORDER BY a.assigned_at DESC, a.id DESC`, caseID)
+}
+
+func queryAssignments(db *sql.DB, where string, args ...interface{}) ([]CaseAssignment, error) {
+	query := `
+		SELECT a.id, a.case_id, a.officer_id, COALESCE(u.name, ''), a.assigned_by,
+			a.due_date, COALESCE(a.instructions, ''), a.status, a.assigned_at,
+			a.accepted_at, a.ended_at
+		FROM case_assignments a
+		LEFT JOIN users u ON u.id = a.officer_id
+		` + where
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var assignments []CaseAssignment
+	for rows.Next() {
+		var a CaseAssignment
+		err := rows.Scan(&a.ID, &a.CaseID, &a.OfficerID, &a.OfficerName, &a.AssignedBy,
+			&a.DueDate, &a.Instructions, &a.Status, &a.AssignedAt, &a.AcceptedAt, &a.EndedAt)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, a)
+	}
+
+	return assignments, rows.Err()
+}
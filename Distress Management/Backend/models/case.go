@@ -2,9 +2,13 @@ package models
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 )
 
+// ErrCaseStateChanged is returned when a case moved on between being read and updated
+var ErrCaseStateChanged = errors.New("case was modified by another request")
+
 type Case struct {
 	ID                   int64     `json:"id"`
 	ReferenceNumber      string    `json:"reference_number"`
@@ -58,7 +62,13 @@ func (c *Case) Create(db *sql.DB) error {
 
 func GetCase(db *sql.DB, id int64) (*Case, error) {
 	c := &Case{}
-	query := `SELECT * FROM cases WHERE id = ?`
+	var assignedOfficerID sql.NullInt64
+	query := `SELECT 
+			id, reference_number, sender_name, receiving_date, subject,
+			country_of_origin, distressed_person_name, nature_of_case,
+			case_details, status, assigned_officer_id, stage,
+			created_at, updated_at
+		FROM cases WHERE id = ?`
 	err := db.QueryRow(query, id).Scan(
 		&c.ID,
 		&c.ReferenceNumber,
@@ -70,7 +80,7 @@ func GetCase(db *sql.DB, id int64) (*Case, error) {
 		&c.NatureOfCase,
 		&c.CaseDetails,
 		&c.Status,
-		&c.AssignedOfficerID,
+		&assignedOfficerID,
 		&c.Stage,
 		&c.CreatedAt,
 		&c.UpdatedAt,
@@ -78,6 +88,7 @@ func GetCase(db *sql.DB, id int64) (*Case, error) {
 	if err != nil {
 		return nil, err
 	}
+	c.AssignedOfficerID = assignedOfficerID.Int64
 	return c, nil
 }
 
@@ -103,6 +114,7 @@ func GetCases(db *sql.DB, page, limit int) ([]Case, error) {
 	var cases []Case
 	for rows.Next() {
 		var c Case
+		var assignedOfficerID sql.NullInt64
 		err := rows.Scan(
 			&c.ID,
 			&c.ReferenceNumber,
@@ -114,7 +126,7 @@ func GetCases(db *sql.DB, page, limit int) ([]Case, error) {
 			&c.NatureOfCase,
 			&c.CaseDetails,
 			&c.Status,
-			&c.AssignedOfficerID,
+			&assignedOfficerID,
 			&c.Stage,
 			&c.CreatedAt,
 			&c.UpdatedAt,
@@ -122,6 +134,7 @@ func GetCases(db *sql.DB, page, limit int) ([]Case, error) {
 		if err != nil {
 			return nil, err
 		}
+		c.AssignedOfficerID = assignedOfficerID.Int64
 
 		// Convert timestamps to Kenyan time
 		kenyaLocation, _ := time.LoadLocation("Africa/Nairobi")
@@ -161,9 +174,50 @@ func (c *Case) Update(db *sql.DB) error {
 		c.NatureOfCase,
 		c.CaseDetails,
 		c.Status,
-		c.AssignedOfficerID,
+		NullableID(c.AssignedOfficerID),
 		c.Stage,
 		c.ID,
 	)
 	return err
 }
+
+// MoveTo changes the stage and status of the case, but only if it is still in
+// the stage and status it was loaded with. Run it inside a transaction so the
+// row stays locked until the surrounding changes are committed. c is left as
+// it was, so a retried transaction checks against the loaded state again;
+// update c once the transaction has committed.
+func (c *Case) MoveTo(db DBTX, stage, status string) error {
+	var currentStage, currentStatus string
+	err := db.QueryRow(`SELECT stage, status FROM cases WHERE id = ? FOR UPDATE`, c.ID).
+		Scan(&currentStage, &currentStatus)
+	if err != nil {
+		return err
+	}
+	if currentStage != c.Stage || currentStatus != c.Status {
+		return ErrCaseStateChanged
+	}
+
+	_, err = db.Exec(`UPDATE cases SET stage = ?, status = ?, updated_at = NOW() WHERE id = ?`,
+		stage, status, c.ID)
+	return err
+}
+
+// SetAssignedOfficer changes the officer responsible for the case
+func (c *Case) SetAssignedOfficer(db DBTX, officerID int64) error {
+	_, err := db.Exec(`UPDATE cases SET assigned_officer_id = ?, updated_at = NOW() WHERE id = ?`,
+		NullableID(officerID), c.ID)
+	if err != nil {
+		return err
+	}
+
+	c.AssignedOfficerID = officerID
+	return nil
+}
+
+// NullableID converts an unset (zero) foreign key into SQL NULL
+func NullableID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
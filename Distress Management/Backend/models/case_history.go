@@ -0,0 +1,103 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Fields recorded in case history besides the editable case columns
+const (
+	HistoryFieldCreated = "created"
+	HistoryFieldStage   = "stage"
+	HistoryFieldStatus  = "status"
+
+	HistoryFieldAssignedOfficer = "assigned_officer_id"
+)
+
+// CaseHistory records a single change to a case
+type CaseHistory struct {
+	ID        int64     `json:"id"`
+	CaseID    int64     `json:"case_id"`
+	UserID    int64     `json:"user_id"`
+	Field     string    `json:"field"`
+	OldValue  string    `json:"old_value"`
+	NewValue  string    `json:"new_value"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Create stores the history entry
+func (h *CaseHistory) Create(db DBTX) error {
+	query := `INSERT INTO case_history (case_id, user_id, field, old_value, new_value, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, NOW())`
+
+	result, err := db.Exec(query, h.CaseID, NullableID(h.UserID), h.Field, h.OldValue, h.NewValue, h.Reason)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	h.ID = id
+	return nil
+}
+
+// FieldChange is a before/after pair for one case field
+type FieldChange struct {
+	Field    string
+	OldValue string
+	NewValue string
+}
+
+// RecordCaseChanges stores one history entry per changed field. Changes whose
+// old and new values are equal are skipped.
+func RecordCaseChanges(db DBTX, caseID, userID int64, reason string, changes []FieldChange) error {
+	for _, change := range changes {
+		if change.OldValue == change.NewValue {
+			continue
+		}
+		h := &CaseHistory{
+			CaseID:   caseID,
+			UserID:   userID,
+			Field:    change.Field,
+			OldValue: change.OldValue,
+			NewValue: change.NewValue,
+			Reason:   reason,
+		}
+		if err := h.Create(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetCaseHistory retrieves every recorded change to a case, oldest first
+func GetCaseHistory(db *sql.DB, caseID int64) ([]CaseHistory, error) {
+	query := `
+		SELECT id, case_id, COALESCE(user_id, 0), field, COALESCE(old_value, ''),
+			COALESCE(new_value, ''), COALESCE(reason, ''), created_at
+		FROM case_history
+		WHERE case_id = ?
+		ORDER BY created_at ASC, id ASC
+	`
+	rows, err := db.Query(query, caseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []CaseHistory
+	for rows.Next() {
+		var h CaseHistory
+		err := rows.Scan(&h.ID, &h.CaseID, &h.UserID, &h.Field, &h.OldValue, &h.NewValue, &h.Reason, &h.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+
+	return history, rows.Err()
+}
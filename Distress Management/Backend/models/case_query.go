@@ -0,0 +1,188 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// CaseSortColumns maps the sort keys accepted by SearchCases to indexed columns
+var CaseSortColumns = map[string]string{
+	"id":                "id",
+	"reference_number":  "reference_number",
+	"receiving_date":    "receiving_date",
+	"status":            "status",
+	"stage":             "stage",
+	"nature_of_case":    "nature_of_case",
+	"country_of_origin": "country_of_origin",
+	"created_at":        "created_at",
+	"updated_at":        "updated_at",
+}
+
+// caseSearchColumns are matched by CaseQuery.Search
+var caseSearchColumns = []string{
+	"reference_number", "subject", "sender_name", "distressed_person_name", "case_details",
+}
+
+// CaseQuery filters, sorts and pages the case list. Empty fields match everything.
+type CaseQuery struct {
+	Statuses          []string
+	Stages            []string
+	Natures           []string
+	Countries         []string
+	AssignedOfficerID int64
+	ReceivedFrom      time.Time
+	ReceivedTo        time.Time
+	Search            string
+	Sort              string
+	Desc              bool
+	Page              int
+	Limit             int
+}
+
+func (q CaseQuery) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	in := func(column string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		conditions = append(conditions, column+" IN (?"+strings.Repeat(", ?", len(values)-1)+")")
+		for _, v := range values {
+			args = append(args, v)
+		}
+	}
+	in("status", q.Statuses)
+	in("stage", q.Stages)
+	in("nature_of_case", q.Natures)
+	in("country_of_origin", q.Countries)
+
+	if q.AssignedOfficerID != 0 {
+		conditions = append(conditions, "assigned_officer_id = ?")
+		args = append(args, q.AssignedOfficerID)
+	}
+	if !q.ReceivedFrom.IsZero() {
+		conditions = append(conditions, "receiving_date >= ?")
+		args = append(args, q.ReceivedFrom)
+	}
+	if !q.ReceivedTo.IsZero() {
+		conditions = append(conditions, "receiving_date < ?")
+		args = append(args, q.ReceivedTo)
+	}
+
+	if search := strings.TrimSpace(q.Search); search != "" {
+		pattern := "%" + escapeLike(search) + "%"
+		var matches []string
+		for _, column := range caseSearchColumns {
+			matches = append(matches, column+" LIKE ?")
+			args = append(args, pattern)
+		}
+		conditions = append(conditions, "("+strings.Join(matches, " OR ")+")")
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// SearchCases returns one page of cases matching the query together with the
+// total number of matching cases
+func SearchCases(db *sql.DB, q CaseQuery) ([]Case, int, error) {
+	where, args := q.where()
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM cases `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	column, ok := CaseSortColumns[q.Sort]
+	if !ok {
+		column = "created_at"
+	}
+	direction := "ASC"
+	if q.Desc {
+		direction = "DESC"
+	}
+
+	query := `
+		SELECT 
+			id, reference_number, sender_name, receiving_date, subject,
+			country_of_origin, distressed_person_name, nature_of_case,
+			case_details, status, assigned_officer_id, stage,
+			created_at, updated_at
+		FROM cases ` + where + `
+		ORDER BY ` + column + ` ` + direction + `, id ` + direction + `
+		LIMIT ? OFFSET ?`
+	args = append(args, q.Limit, (q.Page-1)*q.Limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	cases := []Case{}
+	for rows.Next() {
+		var c Case
+		var assignedOfficerID sql.NullInt64
+		err := rows.Scan(
+			&c.ID,
+			&c.ReferenceNumber,
+			&c.SenderName,
+			&c.ReceivingDate,
+			&c.Subject,
+			&c.CountryOfOrigin,
+			&c.DistressedPersonName,
+			&c.NatureOfCase,
+			&c.CaseDetails,
+			&c.Status,
+			&assignedOfficerID,
+			&c.Stage,
+			&c.CreatedAt,
+			&c.UpdatedAt,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+		c.AssignedOfficerID = assignedOfficerID.Int64
+		cases = append(cases, c)
+	}
+
+	return cases, total, rows.Err()
+}
+
+// GetAllCases returns every case, for rebuilding derived data such as the search index
+func GetAllCases(db *sql.DB) ([]Case, error) {
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM cases`).Scan(&total); err != nil {
+		return nil, err
+	}
+	cases, _, err := SearchCases(db, CaseQuery{Sort: "id", Page: 1, Limit: max(total, 1)})
+	return cases, err
+}
+
+// GetAssignedCaseIDs returns the IDs of the cases assigned to an officer
+func GetAssignedCaseIDs(db *sql.DB, officerID int64) ([]int64, error) {
+	rows, err := db.Query(`SELECT id FROM cases WHERE assigned_officer_id = ?`, officerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// escapeLike escapes the LIKE wildcards in user input
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
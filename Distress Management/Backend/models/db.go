@@ -0,0 +1,56 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// maxTxAttempts bounds how often WithTx retries after a deadlock
+const maxTxAttempts = 3
+
+// DBTX is satisfied by both *sql.DB and *sql.Tx, so model functions that take
+// it can run inside or outside a transaction
+type DBTX interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// WithTx runs fn inside a transaction, committing if it returns nil and
+// rolling back otherwise. If MySQL aborts the transaction because of a
+// deadlock or lock wait timeout, fn is run again in a fresh transaction.
+func WithTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	var err error
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		err = runTx(db, fn)
+		if !isRetryableTxError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func runTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// isRetryableTxError reports MySQL deadlock (1213) and lock wait timeout (1205) errors
+func isRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	}
+	return false
+}
@@ -2,24 +2,133 @@ package models
 
 import (
 	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
 	"time"
+
+	"distress-management/filetype"
+)
+
+// Virus scan states of a document. Only clean documents may be downloaded.
+// Documents the scanner kept rejecting with an error are failed.
+const (
+	ScanPending  = "pending"
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanFailed   = "failed"
+)
+
+// Thumbnail states of a document. Documents that are not images or PDFs, PDFs
+// without an image on their first page, and documents whose scan found
+// malware have none.
+const (
+	ThumbnailPending = "pending"
+	ThumbnailReady   = "ready"
+	ThumbnailNone    = "none"
+	ThumbnailFailed  = "failed"
+)
+
+// Text extraction states of a document. Types text cannot be extracted from
+// have none.
+const (
+	TextPending   = "pending"
+	TextExtracted = "extracted"
+	TextFailed    = "failed"
+	TextNone      = "none"
 )
 
+// ErrDocumentVersionConflict is returned when a document's latest version
+// changed while a new version was being added
+var ErrDocumentVersionConflict = errors.New("document version changed concurrently")
+
+// Document is one version of an uploaded file. Versions of the same document
+// share a RootID (the ID of version 1) and only the newest has IsLatest set.
 type Document struct {
 	ID         int64     `json:"id"`
+	RootID     int64     `json:"root_id"`
+	Version    int       `json:"version"`
+	IsLatest   bool      `json:"is_latest"`
 	CaseID     int64     `json:"case_id"`
 	FileName   string    `json:"file_name"`
-	FilePath   string    `json:"file_path"`
+	Category   string    `json:"category"`
+	StorageKey string    `json:"-"`
 	FileType   string    `json:"file_type"`
 	FileSize   int64     `json:"file_size"`
+	UploadedBy int64     `json:"uploaded_by"`
 	UploadedAt time.Time `json:"uploaded_at"`
+	ScanStatus string    `json:"scan_status"`
+	// ScanSignature names the malware found in an infected document
+	ScanSignature string   `json:"scan_signature,omitempty"`
+	ScannedAt     NullTime `json:"scanned_at"`
+	// ScanAttempts counts scans the scanner rejected with an error, and
+	// ScanError is the last such error
+	ScanAttempts int    `json:"scan_attempts"`
+	ScanError    string `json:"scan_error,omitempty"`
+	// Checksum is the hex SHA-256 of the content. New uploads are stored
+	// under a key derived from it, so identical files share storage.
+	Checksum      string `json:"checksum"`
+	ChangeComment string `json:"change_comment,omitempty"`
+	// ThumbnailStatus tells whether a thumbnail can be fetched. Until one is
+	// ready, Placeholder describes the generic icon to show instead.
+	ThumbnailStatus string               `json:"thumbnail_status"`
+	Placeholder     *DocumentPlaceholder `json:"placeholder,omitempty"`
+	// TextStatus tells whether the document's text was extracted for
+	// search. TextError says why extraction failed.
+	TextStatus      string   `json:"text_status"`
+	TextError       string   `json:"text_error,omitempty"`
+	TextExtractedAt NullTime `json:"text_extracted_at"`
+}
+
+// DocumentPlaceholder describes a document that has no thumbnail
+type DocumentPlaceholder struct {
+	// Kind is pdf, document, spreadsheet, image, video or file
+	Kind string `json:"kind"`
+	// Label is a short type label such as "PDF"
+	Label string `json:"label"`
+}
+
+// setPlaceholder fills in Placeholder unless a thumbnail is ready
+func (d *Document) setPlaceholder() {
+	if d.ThumbnailStatus == ThumbnailReady {
+		d.Placeholder = nil
+		return
+	}
+
+	if t, ok := filetype.Lookup(d.FileType); ok {
+		d.Placeholder = &DocumentPlaceholder{Kind: t.Kind, Label: strings.ToUpper(t.Name)}
+		return
+	}
+	d.Placeholder = &DocumentPlaceholder{Kind: "file", Label: strings.ToUpper(strings.TrimPrefix(filepath.Ext(d.FileName), "."))}
 }
 
-func (d *Document) Create(db *sql.DB) error {
-	query := `INSERT INTO documents (case_id, file_name, file_path, file_type, file_size) 
-             VALUES (?, ?, ?, ?, ?)`
-	
-	result, err := db.Exec(query, d.CaseID, d.FileName, d.FilePath, d.FileType, d.FileSize)
+// Create stores a new document. Unless RootID is set, the document starts a
+// new version chain at version 1.
+func (d *Document) Create(db DBTX) error {
+	if d.ScanStatus == "" {
+		d.ScanStatus = ScanPending
+	}
+	if d.Version == 0 {
+		d.Version = 1
+	}
+	if d.Category == "" {
+		d.Category = DefaultDocumentCategory
+	}
+	if d.ThumbnailStatus == "" {
+		d.ThumbnailStatus = ThumbnailNone
+	}
+	if d.TextStatus == "" {
+		d.TextStatus = TextNone
+	}
+	d.IsLatest = true
+	d.setPlaceholder()
+
+	query := `INSERT INTO documents (root_id, version, is_latest, case_id, file_name, category, storage_key, file_type, file_size,
+             uploaded_by, scan_status, checksum, change_comment, thumbnail_status, text_status) 
+             VALUES (?, ?, TRUE, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := db.Exec(query, NullableID(d.RootID), d.Version, d.CaseID, d.FileName, d.Category, d.StorageKey, d.FileType,
+		d.FileSize, NullableID(d.UploadedBy), d.ScanStatus, d.Checksum, d.ChangeComment, d.ThumbnailStatus, d.TextStatus)
 	if err != nil {
 		return err
 	}
@@ -30,14 +139,107 @@ func (d *Document) Create(db *sql.DB) error {
 	}
 
 	d.ID = id
+	if d.RootID == 0 {
+		d.RootID = id
+		if _, err := db.Exec(`UPDATE documents SET root_id = id WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	d.UploadedAt = time.Now()
 	return nil
 }
 
-func GetDocumentsByCase(db *sql.DB, caseID int64) ([]Document, error) {
-	query := `SELECT id, case_id, file_name, file_path, file_type, file_size, uploaded_at 
-             FROM documents WHERE case_id = ?`
-	
-	rows, err := db.Query(query, caseID)
+// AddVersion stores next as the newest version of d's document and returns
+// the ID of the version it superseded. Run it in a transaction: the current
+// latest version is locked so concurrent uploads cannot both claim the same
+// version number.
+func (d *Document) AddVersion(tx DBTX, next *Document) (int64, error) {
+	var latestID int64
+	var latestVersion int
+	err := tx.QueryRow(`SELECT id, version FROM documents WHERE root_id = ? AND is_latest = TRUE FOR UPDATE`,
+		d.RootID).Scan(&latestID, &latestVersion)
+	if err == sql.ErrNoRows {
+		return 0, ErrDocumentVersionConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`UPDATE documents SET is_latest = FALSE WHERE id = ?`, latestID); err != nil {
+		return 0, err
+	}
+
+	next.RootID = d.RootID
+	next.CaseID = d.CaseID
+	next.Version = latestVersion + 1
+	return latestID, next.Create(tx)
+}
+
+// GetDocumentsByCase retrieves the latest version of each of a case's
+// documents, or every version when allVersions is set
+func GetDocumentsByCase(db *sql.DB, caseID int64, allVersions bool) ([]Document, error) {
+	if allVersions {
+		return queryDocuments(db, `WHERE case_id = ? ORDER BY root_id, version`, caseID)
+	}
+	return queryDocuments(db, `WHERE case_id = ? AND is_latest = TRUE ORDER BY root_id`, caseID)
+}
+
+// GetDocumentVersions retrieves every version of a document, oldest first
+func GetDocumentVersions(db *sql.DB, rootID int64) ([]Document, error) {
+	return queryDocuments(db, `WHERE root_id = ? ORDER BY version`, rootID)
+}
+
+// GetAllDocuments retrieves the latest version of every document, for
+// rebuilding the search index
+func GetAllDocuments(db *sql.DB) ([]Document, error) {
+	return queryDocuments(db, `WHERE is_latest = TRUE ORDER BY id`)
+}
+
+// documentColumns is the column list scanned by scanDocument
+const documentColumns = `id, root_id, version, is_latest, case_id, file_name, category, storage_key, file_type, file_size, COALESCE(uploaded_by, 0), uploaded_at,
+	scan_status, COALESCE(scan_signature, ''), scanned_at, scan_attempts, COALESCE(scan_error, ''), checksum, COALESCE(change_comment, ''), thumbnail_status,
+	text_status, COALESCE(text_error, ''), text_extracted_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDocument(row rowScanner, doc *Document) error {
+	err := row.Scan(
+		&doc.ID,
+		&doc.RootID,
+		&doc.Version,
+		&doc.IsLatest,
+		&doc.CaseID,
+		&doc.FileName,
+		&doc.Category,
+		&doc.StorageKey,
+		&doc.FileType,
+		&doc.FileSize,
+		&doc.UploadedBy,
+		&doc.UploadedAt,
+		&doc.ScanStatus,
+		&doc.ScanSignature,
+		&doc.ScannedAt,
+		&doc.ScanAttempts,
+		&doc.ScanError,
+		&doc.Checksum,
+		&doc.ChangeComment,
+		&doc.ThumbnailStatus,
+		&doc.TextStatus,
+		&doc.TextError,
+		&doc.TextExtractedAt,
+	)
+	if err == nil {
+		doc.setPlaceholder()
+	}
+	return err
+}
+
+func queryDocuments(db *sql.DB, where string, args ...interface{}) ([]Document, error) {
+	query := `SELECT ` + documentColumns + ` FROM documents ` + where
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -46,26 +248,191 @@ func GetDocumentsByCase(db *sql.DB, caseID int64) ([]Document, error) {
 	var documents []Document
 	for rows.Next() {
 		var doc Document
-		err := rows.Scan(
-			&doc.ID,
-			&doc.CaseID,
-			&doc.FileName,
-			&doc.FilePath,
-			&doc.FileType,
-			&doc.FileSize,
-			&doc.UploadedAt,
-		)
-		if err != nil {
+		if err := scanDocument(rows, &doc); err != nil {
 			return nil, err
 		}
 		documents = append(documents, doc)
 	}
 
-	return documents, nil
+	return documents, rows.Err()
+}
+
+// GetPendingScanDocuments retrieves documents that have not been scanned yet
+func GetPendingScanDocuments(db *sql.DB) ([]Document, error) {
+	return queryDocuments(db, `WHERE scan_status = ? ORDER BY id`, ScanPending)
+}
+
+// GetPendingThumbnailDocuments retrieves clean documents still waiting for
+// their thumbnails
+func GetPendingThumbnailDocuments(db *sql.DB) ([]Document, error) {
+	return queryDocuments(db, `WHERE scan_status = ? AND thumbnail_status = ? ORDER BY id`, ScanClean, ThumbnailPending)
 }
 
+// GetPendingTextDocuments retrieves clean documents still waiting for their
+// text to be extracted
+func GetPendingTextDocuments(db *sql.DB) ([]Document, error) {
+	return queryDocuments(db, `WHERE scan_status = ? AND text_status = ? ORDER BY id`, ScanClean, TextPending)
+}
+
+// GetDocumentsByChecksum retrieves every document version with the given
+// content, for reporting duplicate uploads
+func GetDocumentsByChecksum(db *sql.DB, checksum string) ([]Document, error) {
+	return queryDocuments(db, `WHERE checksum = ? ORDER BY id`, checksum)
+}
+
+// GetStorageKeyByChecksum returns the key content with the given checksum is
+// already stored under, taking the most recent upload if there are several.
+// It returns sql.ErrNoRows if no document has that content.
+func GetStorageKeyByChecksum(db *sql.DB, checksum string) (string, error) {
+	var key string
+	err := db.QueryRow(`SELECT storage_key FROM documents WHERE checksum = ? ORDER BY id DESC LIMIT 1`, checksum).Scan(&key)
+	return key, err
+}
+
+// GetAllDocumentVersions retrieves every version of every document
+func GetAllDocumentVersions(db *sql.DB) ([]Document, error) {
+	return queryDocuments(db, `ORDER BY id`)
+}
+
+// CountDocumentsByStorageKey counts the document versions whose content is
+// stored under key. Content-addressed objects are shared by identical uploads
+// and may only be deleted when this reaches zero.
+func CountDocumentsByStorageKey(db *sql.DB, key string) (int, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM documents WHERE storage_key = ?`, key).Scan(&n)
+	return n, err
+}
+
+// GetDocument retrieves a single document by ID
+func GetDocument(db *sql.DB, id int64) (*Document, error) {
+	doc := &Document{}
+	query := `SELECT ` + documentColumns + ` FROM documents WHERE id = ?`
+	if err := scanDocument(db.QueryRow(query, id), doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Delete removes the document together with all of its versions
 func (d *Document) Delete(db *sql.DB) error {
-	query := `DELETE FROM documents WHERE id = ?`
-	_, err := db.Exec(query, d.ID)
+	query := `DELETE FROM documents WHERE root_id = ?`
+	_, err := db.Exec(query, d.RootID)
 	return err
 }
+
+// SetScanResult records the outcome of a virus scan
+func (d *Document) SetScanResult(db *sql.DB, status, signature string) error {
+	now := time.Now()
+	_, err := db.Exec(`UPDATE documents SET scan_status = ?, scan_signature = ?, scanned_at = ?, scan_error = NULL WHERE id = ?`,
+		status, sql.NullString{String: signature, Valid: signature != ""}, now, d.ID)
+	if err != nil {
+		return err
+	}
+
+	d.ScanStatus = status
+	d.ScanSignature = signature
+	d.ScannedAt = NullTime{sql.NullTime{Time: now, Valid: true}}
+	d.ScanError = ""
+	return nil
+}
+
+// RecordScanError counts a scan the scanner rejected with an error. Once
+// maxAttempts scans have been rejected the document is marked failed and is
+// no longer retried.
+func (d *Document) RecordScanError(db *sql.DB, message string, maxAttempts int) error {
+	if len(message) > 255 {
+		message = strings.ToValidUTF8(message[:255], "")
+	}
+	attempts := d.ScanAttempts + 1
+	status := ScanPending
+	if attempts >= maxAttempts {
+		status = ScanFailed
+	}
+
+	now := time.Now()
+	_, err := db.Exec(`UPDATE documents SET scan_status = ?, scan_attempts = ?, scan_error = ?, scanned_at = ?
+		WHERE id = ? AND scan_status = ?`, status, attempts, message, now, d.ID, ScanPending)
+	if err != nil {
+		return err
+	}
+
+	d.ScanStatus = status
+	d.ScanAttempts = attempts
+	d.ScanError = message
+	d.ScannedAt = NullTime{sql.NullTime{Time: now, Valid: true}}
+	return nil
+}
+
+// SetThumbnailStatus records whether the document's thumbnails are available
+func (d *Document) SetThumbnailStatus(db *sql.DB, status string) error {
+	if _, err := db.Exec(`UPDATE documents SET thumbnail_status = ? WHERE id = ?`, status, d.ID); err != nil {
+		return err
+	}
+
+	d.ThumbnailStatus = status
+	d.setPlaceholder()
+	return nil
+}
+
+// SetExtractedText stores the text extracted from the document
+func (d *Document) SetExtractedText(db *sql.DB, text string) error {
+	return d.setTextResult(db, TextExtracted, text, "")
+}
+
+// SetTextError records why the document's text could not be extracted
+func (d *Document) SetTextError(db *sql.DB, message string) error {
+	if len(message) > 255 {
+		message = strings.ToValidUTF8(message[:255], "")
+	}
+	return d.setTextResult(db, TextFailed, "", message)
+}
+
+// SkipTextExtraction marks the document as having no text to extract, as
+// for quarantined documents
+func (d *Document) SkipTextExtraction(db *sql.DB) error {
+	return d.setTextResult(db, TextNone, "", "")
+}
+
+func (d *Document) setTextResult(db *sql.DB, status, text, message string) error {
+	now := time.Now()
+	_, err := db.Exec(`UPDATE documents SET text_status = ?, extracted_text = ?, text_error = ?, text_extracted_at = ? WHERE id = ?`,
+		status, sql.NullString{String: text, Valid: status == TextExtracted},
+		sql.NullString{String: message, Valid: message != ""}, now, d.ID)
+	if err != nil {
+		return err
+	}
+
+	d.TextStatus = status
+	d.TextError = message
+	d.TextExtractedAt = NullTime{sql.NullTime{Time: now, Valid: true}}
+	return nil
+}
+
+// GetDocumentText returns the text extracted from a document, or "" if there
+// is none
+func GetDocumentText(db *sql.DB, id int64) (string, error) {
+	var text sql.NullString
+	err := db.QueryRow(`SELECT extracted_text FROM documents WHERE id = ?`, id).Scan(&text)
+	return text.String, err
+}
+
+// GetExtractedTexts returns the extracted text of every latest document
+// version that has one, keyed by document ID, for rebuilding the search index
+func GetExtractedTexts(db *sql.DB) (map[int64]string, error) {
+	rows, err := db.Query(`SELECT id, extracted_text FROM documents WHERE is_latest = TRUE AND text_status = ?`, TextExtracted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	texts := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var text string
+		if err := rows.Scan(&id, &text); err != nil {
+			return nil, err
+		}
+		texts[id] = text
+	}
+	return texts, rows.Err()
+}
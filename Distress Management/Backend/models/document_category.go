@@ -0,0 +1,165 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// DefaultDocumentCategory is used for uploads that do not name a category
+const DefaultDocumentCategory = "other"
+
+// DocumentCategory classifies a document, e.g. a passport copy or a police
+// abstract
+type DocumentCategory struct {
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// DocumentRequirement lists the categories a case must have documents for
+// before it can be resolved. An empty Subject applies to every case of the
+// nature; otherwise only to cases whose subject matches it.
+type DocumentRequirement struct {
+	NatureOfCase string             `json:"nature_of_case"`
+	Subject      string             `json:"subject"`
+	Categories   []DocumentCategory `json:"categories"`
+}
+
+// DocumentChecklistItem reports whether a required category has been provided
+type DocumentChecklistItem struct {
+	DocumentCategory
+	Provided    bool    `json:"provided"`
+	DocumentIDs []int64 `json:"document_ids"`
+}
+
+// GetDocumentCategories retrieves every category
+func GetDocumentCategories(db *sql.DB) ([]DocumentCategory, error) {
+	rows, err := db.Query(`SELECT code, name, COALESCE(description, '') FROM document_categories ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []DocumentCategory
+	for rows.Next() {
+		var c DocumentCategory
+		if err := rows.Scan(&c.Code, &c.Name, &c.Description); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// DocumentCategoryExists reports whether code names a category
+func DocumentCategoryExists(db DBTX, code string) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM document_categories WHERE code = ?`, code).Scan(&n)
+	return n > 0, err
+}
+
+// GetDocumentRequirements retrieves every requirement, grouped by nature of
+// case and subject
+func GetDocumentRequirements(db *sql.DB) ([]DocumentRequirement, error) {
+	rows, err := db.Query(`
+		SELECT r.nature_of_case, r.subject, c.code, c.name, COALESCE(c.description, '')
+		FROM document_requirements r
+		JOIN document_categories c ON c.code = r.category_code
+		ORDER BY r.nature_of_case, r.subject, c.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requirements []DocumentRequirement
+	for rows.Next() {
+		var nature, subject string
+		var c DocumentCategory
+		if err := rows.Scan(&nature, &subject, &c.Code, &c.Name, &c.Description); err != nil {
+			return nil, err
+		}
+
+		n := len(requirements)
+		if n == 0 || requirements[n-1].NatureOfCase != nature || requirements[n-1].Subject != subject {
+			requirements = append(requirements, DocumentRequirement{NatureOfCase: nature, Subject: subject})
+			n++
+		}
+		requirements[n-1].Categories = append(requirements[n-1].Categories, c)
+	}
+	return requirements, rows.Err()
+}
+
+// SetDocumentRequirements replaces the categories required for a nature of
+// case and subject. An empty list removes the requirement.
+func SetDocumentRequirements(tx DBTX, nature, subject string, codes []string) error {
+	if _, err := tx.Exec(`DELETE FROM document_requirements WHERE nature_of_case = ? AND subject = ?`,
+		nature, subject); err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		if _, err := tx.Exec(`INSERT IGNORE INTO document_requirements (nature_of_case, subject, category_code)
+			VALUES (?, ?, ?)`, nature, subject, code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDocumentChecklist lists the categories required for a case and whether
+// the latest version of some document in each category has been uploaded.
+// Infected documents do not count.
+func GetDocumentChecklist(db *sql.DB, c *Case) ([]DocumentChecklistItem, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT cat.code, cat.name, COALESCE(cat.description, '')
+		FROM document_requirements r
+		JOIN document_categories cat ON cat.code = r.category_code
+		WHERE r.nature_of_case = ? AND (r.subject = '' OR LOWER(r.subject) = ?)
+		ORDER BY cat.name
+	`, c.NatureOfCase, strings.ToLower(strings.TrimSpace(c.Subject)))
+	if err != nil {
+		return nil, err
+	}
+
+	checklist := []DocumentChecklistItem{}
+	index := map[string]int{}
+	for rows.Next() {
+		item := DocumentChecklistItem{DocumentIDs: []int64{}}
+		if err := rows.Scan(&item.Code, &item.Name, &item.Description); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[item.Code] = len(checklist)
+		checklist = append(checklist, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	documents, err := queryDocuments(db, `WHERE case_id = ? AND is_latest = TRUE AND scan_status <> ? ORDER BY id`,
+		c.ID, ScanInfected)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range documents {
+		if i, ok := index[d.Category]; ok {
+			checklist[i].Provided = true
+			checklist[i].DocumentIDs = append(checklist[i].DocumentIDs, d.ID)
+		}
+	}
+
+	return checklist, nil
+}
+
+// MissingDocuments returns the checklist categories not yet provided
+func MissingDocuments(checklist []DocumentChecklistItem) []DocumentCategory {
+	missing := []DocumentCategory{}
+	for _, item := range checklist {
+		if !item.Provided {
+			missing = append(missing, item.DocumentCategory)
+		}
+	}
+	return missing
+}
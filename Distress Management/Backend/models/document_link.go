@@ -0,0 +1,186 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrDocumentLinkUsed is returned when a one-time link is used again
+var ErrDocumentLinkUsed = errors.New("document link has already been used")
+
+// DocumentLink is a signed, time-limited link to one document version. Links
+// are kept after their document is deleted, with DocumentID 0, so their
+// downloads stay on record.
+type DocumentLink struct {
+	ID         int64  `json:"id"`
+	DocumentID int64  `json:"document_id"`
+	CaseID     int64  `json:"case_id"`
+	FileName   string `json:"file_name"`
+	CreatedBy  int64  `json:"created_by"`
+	// Recipient is a free-text note of who the link was sent to
+	Recipient string    `json:"recipient,omitempty"`
+	OneTime   bool      `json:"one_time"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UsedAt    NullTime  `json:"used_at"`
+	RevokedAt NullTime  `json:"revoked_at"`
+	CreatedAt time.Time `json:"created_at"`
+	// Downloads counts the downloads made through the link
+	Downloads int `json:"downloads"`
+}
+
+// DocumentLinkDownload is one download made through a document link
+type DocumentLinkDownload struct {
+	ID           int64     `json:"id"`
+	LinkID       int64     `json:"link_id"`
+	IPAddress    string    `json:"ip_address"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+}
+
+// Create stores a new link
+func (l *DocumentLink) Create(db *sql.DB) error {
+	l.CreatedAt = time.Now()
+	result, err := db.Exec(`INSERT INTO document_links
+		(document_id, case_id, file_name, created_by, recipient, one_time, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		l.DocumentID, l.CaseID, l.FileName, l.CreatedBy, sql.NullString{String: l.Recipient, Valid: l.Recipient != ""},
+		l.OneTime, l.ExpiresAt, l.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	l.ID = id
+	return nil
+}
+
+const documentLinkColumns = `l.id, COALESCE(l.document_id, 0), COALESCE(l.case_id, 0), l.file_name, l.created_by, COALESCE(l.recipient, ''), l.one_time,
+	l.expires_at, l.used_at, l.revoked_at, l.created_at,
+	(SELECT COUNT(*) FROM document_link_downloads d WHERE d.link_id = l.id)`
+
+func scanDocumentLink(row rowScanner, l *DocumentLink) error {
+	return row.Scan(&l.ID, &l.DocumentID, &l.CaseID, &l.FileName, &l.CreatedBy, &l.Recipient, &l.OneTime,
+		&l.ExpiresAt, &l.UsedAt, &l.RevokedAt, &l.CreatedAt, &l.Downloads)
+}
+
+// GetDocumentLink retrieves a link by ID
+func GetDocumentLink(db *sql.DB, id int64) (*DocumentLink, error) {
+	l := &DocumentLink{}
+	err := scanDocumentLink(db.QueryRow(`SELECT `+documentLinkColumns+` FROM document_links l WHERE l.id = ?`, id), l)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// GetDocumentLinks retrieves the links to a document version, newest first
+func GetDocumentLinks(db *sql.DB, documentID int64) ([]DocumentLink, error) {
+	rows, err := db.Query(`SELECT `+documentLinkColumns+` FROM document_links l
+		WHERE l.document_id = ? ORDER BY l.created_at DESC, l.id DESC`, documentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []DocumentLink{}
+	for rows.Next() {
+		var l DocumentLink
+		if err := scanDocumentLink(rows, &l); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// Usable reports whether the link may still be used to download
+func (l *DocumentLink) Usable(now time.Time) bool {
+	return !l.RevokedAt.Valid && now.Before(l.ExpiresAt) && !(l.OneTime && l.UsedAt.Valid)
+}
+
+// Use records that the link was used. A one-time link can only be used
+// once; using it again returns ErrDocumentLinkUsed.
+func (l *DocumentLink) Use(db *sql.DB) error {
+	now := time.Now()
+	if !l.OneTime {
+		_, err := db.Exec(`UPDATE document_links SET used_at = COALESCE(used_at, ?) WHERE id = ?`, now, l.ID)
+		return err
+	}
+
+	result, err := db.Exec(`UPDATE document_links SET used_at = ?
+		WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL`, now, l.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDocumentLinkUsed
+	}
+
+	l.UsedAt = NullTime{sql.NullTime{Time: now, Valid: true}}
+	return nil
+}
+
+// ReleaseUse makes a one-time link usable again after a download that was
+// recorded by Use was refused
+func (l *DocumentLink) ReleaseUse(db *sql.DB) error {
+	if _, err := db.Exec(`UPDATE document_links SET used_at = NULL WHERE id = ? AND one_time = TRUE`, l.ID); err != nil {
+		return err
+	}
+	l.UsedAt = NullTime{}
+	return nil
+}
+
+// Revoke disables the link
+func (l *DocumentLink) Revoke(db *sql.DB) error {
+	now := time.Now()
+	if _, err := db.Exec(`UPDATE document_links SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?`, now, l.ID); err != nil {
+		return err
+	}
+	if !l.RevokedAt.Valid {
+		l.RevokedAt = NullTime{sql.NullTime{Time: now, Valid: true}}
+	}
+	return nil
+}
+
+// LogDownload records a download made through the link
+func (l *DocumentLink) LogDownload(db *sql.DB, ipAddress, userAgent string) error {
+	if len(userAgent) > 255 {
+		userAgent = strings.ToValidUTF8(userAgent[:255], "")
+	}
+	_, err := db.Exec(`INSERT INTO document_link_downloads (link_id, ip_address, user_agent, downloaded_at)
+		VALUES (?, ?, ?, NOW())`, l.ID, ipAddress, sql.NullString{String: userAgent, Valid: userAgent != ""})
+	if err != nil {
+		return err
+	}
+	l.Downloads++
+	return nil
+}
+
+// GetDocumentLinkDownloads retrieves the downloads made through a link,
+// newest first
+func GetDocumentLinkDownloads(db *sql.DB, linkID int64) ([]DocumentLinkDownload, error) {
+	rows, err := db.Query(`SELECT id, link_id, ip_address, COALESCE(user_agent, ''), downloaded_at
+		FROM document_link_downloads WHERE link_id = ? ORDER BY downloaded_at DESC, id DESC`, linkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	downloads := []DocumentLinkDownload{}
+	for rows.Next() {
+		var d DocumentLinkDownload
+		if err := rows.Scan(&d.ID, &d.LinkID, &d.IPAddress, &d.UserAgent, &d.DownloadedAt); err != nil {
+			return nil, err
+		}
+		downloads = append(downloads, d)
+	}
+	return downloads, rows.Err()
+}
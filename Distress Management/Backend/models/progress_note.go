@@ -2,25 +2,117 @@ package models
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 )
 
+// Actions recorded in a progress note revision
+const (
+	NoteRevisionEdit   = "edit"
+	NoteRevisionDelete = "delete"
+)
+
+// Note types
+const (
+	NoteCallLog             = "call_log"
+	NoteFieldVisit          = "field_visit"
+	NoteDirectorInstruction = "director_instruction"
+	NoteInternalComment     = "internal_comment"
+	NoteSenderUpdate        = "sender_update"
+)
+
+// NoteTypes lists every valid note type
+var NoteTypes = []string{NoteCallLog, NoteFieldVisit, NoteDirectorInstruction, NoteInternalComment, NoteSenderUpdate}
+
+// Note visibility levels, from most to least restricted. Internal notes are
+// seen by their author and supervisors, department notes also by those in
+// the author's department, and requester notes by everyone working the case
+// and may be shared with whoever raised it.
+const (
+	VisibilityInternal   = "internal"
+	VisibilityDepartment = "department"
+	VisibilityRequester  = "requester"
+)
+
+// NoteVisibilities lists every valid visibility level
+var NoteVisibilities = []string{VisibilityInternal, VisibilityDepartment, VisibilityRequester}
+
+// ValidNoteType reports whether t is a known note type
+func ValidNoteType(t string) bool {
+	for _, v := range NoteTypes {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidNoteVisibility reports whether v is a known visibility level
+func ValidNoteVisibility(v string) bool {
+	for _, l := range NoteVisibilities {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultNoteVisibility is the visibility a note of the given type gets when
+// none is chosen: updates for the sender are shareable with the requester,
+// everything else stays within the department
+func DefaultNoteVisibility(noteType string) string {
+	if noteType == NoteSenderUpdate {
+		return VisibilityRequester
+	}
+	return VisibilityDepartment
+}
+
+// ErrNoteDeleted is returned when a deleted progress note is changed
+var ErrNoteDeleted = errors.New("progress note has been deleted")
+
+// ProgressNote is the current revision of a note. Deleted notes are kept as
+// tombstones with their text removed; earlier text is in the note's
+// revisions. Director instructions that are not deleted are Pinned.
+// AuthorDepartment is the author's current department, used to decide who
+// sees department notes.
 type ProgressNote struct {
-	ID        int64     `json:"id"`
-	CaseID    int64     `json:"case_id"`
-	UserID    int64     `json:"user_id"`
-	Note      string    `json:"note"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID               int64     `json:"id"`
+	CaseID           int64     `json:"case_id"`
+	UserID           int64     `json:"user_id"`
+	Note             string    `json:"note"`
+	NoteType         string    `json:"note_type"`
+	Visibility       string    `json:"visibility"`
+	Pinned           bool      `json:"pinned"`
+	Revision         int       `json:"revision"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	DeletedAt        NullTime  `json:"deleted_at"`
+	DeletedBy        int64     `json:"deleted_by,omitempty"`
+	AuthorDepartment string    `json:"-"`
+}
+
+// NoteRevision is the text, type and visibility a note had before it was
+// edited or deleted
+type NoteRevision struct {
+	ID         int64     `json:"id"`
+	NoteID     int64     `json:"note_id"`
+	Revision   int       `json:"revision"`
+	Note       string    `json:"note"`
+	NoteType   string    `json:"note_type"`
+	Visibility string    `json:"visibility"`
+	Action     string    `json:"action"`
+	ChangedBy  int64     `json:"changed_by"`
+	ChangedAt  time.Time `json:"changed_at"`
+	Reason     string    `json:"reason,omitempty"`
 }
 
 // CreateProgressNote adds a new progress note to the database
 func (p *ProgressNote) Create(db *sql.DB) error {
 	query := `
-		INSERT INTO progress_notes (case_id, user_id, note, created_at, updated_at)
-		VALUES (?, ?, ?, NOW(), NOW())
+		INSERT INTO progress_notes (case_id, user_id, note, note_type, visibility, revision, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, 1, NOW(), NOW())
 	`
-	result, err := db.Exec(query, p.CaseID, p.UserID, p.Note)
+	result, err := db.Exec(query, p.CaseID, p.UserID, p.Note, p.NoteType, p.Visibility)
 	if err != nil {
 		return err
 	}
@@ -31,18 +123,153 @@ func (p *ProgressNote) Create(db *sql.DB) error {
 	}
 
 	p.ID = id
+	p.Revision = 1
+	p.Pinned = p.NoteType == NoteDirectorInstruction
+	return nil
+}
+
+// IsDeleted reports whether the note has been tombstoned
+func (p *ProgressNote) IsDeleted() bool {
+	return p.DeletedAt.Valid
+}
+
+// Edit replaces the note's text, type and visibility, keeping the previous
+// ones as a revision. The note row is locked until the surrounding
+// transaction commits.
+func (p *ProgressNote) Edit(tx DBTX, text, noteType, visibility string, editorID int64, reason string) error {
+	if err := p.saveRevision(tx, NoteRevisionEdit, editorID, reason); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err := tx.Exec(`UPDATE progress_notes SET note = ?, note_type = ?, visibility = ?, revision = revision + 1,
+		updated_at = ? WHERE id = ?`, text, noteType, visibility, now, p.ID)
+	if err != nil {
+		return err
+	}
+
+	p.Note = text
+	p.NoteType = noteType
+	p.Visibility = visibility
+	p.Pinned = noteType == NoteDirectorInstruction
+	p.Revision++
+	p.UpdatedAt = now
 	return nil
 }
 
-// GetProgressNotes retrieves all progress notes for a specific case
+// Delete tombstones the note: its text moves to a revision and the note is
+// marked deleted, so it still shows where it was in the record
+func (p *ProgressNote) Delete(tx DBTX, deletedBy int64, reason string) error {
+	if err := p.saveRevision(tx, NoteRevisionDelete, deletedBy, reason); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err := tx.Exec(`UPDATE progress_notes SET note = '', deleted_at = ?, deleted_by = ?, updated_at = ? WHERE id = ?`,
+		now, deletedBy, now, p.ID)
+	if err != nil {
+		return err
+	}
+
+	p.Note = ""
+	p.Pinned = false
+	p.DeletedAt = NullTime{sql.NullTime{Time: now, Valid: true}}
+	p.DeletedBy = deletedBy
+	p.UpdatedAt = now
+	return nil
+}
+
+// saveRevision locks the note and copies its current text, type and
+// visibility into a revision.
+// It fails with ErrNoteDeleted if the note was deleted meanwhile.
+func (p *ProgressNote) saveRevision(tx DBTX, action string, userID int64, reason string) error {
+	var text, noteType, visibility string
+	var revision int
+	var deletedAt sql.NullTime
+	err := tx.QueryRow(`SELECT note, note_type, visibility, revision, deleted_at FROM progress_notes
+		WHERE id = ? FOR UPDATE`, p.ID).Scan(&text, &noteType, &visibility, &revision, &deletedAt)
+	if err != nil {
+		return err
+	}
+	if deletedAt.Valid {
+		return ErrNoteDeleted
+	}
+
+	_, err = tx.Exec(`INSERT INTO progress_note_revisions
+		(note_id, revision, note, note_type, visibility, action, changed_by, changed_at, reason)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NOW(), ?)`,
+		p.ID, revision, text, noteType, visibility, action, userID, sql.NullString{String: reason, Valid: reason != ""})
+	if err != nil {
+		return err
+	}
+
+	p.Note = text
+	p.NoteType = noteType
+	p.Visibility = visibility
+	p.Revision = revision
+	return nil
+}
+
+// GetNoteRevisions retrieves the earlier revisions of a note, oldest first
+func GetNoteRevisions(db *sql.DB, noteID int64) ([]NoteRevision, error) {
+	rows, err := db.Query(`
+		SELECT id, note_id, revision, note, note_type, visibility, action, changed_by, changed_at, COALESCE(reason, '')
+		FROM progress_note_revisions
+		WHERE note_id = ?
+		ORDER BY revision ASC
+	`, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []NoteRevision{}
+	for rows.Next() {
+		var r NoteRevision
+		err := rows.Scan(&r.ID, &r.NoteID, &r.Revision, &r.Note, &r.NoteType, &r.Visibility,
+			&r.Action, &r.ChangedBy, &r.ChangedAt, &r.Reason)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
+
+// GetProgressNote retrieves a single progress note, including tombstones
+func GetProgressNote(db *sql.DB, id int64) (*ProgressNote, error) {
+	notes, err := queryProgressNotes(db, `WHERE n.id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(notes) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &notes[0], nil
+}
+
+// GetProgressNotes retrieves all progress notes for a specific case,
+// including tombstones of deleted ones. Pinned director instructions come
+// first, then the rest newest first.
 func GetProgressNotes(db *sql.DB, caseID int64) ([]ProgressNote, error) {
+	return queryProgressNotes(db, `WHERE n.case_id = ?
+		ORDER BY (n.note_type = 'director_instruction' AND n.deleted_at IS NULL) DESC, n.created_at DESC, n.id DESC`, caseID)
+}
+
+// GetAllProgressNotes retrieves every note that has not been deleted, for
+// rebuilding the search index
+func GetAllProgressNotes(db *sql.DB) ([]ProgressNote, error) {
+	return queryProgressNotes(db, `WHERE n.deleted_at IS NULL ORDER BY n.id`)
+}
+
+func queryProgressNotes(db *sql.DB, where string, args ...interface{}) ([]ProgressNote, error) {
 	query := `
-		SELECT id, case_id, user_id, note, created_at, updated_at
-		FROM progress_notes
-		WHERE case_id = ?
-		ORDER BY created_at DESC
-	`
-	rows, err := db.Query(query, caseID)
+		SELECT n.id, n.case_id, n.user_id, n.note, n.note_type, n.visibility, n.revision, n.created_at, n.updated_at,
+			n.deleted_at, COALESCE(n.deleted_by, 0), COALESCE(u.department, '')
+		FROM progress_notes n
+		LEFT JOIN users u ON u.id = n.user_id
+		` + where
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -51,12 +278,14 @@ func GetProgressNotes(db *sql.DB, caseID int64) ([]ProgressNote, error) {
 	var notes []ProgressNote
 	for rows.Next() {
 		var note ProgressNote
-		err := rows.Scan(&note.ID, &note.CaseID, &note.UserID, &note.Note, &note.CreatedAt, &note.UpdatedAt)
+		err := rows.Scan(&note.ID, &note.CaseID, &note.UserID, &note.Note, &note.NoteType, &note.Visibility,
+			&note.Revision, &note.CreatedAt, &note.UpdatedAt, &note.DeletedAt, &note.DeletedBy, &note.AuthorDepartment)
 		if err != nil {
 			return nil, err
 		}
+		note.Pinned = note.NoteType == NoteDirectorInstruction && !note.IsDeleted()
 		notes = append(notes, note)
 	}
 
-	return notes, nil
+	return notes, rows.Err()
 }
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultReferencePattern is used when no REFERENCE_PATTERN is configured
+const DefaultReferencePattern = "DM/{YYYY}/{NATURE}/{SEQ:05}"
+
+var referenceToken = regexp.MustCompile(`\{([A-Z]+)(?::(\d+))?\}`)
+
+// ReferenceGenerator issues case reference numbers from a pattern such as
+// DM/{YYYY}/{NATURE}/{SEQ:05}. Supported tokens are {YYYY}, {YY}, {MM},
+// {NATURE} (optionally truncated, {NATURE:1}) and exactly one {SEQ}
+// (optionally zero padded, {SEQ:05}).
+//
+// Every distinct rendering of the pattern without its {SEQ} has its own
+// counter in reference_sequences, so a pattern containing the year restarts
+// at 1 every year. Numbers are allocated inside the caller's transaction: the
+// counter row stays locked until commit and a rollback returns the number,
+// so concurrent submissions never share a number and no numbers are skipped.
+type ReferenceGenerator struct {
+	Pattern string
+	// ResetYearly restarts the sequence every year even when the pattern
+	// does not contain the year
+	ResetYearly bool
+}
+
+// NewReferenceGenerator validates the pattern and returns a generator
+func NewReferenceGenerator(pattern string, resetYearly bool) (*ReferenceGenerator, error) {
+	if pattern == "" {
+		pattern = DefaultReferencePattern
+	}
+
+	seqs := 0
+	for _, m := range referenceToken.FindAllStringSubmatch(pattern, -1) {
+		switch m[1] {
+		case "SEQ":
+			seqs++
+		case "YYYY", "YY", "MM", "NATURE":
+		default:
+			return nil, fmt.Errorf("unknown token {%s} in reference pattern", m[1])
+		}
+	}
+	if seqs != 1 {
+		return nil, errors.New("reference pattern must contain exactly one {SEQ} token")
+	}
+	if len(pattern) > 150 {
+		return nil, errors.New("reference pattern is too long")
+	}
+
+	return &ReferenceGenerator{Pattern: pattern, ResetYearly: resetYearly}, nil
+}
+
+// Scope returns the counter a case created at the given time belongs to
+func (g *ReferenceGenerator) Scope(natureOfCase string, now time.Time) string {
+	scope := g.render(natureOfCase, now, nil)
+	if g.ResetYearly && !strings.Contains(g.Pattern, "{YYYY}") && !strings.Contains(g.Pattern, "{YY}") {
+		scope += "@" + strconv.Itoa(now.Year())
+	}
+	return scope
+}
+
+// Format renders the reference number for a given sequence value
+func (g *ReferenceGenerator) Format(natureOfCase string, now time.Time, seq int64) string {
+	return g.render(natureOfCase, now, seq)
+}
+
+func (g *ReferenceGenerator) render(natureOfCase string, now time.Time, seq interface{}) string {
+	return referenceToken.ReplaceAllStringFunc(g.Pattern, func(token string) string {
+		m := referenceToken.FindStringSubmatch(token)
+		width, _ := strconv.Atoi(m[2])
+		switch m[1] {
+		case "YYYY":
+			return fmt.Sprintf("%04d", now.Year())
+		case "YY":
+			return fmt.Sprintf("%02d", now.Year()%100)
+		case "MM":
+			return fmt.Sprintf("%02d", int(now.Month()))
+		case "NATURE":
+			nature := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(natureOfCase), " ", ""))
+			if width > 0 && len(nature) > width {
+				nature = nature[:width]
+			}
+			return nature
+		case "SEQ":
+			n, ok := seq.(int64)
+			if !ok {
+				// Rendering a scope: padding must not split the counter
+				return "{SEQ}"
+			}
+			if m[2] != "" {
+				return fmt.Sprintf("%0*d", width, n)
+			}
+			return strconv.FormatInt(n, 10)
+		}
+		return token
+	})
+}
+
+// Next allocates the next reference number inside tx. The number only
+// becomes permanent when tx commits.
+func (g *ReferenceGenerator) Next(tx *sql.Tx, natureOfCase string, now time.Time) (string, error) {
+	scope := g.Scope(natureOfCase, now)
+
+	_, err := tx.Exec(`INSERT INTO reference_sequences (scope, last_value) VALUES (?, 1)
+		ON DUPLICATE KEY UPDATE last_value = last_value + 1`, scope)
+	if err != nil {
+		return "", err
+	}
+
+	var seq int64
+	if err := tx.QueryRow(`SELECT last_value FROM reference_sequences WHERE scope = ?`, scope).Scan(&seq); err != nil {
+		return "", err
+	}
+
+	return g.Format(natureOfCase, now, seq), nil
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+func TestReferenceGeneratorFormat(t *testing.T) {
+	now := time.Date(2026, time.March, 4, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		pattern string
+		nature  string
+		seq     int64
+		want    string
+		scope   string
+	}{
+		{DefaultReferencePattern, "Emergency", 7, "DM/2026/EMERGENCY/00007", "DM/2026/EMERGENCY/{SEQ}"},
+		{"REF{SEQ:05}", "Standard", 12, "REF00012", "REF{SEQ}@2026"},
+		{"{NATURE:1}-{YY}{MM}-{SEQ}", "Urgent", 123, "U-2603-123", "U-2603-{SEQ}"},
+	}
+
+	for _, tt := range tests {
+		g, err := NewReferenceGenerator(tt.pattern, true)
+		if err != nil {
+			t.Fatalf("NewReferenceGenerator(%q): %v", tt.pattern, err)
+		}
+		if got := g.Format(tt.nature, now, tt.seq); got != tt.want {
+			t.Errorf("Format(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+		if got := g.Scope(tt.nature, now); got != tt.scope {
+			t.Errorf("Scope(%q) = %q, want %q", tt.pattern, got, tt.scope)
+		}
+	}
+}
+
+func TestReferenceGeneratorRejectsBadPatterns(t *testing.T) {
+	for _, pattern := range []string{"DM/{YYYY}", "DM/{SEQ}/{SEQ}", "DM/{DAY}/{SEQ}"} {
+		if _, err := NewReferenceGenerator(pattern, true); err == nil {
+			t.Errorf("NewReferenceGenerator(%q) succeeded, want error", pattern)
+		}
+	}
+}
+
+// TestReferenceGeneratorConcurrent allocates numbers from many goroutines at
+// once, rolling some of the transactions back, and checks that the committed
+// numbers are unique and contiguous. It needs a MySQL database, e.g.
+// TEST_DATABASE_DSN="root:@tcp(localhost:3306)/distress_test?parseTime=true"
+func TestReferenceGeneratorConcurrent(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(20)
+
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS reference_sequences (
+			scope VARCHAR(191) PRIMARY KEY,
+			last_value BIGINT NOT NULL
+		)`,
+		`DROP TABLE IF EXISTS reference_test_cases`,
+		`CREATE TABLE reference_test_cases (
+			reference_number VARCHAR(191) NOT NULL UNIQUE
+		)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prefix := fmt.Sprintf("TEST%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		db.Exec(`DROP TABLE IF EXISTS reference_test_cases`)
+		db.Exec(`DELETE FROM reference_sequences WHERE scope LIKE ?`, prefix+"%")
+	})
+
+	g, err := NewReferenceGenerator(prefix+"/{YYYY}/{SEQ:04}", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 50
+	errRollback := errors.New("simulated failure")
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := WithTx(db, func(tx *sql.Tx) error {
+				ref, err := g.Next(tx, "Standard", now)
+				if err != nil {
+					return err
+				}
+				if _, err := tx.Exec(`INSERT INTO reference_test_cases (reference_number) VALUES (?)`, ref); err != nil {
+					return err
+				}
+				if i%5 == 0 {
+					return errRollback
+				}
+				return nil
+			})
+			if err != nil && err != errRollback {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("allocation failed: %v", err)
+	}
+
+	rows, err := db.Query(`SELECT reference_number FROM reference_test_cases`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	got := make(map[string]bool)
+	for rows.Next() {
+		var ref string
+		if err := rows.Scan(&ref); err != nil {
+			t.Fatal(err)
+		}
+		got[ref] = true
+	}
+
+	committed := workers - workers/5
+	if len(got) != committed {
+		t.Fatalf("got %d committed references, want %d", len(got), committed)
+	}
+	for seq := int64(1); seq <= int64(committed); seq++ {
+		if want := g.Format("Standard", now, seq); !got[want] {
+			t.Errorf("missing %s: sequence has a gap", want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrRefreshTokenUsed is returned when a rotated or revoked refresh token is presented again
+var ErrRefreshTokenUsed = errors.New("refresh token has already been used")
+
+type RefreshToken struct {
+	ID        int64        `json:"id"`
+	UserID    int64        `json:"user_id"`
+	TokenHash string       `json:"-"`
+	FamilyID  string       `json:"family_id"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	RevokedAt sql.NullTime `json:"-"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// Create stores a new refresh token
+func (t *RefreshToken) Create(db *sql.DB) error {
+	query := `INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at, created_at)
+		VALUES (?, ?, ?, ?, NOW())`
+
+	result, err := db.Exec(query, t.UserID, t.TokenHash, t.FamilyID, t.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	t.ID = id
+	return nil
+}
+
+// GetRefreshTokenByHash looks up a refresh token by its stored hash
+func GetRefreshTokenByHash(db *sql.DB, hash string) (*RefreshToken, error) {
+	t := &RefreshToken{}
+	query := `SELECT id, user_id, token_hash, family_id, expires_at, revoked_at, created_at
+		FROM refresh_tokens WHERE token_hash = ?`
+	err := db.QueryRow(query, hash).Scan(
+		&t.ID,
+		&t.UserID,
+		&t.TokenHash,
+		&t.FamilyID,
+		&t.ExpiresAt,
+		&t.RevokedAt,
+		&t.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Revoke marks the token as used. It returns ErrRefreshTokenUsed if the
+// token had already been revoked, so a token can only be rotated once.
+func (t *RefreshToken) Revoke(db *sql.DB) error {
+	result, err := db.Exec(`UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE id = ? AND revoked_at IS NULL`, t.ID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRefreshTokenUsed
+	}
+	return nil
+}
+
+// RevokeRefreshTokenFamily revokes every token descended from the same login
+func RevokeRefreshTokenFamily(db *sql.DB, familyID string) error {
+	_, err := db.Exec(`UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE family_id = ? AND revoked_at IS NULL`, familyID)
+	return err
+}
+
+// RevokeUserRefreshTokens revokes every active refresh token of a user
+func RevokeUserRefreshTokens(db *sql.DB, userID int64) error {
+	_, err := db.Exec(`UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE user_id = ? AND revoked_at IS NULL`, userID)
+	return err
+}
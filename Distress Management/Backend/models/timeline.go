@@ -0,0 +1,124 @@
+package models
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// Timeline event types
+const (
+	TimelineChange   = "change"
+	TimelineNote     = "note"
+	TimelineDocument = "document"
+)
+
+// TimelineEvent is one entry in the chronological history of a case.
+// ActorDepartment is only set for notes.
+type TimelineEvent struct {
+	Type            string    `json:"type"`
+	Timestamp       time.Time `json:"timestamp"`
+	ActorID         int64     `json:"actor_id"`
+	ActorName       string    `json:"actor_name"`
+	ActorDepartment string    `json:"-"`
+	Field           string    `json:"field,omitempty"`
+	OldValue        string    `json:"old_value,omitempty"`
+	NewValue        string    `json:"new_value,omitempty"`
+	Reason          string    `json:"reason,omitempty"`
+	NoteID          int64     `json:"note_id,omitempty"`
+	Note            string    `json:"note,omitempty"`
+	NoteType        string    `json:"note_type,omitempty"`
+	Visibility      string    `json:"visibility,omitempty"`
+	Deleted         bool      `json:"deleted,omitempty"`
+	DocumentID      int64     `json:"document_id,omitempty"`
+	FileName        string    `json:"file_name,omitempty"`
+	Version         int       `json:"version,omitempty"`
+}
+
+// GetCaseTimeline merges the case history, progress notes and document
+// uploads of a case into a single list, oldest first
+func GetCaseTimeline(db *sql.DB, caseID int64) ([]TimelineEvent, error) {
+	events := []TimelineEvent{}
+
+	rows, err := db.Query(`
+		SELECT h.created_at, COALESCE(h.user_id, 0), COALESCE(u.name, ''), h.field,
+			COALESCE(h.old_value, ''), COALESCE(h.new_value, ''), COALESCE(h.reason, '')
+		FROM case_history h
+		LEFT JOIN users u ON u.id = h.user_id
+		WHERE h.case_id = ?
+		ORDER BY h.created_at ASC, h.id ASC
+	`, caseID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		e := TimelineEvent{Type: TimelineChange}
+		if err := rows.Scan(&e.Timestamp, &e.ActorID, &e.ActorName, &e.Field, &e.OldValue, &e.NewValue, &e.Reason); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT n.created_at, n.user_id, COALESCE(u.name, ''), COALESCE(u.department, ''), n.id, n.note,
+			n.note_type, n.visibility, n.deleted_at IS NOT NULL
+		FROM progress_notes n
+		LEFT JOIN users u ON u.id = n.user_id
+		WHERE n.case_id = ?
+		ORDER BY n.created_at ASC, n.id ASC
+	`, caseID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		e := TimelineEvent{Type: TimelineNote}
+		if err := rows.Scan(&e.Timestamp, &e.ActorID, &e.ActorName, &e.ActorDepartment, &e.NoteID, &e.Note,
+			&e.NoteType, &e.Visibility, &e.Deleted); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT d.uploaded_at, COALESCE(d.uploaded_by, 0), COALESCE(u.name, ''), d.id, d.file_name,
+			d.version, COALESCE(d.change_comment, '')
+		FROM documents d
+		LEFT JOIN users u ON u.id = d.uploaded_by
+		WHERE d.case_id = ?
+		ORDER BY d.uploaded_at ASC, d.id ASC
+	`, caseID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		e := TimelineEvent{Type: TimelineDocument}
+		if err := rows.Scan(&e.Timestamp, &e.ActorID, &e.ActorName, &e.DocumentID, &e.FileName,
+			&e.Version, &e.Reason); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Each source is already ordered, so a stable sort keeps same-second
+	// entries in the order they were written
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+
+	return events, nil
+}
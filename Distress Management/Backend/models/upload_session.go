@@ -0,0 +1,151 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Upload session states
+const (
+	UploadActive    = "active"
+	UploadCompleted = "completed"
+	UploadFailed    = "failed"
+)
+
+// ErrUploadOffsetMismatch is returned when a chunk does not start where the
+// session's stored data ends
+var ErrUploadOffsetMismatch = errors.New("upload offset does not match")
+
+// UploadSession tracks a resumable upload. The partial content is kept in a
+// file on the API host named after the session ID until the upload
+// completes, fails or expires.
+type UploadSession struct {
+	ID            string    `json:"id"`
+	CaseID        int64     `json:"case_id"`
+	UserID        int64     `json:"user_id"`
+	FileName      string    `json:"file_name"`
+	Category      string    `json:"category"`
+	ChangeComment string    `json:"change_comment,omitempty"`
+	Length        int64     `json:"length"`
+	Offset        int64     `json:"offset"`
+	Status        string    `json:"status"`
+	DocumentID    int64     `json:"document_id,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Create stores a new active session
+func (s *UploadSession) Create(db DBTX) error {
+	s.Status = UploadActive
+	s.CreatedAt = time.Now()
+
+	_, err := db.Exec(`INSERT INTO upload_sessions
+		(id, case_id, user_id, file_name, category, change_comment, upload_length, upload_offset, status, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?)`,
+		s.ID, s.CaseID, s.UserID, s.FileName, s.Category, s.ChangeComment, s.Length, s.Status, s.ExpiresAt, s.CreatedAt)
+	return err
+}
+
+const uploadSessionColumns = `id, case_id, user_id, file_name, category, COALESCE(change_comment, ''),
+	upload_length, upload_offset, status, COALESCE(document_id, 0), COALESCE(error, ''), expires_at, created_at`
+
+func scanUploadSession(row rowScanner, s *UploadSession) error {
+	return row.Scan(&s.ID, &s.CaseID, &s.UserID, &s.FileName, &s.Category, &s.ChangeComment,
+		&s.Length, &s.Offset, &s.Status, &s.DocumentID, &s.Error, &s.ExpiresAt, &s.CreatedAt)
+}
+
+// GetUploadSession retrieves a session by ID
+func GetUploadSession(db *sql.DB, id string) (*UploadSession, error) {
+	s := &UploadSession{}
+	err := scanUploadSession(db.QueryRow(`SELECT `+uploadSessionColumns+` FROM upload_sessions WHERE id = ?`, id), s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetExpiredUploadSessions retrieves sessions whose expiry has passed
+func GetExpiredUploadSessions(db *sql.DB, now time.Time) ([]UploadSession, error) {
+	rows, err := db.Query(`SELECT `+uploadSessionColumns+` FROM upload_sessions WHERE expires_at < ?`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []UploadSession
+	for rows.Next() {
+		var s UploadSession
+		if err := scanUploadSession(rows, &s); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// Advance records that the session's data now ends at offset and extends its
+// expiry. It fails with ErrUploadOffsetMismatch if another request moved the
+// offset first.
+func (s *UploadSession) Advance(db DBTX, from, offset int64, expiresAt time.Time) error {
+	result, err := db.Exec(`UPDATE upload_sessions SET upload_offset = ?, expires_at = ?
+		WHERE id = ? AND upload_offset = ? AND status = ?`, offset, expiresAt, s.ID, from, UploadActive)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrUploadOffsetMismatch
+	}
+
+	s.Offset = offset
+	s.ExpiresAt = expiresAt
+	return nil
+}
+
+// Complete marks the session as finished with the document it created
+func (s *UploadSession) Complete(db DBTX, documentID int64) error {
+	_, err := db.Exec(`UPDATE upload_sessions SET status = ?, document_id = ? WHERE id = ?`,
+		UploadCompleted, documentID, s.ID)
+	if err != nil {
+		return err
+	}
+	s.Status = UploadCompleted
+	s.DocumentID = documentID
+	return nil
+}
+
+// Fail marks the session as rejected, e.g. because the finished file failed
+// validation
+func (s *UploadSession) Fail(db DBTX, message string) error {
+	_, err := db.Exec(`UPDATE upload_sessions SET status = ?, error = ? WHERE id = ?`, UploadFailed, message, s.ID)
+	if err != nil {
+		return err
+	}
+	s.Status = UploadFailed
+	s.Error = message
+	return nil
+}
+
+// Delete removes the session record
+func (s *UploadSession) Delete(db DBTX) error {
+	_, err := db.Exec(`DELETE FROM upload_sessions WHERE id = ?`, s.ID)
+	return err
+}
+
+// CaseStorageUsage returns the bytes a case's documents take up, counting
+// every version, plus the full length of its active upload sessions
+func CaseStorageUsage(db *sql.DB, caseID int64) (int64, error) {
+	var documents, sessions int64
+	if err := db.QueryRow(`SELECT COALESCE(SUM(file_size), 0) FROM documents WHERE case_id = ?`,
+		caseID).Scan(&documents); err != nil {
+		return 0, err
+	}
+	if err := db.QueryRow(`SELECT COALESCE(SUM(upload_length), 0) FROM upload_sessions WHERE case_id = ? AND status = ?`,
+		caseID, UploadActive).Scan(&sessions); err != nil {
+		return 0, err
+	}
+	return documents + sessions, nil
+}
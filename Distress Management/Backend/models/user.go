@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
-	"log"
 	"strings"
 	"time"
 
@@ -60,6 +59,9 @@ func (nt *NullTime) Scan(value interface{}) error {
 	return nil
 }
 
+// ErrEmailExists is returned when another user already has the email address
+var ErrEmailExists = errors.New("email already exists")
+
 type User struct {
 	ID         int64     `json:"id"`
 	Name       string    `json:"name"`
@@ -73,13 +75,13 @@ type User struct {
 	UpdatedAt  time.Time `json:"updated_at"`
 }
 
-// MarshalJSON implements custom JSON marshaling for User
+// MarshalJSON implements custom JSON marshaling for User. The password hash
+// is never serialised.
 func (u User) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
 		ID         int64     `json:"id"`
 		Name       string    `json:"name"`
 		Email      string    `json:"email"`
-		Password   string    `json:"password,omitempty"`
 		Role       string    `json:"role"`
 		Department string    `json:"department"`
 		Active     bool      `json:"active"`
@@ -90,7 +92,6 @@ func (u User) MarshalJSON() ([]byte, error) {
 		ID:         u.ID,
 		Name:       u.Name,
 		Email:      u.Email,
-		Password:   u.Password,
 		Role:       u.Role,
 		Department: u.Department,
 		Active:     u.Active,
@@ -101,9 +102,6 @@ func (u User) MarshalJSON() ([]byte, error) {
 }
 
 func (u *User) Create(db *sql.DB) error {
-	log.Printf("DEBUG: Creating user with email: %s", u.Email)
-	log.Printf("DEBUG: Password length: %d", len(u.Password))
-
 	if strings.TrimSpace(u.Email) == "" {
 		return errors.New("email is required")
 	}
@@ -142,7 +140,7 @@ func (u *User) Create(db *sql.DB) error {
 
 	if err != nil {
 		if strings.Contains(err.Error(), "Duplicate entry") {
-			return errors.New("email already exists")
+			return ErrEmailExists
 		}
 		return err
 	}
@@ -220,24 +218,23 @@ func GetUserByEmail(db *sql.DB, email string) (*User, error) {
 }
 
 func (u *User) ComparePassword(password string) error {
-	log.Printf("DEBUG: Stored hash: %s", u.Password)
-	log.Printf("DEBUG: Input password: %s", password)
-	log.Printf("DEBUG: Hash length: %d, Input length: %d", len(u.Password), len(password))
-
 	// Make sure we have a valid bcrypt hash
 	if !strings.HasPrefix(u.Password, "$2a$") {
-		log.Printf("DEBUG: Invalid hash format - doesn't start with $2a$")
 		return errors.New("invalid password format")
 	}
 
 	// Compare the password
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+}
+
+// UpdateLastLogin records a successful login
+func (u *User) UpdateLastLogin(db *sql.DB) error {
+	now := time.Now()
+	_, err := db.Exec(`UPDATE users SET last_login = ? WHERE id = ?`, now, u.ID)
 	if err != nil {
-		log.Printf("DEBUG: Password comparison failed: %v", err)
 		return err
 	}
-
-	log.Printf("DEBUG: Password comparison succeeded")
+	u.LastLogin = NullTime{sql.NullTime{Time: now, Valid: true}}
 	return nil
 }
 
@@ -264,6 +261,9 @@ func (u *User) Update(db *sql.DB) error {
 		u.UpdatedAt,
 		u.ID,
 	)
+	if err != nil && strings.Contains(err.Error(), "Duplicate entry") {
+		return ErrEmailExists
+	}
 	return err
 }
 
@@ -278,10 +278,37 @@ func (u *User) UpdatePassword(db *sql.DB, newPassword string) error {
 	return err
 }
 
-func GetUsers(db *sql.DB) ([]User, error) {
+// UserFilter narrows the users returned by GetUsers. Empty fields match everything.
+type UserFilter struct {
+	Role       string
+	Department string
+	Active     *bool
+}
+
+func GetUsers(db *sql.DB, filter UserFilter) ([]User, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.Role != "" {
+		conditions = append(conditions, "role = ?")
+		args = append(args, filter.Role)
+	}
+	if filter.Department != "" {
+		conditions = append(conditions, "department = ?")
+		args = append(args, filter.Department)
+	}
+	if filter.Active != nil {
+		conditions = append(conditions, "active = ?")
+		args = append(args, *filter.Active)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
 	query := `SELECT id, name, email, role, department, active, last_login, created_at, updated_at 
-		FROM users ORDER BY created_at DESC`
-	rows, err := db.Query(query)
+		FROM users ` + where + ` ORDER BY created_at DESC`
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,144 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const clamdChunkSize = 64 << 10
+
+// ClamdStreamMaxLength is clamd's default StreamMaxLength, the largest stream
+// it will scan. Larger files fail to scan unless clamd.conf raises it.
+const ClamdStreamMaxLength = 25 << 20
+
+// ErrClamd is wrapped around errors reported by clamd itself, such as
+// exceeding its StreamMaxLength
+var ErrClamd = errors.New("clamd error")
+
+// Clamd scans files with a ClamAV daemon using the INSTREAM command
+type Clamd struct {
+	Network string // "tcp" or "unix"
+	Address string
+	Timeout time.Duration
+}
+
+// NewClamd parses an address of the form tcp://host:port or
+// unix:///path/to/clamd.sock
+func NewClamd(addr string, timeout time.Duration) (*Clamd, error) {
+	network, address, ok := strings.Cut(addr, "://")
+	if !ok || address == "" || (network != "tcp" && network != "unix") {
+		return nil, fmt.Errorf("scanner: clamd address must be tcp://host:port or unix:///path, got %q", addr)
+	}
+	return &Clamd{Network: network, Address: address, Timeout: timeout}, nil
+}
+
+// Scan streams r to clamd in length-prefixed chunks and parses the verdict,
+// which looks like "stream: OK" or "stream: Eicar-Signature FOUND"
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return Result{}, fmt.Errorf("scanner: connecting to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The z prefix means commands and replies are NUL-terminated
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, fmt.Errorf("scanner: sending to clamd: %w", err)
+	}
+
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				// clamd closes the connection when a size limit is hit;
+				// its reply explains why
+				if reply, replyErr := readReply(conn); replyErr == nil {
+					return parseReply(reply)
+				}
+				return Result{}, fmt.Errorf("scanner: sending to clamd: %w", err)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return Result{}, readErr
+		}
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return Result{}, fmt.Errorf("scanner: sending to clamd: %w", err)
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return Result{}, fmt.Errorf("scanner: reading clamd reply: %w", err)
+	}
+	return parseReply(reply)
+}
+
+// Ping checks that clamd is reachable
+func (c *Clamd) Ping(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("%w: unexpected reply %q", ErrClamd, reply)
+	}
+	return nil
+}
+
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && !(err == io.EOF && len(reply) > 0) {
+		return "", err
+	}
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
+
+func parseReply(reply string) (Result, error) {
+	// Replies to INSTREAM are prefixed with the stream name
+	verdict := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+
+	switch {
+	case verdict == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	case strings.HasSuffix(verdict, " ERROR"):
+		return Result{}, fmt.Errorf("%w: %s", ErrClamd, strings.TrimSuffix(verdict, " ERROR"))
+	}
+	return Result{}, fmt.Errorf("%w: unexpected reply %q", ErrClamd, reply)
+}
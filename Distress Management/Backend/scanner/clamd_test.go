@@ -0,0 +1,163 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd accepts INSTREAM connections and answers each with reply once
+// the whole stream has arrived. The received streams are sent on got.
+func fakeClamd(t *testing.T, reply string) (*Clamd, <-chan []byte) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	got := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn, reply, got)
+		}
+	}()
+
+	return &Clamd{Network: "tcp", Address: ln.Addr().String(), Timeout: 5 * time.Second}, got
+}
+
+func serveClamd(conn net.Conn, reply string, got chan<- []byte) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch command {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+		return
+	case "zINSTREAM\x00":
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var stream bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+			return
+		}
+	}
+	got <- stream.Bytes()
+	conn.Write([]byte(reply + "\x00"))
+}
+
+func TestClamdScan(t *testing.T) {
+	// Larger than one chunk, so the stream is split
+	content := bytes.Repeat([]byte("distress "), clamdChunkSize/4)
+
+	tests := []struct {
+		name      string
+		reply     string
+		want      Result
+		wantError bool
+	}{
+		{"clean", "stream: OK", Result{}, false},
+		{"infected", "stream: Eicar-Signature FOUND", Result{Infected: true, Signature: "Eicar-Signature"}, false},
+		{"error", "INSTREAM size limit exceeded. ERROR", Result{}, true},
+		{"unexpected", "stream: MAYBE", Result{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clamd, got := fakeClamd(t, tt.reply)
+
+			result, err := clamd.Scan(context.Background(), bytes.NewReader(content))
+			if tt.wantError {
+				if !errors.Is(err, ErrClamd) {
+					t.Fatalf("Scan() error = %v, want ErrClamd", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Scan(): %v", err)
+			}
+			if result != tt.want {
+				t.Errorf("Scan() = %+v, want %+v", result, tt.want)
+			}
+
+			if stream := <-got; !bytes.Equal(stream, content) {
+				t.Errorf("clamd received %d bytes, want %d", len(stream), len(content))
+			}
+		})
+	}
+}
+
+func TestClamdScanEmpty(t *testing.T) {
+	clamd, got := fakeClamd(t, "stream: OK")
+
+	if _, err := clamd.Scan(context.Background(), strings.NewReader("")); err != nil {
+		t.Fatalf("Scan(): %v", err)
+	}
+	if stream := <-got; len(stream) != 0 {
+		t.Errorf("clamd received %d bytes, want 0", len(stream))
+	}
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	clamd := &Clamd{Network: "tcp", Address: addr, Timeout: time.Second}
+	_, err = clamd.Scan(context.Background(), strings.NewReader("content"))
+	if err == nil {
+		t.Fatal("Scan() succeeded without clamd")
+	}
+	// Connection errors are retried, so they must not look like clamd errors
+	if errors.Is(err, ErrClamd) {
+		t.Errorf("Scan() error = %v, want a connection error", err)
+	}
+}
+
+func TestClamdPing(t *testing.T) {
+	clamd, _ := fakeClamd(t, "")
+	if err := clamd.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping(): %v", err)
+	}
+}
+
+func TestNewClamd(t *testing.T) {
+	for _, addr := range []string{"tcp://localhost:3310", "unix:///run/clamav/clamd.ctl"} {
+		if _, err := NewClamd(addr, 0); err != nil {
+			t.Errorf("NewClamd(%q): %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"", "localhost:3310", "http://localhost:3310", "tcp://"} {
+		if _, err := NewClamd(addr, 0); err == nil {
+			t.Errorf("NewClamd(%q) succeeded, want error", addr)
+		}
+	}
+}
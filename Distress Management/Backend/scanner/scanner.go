@@ -0,0 +1,27 @@
+// Package scanner checks uploaded files for malware.
+package scanner
+
+import (
+	"context"
+	"io"
+)
+
+// Result is the verdict for one file
+type Result struct {
+	Infected bool
+	// Signature names the detected malware when Infected is set
+	Signature string
+}
+
+// Scanner inspects a stream of file content
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// Noop reports every file as clean. It is only used when scanning has been
+// explicitly disabled.
+type Noop struct{}
+
+func (Noop) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	return Result{}, nil
+}
@@ -0,0 +1,256 @@
+// Package search is an embedded, in-memory full-text index over cases,
+// progress notes and documents. It needs no external search service: the API
+// loads it from the database at startup and keeps it current as records change.
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Entity types held in the index
+const (
+	TypeCase     = "case"
+	TypeNote     = "note"
+	TypeDocument = "document"
+)
+
+// BM25 ranking parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Entry is a record to index
+type Entry struct {
+	Type          string
+	ID            int64
+	CaseID        int64
+	CaseReference string
+	Title         string
+	Text          string
+	// Visibility and AuthorID restrict who may see a progress note
+	Visibility string
+	AuthorID   int64
+}
+
+// Hit is a ranked search result
+type Hit struct {
+	Type          string  `json:"type"`
+	ID            int64   `json:"id"`
+	CaseID        int64   `json:"caseId"`
+	CaseReference string  `json:"caseReference"`
+	Title         string  `json:"title"`
+	Snippet       string  `json:"snippet"`
+	Score         float64 `json:"score"`
+}
+
+// Options restrict a search
+type Options struct {
+	// Types limits the entity types searched; empty means all
+	Types []string
+	// Allow reports whether hits from a case may be returned; nil allows all
+	Allow func(caseID int64) bool
+	// AllowEntry reports whether an entry may be returned; nil allows all
+	AllowEntry func(e Entry) bool
+	// Limit caps the hits returned per entity type; zero means 20
+	Limit int
+}
+
+type key struct {
+	typ string
+	id  int64
+}
+
+type indexed struct {
+	entry  Entry
+	length int
+	terms  map[string]int
+}
+
+// Index is safe for concurrent use
+type Index struct {
+	mu       sync.RWMutex
+	docs     map[key]*indexed
+	postings map[string]map[key]int
+	totalLen int
+}
+
+// NewIndex returns an empty index
+func NewIndex() *Index {
+	return &Index{
+		docs:     make(map[key]*indexed),
+		postings: make(map[string]map[key]int),
+	}
+}
+
+// Put adds an entry, replacing any entry with the same type and ID
+func (ix *Index) Put(e Entry) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	k := key{e.Type, e.ID}
+	ix.remove(k)
+
+	tokens := Tokenize(e.Title + " " + e.Text)
+	doc := &indexed{entry: e, length: len(tokens), terms: make(map[string]int)}
+	for _, t := range tokens {
+		doc.terms[t]++
+	}
+	for t, tf := range doc.terms {
+		if ix.postings[t] == nil {
+			ix.postings[t] = make(map[key]int)
+		}
+		ix.postings[t][k] = tf
+	}
+
+	ix.docs[k] = doc
+	ix.totalLen += doc.length
+}
+
+// Remove deletes an entry from the index
+func (ix *Index) Remove(typ string, id int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(key{typ, id})
+}
+
+// RemoveCase deletes every entry belonging to a case
+func (ix *Index) RemoveCase(caseID int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for k, doc := range ix.docs {
+		if doc.entry.CaseID == caseID {
+			ix.remove(k)
+		}
+	}
+}
+
+func (ix *Index) remove(k key) {
+	doc, ok := ix.docs[k]
+	if !ok {
+		return
+	}
+	for t := range doc.terms {
+		delete(ix.postings[t], k)
+		if len(ix.postings[t]) == 0 {
+			delete(ix.postings, t)
+		}
+	}
+	ix.totalLen -= doc.length
+	delete(ix.docs, k)
+}
+
+// Len returns the number of indexed entries
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.docs)
+}
+
+// Search returns the entries containing every term of the query, ranked by
+// BM25 and grouped by entity type
+func (ix *Index) Search(query string, opts Options) map[string][]Hit {
+	terms := uniqueTerms(Tokenize(query))
+	results := make(map[string][]Hit)
+	if len(terms) == 0 {
+		return results
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+	types := make(map[string]bool)
+	for _, t := range opts.Types {
+		types[t] = true
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	n := float64(len(ix.docs))
+	avgLen := float64(ix.totalLen) / math.Max(n, 1)
+
+	// Start from the rarest term so the candidate set is as small as possible
+	sort.Slice(terms, func(i, j int) bool {
+		return len(ix.postings[terms[i]]) < len(ix.postings[terms[j]])
+	})
+
+	scores := make(map[key]float64)
+	for k := range ix.postings[terms[0]] {
+		scores[k] = 0
+	}
+	for _, t := range terms {
+		posting := ix.postings[t]
+		idf := math.Log(1 + (n-float64(len(posting))+0.5)/(float64(len(posting))+0.5))
+		for k := range scores {
+			tf, ok := posting[k]
+			if !ok {
+				delete(scores, k)
+				continue
+			}
+			norm := 1 - bm25B + bm25B*float64(ix.docs[k].length)/avgLen
+			scores[k] += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*norm)
+		}
+	}
+
+	for k, score := range scores {
+		doc := ix.docs[k]
+		if len(types) > 0 && !types[k.typ] {
+			continue
+		}
+		if opts.Allow != nil && !opts.Allow(doc.entry.CaseID) {
+			continue
+		}
+		if opts.AllowEntry != nil && !opts.AllowEntry(doc.entry) {
+			continue
+		}
+		results[k.typ] = append(results[k.typ], Hit{
+			Type:          k.typ,
+			ID:            doc.entry.ID,
+			CaseID:        doc.entry.CaseID,
+			CaseReference: doc.entry.CaseReference,
+			Title:         doc.entry.Title,
+			Score:         score,
+		})
+	}
+
+	for typ, hits := range results {
+		sort.Slice(hits, func(i, j int) bool {
+			if hits[i].Score != hits[j].Score {
+				return hits[i].Score > hits[j].Score
+			}
+			return hits[i].ID > hits[j].ID
+		})
+		if len(hits) > limit {
+			hits = hits[:limit]
+		}
+		for i := range hits {
+			hits[i].Snippet = entrySnippet(ix.docs[key{typ, hits[i].ID}].entry, terms)
+		}
+		results[typ] = hits
+	}
+
+	return results
+}
+
+func uniqueTerms(tokens []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, t := range tokens {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// Tokenize lowercases text and splits it into runs of letters and digits, so
+// names and identifiers such as passport numbers become single terms
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), isSeparator)
+}
@@ -0,0 +1,217 @@
+package search
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Hello, World!", "hello world"},
+		{"Passport AB123456 lost in Dubai", "passport ab123456 lost in dubai"},
+		{"DM/2026/EMERGENCY/00007", "dm 2026 emergency 00007"},
+		{"O'Brien – São Paulo", "o brien são paulo"},
+		{"  \t\n ", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(Tokenize(tt.text), " "); got != tt.want {
+			t.Errorf("Tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func hitIDs(hits []Hit) []int64 {
+	ids := make([]int64, len(hits))
+	for i, h := range hits {
+		ids[i] = h.ID
+	}
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSearchRanking(t *testing.T) {
+	ix := NewIndex()
+	ix.Put(Entry{Type: TypeCase, ID: 1, CaseID: 1, Title: "Stranded seafarer", Text: "Crew member stranded in port without wages"})
+	ix.Put(Entry{Type: TypeCase, ID: 2, CaseID: 2, Title: "Passport lost", Text: "Passport lost passport stolen, needs emergency passport"})
+	ix.Put(Entry{Type: TypeCase, ID: 3, CaseID: 3, Title: "Medical evacuation", Text: "Hospital needs a copy of the passport"})
+	ix.Put(Entry{Type: TypeNote, ID: 10, CaseID: 3, Text: "Called the hospital about the passport"})
+
+	results := ix.Search("passport", Options{})
+	if got, want := hitIDs(results[TypeCase]), []int64{2, 3}; !equalIDs(got, want) {
+		t.Errorf("case hits = %v, want %v (more occurrences rank higher)", got, want)
+	}
+	if got, want := hitIDs(results[TypeNote]), []int64{10}; !equalIDs(got, want) {
+		t.Errorf("note hits = %v, want %v", got, want)
+	}
+
+	// Every term must match
+	results = ix.Search("passport hospital", Options{})
+	if got, want := hitIDs(results[TypeCase]), []int64{3}; !equalIDs(got, want) {
+		t.Errorf("case hits for two terms = %v, want %v", got, want)
+	}
+
+	// A rare term outweighs a common one
+	ix.Put(Entry{Type: TypeCase, ID: 4, CaseID: 4, Title: "Visa", Text: "visa visa visa passport"})
+	ix.Put(Entry{Type: TypeCase, ID: 5, CaseID: 5, Title: "Deportation", Text: "deportation order passport"})
+	results = ix.Search("passport deportation", Options{Types: []string{TypeCase}})
+	if got, want := hitIDs(results[TypeCase]), []int64{5}; !equalIDs(got, want) {
+		t.Errorf("case hits = %v, want %v", got, want)
+	}
+	if _, ok := results[TypeNote]; ok {
+		t.Error("notes returned although only cases were asked for")
+	}
+
+	if results := ix.Search("  ...  ", Options{}); len(results) != 0 {
+		t.Errorf("search without terms returned %v", results)
+	}
+	if results := ix.Search("nonexistent", Options{}); len(results) != 0 {
+		t.Errorf("search for a missing term returned %v", results)
+	}
+}
+
+func TestSearchUpdatesAndRemoves(t *testing.T) {
+	ix := NewIndex()
+	ix.Put(Entry{Type: TypeDocument, ID: 1, CaseID: 7, Title: "report.pdf", Text: "ambulance invoice"})
+	ix.Put(Entry{Type: TypeDocument, ID: 1, CaseID: 7, Title: "report.pdf", Text: "hotel receipt"})
+
+	if hits := ix.Search("ambulance", Options{}); len(hits) != 0 {
+		t.Errorf("replaced text still found: %v", hits)
+	}
+	if hits := ix.Search("hotel", Options{}); len(hits[TypeDocument]) != 1 {
+		t.Errorf("new text not found: %v", hits)
+	}
+
+	ix.Put(Entry{Type: TypeNote, ID: 1, CaseID: 7, Text: "hotel booked"})
+	ix.Remove(TypeDocument, 1)
+	if hits := ix.Search("hotel", Options{}); len(hits[TypeDocument]) != 0 || len(hits[TypeNote]) != 1 {
+		t.Errorf("after Remove got %v, want only the note", hits)
+	}
+
+	ix.RemoveCase(7)
+	if ix.Len() != 0 {
+		t.Errorf("Len() = %d after RemoveCase, want 0", ix.Len())
+	}
+}
+
+// TestSearchFilters checks that entries rejected by Allow or AllowEntry are
+// never returned, not even when they would rank first or fill the limit
+func TestSearchFilters(t *testing.T) {
+	ix := NewIndex()
+	// The hidden entries mention the term more often, so they rank higher
+	ix.Put(Entry{Type: TypeCase, ID: 1, CaseID: 1, Title: "Secret", Text: "evacuation evacuation evacuation"})
+	ix.Put(Entry{Type: TypeCase, ID: 2, CaseID: 2, Title: "Visible", Text: "evacuation requested"})
+	ix.Put(Entry{Type: TypeNote, ID: 10, CaseID: 2, Text: "evacuation evacuation plan", Visibility: "internal", AuthorID: 99})
+	ix.Put(Entry{Type: TypeNote, ID: 11, CaseID: 2, Text: "evacuation confirmed", Visibility: "department", AuthorID: 5})
+	ix.Put(Entry{Type: TypeNote, ID: 12, CaseID: 1, Text: "evacuation evacuation evacuation", Visibility: "department", AuthorID: 5})
+
+	opts := Options{
+		Allow: func(caseID int64) bool { return caseID == 2 },
+		AllowEntry: func(e Entry) bool {
+			return e.Type != TypeNote || e.Visibility != "internal" || e.AuthorID == 5
+		},
+		Limit: 1,
+	}
+	results := ix.Search("evacuation", opts)
+
+	if got, want := hitIDs(results[TypeCase]), []int64{2}; !equalIDs(got, want) {
+		t.Errorf("case hits = %v, want %v", got, want)
+	}
+	if got, want := hitIDs(results[TypeNote]), []int64{11}; !equalIDs(got, want) {
+		t.Errorf("note hits = %v, want %v", got, want)
+	}
+	for typ, hits := range results {
+		for _, h := range hits {
+			if h.CaseID != 2 {
+				t.Errorf("%s %d from case %d was returned although its case is not allowed", typ, h.ID, h.CaseID)
+			}
+			if strings.Contains(h.Snippet, "plan") {
+				t.Errorf("snippet of a hidden note leaked: %q", h.Snippet)
+			}
+		}
+	}
+
+	// Nothing allowed means nothing returned
+	none := ix.Search("evacuation", Options{Allow: func(int64) bool { return false }})
+	if len(none) != 0 {
+		t.Errorf("search with no allowed cases returned %v", none)
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	ix := NewIndex()
+	for id := int64(1); id <= 30; id++ {
+		ix.Put(Entry{Type: TypeCase, ID: id, CaseID: id, Title: "Repatriation"})
+	}
+
+	if got := len(ix.Search("repatriation", Options{})[TypeCase]); got != 20 {
+		t.Errorf("default limit returned %d hits, want 20", got)
+	}
+	hits := ix.Search("repatriation", Options{Limit: 5})[TypeCase]
+	// Equal scores are ordered newest first
+	if got, want := hitIDs(hits), []int64{30, 29, 28, 27, 26}; !equalIDs(got, want) {
+		t.Errorf("hits = %v, want %v", got, want)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	tests := []struct {
+		text  string
+		terms []string
+		want  string
+	}{
+		{"Called the <b>hospital</b> today", []string{"hospital"}, "Called the &lt;b&gt;<mark>hospital</mark>&lt;/b&gt; today"},
+		{"Passport lost, PASSPORT stolen", []string{"passport"}, "<mark>Passport</mark> lost, <mark>PASSPORT</mark> stolen"},
+		{"no match here", []string{"visa"}, "no match here"},
+		{strings.Repeat("a ", 100) + "visa" + strings.Repeat(" b", 100), []string{"visa"},
+			"…" + strings.Repeat("a ", 40) + "<mark>visa</mark>" + strings.Repeat(" b", 40) + "…"},
+	}
+	for _, tt := range tests {
+		if got := Snippet(tt.text, tt.terms); got != tt.want {
+			t.Errorf("Snippet(%q, %v) =\n%q\nwant\n%q", tt.text, tt.terms, got, tt.want)
+		}
+	}
+}
+
+func TestSnippetFromTitle(t *testing.T) {
+	ix := NewIndex()
+	ix.Put(Entry{Type: TypeDocument, ID: 1, CaseID: 1, Title: "passport_scan.pdf", Text: "Republic of Ghana travel document"})
+	ix.Put(Entry{Type: TypeDocument, ID: 2, CaseID: 1, Title: "passport.pdf", Text: "Copy of the passport"})
+	ix.Put(Entry{Type: TypeDocument, ID: 3, CaseID: 1, Title: "photo <1>.jpg"})
+
+	snippets := map[int64]string{}
+	for _, h := range ix.Search("passport", Options{})[TypeDocument] {
+		snippets[h.ID] = h.Snippet
+	}
+	for _, h := range ix.Search("photo", Options{})[TypeDocument] {
+		snippets[h.ID] = h.Snippet
+	}
+
+	want := map[int64]string{
+		// Only the title matches
+		1: "<mark>passport</mark>_scan.pdf",
+		// The text matches, so it is preferred
+		2: "Copy of the <mark>passport</mark>",
+		// No text at all
+		3: "<mark>photo</mark> &lt;1&gt;.jpg",
+	}
+	for id, w := range want {
+		if snippets[id] != w {
+			t.Errorf("snippet of document %d = %q, want %q", id, snippets[id], w)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package search
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+const snippetRadius = 80
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+type span struct{ start, end int }
+
+// matchSpans returns the byte ranges of the words in text that are among terms
+func matchSpans(text string, terms []string) []span {
+	match := make(map[string]bool, len(terms))
+	for _, t := range terms {
+		match[t] = true
+	}
+
+	var spans []span
+	start := -1
+	for i, r := range text + " " {
+		if isSeparator(r) {
+			if start >= 0 && match[strings.ToLower(text[start:i])] {
+				spans = append(spans, span{start, i})
+			}
+			start = -1
+		} else if start < 0 {
+			start = i
+		}
+	}
+	return spans
+}
+
+// entrySnippet returns the snippet of an entry's text, or of its title when
+// only the title matches
+func entrySnippet(e Entry, terms []string) string {
+	if len(matchSpans(e.Text, terms)) == 0 && len(matchSpans(e.Title, terms)) > 0 {
+		return Snippet(e.Title, terms)
+	}
+	return Snippet(e.Text, terms)
+}
+
+// Snippet returns an HTML-escaped excerpt of text around the first matching
+// term, with every matching term wrapped in <mark></mark>
+func Snippet(text string, terms []string) string {
+	spans := matchSpans(text, terms)
+	if len(spans) == 0 {
+		if len(text) <= 2*snippetRadius {
+			return html.EscapeString(text)
+		}
+		return html.EscapeString(strings.TrimSpace(text[:runeBoundary(text, 2*snippetRadius)])) + "…"
+	}
+
+	from := runeBoundary(text, max(spans[0].start-snippetRadius, 0))
+	to := runeBoundary(text, min(spans[0].end+snippetRadius, len(text)))
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := from
+	for _, s := range spans {
+		if s.start < from || s.end > to {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:s.start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[s.start:s.end]))
+		b.WriteString("</mark>")
+		pos = s.end
+	}
+	b.WriteString(html.EscapeString(text[pos:to]))
+	if to < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// runeBoundary moves i back to the start of the UTF-8 sequence containing it
+func runeBoundary(s string, i int) int {
+	for i > 0 && i < len(s) && s[i]&0xC0 == 0x80 {
+		i--
+	}
+	return i
+}
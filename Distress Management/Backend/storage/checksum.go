@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrChecksumMismatch means stored content no longer matches its recorded
+// SHA-256 checksum
+var ErrChecksumMismatch = errors.New("storage: checksum mismatch")
+
+// ContentKey returns the content-addressed key for a hex SHA-256 checksum.
+// The first two hex digits fan objects out over 256 directories.
+func ContentKey(checksum string) string {
+	return fmt.Sprintf("sha256/%s/%s", checksum[:2], checksum)
+}
+
+// ContentKeyFor returns the key content with checksum is stored under in s.
+// Storages that name content themselves, like Encrypted, are asked;
+// otherwise it is ContentKey.
+func ContentKeyFor(s Storage, checksum string) string {
+	if namer, ok := s.(interface{ ContentKey(string) string }); ok {
+		return namer.ContentKey(checksum)
+	}
+	return ContentKey(checksum)
+}
+
+// Checksum returns the hex SHA-256 of everything read from r and its length
+func Checksum(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// Verify reads the object stored under key and checks it against checksum
+func Verify(ctx context.Context, s Storage, key, checksum string) error {
+	f, _, err := s.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sum, _, err := Checksum(f)
+	if err != nil {
+		return err
+	}
+	if sum != checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
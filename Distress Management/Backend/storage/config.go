@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// FromEnv builds the backend selected by STORAGE_BACKEND: "local" (the
+// default) stores files below STORAGE_ROOT, "s3" uses the S3_* variables.
+// If master keys are configured (see KeyringFromEnv) objects are encrypted.
+func FromEnv() (Storage, error) {
+	backend, err := backendFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := KeyringFromEnv()
+	if err != nil || keys == nil {
+		return backend, err
+	}
+	return NewEncrypted(backend, keys), nil
+}
+
+// KeyringFromEnv loads the master keys from STORAGE_ENCRYPTION_KEY_FILE or
+// STORAGE_ENCRYPTION_KEYS ("id:base64key,...", the first being the primary).
+// It returns nil if neither is set.
+func KeyringFromEnv() (*Keyring, error) {
+	file := os.Getenv("STORAGE_ENCRYPTION_KEY_FILE")
+	spec := os.Getenv("STORAGE_ENCRYPTION_KEYS")
+	switch {
+	case file != "" && spec != "":
+		return nil, fmt.Errorf("storage: set only one of STORAGE_ENCRYPTION_KEY_FILE and STORAGE_ENCRYPTION_KEYS")
+	case file != "":
+		return LoadKeyFile(file)
+	case spec != "":
+		return ParseKeyring(spec)
+	}
+	return nil, nil
+}
+
+func backendFromEnv() (Storage, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		root := os.Getenv("STORAGE_ROOT")
+		if root == "" {
+			root = "./uploads"
+		}
+		return NewLocal(root)
+	case "s3":
+		return NewS3(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Prefix:    os.Getenv("S3_PREFIX"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Client:    &http.Client{Timeout: 5 * time.Minute},
+		})
+	default:
+		return nil, fmt.Errorf("storage: unknown STORAGE_BACKEND %q", backend)
+	}
+}
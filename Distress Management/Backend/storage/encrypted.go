@@ -0,0 +1,459 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Layout of encrypted objects. The body starts with a fixed header naming
+// its data key, followed by the content in chunks that are each sealed with
+// AES-256-GCM, so any range can be decrypted without reading from the start.
+// The data key, wrapped by a master key, is stored in a small sidecar object
+// next to the body; rotating master keys only rewrites sidecars.
+const (
+	encryptedMagic = "DMENC\x00\x00\x01"
+	dataKeyIDSize  = 16
+	headerSize     = len(encryptedMagic) + dataKeyIDSize + 8
+	chunkSize      = 64 << 10
+	tagSize        = 16
+	dataKeySize    = 32
+)
+
+// ErrNotEncrypted is returned by Rewrap for objects stored before
+// encryption was enabled
+var ErrNotEncrypted = errors.New("storage: object is not encrypted")
+
+// Encrypted wraps another Storage and encrypts every object at rest with its
+// own data key. Objects written before encryption was enabled are still read
+// as plain text.
+type Encrypted struct {
+	inner Storage
+	keys  *Keyring
+}
+
+// NewEncrypted returns a Storage that encrypts objects stored in inner
+func NewEncrypted(inner Storage, keys *Keyring) *Encrypted {
+	return &Encrypted{inner: inner, keys: keys}
+}
+
+// Keys returns the keyring objects are encrypted with
+func (e *Encrypted) Keys() *Keyring {
+	return e.keys
+}
+
+// ContentKey names content by an HMAC of its checksum instead of the checksum
+// itself, so object names do not reveal which known files are stored. The
+// HMAC key is derived from the primary master key, so names change when it
+// is rotated; callers that deduplicate content must look for content already
+// stored by its checksum first.
+func (e *Encrypted) ContentKey(checksum string) string {
+	mac := hmac.New(sha256.New, e.keys.naming)
+	mac.Write([]byte(checksum))
+	sum := hex.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("hmac-sha256/%s/%s", sum[:2], sum)
+}
+
+// header is the parsed header of an encrypted object
+type header struct {
+	raw []byte
+	id  []byte
+}
+
+// sidecarKey is where the wrapped data key of an object is kept. It includes
+// the data key ID, so concurrent writers of the same key cannot pair a body
+// with another writer's data key.
+func sidecarKey(key string, id []byte) string {
+	return key + ".dek-" + hex.EncodeToString(id)
+}
+
+// chunkAAD binds every chunk to its object and header
+func chunkAAD(key string, h header) []byte {
+	return append(append([]byte{}, h.raw...), key...)
+}
+
+// chunkNonce derives a chunk's nonce from its index. The final chunk is
+// flagged so a truncated object fails to decrypt instead of reading short.
+// Every object has its own data key, so nonces never repeat under a key.
+func chunkNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if final {
+		nonce[8] = 1
+	}
+	return nonce
+}
+
+// encryptedSize returns the stored size of size bytes of content
+func encryptedSize(size int64) int64 {
+	chunks := (size + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(headerSize) + size + chunks*tagSize
+}
+
+// plainSize returns the content size of a stored object, or -1 if the size
+// is not a valid encrypted size
+func plainSize(stored int64) int64 {
+	body := stored - int64(headerSize)
+	if body < tagSize {
+		return -1
+	}
+	chunks := (body + chunkSize + tagSize - 1) / (chunkSize + tagSize)
+	return body - chunks*tagSize
+}
+
+func (e *Encrypted) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dataKey := make([]byte, dataKeySize)
+	id := make([]byte, dataKeyIDSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	h := header{raw: make([]byte, headerSize), id: id}
+	copy(h.raw, encryptedMagic)
+	copy(h.raw[len(encryptedMagic):], id)
+	binary.BigEndian.PutUint32(h.raw[len(encryptedMagic)+dataKeyIDSize:], chunkSize)
+
+	aead, err := newDataCipher(dataKey)
+	if err != nil {
+		return err
+	}
+
+	// The replaced object's data key is removed once the new body is in place
+	previous, _ := e.readHeader(ctx, key)
+
+	// Store the wrapped data key first, so the body is never readable
+	// without it
+	if err := e.putDataKey(ctx, key, id, dataKey); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encryptStream(pw, r, aead, h, key))
+	}()
+
+	storedSize := int64(-1)
+	if size >= 0 {
+		storedSize = encryptedSize(size)
+	}
+	err = e.inner.Put(ctx, key, pr, storedSize)
+	pr.CloseWithError(err)
+	if err != nil {
+		e.inner.Delete(ctx, sidecarKey(key, id))
+		return err
+	}
+
+	if previous != nil && !bytes.Equal(previous.id, id) {
+		e.inner.Delete(ctx, sidecarKey(key, previous.id))
+	}
+	return nil
+}
+
+// encryptStream writes the header and the sealed chunks of r to w
+func encryptStream(w io.Writer, r io.Reader, aead cipher.AEAD, h header, key string) error {
+	if _, err := w.Write(h.raw); err != nil {
+		return err
+	}
+
+	aad := chunkAAD(key, h)
+	br := bufio.NewReaderSize(r, chunkSize)
+	plain := make([]byte, chunkSize)
+	sealed := make([]byte, 0, chunkSize+tagSize)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(br, plain)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+		if !final {
+			// A full chunk is the last one if nothing follows it
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(index, final), plain[:n], aad)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+func (e *Encrypted) Open(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	f, info, err := e.inner.Open(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	h, err := parseHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	if h == nil {
+		// Stored before encryption was enabled
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, ObjectInfo{}, err
+		}
+		return f, info, nil
+	}
+
+	size := plainSize(info.Size)
+	if size < 0 {
+		f.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("storage: encrypted object %s is truncated", key)
+	}
+	dataKey, err := e.dataKey(ctx, key, h.id)
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	aead, err := newDataCipher(dataKey)
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+
+	info.Size = size
+	return &decryptingReader{
+		inner:  f,
+		aead:   aead,
+		aad:    chunkAAD(key, *h),
+		size:   size,
+		chunks: (info.Size + chunkSize - 1) / chunkSize,
+		index:  -1,
+		buf:    make([]byte, chunkSize+tagSize),
+	}, info, nil
+}
+
+// Stat reads the object's header to report its content size
+func (e *Encrypted) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	f, info, err := e.Open(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	f.Close()
+	return info, nil
+}
+
+func (e *Encrypted) Delete(ctx context.Context, key string) error {
+	h, err := e.readHeader(ctx, key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err := e.inner.Delete(ctx, key); err != nil {
+		return err
+	}
+	if h != nil {
+		return e.inner.Delete(ctx, sidecarKey(key, h.id))
+	}
+	return nil
+}
+
+// Rewrap re-encrypts an object's data key with the primary master key,
+// leaving the body untouched. It reports whether the data key was rewrapped;
+// keys already wrapped with the primary key are left alone.
+func (e *Encrypted) Rewrap(ctx context.Context, key string) (bool, error) {
+	h, err := e.readHeader(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if h == nil {
+		return false, ErrNotEncrypted
+	}
+
+	w, err := e.readDataKey(ctx, key, h.id)
+	if err != nil {
+		return false, err
+	}
+	if w.MasterKeyID == e.keys.Primary() {
+		return false, nil
+	}
+
+	dataKey, err := e.keys.unwrap(w, []byte(sidecarKey(key, h.id)))
+	if err != nil {
+		return false, fmt.Errorf("storage: unwrapping data key of %s: %w", key, err)
+	}
+	return true, e.putDataKey(ctx, key, h.id, dataKey)
+}
+
+// IsEncrypted reports whether an object is stored encrypted
+func (e *Encrypted) IsEncrypted(ctx context.Context, key string) (bool, error) {
+	h, err := e.readHeader(ctx, key)
+	return h != nil, err
+}
+
+// readHeader returns the header of a stored object, or nil if it is not
+// encrypted
+func (e *Encrypted) readHeader(ctx context.Context, key string) (*header, error) {
+	f, _, err := e.inner.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseHeader(f)
+}
+
+func parseHeader(r io.Reader) (*header, error) {
+	raw := make([]byte, headerSize)
+	n, err := io.ReadFull(r, raw)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && string(raw[:len(encryptedMagic)]) != encryptedMagic) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(raw[len(encryptedMagic)+dataKeyIDSize:]) != chunkSize {
+		return nil, errors.New("storage: unsupported encrypted object chunk size")
+	}
+	return &header{raw: raw[:n], id: raw[len(encryptedMagic) : len(encryptedMagic)+dataKeyIDSize]}, nil
+}
+
+// putDataKey wraps a data key with the primary master key and stores it
+func (e *Encrypted) putDataKey(ctx context.Context, key string, id, dataKey []byte) error {
+	name := sidecarKey(key, id)
+	w, err := e.keys.wrap(dataKey, []byte(name))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return e.inner.Put(ctx, name, bytes.NewReader(data), int64(len(data)))
+}
+
+func (e *Encrypted) readDataKey(ctx context.Context, key string, id []byte) (wrappedKey, error) {
+	f, _, err := e.inner.Open(ctx, sidecarKey(key, id))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return wrappedKey{}, fmt.Errorf("storage: data key of %s is missing", key)
+		}
+		return wrappedKey{}, err
+	}
+	defer f.Close()
+
+	var w wrappedKey
+	if err := json.NewDecoder(io.LimitReader(f, 4096)).Decode(&w); err != nil {
+		return wrappedKey{}, fmt.Errorf("storage: reading data key of %s: %w", key, err)
+	}
+	return w, nil
+}
+
+// dataKey loads and unwraps an object's data key
+func (e *Encrypted) dataKey(ctx context.Context, key string, id []byte) ([]byte, error) {
+	w, err := e.readDataKey(ctx, key, id)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := e.keys.unwrap(w, []byte(sidecarKey(key, id)))
+	if err != nil {
+		return nil, fmt.Errorf("storage: unwrapping data key of %s: %w", key, err)
+	}
+	return dataKey, nil
+}
+
+func newDataCipher(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptingReader decrypts an encrypted object one chunk at a time,
+// supporting seeks for Range requests
+type decryptingReader struct {
+	inner  io.ReadSeekCloser
+	aead   cipher.AEAD
+	aad    []byte
+	size   int64
+	chunks int64
+	pos    int64
+
+	// index is the chunk held in plain, or -1
+	index int64
+	plain []byte
+	buf   []byte
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+
+	index := d.pos / chunkSize
+	if index != d.index {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain[d.pos-index*chunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// load reads and decrypts one chunk
+func (d *decryptingReader) load(index int64) error {
+	d.index = -1
+	if _, err := d.inner.Seek(int64(headerSize)+index*(chunkSize+tagSize), io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := io.ReadFull(d.inner, d.buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	final := index == d.chunks-1
+	plain, err := d.aead.Open(d.buf[:0], chunkNonce(index, final), d.buf[:n], d.aad)
+	if err != nil {
+		return fmt.Errorf("storage: decrypting chunk %d: %w", index, ErrChecksumMismatch)
+	}
+	d.plain = plain
+	d.index = index
+	return nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decryptingReader) Close() error {
+	return d.inner.Close()
+}
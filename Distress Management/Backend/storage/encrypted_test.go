@@ -0,0 +1,389 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// testMasterKey returns a base64-encoded master key filled with b
+func testMasterKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, masterKeySize))
+}
+
+func testKeyring(t *testing.T, primary string, ids ...string) *Keyring {
+	t.Helper()
+
+	keys := map[string]string{}
+	for _, id := range append(ids, primary) {
+		keys[id] = testMasterKey(id[len(id)-1])
+	}
+	k, err := NewKeyring(primary, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// newTestEncrypted returns an Encrypted storage keyed with "k1" over a
+// Local one in a temporary directory
+func newTestEncrypted(t *testing.T) (*Encrypted, *Local) {
+	t.Helper()
+
+	inner, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEncrypted(inner, testKeyring(t, "k1")), inner
+}
+
+func randomContent(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func putContent(t *testing.T, s Storage, key string, data []byte) {
+	t.Helper()
+	if err := s.Put(context.Background(), key, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put(%s): %v", key, err)
+	}
+}
+
+func readContent(s Storage, key string) ([]byte, error) {
+	f, _, err := s.Open(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// innerPath is the file an object of the Local storage is kept in
+func innerPath(t *testing.T, l *Local, key string) string {
+	t.Helper()
+	p, err := l.path(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	e, inner := newTestEncrypted(t)
+	ctx := context.Background()
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 5} {
+		for _, knownSize := range []bool{true, false} {
+			data := randomContent(size)
+			putSize := int64(len(data))
+			if !knownSize {
+				putSize = -1
+			}
+			if err := e.Put(ctx, "docs/object", bytes.NewReader(data), putSize); err != nil {
+				t.Fatalf("Put(%d bytes): %v", size, err)
+			}
+
+			got, err := readContent(e, "docs/object")
+			if err != nil {
+				t.Fatalf("reading %d bytes: %v", size, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes back, want the %d bytes stored", len(got), size)
+			}
+
+			info, err := e.Stat(ctx, "docs/object")
+			if err != nil || info.Size != int64(size) {
+				t.Errorf("Stat() = %d, %v; want %d", info.Size, err, size)
+			}
+			stored, err := inner.Stat(ctx, "docs/object")
+			if err != nil || stored.Size != encryptedSize(int64(size)) {
+				t.Errorf("stored %d bytes for %d, want %d", stored.Size, size, encryptedSize(int64(size)))
+			}
+			if size >= 16 {
+				raw, _ := readContent(inner, "docs/object")
+				if bytes.Contains(raw, data[:16]) {
+					t.Errorf("stored object of %d bytes contains its plaintext", size)
+				}
+			}
+		}
+	}
+}
+
+func TestEncryptedSeek(t *testing.T) {
+	e, _ := newTestEncrypted(t)
+	data := randomContent(3*chunkSize + 100)
+	putContent(t, e, "object", data)
+
+	f, _, err := e.Open(context.Background(), "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	size := int64(len(data))
+	tests := []struct {
+		offset int64
+		whence int
+		length int64
+		want   int64 // position expected after seeking
+	}{
+		{0, io.SeekStart, 10, 0},
+		{chunkSize - 5, io.SeekStart, 10, chunkSize - 5},
+		{chunkSize, io.SeekStart, chunkSize, chunkSize},
+		{2*chunkSize + 7, io.SeekStart, chunkSize + 93, 2*chunkSize + 7},
+		{-3, io.SeekEnd, 3, size - 3},
+		// Back to the first chunk after reading the last
+		{100, io.SeekStart, 2 * chunkSize, 100},
+		{-50, io.SeekCurrent, 50, 2*chunkSize + 50},
+	}
+	for _, tt := range tests {
+		pos, err := f.Seek(tt.offset, tt.whence)
+		if err != nil || pos != tt.want {
+			t.Fatalf("Seek(%d, %d) = %d, %v; want %d", tt.offset, tt.whence, pos, err, tt.want)
+		}
+		buf := make([]byte, tt.length)
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatalf("reading %d bytes at %d: %v", tt.length, pos, err)
+		}
+		if !bytes.Equal(buf, data[pos:pos+tt.length]) {
+			t.Errorf("%d bytes at %d do not match the content", tt.length, pos)
+		}
+	}
+
+	if _, err := f.Seek(size+10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Read past the end = %d, %v; want 0, EOF", n, err)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek to a negative position succeeded")
+	}
+}
+
+func TestEncryptedTampered(t *testing.T) {
+	data := randomContent(2*chunkSize + 10)
+	firstChunk := int64(headerSize)
+	secondChunk := firstChunk + chunkSize + tagSize
+
+	tests := []struct {
+		name   string
+		offset int64
+	}{
+		{"first chunk", firstChunk + 100},
+		{"first chunk tag", secondChunk - 1},
+		{"second chunk", secondChunk},
+		{"last byte", encryptedSize(int64(len(data))) - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, inner := newTestEncrypted(t)
+			putContent(t, e, "object", data)
+
+			f, err := os.OpenFile(innerPath(t, inner, "object"), os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 1)
+			f.ReadAt(b, tt.offset)
+			b[0] ^= 0x01
+			f.WriteAt(b, tt.offset)
+			f.Close()
+
+			if _, err := readContent(e, "object"); !errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("reading a flipped byte at %d: error = %v, want ErrChecksumMismatch", tt.offset, err)
+			}
+		})
+	}
+}
+
+func TestEncryptedTruncated(t *testing.T) {
+	data := randomContent(3 * chunkSize)
+	chunk := int64(chunkSize + tagSize)
+
+	tests := []struct {
+		name string
+		size int64
+	}{
+		{"at the second chunk boundary", int64(headerSize) + 2*chunk},
+		{"at the first chunk boundary", int64(headerSize) + chunk},
+		{"inside the last chunk", int64(headerSize) + 3*chunk - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, inner := newTestEncrypted(t)
+			putContent(t, e, "object", data)
+			if err := os.Truncate(innerPath(t, inner, "object"), tt.size); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := readContent(e, "object"); !errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("reading an object truncated to %d bytes: error = %v, want ErrChecksumMismatch", tt.size, err)
+			}
+		})
+	}
+
+	// Without even one chunk's tag the object cannot be opened
+	e, inner := newTestEncrypted(t)
+	putContent(t, e, "object", data)
+	if err := os.Truncate(innerPath(t, inner, "object"), int64(headerSize)+tagSize-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readContent(e, "object"); err == nil {
+		t.Error("opening an object without a whole chunk succeeded")
+	}
+}
+
+func TestEncryptedMissingDataKey(t *testing.T) {
+	e, inner := newTestEncrypted(t)
+	ctx := context.Background()
+	putContent(t, e, "object", []byte("content"))
+
+	h, err := e.readHeader(ctx, "object")
+	if err != nil || h == nil {
+		t.Fatalf("readHeader() = %v, %v", h, err)
+	}
+	if err := inner.Delete(ctx, sidecarKey("object", h.id)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The body is there, so the object is unreadable rather than missing
+	if _, err := readContent(e, "object"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("reading without the data key: error = %v, want an error other than ErrNotFound", err)
+	}
+	if _, err := e.Rewrap(ctx, "object"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Rewrap() without the data key: error = %v, want an error other than ErrNotFound", err)
+	}
+}
+
+// TestEncryptedReplaceAndDelete checks that replacing or deleting an object
+// also removes its data key
+func TestEncryptedReplaceAndDelete(t *testing.T) {
+	e, inner := newTestEncrypted(t)
+	ctx := context.Background()
+
+	putContent(t, e, "object", []byte("first"))
+	first, _ := e.readHeader(ctx, "object")
+	putContent(t, e, "object", []byte("second"))
+	second, _ := e.readHeader(ctx, "object")
+
+	if _, err := inner.Stat(ctx, sidecarKey("object", first.id)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("data key of the replaced object: Stat() error = %v, want ErrNotFound", err)
+	}
+	if got, err := readContent(e, "object"); err != nil || string(got) != "second" {
+		t.Errorf("reading the replaced object = %q, %v; want %q", got, err, "second")
+	}
+
+	if err := e.Delete(ctx, "object"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"object", sidecarKey("object", second.id)} {
+		if _, err := inner.Stat(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s after Delete: Stat() error = %v, want ErrNotFound", key, err)
+		}
+	}
+	if err := e.Delete(ctx, "object"); err != nil {
+		t.Errorf("deleting a missing object: %v", err)
+	}
+}
+
+func TestEncryptedRewrap(t *testing.T) {
+	inner, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	data := randomContent(chunkSize + 1)
+
+	before := NewEncrypted(inner, testKeyring(t, "k1"))
+	putContent(t, before, "object", data)
+
+	// k2 becomes the primary; k1 is kept to read what it wrapped
+	rotated := NewEncrypted(inner, testKeyring(t, "k2", "k1"))
+	if got, err := readContent(rotated, "object"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("reading with the old key still in the keyring: %v", err)
+	}
+
+	if changed, err := rotated.Rewrap(ctx, "object"); err != nil || !changed {
+		t.Fatalf("Rewrap() = %v, %v; want true", changed, err)
+	}
+	if changed, err := rotated.Rewrap(ctx, "object"); err != nil || changed {
+		t.Errorf("second Rewrap() = %v, %v; want false", changed, err)
+	}
+
+	h, _ := rotated.readHeader(ctx, "object")
+	w, err := rotated.readDataKey(ctx, "object", h.id)
+	if err != nil || w.MasterKeyID != "k2" {
+		t.Errorf("data key wrapped with %q, %v; want k2", w.MasterKeyID, err)
+	}
+
+	// With k1 retired the object is still readable, and only k1 no longer
+	// opens it
+	retired := NewEncrypted(inner, testKeyring(t, "k2"))
+	if got, err := readContent(retired, "object"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("reading after retiring k1: %v", err)
+	}
+	if _, err := readContent(before, "object"); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("reading with only k1: error = %v, want ErrUnknownMasterKey", err)
+	}
+
+	if _, err := rotated.Rewrap(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Rewrap() of a missing object: error = %v, want ErrNotFound", err)
+	}
+	putContent(t, inner, "plain", []byte("stored before encryption"))
+	if _, err := rotated.Rewrap(ctx, "plain"); err != ErrNotEncrypted {
+		t.Errorf("Rewrap() of a plaintext object: error = %v, want ErrNotEncrypted", err)
+	}
+}
+
+// TestEncryptedPlaintext checks that objects stored before encryption was
+// enabled are read as they are
+func TestEncryptedPlaintext(t *testing.T) {
+	e, inner := newTestEncrypted(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"shorter than a header", []byte("%PDF")},
+		{"longer than a header", bytes.Repeat([]byte("plain text "), 100)},
+		{"magic cut short", []byte(encryptedMagic + "abc")},
+	}
+	for _, tt := range tests {
+		putContent(t, inner, "plain", tt.data)
+
+		if encrypted, err := e.IsEncrypted(ctx, "plain"); err != nil || encrypted {
+			t.Errorf("%s: IsEncrypted() = %v, %v; want false", tt.name, encrypted, err)
+		}
+		if got, err := readContent(e, "plain"); err != nil || !bytes.Equal(got, tt.data) {
+			t.Errorf("%s: read %q, %v; want %q", tt.name, got, err, tt.data)
+		}
+	}
+
+	putContent(t, e, "encrypted", []byte("secret"))
+	if encrypted, err := e.IsEncrypted(ctx, "encrypted"); err != nil || !encrypted {
+		t.Errorf("IsEncrypted() of an encrypted object = %v, %v; want true", encrypted, err)
+	}
+	if _, err := e.IsEncrypted(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("IsEncrypted() of a missing object: error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestEncryptedSizes(t *testing.T) {
+	for _, size := range []int64{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 5 * chunkSize} {
+		if got := plainSize(encryptedSize(size)); got != size {
+			t.Errorf("plainSize(encryptedSize(%d)) = %d", size, got)
+		}
+	}
+	if got := plainSize(int64(headerSize) + tagSize - 1); got != -1 {
+		t.Errorf("plainSize() of an object without a whole tag = %d, want -1", got)
+	}
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// masterKeySize is the length of a master key: AES-256
+const masterKeySize = 32
+
+// ErrUnknownMasterKey is returned when a data key was wrapped with a master
+// key that is not in the keyring
+var ErrUnknownMasterKey = errors.New("storage: data key wrapped with an unknown master key")
+
+// Keyring holds the master keys that wrap per-object data keys. New data
+// keys are wrapped with the primary key; the others are kept so data keys
+// wrapped before a rotation can still be unwrapped.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+	// naming is derived from the primary key and keys the HMAC that names
+	// content-addressed objects
+	naming []byte
+}
+
+// keyFile is the format of a key file
+type keyFile struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// NewKeyring builds a keyring from base64-encoded 32-byte keys by ID
+func NewKeyring(primary string, keys map[string]string) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("storage: primary master key %q is not in the keyring", primary)
+	}
+
+	k := &Keyring{primary: primary, keys: make(map[string]cipher.AEAD, len(keys))}
+	for id, encoded := range keys {
+		if id == "" || strings.ContainsAny(id, ":,") {
+			return nil, fmt.Errorf("storage: invalid master key ID %q", id)
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(raw) != masterKeySize {
+			return nil, fmt.Errorf("storage: master key %q must be %d bytes, base64-encoded", id, masterKeySize)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		if id == primary {
+			mac := hmac.New(sha256.New, raw)
+			mac.Write([]byte("distress-management content keys"))
+			k.naming = mac.Sum(nil)
+		}
+		if k.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// ParseKeyring parses "id:base64key,id:base64key". The first key is the
+// primary.
+func ParseKeyring(spec string) (*Keyring, error) {
+	keys := map[string]string{}
+	primary := ""
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, key, found := strings.Cut(item, ":")
+		if !found {
+			return nil, errors.New("storage: master keys must be given as id:base64key")
+		}
+		id = strings.TrimSpace(id)
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("storage: duplicate master key ID %q", id)
+		}
+		keys[id] = key
+		if primary == "" {
+			primary = id
+		}
+	}
+	return NewKeyring(primary, keys)
+}
+
+// LoadKeyFile reads a JSON key file of the form
+// {"primary": "id", "keys": {"id": "base64key"}}. The file must not be
+// readable by other users.
+func LoadKeyFile(path string) (*Keyring, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("storage: key file %s must not be accessible by group or others (chmod 600)", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kf keyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("storage: parsing key file %s: %w", path, err)
+	}
+	return NewKeyring(kf.Primary, kf.Keys)
+}
+
+// Primary returns the ID of the key new data keys are wrapped with
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// IDs lists the master key IDs in the keyring
+func (k *Keyring) IDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// wrap encrypts a data key with the primary master key. aad binds the
+// wrapped key to the object it belongs to.
+func (k *Keyring) wrap(dataKey, aad []byte) (wrappedKey, error) {
+	aead := k.keys[k.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return wrappedKey{}, err
+	}
+	return wrappedKey{
+		Version:     1,
+		MasterKeyID: k.primary,
+		Nonce:       nonce,
+		Key:         aead.Seal(nil, nonce, dataKey, aad),
+	}, nil
+}
+
+// unwrap decrypts a data key
+func (k *Keyring) unwrap(w wrappedKey, aad []byte) ([]byte, error) {
+	aead, ok := k.keys[w.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownMasterKey, w.MasterKeyID)
+	}
+	if len(w.Nonce) != aead.NonceSize() {
+		return nil, errors.New("storage: malformed wrapped data key")
+	}
+	return aead.Open(nil, w.Nonce, w.Key, aad)
+}
+
+// wrappedKey is the stored form of a wrapped data key
+type wrappedKey struct {
+	Version     int    `json:"version"`
+	MasterKeyID string `json:"masterKeyId"`
+	Nonce       []byte `json:"nonce"`
+	Key         []byte `json:"wrappedKey"`
+}
+
+// GenerateMasterKey returns a new random master key, base64-encoded
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyring(t *testing.T) {
+	k1, k2 := testMasterKey(1), testMasterKey(2)
+
+	tests := []struct {
+		spec    string
+		primary string
+		ids     []string
+		wantErr string
+	}{
+		{"k1:" + k1, "k1", []string{"k1"}, ""},
+		{" k2:" + k2 + " , k1:" + k1 + ",", "k2", []string{"k1", "k2"}, ""},
+		{"", "", nil, "primary"},
+		{k1, "", nil, "id:base64key"},
+		{"k1:" + k1 + ",k1:" + k2, "", nil, "duplicate"},
+		{"k1:not-base64", "", nil, "base64"},
+		{"k1:" + testMasterKey(1)[:20], "", nil, "32 bytes"},
+		{"a,b:" + k1, "", nil, "id:base64key"},
+	}
+	for _, tt := range tests {
+		k, err := ParseKeyring(tt.spec)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseKeyring(%q) error = %v, want one mentioning %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseKeyring(%q): %v", tt.spec, err)
+			continue
+		}
+		if k.Primary() != tt.primary || strings.Join(k.IDs(), ",") != strings.Join(tt.ids, ",") {
+			t.Errorf("ParseKeyring(%q) = primary %q, IDs %v; want %q, %v", tt.spec, k.Primary(), k.IDs(), tt.primary, tt.ids)
+		}
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string, perm os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, perm); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	valid := `{"primary": "k2", "keys": {"k2": "` + testMasterKey(2) + `", "k1": "` + testMasterKey(1) + `"}}`
+
+	k, err := LoadKeyFile(write("keys.json", valid, 0600))
+	if err != nil {
+		t.Fatalf("LoadKeyFile(): %v", err)
+	}
+	if k.Primary() != "k2" || len(k.IDs()) != 2 {
+		t.Errorf("LoadKeyFile() = primary %q, IDs %v", k.Primary(), k.IDs())
+	}
+
+	if _, err := LoadKeyFile(write("readable.json", valid, 0644)); err == nil || !strings.Contains(err.Error(), "chmod 600") {
+		t.Errorf("LoadKeyFile() of a group-readable file: error = %v", err)
+	}
+	if _, err := LoadKeyFile(write("noprimary.json", `{"primary": "k3", "keys": {"k1": "`+testMasterKey(1)+`"}}`, 0600)); err == nil {
+		t.Error("LoadKeyFile() with a primary not in the keyring succeeded")
+	}
+	if _, err := LoadKeyFile(write("bad.json", `{"primary": `, 0600)); err == nil {
+		t.Error("LoadKeyFile() of malformed JSON succeeded")
+	}
+	if _, err := LoadKeyFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("LoadKeyFile() of a missing file succeeded")
+	}
+}
+
+func TestKeyringWrap(t *testing.T) {
+	k := testKeyring(t, "k1")
+	dataKey := bytes.Repeat([]byte{7}, dataKeySize)
+
+	w, err := k.wrap(dataKey, []byte("object.dek-01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := k.unwrap(w, []byte("object.dek-01")); err != nil || !bytes.Equal(got, dataKey) {
+		t.Errorf("unwrap() = %x, %v; want the data key", got, err)
+	}
+
+	// A wrapped key moved to another object does not unwrap
+	if _, err := k.unwrap(w, []byte("other.dek-01")); err == nil {
+		t.Error("unwrap() with another object's AAD succeeded")
+	}
+	w.Nonce = w.Nonce[:4]
+	if _, err := k.unwrap(w, []byte("object.dek-01")); err == nil {
+		t.Error("unwrap() with a short nonce succeeded")
+	}
+}
+
+func TestGenerateMasterKey(t *testing.T) {
+	a, err := GenerateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := GenerateMasterKey()
+	if a == b {
+		t.Error("GenerateMasterKey() returned the same key twice")
+	}
+	if _, err := ParseKeyring("k1:" + a); err != nil {
+		t.Errorf("generated key is not accepted: %v", err)
+	}
+}
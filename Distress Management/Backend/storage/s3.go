@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3-compatible object store
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.eu-west-1.amazonaws.com
+	// or http://localhost:9000 for MinIO
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Client is used for requests; http.DefaultClient when nil
+	Client *http.Client
+}
+
+// S3 stores objects in a bucket of an S3-compatible service. Requests use
+// path-style addressing so the same code works against AWS and MinIO.
+type S3 struct {
+	endpoint *url.URL
+	cfg      S3Config
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3 validates the configuration and returns an S3 storage
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("storage: S3 endpoint and bucket are required")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("storage: S3 access key and secret key are required")
+	}
+	u, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("storage: invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &S3{endpoint: u, cfg: cfg, client: client, now: time.Now}, nil
+}
+
+func (s *S3) objectURL(key string) (*url.URL, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, err
+	}
+	name := key
+	if s.cfg.Prefix != "" {
+		name = s.cfg.Prefix + "/" + key
+	}
+
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.cfg.Bucket + "/" + name
+	// Send the path exactly as it was signed
+	u.RawPath = uriEncodePath(u.Path)
+	return &u, nil
+}
+
+func (s *S3) do(ctx context.Context, method, key string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	s.sign(req, unsignedPayload)
+	return s.client.Do(req)
+}
+
+// Put uploads the object in a single request. When the size is unknown the
+// content is spooled to a temporary file first, since S3 requires a length.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size < 0 {
+		tmp, err := os.CreateTemp("", "s3-put-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if size, err = io.Copy(tmp, r); err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = tmp
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+
+	// Wrap the reader so net/http does not sniff it for a length or close it
+	resp, err := s.do(ctx, http.MethodPut, key, io.LimitReader(r, size), size, header)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, 0, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ObjectInfo{}, ErrNotFound
+	default:
+		return ObjectInfo{}, s3Error(resp)
+	}
+
+	info := ObjectInfo{Key: key, Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info, nil
+}
+
+// Open stats the object and returns a reader that fetches it with ranged
+// GETs, so seeking (for HTTP Range requests) does not download the whole
+// object
+func (s *S3) Open(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return &s3Reader{ctx: ctx, s: s, key: key, size: info.Size}, info, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return s3Error(resp)
+}
+
+// s3Reader reads an object from the current offset onwards. A seek drops the
+// open response body and the next Read issues a new ranged GET.
+type s3Reader struct {
+	ctx    context.Context
+	s      *S3
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		header := http.Header{}
+		header.Set("Range", "bytes="+strconv.FormatInt(r.offset, 10)+"-")
+
+		resp, err := r.s.do(r.ctx, http.MethodGet, r.key, nil, 0, header)
+		if err != nil {
+			return 0, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusPartialContent:
+		case http.StatusNotFound:
+			drain(resp)
+			return 0, ErrNotFound
+		default:
+			defer drain(resp)
+			return 0, s3Error(resp)
+		}
+		if resp.StatusCode == http.StatusOK && r.offset > 0 {
+			// The server ignored the range; skip to the offset ourselves
+			if _, err := io.CopyN(io.Discard, resp.Body, r.offset); err != nil {
+				drain(resp)
+				return 0, err
+			}
+		}
+		r.body = resp.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+
+	if abs != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = abs
+	return abs, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body != nil {
+		err := r.body.Close()
+		r.body = nil
+		return err
+	}
+	return nil
+}
+
+func drain(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+}
+
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		return fmt.Errorf("storage: S3 %s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+	}
+	return fmt.Errorf("storage: S3 %s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, msg)
+}
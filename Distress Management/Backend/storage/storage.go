@@ -0,0 +1,52 @@
+// Package storage abstracts where document content is kept, so attachments
+// can live on local disk or in an S3-compatible object store.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when an object does not exist
+var ErrNotFound = errors.New("storage: object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage stores opaque objects under slash-separated keys
+type Storage interface {
+	// Put stores the content of r under key, replacing any existing object.
+	// size is the content length, or -1 if it is not known in advance.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Open returns a seekable reader over the object
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error)
+	// Stat returns the object's metadata without reading it
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete removes the object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// ValidateKey rejects keys that could escape the storage root
+func ValidateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("storage: invalid key %q", key)
+	}
+	if path.Clean(key) != key {
+		return fmt.Errorf("storage: invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." || part == "." {
+			return fmt.Errorf("storage: invalid key %q", key)
+		}
+	}
+	return nil
+}
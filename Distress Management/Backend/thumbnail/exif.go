@@ -0,0 +1,92 @@
+package thumbnail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// orientationTag is the EXIF tag holding the image orientation
+const orientationTag = 0x0112
+
+// readOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 if it
+// has none. Only the segments before the image data are read.
+func readOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+		// Start of scan or end of image: no more metadata
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return 1
+		}
+
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return 1
+		}
+		if marker[1] != 0xE1 {
+			if _, err := br.Discard(length); err != nil {
+				return 1
+			}
+			continue
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 1
+		}
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+	}
+}
+
+// tiffOrientation finds the orientation tag in the first IFD of the TIFF
+// structure embedded in an EXIF segment
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != orientationTag {
+			continue
+		}
+		// A SHORT value is stored in the first two bytes of the value field
+		value := int(order.Uint16(tiff[entry+8:]))
+		if value < 1 || value > 8 {
+			return 1
+		}
+		return value
+	}
+	return 1
+}
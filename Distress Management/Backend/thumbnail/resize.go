@@ -0,0 +1,109 @@
+package thumbnail
+
+import (
+	"image"
+	"image/color"
+)
+
+// scale shrinks src to w x h by averaging the block of source pixels behind
+// each output pixel, and flattens it onto a white background. w and h must
+// not exceed the source dimensions.
+func scale(src image.Image, w, h int) *image.RGBA {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	// Output column of each source column
+	column := make([]int, sw)
+	for x := range column {
+		column[x] = x * w / sw
+	}
+
+	sums := make([]uint64, w*4)
+	counts := make([]uint64, w)
+	for dy := 0; dy < h; dy++ {
+		for i := range sums {
+			sums[i] = 0
+		}
+		for i := range counts {
+			counts[i] = 0
+		}
+
+		for sy := dy * sh / h; sy < (dy+1)*sh/h; sy++ {
+			for sx := 0; sx < sw; sx++ {
+				r, g, b, a := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+				i := column[sx]
+				sums[i*4] += uint64(r)
+				sums[i*4+1] += uint64(g)
+				sums[i*4+2] += uint64(b)
+				sums[i*4+3] += uint64(a)
+				counts[i]++
+			}
+		}
+
+		for dx := 0; dx < w; dx++ {
+			n := counts[dx]
+			if n == 0 {
+				continue
+			}
+			// Colors are alpha-premultiplied, so compositing over white
+			// adds the missing coverage to each channel
+			a := sums[dx*4+3] / n
+			dst.SetRGBA(dx, dy, color.RGBA{
+				R: uint8((sums[dx*4]/n + 0xffff - a) >> 8),
+				G: uint8((sums[dx*4+1]/n + 0xffff - a) >> 8),
+				B: uint8((sums[dx*4+2]/n + 0xffff - a) >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}
+
+// orientedImage presents an image transformed by an EXIF orientation without
+// copying its pixels
+type orientedImage struct {
+	image.Image
+	orientation int
+}
+
+// orient returns img as it should be displayed for an EXIF orientation
+// (1-8). Orientation 1 and unknown values leave the image unchanged.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	return &orientedImage{Image: img, orientation: orientation}
+}
+
+func (o *orientedImage) Bounds() image.Rectangle {
+	b := o.Image.Bounds()
+	if o.orientation >= 5 {
+		return image.Rect(0, 0, b.Dy(), b.Dx())
+	}
+	return image.Rect(0, 0, b.Dx(), b.Dy())
+}
+
+func (o *orientedImage) At(x, y int) color.Color {
+	b := o.Image.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	var sx, sy int
+	switch o.orientation {
+	case 2: // mirrored horizontally
+		sx, sy = w-1-x, y
+	case 3: // rotated 180°
+		sx, sy = w-1-x, h-1-y
+	case 4: // mirrored vertically
+		sx, sy = x, h-1-y
+	case 5: // transposed
+		sx, sy = y, x
+	case 6: // rotated 90° clockwise
+		sx, sy = y, h-1-x
+	case 7: // transversed
+		sx, sy = w-1-y, h-1-x
+	case 8: // rotated 90° counter-clockwise
+		sx, sy = w-1-y, x
+	}
+	return o.Image.At(b.Min.X+sx, b.Min.Y+sy)
+}
@@ -0,0 +1,173 @@
+// Package thumbnail renders small JPEG previews of uploaded images and PDFs
+// using only the standard library's image decoders. A PDF is previewed by the
+// image on its first page, which is what scanned documents consist of.
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"strconv"
+	"strings"
+
+	"distress-management/extract"
+
+	// Register the decoders for the image types documents may have
+	_ "image/gif"
+	_ "image/png"
+)
+
+// DefaultSizes is the size list used when none is configured
+const DefaultSizes = "small=128,medium=256,large=512"
+
+// MaxPixels bounds the dimensions of images that are thumbnailed, so a small
+// file that decodes to a huge bitmap cannot exhaust memory
+const MaxPixels = 50_000_000
+
+// Limits on a configured thumbnail size, in pixels
+const (
+	minSize = 16
+	maxSize = 2048
+)
+
+// jpegQuality is the quality thumbnails are encoded with
+const jpegQuality = 85
+
+var (
+	// ErrTooLarge is returned for images with more than MaxPixels pixels
+	ErrTooLarge = errors.New("image dimensions too large to thumbnail")
+	// ErrNoPreview is returned for PDFs whose first page has no image to
+	// preview, such as documents made of text, which keep their placeholder
+	ErrNoPreview = errors.New("PDF has no page image to preview")
+)
+
+// Size is a named thumbnail size. Images are scaled to fit a square of
+// Pixels on each side, keeping their aspect ratio.
+type Size struct {
+	Name   string `json:"name"`
+	Pixels int    `json:"pixels"`
+}
+
+// ParseSizes parses a comma-separated list of sizes such as
+// "small=128,medium=256". A bare number is named after itself.
+func ParseSizes(spec string) ([]Size, error) {
+	var sizes []Size
+	seen := map[string]bool{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(item, "=")
+		if !found {
+			value = name
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		pixels, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || pixels < minSize || pixels > maxSize {
+			return nil, fmt.Errorf("invalid thumbnail size %q (must be %d-%d pixels)", item, minSize, maxSize)
+		}
+		if name == "" || seen[name] {
+			return nil, fmt.Errorf("invalid or duplicate thumbnail size name in %q", item)
+		}
+		seen[name] = true
+		sizes = append(sizes, Size{Name: name, Pixels: pixels})
+	}
+	if len(sizes) == 0 {
+		return nil, errors.New("no thumbnail sizes configured")
+	}
+	return sizes, nil
+}
+
+// Supported reports whether thumbnails can be made for the MIME type
+func Supported(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "application/pdf":
+		return true
+	}
+	return false
+}
+
+// Key returns the storage key of a thumbnail, next to the original content
+func Key(contentKey string, size Size) string {
+	return fmt.Sprintf("%s.thumb-%d.jpg", contentKey, size.Pixels)
+}
+
+// Decode reads an image, refusing ones larger than MaxPixels. GIFs yield
+// their first frame, and JPEGs are turned upright according to their EXIF
+// orientation.
+func Decode(r io.ReadSeeker) (image.Image, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		orientation = readOrientation(r)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return orient(img, orientation), nil
+}
+
+// DecodePDF returns the largest image on the first page of a PDF; see
+// extract.PageImage for the images it can read. Images larger than MaxPixels
+// are passed over.
+func DecodePDF(ctx context.Context, r io.ReaderAt, size int64) (image.Image, error) {
+	img, err := extract.PageImage(ctx, r, size, MaxPixels)
+	if err == extract.ErrNoImage || err == extract.ErrEncrypted {
+		return nil, ErrNoPreview
+	}
+	return img, err
+}
+
+// Render scales img to fit size and encodes it as a JPEG. Images smaller than
+// the size are not enlarged. Transparent areas become white.
+func Render(img image.Image, size Size) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := fit(bounds.Dx(), bounds.Dy(), size.Pixels)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scale(img, width, height), &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fit returns the dimensions of a w x h image scaled down to fit within max
+// pixels on each side
+func fit(w, h, max int) (int, int) {
+	if w <= max && h <= max {
+		return w, h
+	}
+	if w >= h {
+		return max, clampDim(h * max / w)
+	}
+	return clampDim(w * max / h), max
+}
+
+func clampDim(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
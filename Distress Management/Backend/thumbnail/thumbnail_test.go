@@ -0,0 +1,309 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestParseSizes(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []Size
+		wantErr bool
+	}{
+		{"small=128,medium=256", []Size{{"small", 128}, {"medium", 256}}, false},
+		{" Large = 512 , ", []Size{{"large", 512}}, false},
+		{"64,small=128", []Size{{"64", 64}, {"small", 128}}, false},
+		{"16,2048", []Size{{"16", 16}, {"2048", 2048}}, false},
+		{"", nil, true},
+		{" , ", nil, true},
+		{"small=15", nil, true},
+		{"small=2049", nil, true},
+		{"small=big", nil, true},
+		{"=128", nil, true},
+		{"small=128,Small=256", nil, true},
+		{"128,128", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSizes(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSizes(%q) = %v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("ParseSizes(%q) = %v, %v; want %v", tt.spec, got, err, tt.want)
+		}
+	}
+
+	if _, err := ParseSizes(DefaultSizes); err != nil {
+		t.Errorf("ParseSizes(DefaultSizes): %v", err)
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		w, h, max    int
+		wantW, wantH int
+	}{
+		{100, 50, 128, 100, 50},
+		{128, 128, 128, 128, 128},
+		{1000, 500, 128, 128, 64},
+		{500, 1000, 128, 64, 128},
+		{1000, 1000, 128, 128, 128},
+		{10000, 1, 128, 128, 1},
+		{1, 10000, 128, 1, 128},
+	}
+	for _, tt := range tests {
+		if w, h := fit(tt.w, tt.h, tt.max); w != tt.wantW || h != tt.wantH {
+			t.Errorf("fit(%d, %d, %d) = %d, %d; want %d, %d", tt.w, tt.h, tt.max, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+// exifSegment is an APP1 segment holding an EXIF block whose first IFD has
+// the orientation tag, in the given byte order
+func exifSegment(order binary.ByteOrder, orientation uint16) []byte {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8))
+	// Two entries: an image width, then the orientation as a SHORT
+	binary.Write(&tiff, order, uint16(2))
+	binary.Write(&tiff, order, []uint16{0x0100, 3})
+	binary.Write(&tiff, order, []uint32{1, 40})
+	binary.Write(&tiff, order, []uint16{orientationTag, 3})
+	binary.Write(&tiff, order, uint32(1))
+	binary.Write(&tiff, order, []uint16{orientation, 0})
+	binary.Write(&tiff, order, uint32(0))
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// withSegments inserts segments into a JPEG right after its SOI marker
+func withSegments(jpegData []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, jpegData[:2]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, jpegData[2:]...)
+}
+
+// halvesJPEG is a 40x20 JPEG whose left half is black and right half white
+func halvesJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 20; x < 40; x++ {
+			img.SetGray(x, y, color.Gray{255})
+		}
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestReadOrientation(t *testing.T) {
+	plain := halvesJPEG(t)
+	comment := []byte{0xFF, 0xFE, 0, 7, 'h', 'e', 'l', 'l', 'o'}
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no EXIF", plain, 1},
+		{"little-endian", withSegments(plain, exifSegment(binary.LittleEndian, 6)), 6},
+		{"big-endian", withSegments(plain, exifSegment(binary.BigEndian, 8)), 8},
+		{"after another segment", withSegments(plain, comment, exifSegment(binary.BigEndian, 3)), 3},
+		{"out of range", withSegments(plain, exifSegment(binary.LittleEndian, 9)), 1},
+		{"truncated", withSegments(plain, exifSegment(binary.LittleEndian, 6)[:20]), 1},
+		{"not a JPEG", []byte("GIF89a"), 1},
+		{"empty", nil, 1},
+	}
+	for _, tt := range tests {
+		if got := readOrientation(bytes.NewReader(tt.data)); got != tt.want {
+			t.Errorf("%s: readOrientation() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeOrientation(t *testing.T) {
+	plain := halvesJPEG(t)
+	// Where the black left half of the image ends up, sampled at a point
+	// well inside each half
+	tests := []struct {
+		orientation   uint16
+		width, height int
+		black, white  image.Point
+	}{
+		{1, 40, 20, image.Pt(5, 10), image.Pt(35, 10)},
+		{2, 40, 20, image.Pt(35, 10), image.Pt(5, 10)},
+		{3, 40, 20, image.Pt(35, 10), image.Pt(5, 10)},
+		{4, 40, 20, image.Pt(5, 10), image.Pt(35, 10)},
+		{5, 20, 40, image.Pt(10, 5), image.Pt(10, 35)},
+		{6, 20, 40, image.Pt(10, 5), image.Pt(10, 35)},
+		{7, 20, 40, image.Pt(10, 35), image.Pt(10, 5)},
+		{8, 20, 40, image.Pt(10, 35), image.Pt(10, 5)},
+	}
+	for _, tt := range tests {
+		img, err := Decode(bytes.NewReader(withSegments(plain, exifSegment(binary.BigEndian, tt.orientation))))
+		if err != nil {
+			t.Fatalf("orientation %d: Decode(): %v", tt.orientation, err)
+		}
+		b := img.Bounds()
+		if b.Dx() != tt.width || b.Dy() != tt.height {
+			t.Errorf("orientation %d: image is %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.width, tt.height)
+			continue
+		}
+		if g := gray(img, tt.black); g > 50 {
+			t.Errorf("orientation %d: pixel %v = %d, want black", tt.orientation, tt.black, g)
+		}
+		if g := gray(img, tt.white); g < 200 {
+			t.Errorf("orientation %d: pixel %v = %d, want white", tt.orientation, tt.white, g)
+		}
+	}
+}
+
+func gray(img image.Image, p image.Point) uint8 {
+	return color.GrayModel.Convert(img.At(p.X, p.Y)).(color.Gray).Y
+}
+
+// pngHeader is the start of a PNG claiming the given dimensions, enough for
+// its configuration to be read
+func pngHeader(w, h uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], w)
+	binary.BigEndian.PutUint32(ihdr[8:], h)
+	ihdr[12], ihdr[13] = 8, 0 // 8-bit grayscale
+
+	b := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	b = append(b, ihdr...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestDecodeTooLarge(t *testing.T) {
+	if _, err := Decode(bytes.NewReader(pngHeader(10000, 10000))); err != ErrTooLarge {
+		t.Errorf("Decode() of a 10000x10000 PNG: error = %v, want ErrTooLarge", err)
+	}
+	if _, err := Decode(bytes.NewReader(pngHeader(1<<31-1, 1<<31-1))); err == nil {
+		t.Error("Decode() of a PNG with huge dimensions succeeded")
+	}
+
+	// Within the limit, a PNG is decoded normally
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewGray(image.Rect(0, 0, 300, 200))); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Decode(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode() of a 300x200 PNG: %v", err)
+	}
+	if img.Bounds().Dx() != 300 || img.Bounds().Dy() != 200 {
+		t.Errorf("Decode() of a 300x200 PNG = %v", img.Bounds())
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		w, h          int
+		size          int
+		width, height int
+	}{
+		{400, 200, 128, 128, 64},
+		{200, 400, 128, 64, 128},
+		// Small images are not enlarged
+		{40, 20, 128, 40, 20},
+	}
+	for _, tt := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, tt.w, tt.h))
+		data, err := Render(img, Size{Name: "test", Pixels: tt.size})
+		if err != nil {
+			t.Fatalf("Render(): %v", err)
+		}
+		config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Render() output is not a JPEG: %v", err)
+		}
+		if config.Width != tt.width || config.Height != tt.height {
+			t.Errorf("Render() of %dx%d at %d = %dx%d, want %dx%d", tt.w, tt.h, tt.size, config.Width, config.Height, tt.width, tt.height)
+		}
+	}
+
+	// Transparent areas become white
+	data, err := Render(image.NewRGBA(image.Rect(0, 0, 8, 8)), Size{Pixels: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := gray(img, image.Pt(4, 4)); g < 250 {
+		t.Errorf("transparent pixel rendered as %d, want white", g)
+	}
+}
+
+// pdfWithImage is a one-page PDF whose page draws an image XObject with the
+// given dictionary entries and data, or no image if dict is empty
+func pdfWithImage(dict string, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	b.WriteString("1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n")
+	b.WriteString("2 0 obj << /Type /Pages /Kids [3 0 R] /Count 1 >> endobj\n")
+	if dict == "" {
+		b.WriteString("3 0 obj << /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >> endobj\n")
+	} else {
+		b.WriteString("3 0 obj << /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /XObject << /Im1 4 0 R >> >> >> endobj\n")
+		fmt.Fprintf(&b, "4 0 obj << /Type /XObject /Subtype /Image %s /Length %d >>\nstream\n%s\nendstream\nendobj\n", dict, len(data), data)
+	}
+	b.WriteString("trailer << /Root 1 0 R >>\n%%EOF\n")
+	return b.Bytes()
+}
+
+func TestDecodePDF(t *testing.T) {
+	decode := func(data []byte) (image.Image, error) {
+		return DecodePDF(context.Background(), bytes.NewReader(data), int64(len(data)))
+	}
+
+	scan := halvesJPEG(t)
+	img, err := decode(pdfWithImage("/Width 40 /Height 20 /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /DCTDecode", scan))
+	if err != nil {
+		t.Fatalf("DecodePDF() of a scanned page: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 40 || b.Dy() != 20 {
+		t.Errorf("DecodePDF() = %dx%d image, want 40x20", b.Dx(), b.Dy())
+	}
+	if _, err := Render(img, Size{Pixels: 16}); err != nil {
+		t.Errorf("Render() of a PDF page image: %v", err)
+	}
+
+	if _, err := decode(pdfWithImage("", nil)); err != ErrNoPreview {
+		t.Errorf("DecodePDF() of a page without images: error = %v, want ErrNoPreview", err)
+	}
+	if _, err := decode(pdfWithImage("/Width 10000 /Height 10000 /ColorSpace /DeviceGray /BitsPerComponent 8", nil)); err != ErrNoPreview {
+		t.Errorf("DecodePDF() of an image over MaxPixels: error = %v, want ErrNoPreview", err)
+	}
+	if _, err := decode([]byte("Hello, world")); err == nil || err == ErrNoPreview {
+		t.Errorf("DecodePDF() of a file that is not a PDF: error = %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+// Package workflow defines the legal moves of a distress case through its
+// stages, the status each move implies and the roles allowed to make it.
+package workflow
+
+import (
+	"errors"
+
+	"distress-management/auth"
+)
+
+// Stages, matching the cases.stage ENUM
+const (
+	StageFrontOffice     = "Front Office Receipt"
+	StageDirectorReview  = "Director Review"
+	StageCadetAssignment = "Cadet Assignment"
+	StageInvestigation   = "Case Investigation"
+	StageResolution      = "Case Resolution"
+)
+
+// Statuses, matching the cases.status ENUM
+const (
+	StatusPending     = "Pending"
+	StatusUnderReview = "Under Review"
+	StatusAssigned    = "Assigned"
+	StatusInProgress  = "In Progress"
+	StatusResolved    = "Resolved"
+	StatusClosed      = "Closed"
+)
+
+// Actions name each transition
+const (
+	ActionSubmitForReview    = "submit_for_review"
+	ActionReturnToFrontDesk  = "return_to_front_office"
+	ActionAssign             = "assign"
+	ActionStartInvestigation = "start_investigation"
+	ActionEscalate           = "escalate"
+	ActionResolve            = "resolve"
+	ActionClose              = "close"
+	ActionReopen             = "reopen"
+)
+
+var (
+	// ErrIllegalTransition is returned when no transition leads from the
+	// current state to the requested one
+	ErrIllegalTransition = errors.New("transition not allowed from the current stage")
+	// ErrRoleNotAllowed is returned when the transition exists but the
+	// caller's role may not perform it
+	ErrRoleNotAllowed = errors.New("your role may not perform this transition")
+)
+
+// State is the position of a case in the workflow
+type State struct {
+	Stage  string `json:"stage"`
+	Status string `json:"status"`
+}
+
+// Transition is a legal move between two states. Transitions with an
+// Endpoint carry extra data and can only be made through that endpoint
+// (relative to /api/cases/{id}), not through the generic status update.
+type Transition struct {
+	Action   string   `json:"action"`
+	Name     string   `json:"name"`
+	From     State    `json:"from"`
+	To       State    `json:"to"`
+	Roles    []string `json:"roles"`
+	Endpoint string   `json:"endpoint,omitempty"`
+	// RequiresDocuments means every document category required for the case
+	// must have been uploaded first
+	RequiresDocuments bool `json:"requiresDocuments,omitempty"`
+}
+
+// Endpoints of transitions that need more than a status change
+const (
+	EndpointAssign = "/assign"
+	EndpointAccept = "/assignment/accept"
+)
+
+// Transitions is the case workflow. Admins may perform every transition.
+var Transitions = []Transition{
+	{
+		Action: ActionSubmitForReview,
+		Name:   "Submit for director review",
+		From:   State{StageFrontOffice, StatusPending},
+		To:     State{StageDirectorReview, StatusUnderReview},
+		Roles:  []string{auth.RoleFrontOffice},
+	},
+	{
+		Action: ActionReturnToFrontDesk,
+		Name:   "Return to front office",
+		From:   State{StageDirectorReview, StatusUnderReview},
+		To:     State{StageFrontOffice, StatusPending},
+		Roles:  []string{auth.RoleDirector},
+	},
+	{
+		Action:   ActionAssign,
+		Name:     "Approve and assign",
+		From:     State{StageDirectorReview, StatusUnderReview},
+		To:       State{StageCadetAssignment, StatusAssigned},
+		Roles:    []string{auth.RoleDirector},
+		Endpoint: EndpointAssign,
+	},
+	{
+		Action:   ActionAssign,
+		Name:     "Reassign",
+		From:     State{StageCadetAssignment, StatusAssigned},
+		To:       State{StageCadetAssignment, StatusAssigned},
+		Roles:    []string{auth.RoleDirector},
+		Endpoint: EndpointAssign,
+	},
+	{
+		Action:   ActionAssign,
+		Name:     "Reassign",
+		From:     State{StageInvestigation, StatusInProgress},
+		To:       State{StageCadetAssignment, StatusAssigned},
+		Roles:    []string{auth.RoleDirector},
+		Endpoint: EndpointAssign,
+	},
+	{
+		Action: ActionClose,
+		Name:   "Close without action",
+		From:   State{StageDirectorReview, StatusUnderReview},
+		To:     State{StageResolution, StatusClosed},
+		Roles:  []string{auth.RoleDirector},
+	},
+	{
+		Action:   ActionStartInvestigation,
+		Name:     "Accept assignment and start investigation",
+		From:     State{StageCadetAssignment, StatusAssigned},
+		To:       State{StageInvestigation, StatusInProgress},
+		Roles:    []string{auth.RoleOfficer, auth.RoleCadet},
+		Endpoint: EndpointAccept,
+	},
+	{
+		Action: ActionEscalate,
+		Name:   "Escalate to director",
+		From:   State{StageInvestigation, StatusInProgress},
+		To:     State{StageDirectorReview, StatusUnderReview},
+		Roles:  []string{auth.RoleOfficer, auth.RoleCadet},
+	},
+	{
+		Action:            ActionResolve,
+		Name:              "Mark resolved",
+		From:              State{StageInvestigation, StatusInProgress},
+		To:                State{StageResolution, StatusResolved},
+		Roles:             []string{auth.RoleOfficer, auth.RoleCadet, auth.RoleDirector},
+		RequiresDocuments: true,
+	},
+	{
+		Action: ActionClose,
+		Name:   "Close case",
+		From:   State{StageResolution, StatusResolved},
+		To:     State{StageResolution, StatusClosed},
+		Roles:  []string{auth.RoleDirector},
+	},
+	{
+		Action: ActionReopen,
+		Name:   "Reopen investigation",
+		From:   State{StageResolution, StatusResolved},
+		To:     State{StageInvestigation, StatusInProgress},
+		Roles:  []string{auth.RoleDirector},
+	},
+	{
+		Action: ActionReopen,
+		Name:   "Reopen investigation",
+		From:   State{StageResolution, StatusClosed},
+		To:     State{StageInvestigation, StatusInProgress},
+		Roles:  []string{auth.RoleDirector},
+	},
+}
+
+// Available returns every transition leaving the given state
+func Available(from State) []Transition {
+	var out []Transition
+	for _, t := range Transitions {
+		if t.From == from {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// AllowedFor returns the transitions leaving the given state that the role may perform
+func AllowedFor(from State, role string) []Transition {
+	out := []Transition{}
+	for _, t := range Available(from) {
+		if t.AllowedFor(role) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// AllowedFor reports whether the role may perform the transition
+func (t Transition) AllowedFor(role string) bool {
+	role = auth.NormalizeRole(role)
+	if role == auth.RoleAdmin {
+		return true
+	}
+	for _, r := range t.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve finds the transition a request asks for. The request names either
+// an action, or a target stage and/or status; the missing half of the target
+// is implied by the transition.
+func Resolve(from State, role, action string, to State) (*Transition, error) {
+	var match *Transition
+	for _, t := range Available(from) {
+		if action != "" && t.Action != action {
+			continue
+		}
+		if to.Stage != "" && t.To.Stage != to.Stage {
+			continue
+		}
+		if to.Status != "" && t.To.Status != to.Status {
+			continue
+		}
+		if action == "" && to.Stage == "" && to.Status == "" {
+			continue
+		}
+		t := t
+		match = &t
+		break
+	}
+
+	if match == nil {
+		return nil, ErrIllegalTransition
+	}
+	if !match.AllowedFor(role) {
+		return match, ErrRoleNotAllowed
+	}
+	return match, nil
+}
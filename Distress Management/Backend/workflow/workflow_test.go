@@ -0,0 +1,184 @@
+package workflow
+
+import (
+	"fmt"
+	"testing"
+
+	"distress-management/auth"
+)
+
+var (
+	pending     = State{StageFrontOffice, StatusPending}
+	underReview = State{StageDirectorReview, StatusUnderReview}
+	assigned    = State{StageCadetAssignment, StatusAssigned}
+	inProgress  = State{StageInvestigation, StatusInProgress}
+	resolved    = State{StageResolution, StatusResolved}
+	closed      = State{StageResolution, StatusClosed}
+)
+
+var roles = []string{auth.RoleAdmin, auth.RoleDirector, auth.RoleFrontOffice, auth.RoleOfficer, auth.RoleCadet}
+
+// TestAllowedFor lists, for every state and role, the actions the role may
+// take from that state
+func TestAllowedFor(t *testing.T) {
+	all := map[State][]string{
+		pending:     {ActionSubmitForReview},
+		underReview: {ActionReturnToFrontDesk, ActionAssign, ActionClose},
+		assigned:    {ActionAssign, ActionStartInvestigation},
+		inProgress:  {ActionAssign, ActionEscalate, ActionResolve},
+		resolved:    {ActionClose, ActionReopen},
+		closed:      {ActionReopen},
+	}
+	want := map[State]map[string][]string{
+		pending: {
+			auth.RoleFrontOffice: {ActionSubmitForReview},
+		},
+		underReview: {
+			auth.RoleDirector: {ActionReturnToFrontDesk, ActionAssign, ActionClose},
+		},
+		assigned: {
+			auth.RoleDirector: {ActionAssign},
+			auth.RoleOfficer:  {ActionStartInvestigation},
+			auth.RoleCadet:    {ActionStartInvestigation},
+		},
+		inProgress: {
+			auth.RoleDirector: {ActionAssign, ActionResolve},
+			auth.RoleOfficer:  {ActionEscalate, ActionResolve},
+			auth.RoleCadet:    {ActionEscalate, ActionResolve},
+		},
+		resolved: {
+			auth.RoleDirector: {ActionClose, ActionReopen},
+		},
+		closed: {
+			auth.RoleDirector: {ActionReopen},
+		},
+	}
+
+	for from, actions := range all {
+		// Admins may do everything
+		want[from][auth.RoleAdmin] = actions
+
+		for _, role := range roles {
+			var got []string
+			for _, tr := range AllowedFor(from, role) {
+				got = append(got, tr.Action)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want[from][role]) {
+				t.Errorf("AllowedFor(%v, %s) = %v, want %v", from, role, got, want[from][role])
+			}
+		}
+	}
+
+	// Roles are matched however they are written
+	if got := AllowedFor(pending, "Front Office"); len(got) != 1 {
+		t.Errorf("AllowedFor(pending, \"Front Office\") = %v, want the submission", got)
+	}
+	if got := AllowedFor(State{"Archived", StatusClosed}, auth.RoleAdmin); got == nil || len(got) != 0 {
+		t.Errorf("AllowedFor() from an unknown state = %#v, want an empty list", got)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		from   State
+		role   string
+		action string
+		to     State
+		// want is the state the transition leads to
+		want    State
+		wantErr error
+	}{
+		// By action
+		{pending, auth.RoleFrontOffice, ActionSubmitForReview, State{}, underReview, nil},
+		{pending, auth.RoleAdmin, ActionSubmitForReview, State{}, underReview, nil},
+		{pending, auth.RoleDirector, ActionSubmitForReview, State{}, underReview, ErrRoleNotAllowed},
+		{pending, auth.RoleOfficer, ActionSubmitForReview, State{}, underReview, ErrRoleNotAllowed},
+		{pending, auth.RoleFrontOffice, ActionResolve, State{}, State{}, ErrIllegalTransition},
+		{underReview, auth.RoleDirector, ActionReturnToFrontDesk, State{}, pending, nil},
+		{underReview, auth.RoleFrontOffice, ActionReturnToFrontDesk, State{}, pending, ErrRoleNotAllowed},
+		{underReview, auth.RoleDirector, ActionAssign, State{}, assigned, nil},
+		{underReview, auth.RoleDirector, ActionClose, State{}, closed, nil},
+		{underReview, auth.RoleCadet, ActionClose, State{}, closed, ErrRoleNotAllowed},
+		{assigned, auth.RoleDirector, ActionAssign, State{}, assigned, nil},
+		{assigned, auth.RoleCadet, ActionStartInvestigation, State{}, inProgress, nil},
+		{assigned, auth.RoleOfficer, ActionStartInvestigation, State{}, inProgress, nil},
+		{assigned, auth.RoleDirector, ActionStartInvestigation, State{}, inProgress, ErrRoleNotAllowed},
+		{assigned, auth.RoleOfficer, ActionResolve, State{}, State{}, ErrIllegalTransition},
+		{inProgress, auth.RoleOfficer, ActionEscalate, State{}, underReview, nil},
+		{inProgress, auth.RoleDirector, ActionEscalate, State{}, underReview, ErrRoleNotAllowed},
+		{inProgress, auth.RoleCadet, ActionResolve, State{}, resolved, nil},
+		{inProgress, auth.RoleDirector, ActionResolve, State{}, resolved, nil},
+		{inProgress, auth.RoleFrontOffice, ActionResolve, State{}, resolved, ErrRoleNotAllowed},
+		{inProgress, auth.RoleDirector, ActionAssign, State{}, assigned, nil},
+		{inProgress, auth.RoleOfficer, ActionAssign, State{}, assigned, ErrRoleNotAllowed},
+		{resolved, auth.RoleDirector, ActionClose, State{}, closed, nil},
+		{resolved, auth.RoleOfficer, ActionClose, State{}, closed, ErrRoleNotAllowed},
+		{resolved, auth.RoleDirector, ActionReopen, State{}, inProgress, nil},
+		{closed, auth.RoleDirector, ActionReopen, State{}, inProgress, nil},
+		{closed, auth.RoleAdmin, ActionReopen, State{}, inProgress, nil},
+		{closed, auth.RoleDirector, ActionClose, State{}, State{}, ErrIllegalTransition},
+		{closed, auth.RoleAdmin, "archive", State{}, State{}, ErrIllegalTransition},
+
+		// By target stage and/or status
+		{pending, auth.RoleFrontOffice, "", State{Stage: StageDirectorReview}, underReview, nil},
+		{pending, auth.RoleFrontOffice, "", State{Status: StatusUnderReview}, underReview, nil},
+		{pending, auth.RoleFrontOffice, "", underReview, underReview, nil},
+		{pending, auth.RoleFrontOffice, "", State{Status: StatusResolved}, State{}, ErrIllegalTransition},
+		{underReview, auth.RoleDirector, "", State{Status: StatusClosed}, closed, nil},
+		{underReview, auth.RoleDirector, "", State{Stage: StageFrontOffice}, pending, nil},
+		{inProgress, auth.RoleOfficer, "", State{Status: StatusResolved}, resolved, nil},
+		{inProgress, auth.RoleOfficer, "", State{Stage: StageDirectorReview}, underReview, nil},
+		{resolved, auth.RoleDirector, "", State{Status: StatusClosed}, closed, nil},
+		{resolved, auth.RoleOfficer, "", State{Status: StatusInProgress}, inProgress, ErrRoleNotAllowed},
+
+		// The action and target must agree
+		{underReview, auth.RoleDirector, ActionClose, State{Status: StatusClosed}, closed, nil},
+		{underReview, auth.RoleDirector, ActionClose, State{Status: StatusPending}, State{}, ErrIllegalTransition},
+
+		// An empty request matches nothing
+		{pending, auth.RoleAdmin, "", State{}, State{}, ErrIllegalTransition},
+		// Nothing leaves an unknown state
+		{State{"Archived", StatusClosed}, auth.RoleAdmin, ActionReopen, State{}, State{}, ErrIllegalTransition},
+	}
+	for _, tt := range tests {
+		got, err := Resolve(tt.from, tt.role, tt.action, tt.to)
+		if err != tt.wantErr {
+			t.Errorf("Resolve(%v, %s, %q, %v) error = %v, want %v", tt.from, tt.role, tt.action, tt.to, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr == ErrIllegalTransition {
+			if got != nil {
+				t.Errorf("Resolve(%v, %s, %q, %v) = %+v, want no transition", tt.from, tt.role, tt.action, tt.to, got)
+			}
+			continue
+		}
+		// A role that may not make the move still learns which one it was
+		if got == nil || got.From != tt.from || got.To != tt.want {
+			t.Errorf("Resolve(%v, %s, %q, %v) = %+v, want a move to %v", tt.from, tt.role, tt.action, tt.to, got, tt.want)
+		}
+	}
+}
+
+// TestTransitions checks the table itself: every action is known, every
+// transition names at least one role other than admin, and no two
+// transitions from one state share an action and target
+func TestTransitions(t *testing.T) {
+	known := map[string]bool{
+		ActionSubmitForReview: true, ActionReturnToFrontDesk: true, ActionAssign: true, ActionStartInvestigation: true,
+		ActionEscalate: true, ActionResolve: true, ActionClose: true, ActionReopen: true,
+	}
+	seen := map[string]bool{}
+	for _, tr := range Transitions {
+		if !known[tr.Action] {
+			t.Errorf("transition %q has unknown action %q", tr.Name, tr.Action)
+		}
+		if len(tr.Roles) == 0 {
+			t.Errorf("transition %q names no roles", tr.Name)
+		}
+		key := fmt.Sprint(tr.From, tr.Action, tr.To)
+		if seen[key] {
+			t.Errorf("transition %q from %v is listed twice", tr.Name, tr.From)
+		}
+		seen[key] = true
+	}
+}